@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 	"strings"
 	"unicode"
@@ -53,6 +54,8 @@ func (entry Entry) String() string {
 // If the value starts with a rune that is considered a number, as determined by
 // unicode.IsDigit, then it is treated like a base-10 integer and an attempt is
 // made to parse it as such. The parsed integer will always be of type int64.
+// As in Git, the integer may be followed by one of the unit suffixes "k", "m",
+// or "g", in either case, which scale it by 1024, 1024^2, or 1024^3.
 //
 // If the value is the literal "true" or "false", it is considered a boolean.
 //
@@ -79,7 +82,7 @@ func (entry *Entry) Decode(reader io.Reader) error {
 		}
 		value = s
 	case unicode.IsDigit(rune(restString[0])):
-		i, err := strconv.ParseInt(restString, 10, 64)
+		i, err := parseInt(restString)
 		if err != nil {
 			return err
 		}
@@ -96,3 +99,28 @@ func (entry *Entry) Decode(reader io.Reader) error {
 	entry.Value = value
 	return nil
 }
+
+// parseInt parses a base-10 integer that is optionally followed by a unit
+// suffix.
+func parseInt(s string) (int64, error) {
+	var unit int64 = 1
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		unit = 1 << 10
+	case 'm', 'M':
+		unit = 1 << 20
+	case 'g', 'G':
+		unit = 1 << 30
+	}
+	if unit != 1 {
+		s = s[:len(s)-1]
+	}
+
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	} else if i > math.MaxInt64/unit {
+		return 0, &strconv.NumError{Func: "ParseInt", Num: s, Err: strconv.ErrRange}
+	}
+	return i * unit, nil
+}
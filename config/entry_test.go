@@ -24,11 +24,14 @@ var (
 	_fixtureEntry4 entryFixture = entryFixture{
 		Entry{"repositoryformatversion", int64(0)}, "repositoryformatversion  = 0", "repositoryformatversion = 0",
 	}
+	_fixtureEntry5 entryFixture = entryFixture{
+		Entry{"bigFileThreshold", int64(512 << 20)}, "bigFileThreshold = 512m", "bigFileThreshold = 536870912",
+	}
 )
 
 func TestEntry_String(t *testing.T) {
 	for _, fixture := range []entryFixture{
-		_fixtureEntry1, _fixtureEntry2, _fixtureEntry3, _fixtureEntry4,
+		_fixtureEntry1, _fixtureEntry2, _fixtureEntry3, _fixtureEntry4, _fixtureEntry5,
 	} {
 		var actual string = fixture.Entry.String()
 		var expected string = fixture.NormalizedString
@@ -41,12 +44,14 @@ func TestEntry_String(t *testing.T) {
 
 func TestEntry_Decode(t *testing.T) {
 	for _, fixture := range []entryFixture{
-		_fixtureEntry1, _fixtureEntry2, _fixtureEntry3, _fixtureEntry4,
+		_fixtureEntry1, _fixtureEntry2, _fixtureEntry3, _fixtureEntry4, _fixtureEntry5,
 	} {
 		var actual *Entry = &Entry{}
 		var expected *Entry = &fixture.Entry
 
-		actual.Decode(strings.NewReader(fixture.String))
+		if err := actual.Decode(strings.NewReader(fixture.String)); err != nil {
+			t.Errorf("entry.Decode() returned error %v", err)
+		}
 
 		if *actual != *expected {
 			t.Errorf("entry.Decode() produced %v, want %v", *actual, *expected)
@@ -3,6 +3,7 @@ package core
 import (
 	"fmt"
 	"io"
+	"os"
 	"strconv"
 	"strings"
 )
@@ -55,3 +56,28 @@ func GitModeFromString(s string) (GitMode, error) {
 		return GitMode(mode), nil
 	}
 }
+
+// GitModeFromFileMode returns the GitMode that Git records for a file in the
+// working tree with the given os.FileMode. Regular files are either executable
+// or read-writable, depending on whether the owner may execute them. For any
+// other kind of file than a regular file, a directory or a symbolic link,
+// GitModeNull is returned.
+func GitModeFromFileMode(mode os.FileMode) GitMode {
+	switch {
+	case mode.IsRegular() && mode&0100 != 0:
+		return GitModeRegular | GitModeExecutable
+	case mode.IsRegular():
+		return GitModeRegular | GitModeReadWritable
+	case mode.IsDir():
+		return GitModeDir | GitModeNullPerm
+	case mode&os.ModeSymlink != 0:
+		return GitModeSymlink | GitModeNullPerm
+	}
+	return GitModeNull
+}
+
+// Type returns this GitMode without its permission bits, e.g. GitModeRegular
+// for both executable and read-writable files.
+func (mode GitMode) Type() GitMode {
+	return mode &^ 0777
+}
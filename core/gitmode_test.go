@@ -2,6 +2,7 @@ package core
 
 import (
 	"bytes"
+	"os"
 	"testing"
 )
 
@@ -52,3 +53,21 @@ func TestGitmode_Reader_Dir(t *testing.T) {
 		t.Errorf("mode.String() gave %v, want %v", actual, expected)
 	}
 }
+
+func TestGitModeFromFileMode(t *testing.T) {
+	for _, test := range []struct {
+		mode     os.FileMode
+		expected GitMode
+	}{
+		{0644, GitModeRegular | GitModeReadWritable},
+		{0664, GitModeRegular | GitModeReadWritable},
+		{0744, GitModeRegular | GitModeExecutable},
+		{os.ModeDir | 0755, GitModeDir},
+		{os.ModeSymlink | 0777, GitModeSymlink},
+		{os.ModeNamedPipe | 0644, GitModeNull},
+	} {
+		if actual := GitModeFromFileMode(test.mode); actual != test.expected {
+			t.Errorf("GitModeFromFileMode(%v) = %v, want %v", test.mode, actual, test.expected)
+		}
+	}
+}
@@ -15,3 +15,21 @@ type Object interface {
 	Size() int
 	EncodeDecoder
 }
+
+// NewObjectOfType returns the zero value of the Object type whose Type method
+// yields the given string. An error is returned if the string is not a known
+// object type.
+func NewObjectOfType(typeString string) (Object, error) {
+	switch typeString {
+	case "blob":
+		return &Blob{}, nil
+	case "tree":
+		return &Tree{}, nil
+	case "commit":
+		return &Commit{}, nil
+	case "tag":
+		return &Tag{}, nil
+	default:
+		return nil, Errorf("%v is not a known object type", typeString)
+	}
+}
@@ -66,3 +66,19 @@ func Sha1FromByteSlice(slice []byte) Sha1 {
 	copy(sha[:], slice[:])
 	return sha
 }
+
+// A slice type that satisfies sort.Interface so that a slice of Sha1s can be
+// sorted in ascending order.
+type Sha1Slice []Sha1
+
+func (s Sha1Slice) Len() int {
+	return len(s)
+}
+
+func (s Sha1Slice) Less(i, j int) bool {
+	return s[i].Compare(s[j]) < 0
+}
+
+func (s Sha1Slice) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
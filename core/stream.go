@@ -85,17 +85,10 @@ func (stream *Stream) Decode(reader io.Reader) error {
 	} else {
 		typeString = typeString[:len(typeString)-1]
 
-		switch typeString {
-		case "blob":
-			stream.object = &Blob{}
-		case "tree":
-			stream.object = &Tree{}
-		case "commit":
-			stream.object = &Commit{}
-		case "tag":
-			stream.object = &Tag{}
-		default:
-			return Errorf("%v is not a known object type", typeString)
+		if object, err := NewObjectOfType(typeString); err != nil {
+			return err
+		} else {
+			stream.object = object
 		}
 	}
 
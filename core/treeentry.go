@@ -84,8 +84,18 @@ func TreeEntryFromObject(object Object, mode GitMode, name string) (*TreeEntry,
 	return entry, nil
 }
 
+// sortName returns the name by which this entry is sorted within a tree. Git
+// sorts a subtree as if its name ended with a slash.
+func (entry TreeEntry) sortName() string {
+	if entry.Mode == GitModeDir {
+		return entry.Name + "/"
+	}
+	return entry.Name
+}
+
 // A slice type that satisfies sort.Interface so that a slice of TreeEntries can
-// be lexicographically sorted by their entry name.
+// be lexicographically sorted by their entry name, in the same order as Git,
+// which sorts a subtree as if its name ended with a slash.
 type TreeEntrySlice []TreeEntry
 
 func (entries TreeEntrySlice) Len() int {
@@ -93,7 +103,7 @@ func (entries TreeEntrySlice) Len() int {
 }
 
 func (entries TreeEntrySlice) Less(i, j int) bool {
-	return entries[i].Name < entries[j].Name
+	return entries[i].sortName() < entries[j].sortName()
 }
 
 func (entries TreeEntrySlice) Swap(i, j int) {
@@ -140,3 +140,17 @@ func TestTreeEntrySlice_Sort(t *testing.T) {
 		t.Errorf("Sorted tree entries = %v, want %v", actual, expected)
 	}
 }
+
+func TestTreeEntrySlice_Sort_Subtrees(t *testing.T) {
+	dir := TreeEntry{Mode: GitModeDir, Name: "a"}
+	dash := TreeEntry{Mode: _frw_r__r__, Name: "a-b"}
+	file := TreeEntry{Mode: _frw_r__r__, Name: "a0"}
+
+	var expected TreeEntrySlice = TreeEntrySlice([]TreeEntry{dash, dir, file})
+	var actual TreeEntrySlice = TreeEntrySlice([]TreeEntry{dir, file, dash})
+	sort.Sort(actual)
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Sorted tree entries = %v, want %v", actual, expected)
+	}
+}
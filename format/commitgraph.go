@@ -0,0 +1,703 @@
+package format
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kourge/ggit/core"
+)
+
+var (
+	ErrCommitNotInGraph        = errors.New("commit not found in commit graph")
+	ErrInvalidCommitGraphChain = errors.New("commit graph chain does not match its layers")
+)
+
+var commitGraphSignature = [4]byte{'C', 'G', 'P', 'H'}
+
+const (
+	commitGraphParentNone     uint32 = 0x70000000
+	commitGraphParentExtended uint32 = 0x80000000
+	commitGraphLastEdge       uint32 = 0x80000000
+	commitGraphOffsetOverflow uint32 = 0x80000000
+
+	// CommitGraphGenerationMax is the largest topological level that can be
+	// stored in a commit graph. Any commit whose level would be greater is
+	// recorded with this value instead.
+	CommitGraphGenerationMax uint32 = 0x3fffffff
+)
+
+var (
+	commitGraphChunkFanout         = [4]byte{'O', 'I', 'D', 'F'}
+	commitGraphChunkOids           = [4]byte{'O', 'I', 'D', 'L'}
+	commitGraphChunkData           = [4]byte{'C', 'D', 'A', 'T'}
+	commitGraphChunkGeneration     = [4]byte{'G', 'D', 'A', '2'}
+	commitGraphChunkGenerationOver = [4]byte{'G', 'D', 'O', '2'}
+	commitGraphChunkExtraEdges     = [4]byte{'E', 'D', 'G', 'E'}
+	commitGraphChunkBase           = [4]byte{'B', 'A', 'S', 'E'}
+)
+
+type commitGraphHeader struct {
+	Signature   [4]byte // == commitGraphSignature
+	Version     uint8   // == 1
+	HashVersion uint8   // == 1, i.e. SHA-1
+	ChunkCount  uint8
+	BaseCount   uint8
+}
+
+type commitGraphChunkEntry struct {
+	Id     [4]byte
+	Offset uint64
+}
+
+type commitGraphData struct {
+	Tree          core.Sha1
+	Parent1       uint32
+	Parent2       uint32
+	GenerationHi  uint32 // topological level and the top 2 bits of the time
+	CommitTimeLow uint32
+}
+
+func (d commitGraphData) generation() uint32 {
+	return d.GenerationHi >> 2
+}
+
+func (d commitGraphData) commitTime() int64 {
+	return int64(d.GenerationHi&0x3)<<32 | int64(d.CommitTimeLow)
+}
+
+// A CommitGraphCommit holds everything that a commit graph records about a
+// single commit. Parents are given as positions within the commit graph and
+// can be looked up with CommitAt.
+//
+// Generation is the topological level of the commit: a commit without parents
+// has a level of 1, and any other commit has a level of one more than the
+// maximum level of its parents. CorrectedCommitDate is the generation number
+// introduced by the second version of the format. It is zero if the commit
+// graph does not carry generation data.
+type CommitGraphCommit struct {
+	Sha1                core.Sha1
+	Tree                core.Sha1
+	Parents             []uint32
+	Generation          uint32
+	CommitTime          int64
+	CorrectedCommitDate uint64
+}
+
+// A CommitGraph is the in-memory representation of a commit graph file, which
+// caches the structure of the commit history so that a walk through history
+// does not need to decompress and parse any commit object.
+//
+// A commit graph may be one layer of a split commit graph chain, in which case
+// it is stacked on top of a base graph. The positions of the commits in a layer
+// come after all those of its base, so every position is valid throughout the
+// whole chain.
+//
+// For more information on the commit graph format, see:
+// https://git-scm.com/docs/commit-graph-format
+type CommitGraph struct {
+	fanout              [256]uint32
+	oids                []core.Sha1
+	data                []commitGraphData
+	generationOffsets   []uint32
+	generationOverflows []uint64
+	extraEdges          []uint32
+	baseGraphs          []core.Sha1
+	sha1                core.Sha1
+
+	base      *CommitGraph
+	baseCount uint32
+}
+
+var _ core.EncodeDecoder = &CommitGraph{}
+
+// CommitGraphAtPath attempts to open the file at the given path and decode it
+// into a CommitGraph. The result is a single layer without a base.
+func CommitGraphAtPath(path string) (*CommitGraph, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	graph := &CommitGraph{}
+	if err := graph.Decode(file); err != nil {
+		return nil, err
+	}
+
+	return graph, nil
+}
+
+// OpenCommitGraph loads the commit graph of the given objects directory. If
+// a split commit graph chain exists at "info/commit-graphs/commit-graph-chain",
+// every layer in it is loaded and the top-most layer is returned. Otherwise,
+// the single commit graph file at "info/commit-graph" is loaded. If neither
+// exists, an error satisfying os.IsNotExist is returned.
+func OpenCommitGraph(objectsDir string) (*CommitGraph, error) {
+	graphsDir := filepath.Join(objectsDir, "info", "commit-graphs")
+	file, err := os.Open(filepath.Join(graphsDir, "commit-graph-chain"))
+	if os.IsNotExist(err) {
+		return CommitGraphAtPath(filepath.Join(objectsDir, "info", "commit-graph"))
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	chain := &CommitGraphChain{}
+	if err := chain.Decode(file); err != nil {
+		return nil, err
+	}
+
+	var graph *CommitGraph
+	for _, hash := range chain.Layers {
+		layer, err := CommitGraphAtPath(CommitGraphLayerPath(objectsDir, hash))
+		if err != nil {
+			return nil, err
+		} else if layer.sha1 != hash {
+			return nil, ErrInvalidCommitGraphChain
+		} else if err := layer.SetBase(graph); err != nil {
+			return nil, err
+		}
+		graph = layer
+	}
+
+	if graph == nil {
+		return nil, Errorf("commit graph chain is empty")
+	}
+	return graph, nil
+}
+
+// CommitGraphLayerPath returns the path of the layer with the given checksum
+// in the split commit graph chain of the given objects directory.
+func CommitGraphLayerPath(objectsDir string, hash core.Sha1) string {
+	return filepath.Join(objectsDir, "info", "commit-graphs", "graph-"+hash.String()+".graph")
+}
+
+// NewCommitGraph builds a commit graph out of the given commits, keyed by
+// their SHA-1 checksums. If base is nil, every parent of every commit must be
+// among the given commits. Otherwise, the result is a new layer on top of base
+// and parents may also be found in base; commits that are already in base are
+// left out of the new layer.
+func NewCommitGraph(commits map[core.Sha1]*core.Commit, base *CommitGraph) (*CommitGraph, error) {
+	graph := &CommitGraph{}
+	if err := graph.SetBase(base); err != nil {
+		return nil, err
+	}
+
+	for sha := range commits {
+		if _, inBase := base.Position(sha); !inBase {
+			graph.oids = append(graph.oids, sha)
+		}
+	}
+	sort.Sort(core.Sha1Slice(graph.oids))
+	for _, sha := range graph.oids {
+		graph.fanout[sha[0]] += 1
+	}
+	for i := 1; i < len(graph.fanout); i++ {
+		graph.fanout[i] += graph.fanout[i-1]
+	}
+
+	n := len(graph.oids)
+	graph.data = make([]commitGraphData, n)
+	graph.generationOffsets = make([]uint32, n)
+
+	levels := make([]uint32, n)
+	dates := make([]uint64, n)
+	visiting := make([]bool, n)
+	for i := range graph.oids {
+		if err := graph.computeGeneration(commits, i, levels, dates, visiting); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, sha := range graph.oids {
+		commit := commits[sha]
+		var parents []uint32
+		for _, parent := range commit.Parents() {
+			pos, _ := graph.Position(parent)
+			parents = append(parents, pos)
+		}
+
+		d := &graph.data[i]
+		d.Tree = commit.Tree()
+		d.Parent1, d.Parent2 = commitGraphParentNone, commitGraphParentNone
+		if len(parents) > 0 {
+			d.Parent1 = parents[0]
+		}
+		if len(parents) == 2 {
+			d.Parent2 = parents[1]
+		} else if len(parents) > 2 {
+			d.Parent2 = commitGraphParentExtended | uint32(len(graph.extraEdges))
+			for j, parent := range parents[1:] {
+				if j == len(parents)-2 {
+					parent |= commitGraphLastEdge
+				}
+				graph.extraEdges = append(graph.extraEdges, parent)
+			}
+		}
+
+		commitTime := commitGraphCommitTime(commit)
+		d.GenerationHi = levels[i]<<2 | uint32(commitTime>>32)&0x3
+		d.CommitTimeLow = uint32(commitTime)
+
+		if offset := dates[i] - uint64(commitTime); offset >= uint64(commitGraphOffsetOverflow) {
+			graph.generationOffsets[i] = commitGraphOffsetOverflow | uint32(len(graph.generationOverflows))
+			graph.generationOverflows = append(graph.generationOverflows, offset)
+		} else {
+			graph.generationOffsets[i] = uint32(offset)
+		}
+	}
+
+	graph.sha1 = sha1.Sum(graph.body())
+	return graph, nil
+}
+
+// computeGeneration fills in the topological level and the corrected commit
+// date of the commit at local index i and of any of its ancestors in this
+// layer that have not been visited yet. An explicit stack is used so that long
+// histories do not exhaust the call stack. Every commit above a commit on the
+// stack is one of its ancestors, so reaching a commit that is still being
+// visited means that the history is cyclic.
+func (graph *CommitGraph) computeGeneration(
+	commits map[core.Sha1]*core.Commit,
+	i int,
+	levels []uint32,
+	dates []uint64,
+	visiting []bool,
+) error {
+	stack := []int{i}
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		if levels[top] != 0 {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		commit := commits[graph.oids[top]]
+		level, date := uint32(0), uint64(0)
+		pending := false
+		for _, parent := range commit.Parents() {
+			pos, found := graph.Position(parent)
+			if !found {
+				return Errorf("parent %s of commit %s is not in the commit graph", parent, graph.oids[top])
+			}
+
+			var parentLevel uint32
+			var parentDate uint64
+			if pos < graph.baseCount {
+				c, err := graph.base.CommitAt(pos)
+				if err != nil {
+					return err
+				}
+				parentLevel, parentDate = c.Generation, c.CorrectedCommitDate
+			} else if local := int(pos - graph.baseCount); visiting[local] {
+				return Errorf("commit history is cyclic at %s", graph.oids[local])
+			} else if levels[local] == 0 {
+				stack = append(stack, local)
+				pending = true
+				continue
+			} else {
+				parentLevel, parentDate = levels[local], dates[local]
+			}
+
+			if parentLevel > level {
+				level = parentLevel
+			}
+			if parentDate > date {
+				date = parentDate
+			}
+		}
+		if pending {
+			visiting[top] = true
+			continue
+		}
+
+		if level < CommitGraphGenerationMax {
+			level += 1
+		}
+		if commitTime := uint64(commitGraphCommitTime(commit)); date+1 > commitTime {
+			date += 1
+		} else {
+			date = commitTime
+		}
+		levels[top], dates[top] = level, date
+		visiting[top] = false
+		stack = stack[:len(stack)-1]
+	}
+
+	return nil
+}
+
+func commitGraphCommitTime(commit *core.Commit) int64 {
+	t := commit.Committer().Unix()
+	if t < 0 {
+		return 0
+	} else if t >= 1<<34 {
+		return 1<<34 - 1
+	}
+	return t
+}
+
+// SetBase stacks this layer on top of the given base graph. The base graphs
+// recorded in this layer, if any, must be exactly the layers that make up
+// base. Passing nil removes the base.
+func (graph *CommitGraph) SetBase(base *CommitGraph) error {
+	var layers []core.Sha1
+	for b := base; b != nil; b = b.base {
+		layers = append([]core.Sha1{b.sha1}, layers...)
+	}
+
+	if len(graph.oids) != 0 || len(graph.baseGraphs) != 0 {
+		if len(layers) != len(graph.baseGraphs) {
+			return ErrInvalidCommitGraphChain
+		}
+		for i, hash := range layers {
+			if graph.baseGraphs[i] != hash {
+				return ErrInvalidCommitGraphChain
+			}
+		}
+	}
+
+	graph.base = base
+	graph.baseGraphs = layers
+	graph.baseCount = 0
+	if base != nil {
+		graph.baseCount = uint32(base.Len())
+	}
+	return nil
+}
+
+// Base returns the graph that this layer is stacked upon, or nil if this is
+// the bottom-most layer.
+func (graph *CommitGraph) Base() *CommitGraph {
+	return graph.base
+}
+
+// Sha1 returns the checksum of this layer, which is also the name under which
+// it is stored in a split commit graph chain.
+func (graph *CommitGraph) Sha1() core.Sha1 {
+	return graph.sha1
+}
+
+// Len returns the number of commits in this graph, including those in all the
+// layers below it.
+func (graph *CommitGraph) Len() int {
+	if graph == nil {
+		return 0
+	}
+	return int(graph.baseCount) + len(graph.oids)
+}
+
+// HasGenerationData returns true if every layer of this graph carries
+// corrected commit dates.
+func (graph *CommitGraph) HasGenerationData() bool {
+	for g := graph; g != nil; g = g.base {
+		if g.generationOffsets == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Position returns the position of the commit with the given SHA-1 in this
+// graph. If the commit is not found in this layer nor in any layer below it,
+// the bool returned is false.
+func (graph *CommitGraph) Position(sha core.Sha1) (uint32, bool) {
+	for g := graph; g != nil; g = g.base {
+		lower := uint32(0)
+		if sha[0] != 0x00 {
+			lower = g.fanout[int(sha[0])-1]
+		}
+		upper := g.fanout[int(sha[0])]
+		oids := g.oids[lower:upper]
+
+		i := sort.Search(len(oids), func(i int) bool {
+			return oids[i].Compare(sha) >= 0
+		})
+		if i < len(oids) && oids[i] == sha {
+			return g.baseCount + lower + uint32(i), true
+		}
+	}
+
+	return 0, false
+}
+
+// Lookup returns what the commit graph records about the commit with the given
+// SHA-1. If the commit is not in the graph, the error ErrCommitNotInGraph is
+// returned.
+func (graph *CommitGraph) Lookup(sha core.Sha1) (*CommitGraphCommit, error) {
+	pos, found := graph.Position(sha)
+	if !found {
+		return nil, ErrCommitNotInGraph
+	}
+	return graph.CommitAt(pos)
+}
+
+// CommitAt returns what the commit graph records about the commit at the given
+// position.
+func (graph *CommitGraph) CommitAt(pos uint32) (*CommitGraphCommit, error) {
+	g := graph
+	for g != nil && pos < g.baseCount {
+		g = g.base
+	}
+	if g == nil || pos >= g.baseCount+uint32(len(g.oids)) {
+		return nil, Errorf("%d is not a valid commit graph position", pos)
+	}
+
+	local := pos - g.baseCount
+	d := g.data[local]
+	commit := &CommitGraphCommit{
+		Sha1:       g.oids[local],
+		Tree:       d.Tree,
+		Generation: d.generation(),
+		CommitTime: d.commitTime(),
+	}
+
+	if d.Parent1 != commitGraphParentNone {
+		commit.Parents = append(commit.Parents, d.Parent1)
+	}
+	if d.Parent2&commitGraphParentExtended != 0 {
+		for i := int(d.Parent2 &^ commitGraphParentExtended); i < len(g.extraEdges); i++ {
+			edge := g.extraEdges[i]
+			commit.Parents = append(commit.Parents, edge&^commitGraphLastEdge)
+			if edge&commitGraphLastEdge != 0 {
+				break
+			}
+		}
+	} else if d.Parent2 != commitGraphParentNone {
+		commit.Parents = append(commit.Parents, d.Parent2)
+	}
+
+	if graph.HasGenerationData() {
+		offset := uint64(g.generationOffsets[local])
+		if offset&uint64(commitGraphOffsetOverflow) != 0 {
+			i := offset &^ uint64(commitGraphOffsetOverflow)
+			if i >= uint64(len(g.generationOverflows)) {
+				return nil, Errorf("generation data overflow index %d is out of range", i)
+			}
+			offset = g.generationOverflows[i]
+		}
+		commit.CorrectedCommitDate = uint64(commit.CommitTime) + offset
+	}
+
+	return commit, nil
+}
+
+// Sha1At returns the SHA-1 of the commit at the given position.
+func (graph *CommitGraph) Sha1At(pos uint32) (core.Sha1, error) {
+	commit, err := graph.CommitAt(pos)
+	if err != nil {
+		return core.Sha1{}, err
+	}
+	return commit.Sha1, nil
+}
+
+// Reader returns an io.Reader that yields this layer in the commit graph file
+// format, followed by its checksum.
+func (graph *CommitGraph) Reader() io.Reader {
+	body := graph.body()
+	hash := sha1.Sum(body)
+	return io.MultiReader(bytes.NewReader(body), bytes.NewReader(hash[:]))
+}
+
+type commitGraphChunk struct {
+	id   [4]byte
+	data interface{}
+}
+
+func (graph *CommitGraph) chunks() []commitGraphChunk {
+	chunks := []commitGraphChunk{
+		{commitGraphChunkFanout, graph.fanout},
+		{commitGraphChunkOids, graph.oids},
+		{commitGraphChunkData, graph.data},
+	}
+	if graph.generationOffsets != nil {
+		chunks = append(chunks, commitGraphChunk{commitGraphChunkGeneration, graph.generationOffsets})
+	}
+	if len(graph.generationOverflows) != 0 {
+		chunks = append(chunks, commitGraphChunk{commitGraphChunkGenerationOver, graph.generationOverflows})
+	}
+	if len(graph.extraEdges) != 0 {
+		chunks = append(chunks, commitGraphChunk{commitGraphChunkExtraEdges, graph.extraEdges})
+	}
+	if len(graph.baseGraphs) != 0 {
+		chunks = append(chunks, commitGraphChunk{commitGraphChunkBase, graph.baseGraphs})
+	}
+	return chunks
+}
+
+// body serializes everything in this layer except for the trailing checksum.
+func (graph *CommitGraph) body() []byte {
+	chunks := graph.chunks()
+	header := commitGraphHeader{
+		Signature:   commitGraphSignature,
+		Version:     1,
+		HashVersion: 1,
+		ChunkCount:  uint8(len(chunks)),
+		BaseCount:   uint8(len(graph.baseGraphs)),
+	}
+
+	offset := uint64(binary.Size(header) + (len(chunks)+1)*binary.Size(commitGraphChunkEntry{}))
+	table := make([]commitGraphChunkEntry, 0, len(chunks)+1)
+	for _, chunk := range chunks {
+		table = append(table, commitGraphChunkEntry{chunk.id, offset})
+		offset += uint64(binary.Size(chunk.data))
+	}
+	table = append(table, commitGraphChunkEntry{[4]byte{}, offset})
+
+	buffer := new(bytes.Buffer)
+	for _, data := range []interface{}{header, table} {
+		if err := binary.Write(buffer, binary.BigEndian, data); err != nil {
+			core.Die(err)
+		}
+	}
+	for _, chunk := range chunks {
+		if err := binary.Write(buffer, binary.BigEndian, chunk.data); err != nil {
+			core.Die(err)
+		}
+	}
+	return buffer.Bytes()
+}
+
+// Decode reads a single commit graph file from reader. The trailing checksum
+// is verified. Chunks that are not understood, such as Bloom filters, are
+// skipped. If the file names any base graphs, SetBase must be called with the
+// matching layers before any commit in a base can be looked up.
+func (graph *CommitGraph) Decode(reader io.Reader) error {
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	} else if len(content) < sha1.Size {
+		return io.ErrUnexpectedEOF
+	}
+
+	body, trailer := content[:len(content)-sha1.Size], content[len(content)-sha1.Size:]
+	if actual := core.Sha1(sha1.Sum(body)); actual != core.Sha1FromByteSlice(trailer) {
+		return Errorf("commit graph SHA-1 is %s, expected %s", actual, core.Sha1FromByteSlice(trailer))
+	}
+	graph.sha1 = core.Sha1FromByteSlice(trailer)
+
+	r := bytes.NewReader(body)
+	header := commitGraphHeader{}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	if header.Signature != commitGraphSignature {
+		return Errorf("%v is not a valid commit graph header", header.Signature)
+	} else if header.Version != 1 {
+		return Errorf("%d is not a valid commit graph version", header.Version)
+	} else if header.HashVersion != 1 {
+		return Errorf("commit graph hash version %d is not supported", header.HashVersion)
+	}
+
+	table := make([]commitGraphChunkEntry, int(header.ChunkCount)+1)
+	if err := binary.Read(r, binary.BigEndian, table); err != nil {
+		return err
+	}
+
+	chunks := make(map[[4]byte][]byte)
+	for i := 0; i < int(header.ChunkCount); i++ {
+		start, end := table[i].Offset, table[i+1].Offset
+		if start > end || end > uint64(len(body)) {
+			return Errorf("commit graph chunk %q is out of bounds", table[i].Id[:])
+		}
+		chunks[table[i].Id] = body[start:end]
+	}
+
+	readChunk := func(id [4]byte, data interface{}, required bool) error {
+		chunk, exists := chunks[id]
+		if !exists {
+			if required {
+				return Errorf("commit graph is missing chunk %q", id[:])
+			}
+			return nil
+		}
+		return binary.Read(bytes.NewReader(chunk), binary.BigEndian, data)
+	}
+
+	if err := readChunk(commitGraphChunkFanout, &graph.fanout, true); err != nil {
+		return err
+	}
+
+	n := int(graph.fanout[255])
+	graph.oids = make([]core.Sha1, n)
+	graph.data = make([]commitGraphData, n)
+	if err := readChunk(commitGraphChunkOids, graph.oids, true); err != nil {
+		return err
+	}
+	if err := readChunk(commitGraphChunkData, graph.data, true); err != nil {
+		return err
+	}
+
+	if chunk, exists := chunks[commitGraphChunkGeneration]; exists {
+		graph.generationOffsets = make([]uint32, n)
+		if err := binary.Read(bytes.NewReader(chunk), binary.BigEndian, graph.generationOffsets); err != nil {
+			return err
+		}
+	}
+	if chunk, exists := chunks[commitGraphChunkGenerationOver]; exists {
+		graph.generationOverflows = make([]uint64, len(chunk)/8)
+		if err := binary.Read(bytes.NewReader(chunk), binary.BigEndian, graph.generationOverflows); err != nil {
+			return err
+		}
+	}
+	if chunk, exists := chunks[commitGraphChunkExtraEdges]; exists {
+		graph.extraEdges = make([]uint32, len(chunk)/4)
+		if err := binary.Read(bytes.NewReader(chunk), binary.BigEndian, graph.extraEdges); err != nil {
+			return err
+		}
+	}
+
+	graph.baseGraphs = make([]core.Sha1, header.BaseCount)
+	if err := readChunk(commitGraphChunkBase, graph.baseGraphs, header.BaseCount != 0); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// A CommitGraphChain represents the "commit-graph-chain" file that lists the
+// layers of a split commit graph, from the bottom-most layer to the top-most
+// layer, by their checksums.
+type CommitGraphChain struct {
+	Layers []core.Sha1
+}
+
+var _ core.EncodeDecoder = &CommitGraphChain{}
+
+// Reader returns an io.Reader that yields the checksum of each layer on its
+// own line.
+func (chain *CommitGraphChain) Reader() io.Reader {
+	readers := make([]io.Reader, len(chain.Layers))
+	for i, hash := range chain.Layers {
+		readers[i] = strings.NewReader(hash.String() + "\n")
+	}
+	return io.MultiReader(readers...)
+}
+
+// Decode reads a commit graph chain file, one layer checksum per line.
+func (chain *CommitGraphChain) Decode(reader io.Reader) error {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		hash, err := core.Sha1FromString(line)
+		if err != nil {
+			return err
+		}
+		chain.Layers = append(chain.Layers, hash)
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,131 @@
+package format
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kourge/ggit/core"
+)
+
+// _fixtureHistory builds a history in which commit i has the given parents,
+// committed i seconds after the epoch of the fixture.
+func _fixtureHistory(parents [][]int) ([]core.Sha1, map[core.Sha1]*core.Commit) {
+	shas := make([]core.Sha1, len(parents))
+	commits := make(map[core.Sha1]*core.Commit)
+	for i, ps := range parents {
+		var parentShas []core.Sha1
+		for _, p := range ps {
+			parentShas = append(parentShas, shas[p])
+		}
+		person := core.NewPerson("Jane Doe", "jane@example.com", 1400000000+int64(i), 0)
+		commit := core.NewCommit(core.Sha1{byte(i)}, parentShas, person, person, "commit")
+		shas[i] = core.NewStream(commit).Hash()
+		commits[shas[i]] = commit
+	}
+	return shas, commits
+}
+
+var _fixtureGraphParents = [][]int{{}, {0}, {0}, {0}, {1, 2, 3}, {4}}
+
+func TestNewCommitGraph(t *testing.T) {
+	shas, commits := _fixtureHistory(_fixtureGraphParents)
+	graph, err := NewCommitGraph(commits, nil)
+	if err != nil {
+		t.Fatalf("NewCommitGraph() returned error %v", err)
+	}
+
+	decoded := &CommitGraph{}
+	if err := decoded.Decode(graph.Reader()); err != nil {
+		t.Fatalf("graph.Decode() returned error %v", err)
+	}
+
+	for i, sha := range shas {
+		commit, err := decoded.Lookup(sha)
+		if err != nil {
+			t.Errorf("graph.Lookup(%s) returned error %v", sha, err)
+			continue
+		}
+
+		if commit.Tree != (core.Sha1{byte(i)}) {
+			t.Errorf("commit %d has tree %s", i, commit.Tree)
+		}
+		if commit.CommitTime != 1400000000+int64(i) {
+			t.Errorf("commit %d has time %d", i, commit.CommitTime)
+		}
+
+		var parents []core.Sha1
+		for _, pos := range commit.Parents {
+			parent, _ := decoded.Sha1At(pos)
+			parents = append(parents, parent)
+		}
+		if expected := commits[sha].Parents(); len(parents) != len(expected) || (len(expected) != 0 && !reflect.DeepEqual(parents, expected)) {
+			t.Errorf("commit %d has parents %v, want %v", i, parents, expected)
+		}
+	}
+
+	for i, expected := range []uint32{1, 2, 2, 2, 3, 4} {
+		if commit, _ := decoded.Lookup(shas[i]); commit.Generation != expected {
+			t.Errorf("commit %d has generation %d, want %d", i, commit.Generation, expected)
+		}
+	}
+
+	if _, err := decoded.Lookup(core.Sha1{0xff}); err != ErrCommitNotInGraph {
+		t.Errorf("graph.Lookup() of a missing commit returned %v", err)
+	}
+}
+
+func TestNewCommitGraph_MissingParent(t *testing.T) {
+	shas, commits := _fixtureHistory(_fixtureGraphParents)
+	delete(commits, shas[0])
+
+	if _, err := NewCommitGraph(commits, nil); err == nil {
+		t.Errorf("NewCommitGraph() should fail when a parent is missing")
+	}
+}
+
+func TestNewCommitGraph_Split(t *testing.T) {
+	shas, commits := _fixtureHistory(_fixtureGraphParents)
+	lower := make(map[core.Sha1]*core.Commit)
+	for _, sha := range shas[:4] {
+		lower[sha] = commits[sha]
+	}
+
+	base, err := NewCommitGraph(lower, nil)
+	if err != nil {
+		t.Fatalf("NewCommitGraph() returned error %v", err)
+	}
+	top, err := NewCommitGraph(commits, base)
+	if err != nil {
+		t.Fatalf("NewCommitGraph() returned error %v", err)
+	}
+
+	decoded := &CommitGraph{}
+	if err := decoded.Decode(top.Reader()); err != nil {
+		t.Fatalf("graph.Decode() returned error %v", err)
+	}
+	if _, err := decoded.Lookup(shas[5]); err != nil {
+		t.Errorf("graph.Lookup() of a commit in the top layer returned error %v", err)
+	}
+	if err := decoded.SetBase(nil); err != ErrInvalidCommitGraphChain {
+		t.Errorf("graph.SetBase(nil) returned %v, want %v", err, ErrInvalidCommitGraphChain)
+	}
+	if err := decoded.SetBase(base); err != nil {
+		t.Fatalf("graph.SetBase() returned error %v", err)
+	}
+
+	if decoded.Len() != len(shas) {
+		t.Errorf("graph.Len() = %d, want %d", decoded.Len(), len(shas))
+	}
+
+	commit, err := decoded.Lookup(shas[4])
+	if err != nil {
+		t.Fatalf("graph.Lookup() returned error %v", err)
+	} else if commit.Generation != 3 {
+		t.Errorf("commit 4 has generation %d, want 3", commit.Generation)
+	}
+	for _, pos := range commit.Parents {
+		if pos >= uint32(base.Len()) {
+			t.Errorf("parent of commit 4 at %d is not in the base layer", pos)
+		}
+	}
+}
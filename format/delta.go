@@ -0,0 +1,242 @@
+package format
+
+import (
+	"bytes"
+	"errors"
+)
+
+var (
+	ErrDeltaTruncated          = errors.New("delta truncated")
+	ErrDeltaBaseSizeMismatch   = errors.New("delta base size mismatch")
+	ErrDeltaTargetSizeMismatch = errors.New("delta target size mismatch")
+)
+
+// ApplyDelta reconstructs an object by applying the given delta to the given
+// base. Both the base and the result are raw object content, i.e. without
+// the type and size header that precedes a loose object.
+//
+// A delta starts with two variable-length sizes: the expected size of the
+// base and the size of the resulting object. What follows is a sequence of
+// instructions. An instruction whose most significant bit is set copies a
+// range of bytes from the base; the lower seven bits indicate which of the
+// following bytes make up the little-endian offset and length of said range.
+// Any other non-zero instruction inserts that many of the bytes that follow it
+// verbatim. The zero instruction is reserved and treated as an error.
+//
+// For more information on the delta format, see:
+// https://git-scm.com/docs/pack-format#_deltified_representation
+func ApplyDelta(base, delta []byte) ([]byte, error) {
+	baseSize, pos, err := decodeDeltaSize(delta, 0)
+	if err != nil {
+		return nil, err
+	} else if baseSize != uint64(len(base)) {
+		return nil, ErrDeltaBaseSizeMismatch
+	}
+
+	targetSize, pos, err := decodeDeltaSize(delta, pos)
+	if err != nil {
+		return nil, err
+	}
+
+	// The target size is only taken at its word up to what the delta could
+	// plausibly produce, so that a corrupt size cannot exhaust memory up front.
+	// The target grows past that as it is written, should it need to.
+	capacity := targetSize
+	if plausible := uint64(len(base) + len(delta)); capacity > plausible {
+		capacity = plausible
+	}
+	target := make([]byte, 0, capacity)
+	for pos < len(delta) {
+		cmd := delta[pos]
+		pos += 1
+
+		switch {
+		case cmd&0x80 != 0:
+			var offset, size uint64
+			for i := uint(0); i < 4; i++ {
+				if cmd&(1<<i) == 0 {
+					continue
+				} else if pos >= len(delta) {
+					return nil, ErrDeltaTruncated
+				}
+				offset |= uint64(delta[pos]) << (i * 8)
+				pos += 1
+			}
+			for i := uint(0); i < 3; i++ {
+				if cmd&(0x10<<i) == 0 {
+					continue
+				} else if pos >= len(delta) {
+					return nil, ErrDeltaTruncated
+				}
+				size |= uint64(delta[pos]) << (i * 8)
+				pos += 1
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+
+			if offset+size > uint64(len(base)) {
+				return nil, Errorf("delta copies %d bytes at %d from a base of %d bytes", size, offset, len(base))
+			}
+			target = append(target, base[offset:offset+size]...)
+		case cmd != 0:
+			n := int(cmd)
+			if pos+n > len(delta) {
+				return nil, ErrDeltaTruncated
+			}
+			target = append(target, delta[pos:pos+n]...)
+			pos += n
+		default:
+			return nil, errors.New("delta contains reserved instruction 0")
+		}
+	}
+
+	if uint64(len(target)) != targetSize {
+		return nil, ErrDeltaTargetSizeMismatch
+	}
+
+	return target, nil
+}
+
+// decodeDeltaSize decodes the variable-length size found in a delta header
+// starting at pos. It returns the size and the position right after it.
+func decodeDeltaSize(delta []byte, pos int) (size uint64, next int, err error) {
+	shift := uint(0)
+	for {
+		if pos >= len(delta) {
+			return 0, pos, ErrDeltaTruncated
+		}
+		c := delta[pos]
+		pos += 1
+
+		size |= uint64(c&0x7f) << shift
+		shift += 7
+		if c&0x80 == 0 {
+			return size, pos, nil
+		}
+	}
+}
+
+const (
+	deltaBlockSize   = 16
+	deltaMaxInsert   = 0x7f
+	deltaMaxCopySize = 0x10000
+	deltaMaxOffset   = 0xffffffff
+)
+
+// ComputeDelta produces a delta that, when applied to base with ApplyDelta,
+// yields target. The base is indexed in fixed-size blocks, and the target is
+// scanned for runs of bytes that can be copied from the base. Whatever cannot
+// be copied is inserted verbatim.
+//
+// The delta produced is not guaranteed to be smaller than target. It is up to
+// the caller to decide whether storing a delta is worthwhile.
+func ComputeDelta(base, target []byte) []byte {
+	delta := make([]byte, 0, len(target)/2+16)
+	delta = appendDeltaSize(delta, uint64(len(base)))
+	delta = appendDeltaSize(delta, uint64(len(target)))
+
+	index := make(map[uint32]int)
+	for i := 0; i+deltaBlockSize <= len(base) && int64(i) <= deltaMaxOffset; i += deltaBlockSize {
+		h := deltaBlockHash(base[i : i+deltaBlockSize])
+		if _, exists := index[h]; !exists {
+			index[h] = i
+		}
+	}
+
+	pending := 0
+	flush := func(end int) {
+		for pending < end {
+			n := end - pending
+			if n > deltaMaxInsert {
+				n = deltaMaxInsert
+			}
+			delta = append(delta, byte(n))
+			delta = append(delta, target[pending:pending+n]...)
+			pending += n
+		}
+	}
+
+	i := 0
+	for i+deltaBlockSize <= len(target) {
+		offset, found := index[deltaBlockHash(target[i:i+deltaBlockSize])]
+		if !found || !bytes.Equal(base[offset:offset+deltaBlockSize], target[i:i+deltaBlockSize]) {
+			i += 1
+			continue
+		}
+
+		// Extend the match backward into the bytes not yet emitted, and then
+		// forward as far as the base and the target agree.
+		for offset > 0 && i > pending && base[offset-1] == target[i-1] {
+			offset -= 1
+			i -= 1
+		}
+		n := deltaBlockSize
+		for offset+n < len(base) && i+n < len(target) && base[offset+n] == target[i+n] {
+			n += 1
+		}
+
+		flush(i)
+		delta = appendDeltaCopy(delta, offset, n)
+		i += n
+		pending = i
+	}
+	flush(len(target))
+
+	return delta
+}
+
+// appendDeltaSize appends the variable-length encoding of size used by delta
+// headers to delta.
+func appendDeltaSize(delta []byte, size uint64) []byte {
+	for size >= 0x80 {
+		delta = append(delta, byte(size)|0x80)
+		size >>= 7
+	}
+	return append(delta, byte(size))
+}
+
+// appendDeltaCopy appends as many copy instructions as needed to copy size
+// bytes from the base starting at offset.
+func appendDeltaCopy(delta []byte, offset, size int) []byte {
+	for size > 0 {
+		n := size
+		if n > deltaMaxCopySize {
+			n = deltaMaxCopySize
+		}
+
+		cmd := byte(0x80)
+		args := make([]byte, 0, 7)
+		for i := uint(0); i < 4; i++ {
+			if b := byte(uint64(offset) >> (i * 8)); b != 0 {
+				cmd |= 1 << i
+				args = append(args, b)
+			}
+		}
+		// A size of 0x10000 is encoded by omitting every size byte.
+		if n != deltaMaxCopySize {
+			for i := uint(0); i < 3; i++ {
+				if b := byte(n >> (i * 8)); b != 0 {
+					cmd |= 0x10 << i
+					args = append(args, b)
+				}
+			}
+		}
+
+		delta = append(delta, cmd)
+		delta = append(delta, args...)
+		offset += n
+		size -= n
+	}
+	return delta
+}
+
+// deltaBlockHash is a simple FNV-1a hash over a block of bytes.
+func deltaBlockHash(block []byte) uint32 {
+	h := uint32(2166136261)
+	for _, b := range block {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	return h
+}
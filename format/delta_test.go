@@ -0,0 +1,107 @@
+package format
+
+import (
+	"bytes"
+	"testing"
+)
+
+var (
+	_fixtureDeltaBase   = []byte("the quick brown fox jumps over the lazy dog")
+	_fixtureDeltaTarget = []byte("the quick red fox jumps over the lazy dog!")
+	_fixtureDelta       = []byte{
+		43, 42, // base size, target size
+		0x90, 10, // copy 10 bytes from offset 0
+		3, 'r', 'e', 'd', // insert "red"
+		0x91, 15, 28, // copy 28 bytes from offset 15
+		1, '!', // insert "!"
+	}
+)
+
+func TestApplyDelta(t *testing.T) {
+	actual, err := ApplyDelta(_fixtureDeltaBase, _fixtureDelta)
+	if err != nil {
+		t.Fatalf("ApplyDelta() returned error %v", err)
+	}
+
+	if !bytes.Equal(actual, _fixtureDeltaTarget) {
+		t.Errorf("ApplyDelta() = %q, want %q", actual, _fixtureDeltaTarget)
+	}
+}
+
+func TestApplyDelta_Errors(t *testing.T) {
+	for _, test := range []struct {
+		base  []byte
+		delta []byte
+	}{
+		{_fixtureDeltaBase[1:], _fixtureDelta},
+		{_fixtureDeltaBase, _fixtureDelta[:len(_fixtureDelta)-1]},
+		{_fixtureDeltaBase, []byte{43, 1, 0}},
+		{_fixtureDeltaBase, []byte{43, 1, 0x91, 43, 1}},
+		{_fixtureDeltaBase, []byte{43, 5, 0x90, 4}},
+		{_fixtureDeltaBase, []byte{0x80}},
+		{_fixtureDeltaBase, []byte{43, 0x80, 0x80, 0x80, 0x80, 0x80, 0x20, 1, 'x'}}, // target size of 1 TiB
+	} {
+		if _, err := ApplyDelta(test.base, test.delta); err == nil {
+			t.Errorf("ApplyDelta(_, %v) should fail", test.delta)
+		}
+	}
+}
+
+func TestDecodePackEntryBaseOffset(t *testing.T) {
+	for _, test := range []struct {
+		encoded []byte
+		offset  int64
+	}{
+		{[]byte{0x05}, 5},
+		{[]byte{0x7f}, 127},
+		{[]byte{0x80, 0x00}, 128},
+		{[]byte{0x81, 0x7f}, 383},
+		{[]byte{0x80, 0x80, 0x00}, 16512},
+	} {
+		offset, err := decodePackEntryBaseOffset(bytes.NewReader(test.encoded))
+		if err != nil {
+			t.Errorf("decodePackEntryBaseOffset(%v) returned error %v", test.encoded, err)
+		} else if offset != test.offset {
+			t.Errorf("decodePackEntryBaseOffset(%v) = %d, want %d", test.encoded, offset, test.offset)
+		}
+	}
+}
+
+func TestComputeDelta(t *testing.T) {
+	long := bytes.Repeat([]byte("0123456789abcdef"), 5000)
+	edited := append(append([]byte("prefix"), long[:40000]...), long[40007:]...)
+
+	for _, test := range []struct {
+		base   []byte
+		target []byte
+	}{
+		{_fixtureDeltaBase, _fixtureDeltaTarget},
+		{_fixtureDeltaBase, _fixtureDeltaBase},
+		{_fixtureDeltaBase, []byte{}},
+		{[]byte{}, _fixtureDeltaTarget},
+		{long, edited},
+	} {
+		delta := ComputeDelta(test.base, test.target)
+		actual, err := ApplyDelta(test.base, delta)
+		if err != nil {
+			t.Errorf("ApplyDelta(_, ComputeDelta()) returned error %v", err)
+		} else if !bytes.Equal(actual, test.target) {
+			t.Errorf("ApplyDelta(_, ComputeDelta()) did not reproduce the target")
+		}
+	}
+
+	if delta := ComputeDelta(long, edited); len(delta) > 100 {
+		t.Errorf("ComputeDelta() produced %d bytes for a small edit", len(delta))
+	}
+}
+
+func TestEncodePackEntryBaseOffset(t *testing.T) {
+	for _, offset := range []int64{1, 127, 128, 383, 16512, 1 << 40} {
+		encoded := encodePackEntryBaseOffset(offset)
+		if actual, err := decodePackEntryBaseOffset(bytes.NewReader(encoded)); err != nil {
+			t.Errorf("decodePackEntryBaseOffset(%v) returned error %v", encoded, err)
+		} else if actual != offset {
+			t.Errorf("encodePackEntryBaseOffset(%d) round-tripped to %d", offset, actual)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/bits"
+
+	"github.com/kourge/ggit/core"
+)
+
+const (
+	ewahMaxRunningLength = 1<<32 - 1
+	ewahMaxLiteralWords  = 1<<31 - 1
+)
+
+// An EWAHBitmap is a bitmap that is stored on disk compressed with the EWAH
+// (Enhanced Word-Aligned Hybrid) scheme, as used by the split index and
+// untracked cache extensions of an index and by pack bitmaps. It is kept
+// uncompressed in memory.
+//
+// On disk, an EWAH bitmap is made of the number of bits in the bitmap as a
+// 32-bit integer, the number of 64-bit words that follow as a 32-bit integer,
+// the words themselves, and the position of the last marker word as a 32-bit
+// integer, all of them big-endian. Each marker word, also known as a running
+// length word, holds in its lowest bit the value of a run of words whose bits
+// are all the same, in its next 32 bits the length of that run, and in its
+// highest 31 bits the number of literal words that follow the run.
+type EWAHBitmap struct {
+	words []uint64
+	size  int
+}
+
+var _ core.EncodeDecoder = &EWAHBitmap{}
+
+// NewEWAHBitmap returns a bitmap in which the bits at the given positions are
+// set.
+func NewEWAHBitmap(positions ...int) *EWAHBitmap {
+	b := &EWAHBitmap{}
+	for _, i := range positions {
+		b.Set(i)
+	}
+	return b
+}
+
+// Size returns the number of bits in this bitmap, which is one more than the
+// position of the highest bit that was ever set, unless a larger size was
+// decoded.
+func (b *EWAHBitmap) Size() int {
+	return b.size
+}
+
+// Set sets the bit at position i.
+func (b *EWAHBitmap) Set(i int) {
+	for len(b.words) <= i/64 {
+		b.words = append(b.words, 0)
+	}
+	b.words[i/64] |= 1 << uint(i%64)
+	if i >= b.size {
+		b.size = i + 1
+	}
+}
+
+// Get returns true if the bit at position i is set.
+func (b *EWAHBitmap) Get(i int) bool {
+	if i < 0 || i/64 >= len(b.words) {
+		return false
+	}
+	return b.words[i/64]&(1<<uint(i%64)) != 0
+}
+
+// Count returns the number of bits that are set.
+func (b *EWAHBitmap) Count() int {
+	n := 0
+	for _, word := range b.words {
+		n += bits.OnesCount64(word)
+	}
+	return n
+}
+
+// Each calls fn with the position of each bit that is set, in ascending order.
+func (b *EWAHBitmap) Each(fn func(i int)) {
+	for w, word := range b.words {
+		for word != 0 {
+			fn(w*64 + bits.TrailingZeros64(word))
+			word &= word - 1
+		}
+	}
+}
+
+// Or returns a new bitmap in which a bit is set if it is set in either b or
+// other.
+func (b *EWAHBitmap) Or(other *EWAHBitmap) *EWAHBitmap {
+	return b.combine(other, func(x, y uint64) uint64 { return x | y })
+}
+
+// And returns a new bitmap in which a bit is set if it is set in both b and
+// other.
+func (b *EWAHBitmap) And(other *EWAHBitmap) *EWAHBitmap {
+	return b.combine(other, func(x, y uint64) uint64 { return x & y })
+}
+
+// AndNot returns a new bitmap in which a bit is set if it is set in b but not
+// in other.
+func (b *EWAHBitmap) AndNot(other *EWAHBitmap) *EWAHBitmap {
+	return b.combine(other, func(x, y uint64) uint64 { return x &^ y })
+}
+
+// Xor returns a new bitmap in which a bit is set if it is set in exactly one of
+// b and other.
+func (b *EWAHBitmap) Xor(other *EWAHBitmap) *EWAHBitmap {
+	return b.combine(other, func(x, y uint64) uint64 { return x ^ y })
+}
+
+func (b *EWAHBitmap) combine(other *EWAHBitmap, op func(x, y uint64) uint64) *EWAHBitmap {
+	n := len(b.words)
+	if len(other.words) > n {
+		n = len(other.words)
+	}
+
+	result := &EWAHBitmap{words: make([]uint64, n), size: b.size}
+	if other.size > result.size {
+		result.size = other.size
+	}
+	for i := range result.words {
+		var x, y uint64
+		if i < len(b.words) {
+			x = b.words[i]
+		}
+		if i < len(other.words) {
+			y = other.words[i]
+		}
+		result.words[i] = op(x, y)
+	}
+	return result
+}
+
+// Reader returns an io.Reader that yields this bitmap in its compressed form.
+// Runs are compressed in the same manner as Git does, so that a bitmap decoded
+// from a file written by Git is encoded to the same bytes.
+func (b *EWAHBitmap) Reader() io.Reader {
+	var buffer []uint64
+	rlw := 0
+	n := (b.size + 63) / 64
+
+	for i := 0; i < n || len(buffer) == 0; {
+		rlw = len(buffer)
+		buffer = append(buffer, 0)
+
+		var run, runBit uint64
+		if i < n && (b.word(i) == 0 || b.word(i) == ^uint64(0)) {
+			clean := b.word(i)
+			runBit = clean & 1
+			for i < n && b.word(i) == clean && run < ewahMaxRunningLength {
+				run++
+				i++
+			}
+		}
+
+		var literals uint64
+		for i < n && b.word(i) != 0 && b.word(i) != ^uint64(0) && literals < ewahMaxLiteralWords {
+			buffer = append(buffer, b.word(i))
+			literals++
+			i++
+		}
+
+		buffer[rlw] = runBit | run<<1 | literals<<33
+	}
+
+	out := new(bytes.Buffer)
+	binary.Write(out, binary.BigEndian, uint32(b.size))
+	binary.Write(out, binary.BigEndian, uint32(len(buffer)))
+	binary.Write(out, binary.BigEndian, buffer)
+	binary.Write(out, binary.BigEndian, uint32(rlw))
+	return out
+}
+
+func (b *EWAHBitmap) word(i int) uint64 {
+	if i < len(b.words) {
+		return b.words[i]
+	}
+	return 0
+}
+
+// Decode reads a compressed bitmap. Exactly as many bytes as the bitmap takes
+// up are read from reader, so that other data may follow it.
+func (b *EWAHBitmap) Decode(reader io.Reader) error {
+	var header struct {
+		Size      uint32
+		WordCount uint32
+	}
+	if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+		return err
+	}
+
+	buffer := make([]uint64, header.WordCount)
+	if err := binary.Read(reader, binary.BigEndian, buffer); err != nil {
+		return err
+	}
+
+	var rlwPosition uint32
+	if err := binary.Read(reader, binary.BigEndian, &rlwPosition); err != nil {
+		return err
+	}
+
+	b.size = int(header.Size)
+	b.words = make([]uint64, 0, (b.size+63)/64)
+	for i := 0; i < len(buffer); {
+		rlw := buffer[i]
+		i++
+
+		run, literals := int(rlw>>1&ewahMaxRunningLength), int(rlw>>33)
+		if len(b.words)+run > (b.size+63)/64 {
+			return Errorf("EWAH bitmap run of %d words exceeds its size of %d bits", run, b.size)
+		}
+		clean := uint64(0)
+		if rlw&1 != 0 {
+			clean = ^uint64(0)
+		}
+		for j := 0; j < run; j++ {
+			b.words = append(b.words, clean)
+		}
+
+		if i+literals > len(buffer) {
+			return Errorf("EWAH bitmap has %d literal words past its end", i+literals-len(buffer))
+		}
+		b.words = append(b.words, buffer[i:i+literals]...)
+		i += literals
+	}
+
+	return nil
+}
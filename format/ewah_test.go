@@ -0,0 +1,73 @@
+package format
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestEWAHBitmap_Reader(t *testing.T) {
+	// The deletion bitmap of a link extension written by Git, with bit 2 set.
+	expected := []byte{
+		0, 0, 0, 3, 0, 0, 0, 2,
+		0, 0, 0, 2, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 4,
+		0, 0, 0, 0,
+	}
+
+	encoded := new(bytes.Buffer)
+	encoded.ReadFrom(NewEWAHBitmap(2).Reader())
+	if !bytes.Equal(encoded.Bytes(), expected) {
+		t.Errorf("Reader() yielded %v, want %v", encoded.Bytes(), expected)
+	}
+
+	// An empty bitmap still has a single marker word, as it does in Git.
+	empty := new(bytes.Buffer)
+	empty.ReadFrom(NewEWAHBitmap().Reader())
+	if !bytes.Equal(empty.Bytes(), []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("Reader() of an empty bitmap yielded %v", empty.Bytes())
+	}
+}
+
+func TestEWAHBitmap_Decode(t *testing.T) {
+	bitmap := NewEWAHBitmap(3, 5000, 5001)
+	for i := 64; i < 64*10; i++ {
+		bitmap.Set(i)
+	}
+
+	encoded := new(bytes.Buffer)
+	encoded.ReadFrom(bitmap.Reader())
+	encoded.WriteString("trailing")
+
+	decoded := &EWAHBitmap{}
+	if err := decoded.Decode(encoded); err != nil {
+		t.Fatalf("Decode() returned error %v", err)
+	}
+	if encoded.String() != "trailing" {
+		t.Errorf("Decode() consumed data past the bitmap")
+	}
+
+	var want, got []int
+	bitmap.Each(func(i int) { want = append(want, i) })
+	decoded.Each(func(i int) { got = append(got, i) })
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Each() after Decode() = %v, want %v", got, want)
+	}
+	if decoded.Size() != 5002 || decoded.Count() != 64*9+3 {
+		t.Errorf("Size() = %d and Count() = %d", decoded.Size(), decoded.Count())
+	}
+}
+
+func TestEWAHBitmap_AndNot(t *testing.T) {
+	a := NewEWAHBitmap(1, 2, 100)
+	b := NewEWAHBitmap(2, 200)
+
+	var got []int
+	a.AndNot(b).Each(func(i int) { got = append(got, i) })
+	if !reflect.DeepEqual(got, []int{1, 100}) {
+		t.Errorf("AndNot() = %v, want [1 100]", got)
+	}
+	if a.Or(b).Count() != 4 || a.And(b).Count() != 1 || a.Xor(b).Count() != 3 {
+		t.Errorf("Or(), And() or Xor() returned the wrong bits")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -44,7 +45,7 @@ func GlobTableAtPath(path string) (*GlobTable, error) {
 // against an invalid pattern even occurs.
 func (t GlobTable) Match(name string) (matched bool, err error) {
 	for _, pattern := range t.Globs {
-		matched, err = filepath.Match(pattern, name)
+		matched, err = path.Match(pattern, name)
 		if err != nil {
 			return
 		} else if matched {
@@ -54,6 +55,85 @@ func (t GlobTable) Match(name string) (matched bool, err error) {
 	return false, nil
 }
 
+// MatchPath returns whether the given slash-separated path, relative to the
+// directory that this GlobTable applies to, is ignored according to the rules
+// of a .gitignore file. isDir tells whether the path names a directory.
+//
+// Unlike with Match, the last pattern that matches decides the outcome, and a
+// pattern that starts with "!" negates it. A pattern that ends with a slash
+// only matches directories. A pattern that contains a slash anywhere else is
+// matched against the whole path, with any leading slash removed, while any
+// other pattern is matched against the last component of the path. Patterns
+// are matched with path.Match, so that slashes are the separator on every
+// platform. A "**" component matches any number of directories: a leading
+// "**/" matches in any directory, "a/**/b" matches "a/b", "a/x/b" and so on,
+// and a trailing "/**" matches everything inside the directory. Since a path
+// inside an ignored directory is ignored as well, callers should check each
+// directory on the way to a path first.
+func (t GlobTable) MatchPath(p string, isDir bool) (matched bool, err error) {
+	name := p
+	if slash := strings.LastIndexByte(p, '/'); slash != -1 {
+		name = p[slash+1:]
+	}
+	components := strings.Split(p, "/")
+
+	for _, pattern := range t.Globs {
+		negated := strings.HasPrefix(pattern, "!")
+		if negated {
+			pattern = pattern[1:]
+		} else if strings.HasPrefix(pattern, "\\!") {
+			pattern = pattern[1:]
+		}
+
+		if strings.HasSuffix(pattern, "/") {
+			if !isDir {
+				continue
+			}
+			pattern = strings.TrimSuffix(pattern, "/")
+		}
+
+		var ok bool
+		if strings.Contains(pattern, "/") {
+			ok, err = matchGlobComponents(strings.Split(strings.TrimPrefix(pattern, "/"), "/"), components)
+		} else {
+			ok, err = path.Match(pattern, name)
+		}
+		if err != nil {
+			return false, err
+		} else if ok {
+			matched = !negated
+		}
+	}
+	return matched, nil
+}
+
+// matchGlobComponents returns whether the components of a path match those of
+// a pattern one by one. A "**" component of the pattern matches any number of
+// components of the path, except that a trailing one matches at least one.
+func matchGlobComponents(pattern, components []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			if len(pattern) == 1 {
+				return len(components) > 0, nil
+			}
+			for i := range components {
+				if ok, err := matchGlobComponents(pattern[1:], components[i:]); err != nil || ok {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+
+		if len(components) == 0 {
+			return false, nil
+		} else if ok, err := path.Match(pattern[0], components[0]); err != nil || !ok {
+			return ok, err
+		}
+		pattern, components = pattern[1:], components[1:]
+	}
+	return len(components) == 0, nil
+}
+
 // WalkFunc wraps a filepath.WalkFunc so that only file names that are matched
 // by this GlobTable will call the underlying WalkFunc.
 func (t GlobTable) WalkFunc(f filepath.WalkFunc) filepath.WalkFunc {
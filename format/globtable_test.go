@@ -0,0 +1,42 @@
+package format
+
+import (
+	"testing"
+)
+
+func TestGlobTable_MatchPath(t *testing.T) {
+	for _, test := range []struct {
+		globs    []string
+		path     string
+		isDir    bool
+		expected bool
+	}{
+		{[]string{"**/foo"}, "foo", false, true},
+		{[]string{"**/foo"}, "a/b/foo", false, true},
+		{[]string{"**/foo/bar"}, "x/foo/bar", false, true},
+		{[]string{"**/foo/bar"}, "foo/bar", false, true},
+		{[]string{"a/**/b"}, "a/b", false, true},
+		{[]string{"a/**/b"}, "a/x/y/b", false, true},
+		{[]string{"a/**/b"}, "x/a/b", false, false},
+		{[]string{"abc/**"}, "abc/x", false, true},
+		{[]string{"abc/**"}, "abc/x/y", false, true},
+		{[]string{"abc/**"}, "abc", true, false},
+		{[]string{"/a*/c"}, "ab/c", false, true},
+		{[]string{"a*/c"}, "x/ab/c", false, false},
+		{[]string{"a/*/c"}, "a/x/y/c", false, false},
+		{[]string{"*.o"}, "dir/x.o", false, true},
+		{[]string{"foo**"}, "foobar", false, true},
+		{[]string{`a\b`}, `a\b`, false, false},
+		{[]string{"build/"}, "build", false, false},
+		{[]string{"build/"}, "build", true, true},
+		{[]string{"*.o", "!keep.o"}, "keep.o", false, false},
+		{[]string{"*.o", "!keep.o"}, "lose.o", false, true},
+	} {
+		table := GlobTable{Globs: test.globs}
+		if actual, err := table.MatchPath(test.path, test.isDir); err != nil {
+			t.Errorf("%v.MatchPath(%q) returned error %v", test.globs, test.path, err)
+		} else if actual != test.expected {
+			t.Errorf("%v.MatchPath(%q, %v) = %v, want %v", test.globs, test.path, test.isDir, actual, test.expected)
+		}
+	}
+}
@@ -8,13 +8,13 @@ import (
 	"errors"
 	"hash"
 	"io"
+	"sort"
+	"strings"
 
 	"github.com/kourge/ggit/core"
 	"github.com/kourge/ggit/util"
 )
 
-var _ = bytes.Count
-
 var indexHeaderSignature = [4]byte{'D', 'I', 'R', 'C'}
 
 type indexHeader struct {
@@ -23,25 +23,147 @@ type indexHeader struct {
 	EntriesCount uint32
 }
 
+const (
+	IndexVersionMin = 2
+	IndexVersionMax = 4
+)
+
 // An Index is the in-memory representation of a Git index file, which is
 // a stored version of a repository's working tree.
 //
 // Typically, the ReaderLen field should be set to the total number of bytes
 // that the io.Reader given to Decode is expected to yield.
 type Index struct {
-	version    uint32
-	entries    []indexEntry
-	extensions []indexExtension
-	sha1       core.Sha1
-	ReaderLen  int64
+	version        uint32
+	entries        []IndexEntry
+	split          *splitIndex
+	cacheTree      *CacheTree
+	resolveUndo    ResolveUndo
+	untrackedCache *UntrackedCache
+	fsmonitor      *FSMonitor
+	fsmonitorDirty *EWAHBitmap
+	extensions     []indexExtension
+	sha1           core.Sha1
+	ReaderLen      int64
+}
+
+var _ core.EncodeDecoder = &Index{}
+
+// NewIndex returns an empty Index that is written out in the given version of
+// the index file format. If version is not between IndexVersionMin and
+// IndexVersionMax, an error is returned.
+func NewIndex(version uint32) (*Index, error) {
+	idx := &Index{}
+	if err := idx.SetVersion(version); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Version returns the version of the index file format that this index was
+// decoded from and that it will be written out in.
+func (idx *Index) Version() uint32 {
+	return idx.version
+}
+
+// SetVersion changes the version of the index file format that this index is
+// written out in. Version 3 adds extended flags to entries that need them, and
+// version 4 additionally compresses each path name against the path name of
+// the entry preceding it. If an entry needs extended flags, a version 2 index
+// is written out as version 3 instead, as Git does.
+func (idx *Index) SetVersion(version uint32) error {
+	if version < IndexVersionMin || version > IndexVersionMax {
+		return Errorf("%d is not a valid index version", version)
+	}
+	idx.version = version
+	return nil
+}
+
+// Sha1 returns the checksum found at the end of the index file this index was
+// decoded from. For an index that was not decoded from a file, it returns the
+// checksum that Reader would end the index with, which is computed anew on
+// every call.
+func (idx *Index) Sha1() core.Sha1 {
+	if idx.sha1 != (core.Sha1{}) {
+		return idx.sha1
+	}
+	return core.Sha1(sha1.Sum(idx.body()))
+}
+
+// Reader returns an io.Reader that yields this index in the index file format,
+// followed by the SHA-1 checksum of everything that precedes it. The link,
+// TREE, REUC, UNTR and FSMN extensions are written out first, in that order,
+// followed by any other extension in the order in which they were decoded.
+func (idx *Index) Reader() io.Reader {
+	body := idx.body()
+	sum := sha1.Sum(body)
+	return io.MultiReader(bytes.NewReader(body), bytes.NewReader(sum[:]))
 }
 
-var _ core.Decoder = &Index{}
+func (idx *Index) body() []byte {
+	version := idx.version
+	if version == 0 {
+		version = IndexVersionMin
+	}
+	if version == 2 {
+		for _, entry := range idx.entries {
+			if entry.Extended() {
+				version = 3
+				break
+			}
+		}
+	}
+
+	entries := idx.entries
+	var link *splitIndex
+	if idx.split != nil {
+		entries, link = idx.splitEntries()
+	}
+
+	buffer := new(bytes.Buffer)
+	header := indexHeader{indexHeaderSignature, version, uint32(len(entries))}
+	binary.Write(buffer, binary.BigEndian, header)
+
+	previousPath := ""
+	for _, entry := range entries {
+		entry.encode(buffer, version, previousPath)
+		previousPath = entry.Path
+	}
+
+	if link != nil {
+		data := new(bytes.Buffer)
+		link.encode(data)
+		writeIndexExtension(buffer, indexLinkSignature, data)
+	}
+	if idx.cacheTree != nil {
+		writeIndexExtension(buffer, indexCacheTreeSignature, idx.cacheTree.Reader())
+	}
+	if len(idx.resolveUndo) != 0 {
+		writeIndexExtension(buffer, indexResolveUndoSignature, idx.resolveUndo.Reader())
+	}
+	if idx.untrackedCache != nil {
+		writeIndexExtension(buffer, indexUntrackedCacheSignature, idx.untrackedCache.Reader())
+	}
+	if idx.fsmonitor != nil {
+		data := new(bytes.Buffer)
+		idx.fsmonitor.encode(data, idx.fsmonitorDirtyBitmap())
+		writeIndexExtension(buffer, indexFSMonitorSignature, data)
+	}
+	for _, extension := range idx.extensions {
+		binary.Write(buffer, binary.BigEndian, extension.indexExtensionHeader)
+		buffer.Write(extension.Data)
+	}
+
+	return buffer.Bytes()
+}
 
 // Decode takes a reader and treats the stream it yields as an index file and
 // parses it. An error is returned if the stream forms an invalid index file.
 // Otherwise nil is returned.
 //
+// If the index file is split, the index only holds the entries that differ
+// from the shared index it refers to until MergeSharedIndex is called.
+//
 // If ReaderLen is left as a zero value, then the integrity of the index file
 // being decoded will not be verified against the SHA-1 hash located in the
 // index file itself. Conversely, if ReaderLen is given a non-zero value, an
@@ -92,71 +214,39 @@ func decodeIndexHeader(idx *Index, r *bufio.Reader) (*indexHeader, error) {
 	if header.Signature != indexHeaderSignature {
 		return header, Errorf("%v is not a valid index header", header.Signature)
 	}
-	if header.Version != 2 {
-		return header, Errorf("%d is not a valid index version", header.Version)
-	} else {
-		idx.version = header.Version
+	if err := idx.SetVersion(header.Version); err != nil {
+		return header, err
 	}
 
 	return header, nil
 }
 
 func decodeIndexEntries(idx *Index, r *bufio.Reader, n uint32) error {
+	previousPath := ""
 	for i := uint32(0); i < n; i++ {
-		var entryHeader indexEntryHeader
-
-		v2EntryHeader := &indexEntryHeaderV2{}
-		if err := binary.Read(r, binary.BigEndian, v2EntryHeader); err != nil {
+		entry, err := decodeIndexEntry(r, idx.version, previousPath)
+		if err != nil {
 			return err
 		}
-		entryHeader = v2EntryHeader
-
-		if v2EntryHeader.Flags.Extended() {
-			v3EntryHeader := &indexEntryHeaderV3{*v2EntryHeader, 0}
-			if err := binary.Read(r, binary.BigEndian, &(v3EntryHeader.V3Flags)); err != nil {
-				return err
-			}
-			entryHeader = v3EntryHeader
-		}
 
-		entry := &indexEntry{}
-		totalRead := entryHeader.IndexEntryHeaderSize()
-		if pathName, err := r.ReadString(0); err != nil {
-			return err
-		} else {
-			entry.pathName = pathName[:len(pathName)-1]
-			entry.indexEntryHeader = entryHeader
-
-			totalRead += len(pathName)
-			nearestMultiple := roundUpToNearestMultipleOfEight(totalRead)
-			paddingSize := nearestMultiple - totalRead
-			for i := 1; i <= paddingSize; i++ {
-				if c, err := r.ReadByte(); err != nil {
-					return err
-				} else if c != 0 {
-					return Errorf("path name padding is not null byte")
-				}
-			}
-		}
-
-		idx.entries = append(idx.entries, *entry)
+		idx.entries = append(idx.entries, entry)
+		previousPath = entry.Path
 	}
 
 	return nil
 }
 
-func roundUpToNearestMultipleOfEight(i int) int {
-	return (i + 8 - 1) & ^(8 - 1)
-}
-
-// All extensions, including cached tree and resolve undo extensions are
-// currently simply parsed as a byte array. Their contents are neither
-// interpreted nor validated.
+// The link, cache tree, resolve undo, untracked cache and fsmonitor extensions
+// are decoded into their own types. All other optional extensions are kept as
+// a byte array, and their contents are neither interpreted nor validated.
 func decodeIndexExtensionsAndSha1(idx *Index, r *bufio.Reader) error {
 	for {
 		if tentativeSha1, err := tryReadSha1(r); err == nil {
 			idx.sha1 = tentativeSha1
-			return nil
+			if idx.split != nil {
+				return nil
+			}
+			return idx.applyFSMonitorDirty()
 		} else if err != errSha1NotYetReached {
 			return err
 		}
@@ -178,19 +268,74 @@ func decodeIndexExtensionsAndSha1(idx *Index, r *bufio.Reader) error {
 			)
 		}
 
-		extension := indexExtension{*extensionHeader, extensionData}
-		if !extension.Optional() {
-			return Errorf(
-				"cannot handle non-optional index extension %v",
-				extension.Signature,
-			)
+		var err error
+		switch extensionHeader.Signature {
+		case indexLinkSignature:
+			idx.split, err = decodeIndexLink(extensionData)
+		case indexCacheTreeSignature:
+			idx.cacheTree = &CacheTree{}
+			err = idx.cacheTree.Decode(bytes.NewReader(extensionData))
+		case indexResolveUndoSignature:
+			err = idx.resolveUndo.Decode(bytes.NewReader(extensionData))
+		case indexUntrackedCacheSignature:
+			idx.untrackedCache = &UntrackedCache{}
+			err = idx.untrackedCache.Decode(bytes.NewReader(extensionData))
+		case indexFSMonitorSignature:
+			idx.fsmonitor = &FSMonitor{}
+			idx.fsmonitorDirty, err = idx.fsmonitor.decode(bytes.NewReader(extensionData))
+		default:
+			extension := indexExtension{*extensionHeader, extensionData}
+			if !extension.Optional() {
+				return Errorf(
+					"cannot handle non-optional index extension %v",
+					extension.Signature,
+				)
+			}
+			idx.extensions = append(idx.extensions, extension)
+		}
+		if err != nil {
+			return err
 		}
-		idx.extensions = append(idx.extensions, extension)
 	}
 
 	return nil
 }
 
+// applyFSMonitorDirty sets FSMonitorValid on each entry that the decoded
+// fsmonitor bitmap does not mark as dirty. With a split index, this can only
+// happen once the shared index is merged in, since the bitmap covers all
+// entries.
+func (idx *Index) applyFSMonitorDirty() error {
+	dirty := idx.fsmonitorDirty
+	if dirty == nil {
+		return nil
+	} else if dirty.Size() > len(idx.entries) {
+		return Errorf("fsmonitor bitmap refers to entry %d of %d", dirty.Size()-1, len(idx.entries))
+	}
+
+	for i := range idx.entries {
+		idx.entries[i].FSMonitorValid = !dirty.Get(i)
+	}
+	idx.fsmonitorDirty = nil
+	return nil
+}
+
+// fsmonitorDirtyBitmap returns the bitmap of entries that are not
+// FSMonitorValid, or the bitmap as it was decoded if it has yet to be applied.
+func (idx *Index) fsmonitorDirtyBitmap() *EWAHBitmap {
+	if idx.fsmonitorDirty != nil {
+		return idx.fsmonitorDirty
+	}
+
+	dirty := NewEWAHBitmap()
+	for i, entry := range idx.entries {
+		if !entry.FSMonitorValid {
+			dirty.Set(i)
+		}
+	}
+	return dirty
+}
+
 var errSha1NotYetReached = errors.New("SHA-1 checksum not yet reached in index")
 
 func tryReadSha1(r *bufio.Reader) (sha1 core.Sha1, err error) {
@@ -207,7 +352,235 @@ func tryReadSha1(r *bufio.Reader) (sha1 core.Sha1, err error) {
 func (idx *Index) Pathnames() []string {
 	pathnames := make([]string, len(idx.entries))
 	for i, entry := range idx.entries {
-		pathnames[i] = entry.pathName
+		pathnames[i] = entry.Path
 	}
 	return pathnames
 }
+
+// Len returns the number of entries in this index.
+func (idx *Index) Len() int {
+	return len(idx.entries)
+}
+
+// Entries returns a copy of all the entries within this index, sorted by path
+// and then by stage.
+func (idx *Index) Entries() []IndexEntry {
+	entries := make([]IndexEntry, len(idx.entries))
+	copy(entries, idx.entries)
+	return entries
+}
+
+// search returns the position of the entry with the given path and stage, and
+// whether it exists. If it does not, the position is where it would be
+// inserted.
+func (idx *Index) search(path string, stage IndexEntryStage) (int, bool) {
+	key := &IndexEntry{Path: path, Stage: stage}
+	i := sort.Search(len(idx.entries), func(i int) bool {
+		return !idx.entries[i].Less(key)
+	})
+	found := i < len(idx.entries) && idx.entries[i].Path == path && idx.entries[i].Stage == stage
+	return i, found
+}
+
+// Lookup returns the entry with the given path at the given stage, and whether
+// such an entry exists.
+func (idx *Index) Lookup(path string, stage IndexEntryStage) (IndexEntry, bool) {
+	if i, found := idx.search(path, stage); found {
+		return idx.entries[i], true
+	}
+	return IndexEntry{}, false
+}
+
+// Stages returns all the entries with the given path, sorted by stage. A path
+// that is not in conflict has a single entry at IndexStageNormal, while a path
+// that is in conflict has one entry for each of the stages present.
+func (idx *Index) Stages(path string) []IndexEntry {
+	i, _ := idx.search(path, IndexStageNormal)
+	var entries []IndexEntry
+	for ; i < len(idx.entries) && idx.entries[i].Path == path; i++ {
+		entries = append(entries, idx.entries[i])
+	}
+	return entries
+}
+
+// Conflicts returns the paths of all the entries within this index that are in
+// conflict, i.e. that have entries at a stage other than IndexStageNormal.
+func (idx *Index) Conflicts() []string {
+	var paths []string
+	for _, entry := range idx.entries {
+		if entry.Stage != IndexStageNormal &&
+			(len(paths) == 0 || paths[len(paths)-1] != entry.Path) {
+			paths = append(paths, entry.Path)
+		}
+	}
+	return paths
+}
+
+// Add inserts the given entry into this index at the position dictated by its
+// path and stage, replacing any entry with the same path and stage. An error
+// is returned if the path of the entry is not valid according to
+// ValidateIndexPath.
+//
+// Like `git update-index --add`, adding an entry also removes every entry that
+// it conflicts with: an entry at IndexStageNormal replaces all the other
+// stages of the same path and vice versa, a file replaces a directory at the
+// same path and everything under it, and a file under a directory replaces a
+// file at the path of that directory.
+func (idx *Index) Add(entry IndexEntry) error {
+	if err := ValidateIndexPath(entry.Path); err != nil {
+		return err
+	}
+
+	if idx.cacheTree != nil {
+		idx.cacheTree.Invalidate(entry.Path)
+	}
+	if idx.untrackedCache != nil {
+		idx.untrackedCache.Invalidate(entry.Path)
+	}
+
+	if entry.Stage == IndexStageNormal {
+		idx.Remove(entry.Path)
+	} else {
+		idx.remove(entry.Path, IndexStageNormal)
+	}
+
+	for dir := entry.Path; ; {
+		slash := strings.LastIndexByte(dir, '/')
+		if slash == -1 {
+			break
+		}
+		dir = dir[:slash]
+		idx.Remove(dir)
+	}
+	idx.removeDir(entry.Path)
+
+	i, found := idx.search(entry.Path, entry.Stage)
+	if found {
+		idx.entries[i] = entry
+		return nil
+	}
+
+	idx.entries = append(idx.entries, IndexEntry{})
+	copy(idx.entries[i+1:], idx.entries[i:])
+	idx.entries[i] = entry
+	return nil
+}
+
+// Remove removes every entry with the given path from this index, regardless
+// of its stage, and returns true if there was any. If the path was in
+// conflict, its stages are recorded in the resolve undo extension, so that the
+// conflict can be restored with Unresolve.
+func (idx *Index) Remove(path string) bool {
+	i, _ := idx.search(path, IndexStageNormal)
+	j := i
+	for j < len(idx.entries) && idx.entries[j].Path == path {
+		j++
+	}
+	if j == i {
+		return false
+	}
+
+	idx.resolveUndo.record(path, idx.entries[i:j])
+	if idx.cacheTree != nil {
+		idx.cacheTree.Invalidate(path)
+	}
+	if idx.untrackedCache != nil {
+		idx.untrackedCache.Invalidate(path)
+	}
+	idx.entries = append(idx.entries[:i], idx.entries[j:]...)
+	return true
+}
+
+// remove removes the entry with the given path and stage from this index, if
+// it exists.
+func (idx *Index) remove(path string, stage IndexEntryStage) {
+	if i, found := idx.search(path, stage); found {
+		idx.entries = append(idx.entries[:i], idx.entries[i+1:]...)
+	}
+}
+
+// removeDir removes every entry under the directory at the given path.
+func (idx *Index) removeDir(dir string) {
+	prefix := dir + "/"
+	i, _ := idx.search(prefix, IndexStageNormal)
+	for i < len(idx.entries) && strings.HasPrefix(idx.entries[i].Path, prefix) {
+		idx.Remove(idx.entries[i].Path)
+	}
+}
+
+// CacheTree returns the root of the cache tree of this index, or nil if the
+// index has none. The cache tree is kept up to date as entries are added and
+// removed: every directory that an added or removed entry is in is
+// invalidated.
+func (idx *Index) CacheTree() *CacheTree {
+	return idx.cacheTree
+}
+
+// SetCacheTree replaces the cache tree of this index. Passing nil removes the
+// TREE extension altogether.
+func (idx *Index) SetCacheTree(tree *CacheTree) {
+	idx.cacheTree = tree
+}
+
+// UntrackedCache returns the untracked cache of this index, or nil if the index
+// has none. The directory of every entry that is added or removed is
+// invalidated in the cache.
+func (idx *Index) UntrackedCache() *UntrackedCache {
+	return idx.untrackedCache
+}
+
+// SetUntrackedCache replaces the untracked cache of this index. Passing nil
+// removes the UNTR extension altogether.
+func (idx *Index) SetUntrackedCache(uc *UntrackedCache) {
+	idx.untrackedCache = uc
+}
+
+// FSMonitor returns the fsmonitor extension of this index, or nil if the index
+// has none.
+func (idx *Index) FSMonitor() *FSMonitor {
+	return idx.fsmonitor
+}
+
+// SetFSMonitor replaces the fsmonitor extension of this index. Passing nil
+// removes the FSMN extension altogether, in which case the FSMonitorValid
+// field of each entry is not written out.
+func (idx *Index) SetFSMonitor(fsm *FSMonitor) {
+	idx.fsmonitor = fsm
+}
+
+// ResolveUndo returns a copy of the resolve undo entries of this index, sorted
+// by path.
+func (idx *Index) ResolveUndo() []ResolveUndoEntry {
+	return append([]ResolveUndoEntry(nil), idx.resolveUndo...)
+}
+
+// ClearResolveUndo forgets every conflict recorded in the resolve undo
+// extension. Git does so before starting a new merge.
+func (idx *Index) ClearResolveUndo() {
+	idx.resolveUndo = nil
+}
+
+// Unresolve restores the conflicted stages of the given path from the resolve
+// undo extension, replacing its entry at IndexStageNormal. Equivalent to
+// `git update-index --unresolve`. The resolve undo entry is consumed, and
+// true is returned if there was one.
+func (idx *Index) Unresolve(path string) bool {
+	i, found := idx.resolveUndo.search(path)
+	if !found {
+		return false
+	}
+	undo := idx.resolveUndo[i]
+	idx.resolveUndo = append(idx.resolveUndo[:i], idx.resolveUndo[i+1:]...)
+
+	for j, mode := range undo.Modes {
+		if mode != 0 {
+			idx.Add(IndexEntry{
+				Mode:  mode,
+				Sha1:  undo.Sha1s[j],
+				Stage: IndexEntryStage(j + 1),
+				Path:  path,
+			})
+		}
+	}
+	return true
+}
@@ -0,0 +1,350 @@
+package format
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/kourge/ggit/core"
+)
+
+func _fixtureIndex(version uint32) *Index {
+	entry := func(seed uint32, path string) IndexEntry {
+		return IndexEntry{
+			IndexEntryStat: IndexEntryStat{
+				CtimeSecs: seed, MtimeSecs: seed + 1, Ino: seed + 2, FileSize: seed + 3,
+			},
+			Mode: core.GitModeRegular | core.GitModeReadWritable,
+			Sha1: core.Sha1{byte(seed)},
+			Path: path,
+		}
+	}
+
+	idx := &Index{version: version}
+	idx.entries = []IndexEntry{
+		entry(1, "README"),
+		entry(2, "a/b/c/file1"),
+		entry(3, "a/b/c/file2"),
+		entry(4, "a/b/d"),
+		entry(5, "zzz"),
+	}
+	return idx
+}
+
+func _roundTripIndex(t *testing.T, idx *Index) (*Index, []byte) {
+	encoded := new(bytes.Buffer)
+	encoded.ReadFrom(idx.Reader())
+
+	decoded := &Index{ReaderLen: int64(encoded.Len())}
+	if err := decoded.Decode(bytes.NewReader(encoded.Bytes())); err != nil {
+		t.Fatalf("Decode() returned error %v", err)
+	}
+	return decoded, encoded.Bytes()
+}
+
+func TestIndex_Reader(t *testing.T) {
+	for version := uint32(IndexVersionMin); version <= IndexVersionMax; version++ {
+		idx := _fixtureIndex(version)
+		decoded, encoded := _roundTripIndex(t, idx)
+
+		if decoded.Version() != version {
+			t.Errorf("version %d: Version() = %d", version, decoded.Version())
+		}
+		if !reflect.DeepEqual(decoded.Pathnames(), idx.Pathnames()) {
+			t.Errorf("version %d: Pathnames() = %v, want %v", version, decoded.Pathnames(), idx.Pathnames())
+		}
+		if !reflect.DeepEqual(decoded.Entries(), idx.Entries()) {
+			t.Errorf("version %d: Entries() = %+v, want %+v", version, decoded.Entries(), idx.Entries())
+		}
+
+		if version < 4 && len(encoded)%8 != 0 {
+			t.Errorf("version %d: entries are not padded to a multiple of 8 bytes", version)
+		}
+
+		reencoded := new(bytes.Buffer)
+		reencoded.ReadFrom(decoded.Reader())
+		if !bytes.Equal(reencoded.Bytes(), encoded) {
+			t.Errorf("version %d: re-encoding a decoded index is not identical", version)
+		}
+	}
+}
+
+func TestIndex_Reader_ExtendedFlags(t *testing.T) {
+	idx := _fixtureIndex(2)
+	idx.entries[1].IntentToAdd = true
+	idx.entries[2].AssumeValid = true
+	idx.entries[3].Stage = IndexStageTheirs
+
+	decoded, encoded := _roundTripIndex(t, idx)
+	if decoded.Version() != 3 {
+		t.Errorf("Version() = %d, want 3", decoded.Version())
+	}
+	if !reflect.DeepEqual(decoded.Entries(), idx.Entries()) {
+		t.Errorf("Entries() = %+v, want %+v", decoded.Entries(), idx.Entries())
+	}
+
+	// The flags of the second entry follow the 12-byte index header, the
+	// 72-byte first entry, and its own 60 bytes of stat data and SHA-1.
+	flags := indexEntryHeaderV2Flag(uint16(encoded[144])<<8 | uint16(encoded[145]))
+	if !flags.Extended() || flags.NameLength() != uint16(len("a/b/c/file1")) {
+		t.Errorf("second entry has flags %04x", flags)
+	}
+}
+
+func TestIndex_Add(t *testing.T) {
+	idx, err := NewIndex(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"b", "a/x", "c/d/e", "a-b", "a/y"} {
+		if err := idx.Add(IndexEntry{Path: path}); err != nil {
+			t.Errorf("Add(%q) returned error %v", path, err)
+		}
+	}
+	if !reflect.DeepEqual(idx.Pathnames(), []string{"a-b", "a/x", "a/y", "b", "c/d/e"}) {
+		t.Errorf("Pathnames() = %v", idx.Pathnames())
+	}
+
+	// Replacing an entry keeps a single entry for the path.
+	idx.Add(IndexEntry{Path: "b", Sha1: core.Sha1{1}})
+	if entry, ok := idx.Lookup("b", IndexStageNormal); !ok || entry.Sha1 != (core.Sha1{1}) {
+		t.Errorf("Lookup(\"b\", 0) = %+v, %v", entry, ok)
+	}
+
+	// A file replaces a directory and vice versa.
+	idx.Add(IndexEntry{Path: "a"})
+	idx.Add(IndexEntry{Path: "c/d/e/f"})
+	if !reflect.DeepEqual(idx.Pathnames(), []string{"a", "a-b", "b", "c/d/e/f"}) {
+		t.Errorf("Pathnames() after directory/file conflicts = %v", idx.Pathnames())
+	}
+
+	for _, path := range []string{"", "/a", "a/", "a//b", "./a", "a/../b", ".git/config", "x/.GIT"} {
+		if err := idx.Add(IndexEntry{Path: path}); err == nil {
+			t.Errorf("Add(%q) should fail", path)
+		}
+	}
+}
+
+func TestIndex_Stages(t *testing.T) {
+	idx := _fixtureIndex(2)
+	for _, stage := range []IndexEntryStage{IndexStageTheirs, IndexStageBase, IndexStageOurs} {
+		idx.Add(IndexEntry{Path: "a/b/d", Stage: stage, Sha1: core.Sha1{byte(stage)}})
+	}
+
+	stages := idx.Stages("a/b/d")
+	if len(stages) != 3 {
+		t.Fatalf("Stages() returned %d entries, want 3", len(stages))
+	}
+	for i, entry := range stages {
+		if entry.Stage != IndexEntryStage(i+1) || entry.Sha1 != (core.Sha1{byte(i + 1)}) {
+			t.Errorf("Stages()[%d] = %+v", i, entry)
+		}
+	}
+	if _, ok := idx.Lookup("a/b/d", IndexStageNormal); ok {
+		t.Errorf("Lookup() should not find a stage 0 entry for a conflicted path")
+	}
+	if conflicts := idx.Conflicts(); !reflect.DeepEqual(conflicts, []string{"a/b/d"}) {
+		t.Errorf("Conflicts() = %v", conflicts)
+	}
+
+	// Resolving the conflict replaces all stages.
+	idx.Add(IndexEntry{Path: "a/b/d"})
+	if stages := idx.Stages("a/b/d"); len(stages) != 1 || stages[0].Stage != IndexStageNormal {
+		t.Errorf("Stages() after resolution = %+v", stages)
+	}
+
+	if !idx.Remove("a/b/d") || idx.Remove("a/b/d") {
+		t.Errorf("Remove() should only succeed once")
+	}
+	if idx.Len() != 4 {
+		t.Errorf("Len() = %d, want 4", idx.Len())
+	}
+}
+
+func TestIndex_Decode_Corrupt(t *testing.T) {
+	encoded := new(bytes.Buffer)
+	encoded.ReadFrom(_fixtureIndex(4).Reader())
+	data := encoded.Bytes()
+	data[len(data)-30] ^= 0xff
+
+	decoded := &Index{ReaderLen: int64(len(data))}
+	if err := decoded.Decode(bytes.NewReader(data)); err == nil {
+		t.Errorf("Decode() of a corrupt index should fail")
+	}
+}
+
+func TestIndex_SetVersion(t *testing.T) {
+	for _, version := range []uint32{0, 1, 5} {
+		if _, err := NewIndex(version); err == nil {
+			t.Errorf("NewIndex(%d) should fail", version)
+		}
+	}
+}
+
+func TestIndex_CacheTree(t *testing.T) {
+	idx := _fixtureIndex(2)
+	idx.SetCacheTree(&CacheTree{
+		EntryCount: 5,
+		Sha1:       core.Sha1{1},
+		Subtrees: []*CacheTree{
+			{Name: "a", EntryCount: 3, Sha1: core.Sha1{2}, Subtrees: []*CacheTree{
+				{Name: "b", EntryCount: 3, Sha1: core.Sha1{3}, Subtrees: []*CacheTree{
+					{Name: "c", EntryCount: 2, Sha1: core.Sha1{4}},
+				}},
+			}},
+		},
+	})
+
+	decoded, _ := _roundTripIndex(t, idx)
+	if !reflect.DeepEqual(decoded.CacheTree(), idx.CacheTree()) {
+		t.Errorf("CacheTree() = %+v, want %+v", decoded.CacheTree(), idx.CacheTree())
+	}
+
+	tree := decoded.CacheTree()
+	decoded.Add(IndexEntry{Path: "a/b/new"})
+	for _, path := range []string{"", "a", "a/b"} {
+		if tree.Lookup(path).Valid() {
+			t.Errorf("Lookup(%q) should be invalidated after Add()", path)
+		}
+	}
+	if !tree.Lookup("a/b/c").Valid() {
+		t.Errorf("Lookup(\"a/b/c\") should still be valid after Add()")
+	}
+
+	decoded.Add(IndexEntry{Path: "a/b/c"})
+	if tree.Lookup("a/b/c") != nil {
+		t.Errorf("Lookup(\"a/b/c\") should be dropped once a/b/c is a file")
+	}
+}
+
+func TestIndex_ResolveUndo(t *testing.T) {
+	idx := _fixtureIndex(2)
+	mode := core.GitModeRegular | core.GitModeReadWritable
+	idx.Add(IndexEntry{Path: "a/b/d", Stage: IndexStageBase, Mode: mode, Sha1: core.Sha1{1}})
+	idx.Add(IndexEntry{Path: "a/b/d", Stage: IndexStageTheirs, Mode: mode, Sha1: core.Sha1{3}})
+	conflicted := idx.Stages("a/b/d")
+
+	idx.Add(IndexEntry{Path: "a/b/d", Mode: mode, Sha1: core.Sha1{9}})
+	expected := []ResolveUndoEntry{{
+		Path:  "a/b/d",
+		Modes: [3]core.GitMode{mode, 0, mode},
+		Sha1s: [3]core.Sha1{{1}, {}, {3}},
+	}}
+	if !reflect.DeepEqual(idx.ResolveUndo(), expected) {
+		t.Errorf("ResolveUndo() = %+v, want %+v", idx.ResolveUndo(), expected)
+	}
+
+	decoded, _ := _roundTripIndex(t, idx)
+	if !reflect.DeepEqual(decoded.ResolveUndo(), expected) {
+		t.Errorf("decoded ResolveUndo() = %+v, want %+v", decoded.ResolveUndo(), expected)
+	}
+
+	if !decoded.Unresolve("a/b/d") || decoded.Unresolve("a/b/d") {
+		t.Errorf("Unresolve() should only succeed once")
+	}
+	if !reflect.DeepEqual(decoded.Stages("a/b/d"), conflicted) {
+		t.Errorf("Stages() after Unresolve() = %+v, want %+v", decoded.Stages("a/b/d"), conflicted)
+	}
+	if len(decoded.ResolveUndo()) != 0 {
+		t.Errorf("ResolveUndo() after Unresolve() = %+v", decoded.ResolveUndo())
+	}
+}
+
+func TestIndex_SharedIndex(t *testing.T) {
+	shared := _fixtureIndex(2)
+
+	idx := _fixtureIndex(2)
+	readme, _ := idx.Lookup("README", IndexStageNormal)
+	readme.FileSize = 100
+	idx.Add(readme)
+	idx.Remove("zzz")
+	idx.Add(IndexEntry{Path: "new", Sha1: core.Sha1{6}})
+	if err := idx.SetSharedIndex(shared); err != nil {
+		t.Fatalf("SetSharedIndex() returned error %v", err)
+	}
+
+	decoded, encoded := _roundTripIndex(t, idx)
+	if sha1, split := decoded.SharedIndex(); !split || sha1 != shared.Sha1() {
+		t.Errorf("SharedIndex() = %s, %v, want %s, true", sha1, split, shared.Sha1())
+	}
+	if decoded.Len() != 2 || decoded.Entries()[0].Path != "" {
+		t.Errorf("split index entries = %+v, want a replacement and an addition", decoded.Entries())
+	}
+
+	wrong := _fixtureIndex(2)
+	wrong.Remove("zzz")
+	if err := decoded.MergeSharedIndex(wrong); err == nil {
+		t.Errorf("MergeSharedIndex() should fail with the wrong shared index")
+	}
+	if err := decoded.MergeSharedIndex(shared); err != nil {
+		t.Fatalf("MergeSharedIndex() returned error %v", err)
+	}
+	if !reflect.DeepEqual(decoded.Entries(), idx.Entries()) {
+		t.Errorf("merged Entries() = %+v, want %+v", decoded.Entries(), idx.Entries())
+	}
+
+	reencoded := new(bytes.Buffer)
+	reencoded.ReadFrom(decoded.Reader())
+	if !bytes.Equal(reencoded.Bytes(), encoded) {
+		t.Errorf("re-encoding a merged split index is not identical")
+	}
+
+	// Encoding a modified index does not change the checksum it was decoded
+	// with.
+	sha1 := decoded.Sha1()
+	decoded.Remove("new")
+	new(bytes.Buffer).ReadFrom(decoded.Reader())
+	if decoded.Sha1() != sha1 {
+		t.Errorf("Reader() changed Sha1() from %s to %s", sha1, decoded.Sha1())
+	}
+}
+
+func TestIndex_UntrackedCache(t *testing.T) {
+	idx := _fixtureIndex(2)
+	idx.SetUntrackedCache(&UntrackedCache{
+		Ident:           "Location /tmp/repo, system Linux",
+		InfoExcludeSha1: core.Sha1{1},
+		ExcludePerDir:   ".gitignore",
+		Root: &UntrackedCacheDir{
+			Untracked: []string{"junk", "u/"},
+			Valid:     true,
+			Stat:      IndexEntryStat{MtimeSecs: 1},
+			Dirs: []*UntrackedCacheDir{
+				{Name: "a", Valid: true, CheckOnly: true, ExcludeSha1: core.Sha1{2}},
+				{Name: "u", Untracked: []string{"v/"}, Valid: true, Stat: IndexEntryStat{MtimeSecs: 2}},
+			},
+		},
+	})
+
+	decoded, _ := _roundTripIndex(t, idx)
+	if !reflect.DeepEqual(decoded.UntrackedCache(), idx.UntrackedCache()) {
+		t.Errorf("UntrackedCache() = %+v, want %+v", decoded.UntrackedCache(), idx.UntrackedCache())
+	}
+
+	uc := decoded.UntrackedCache()
+	decoded.Add(IndexEntry{Path: "u/new"})
+	if uc.Lookup("u").Valid || !uc.Lookup("").Valid || !uc.Lookup("a").Valid {
+		t.Errorf("Add() should only invalidate the directory of the entry")
+	}
+	if uc.Lookup("u").Untracked != nil {
+		t.Errorf("Add() should drop the untracked files of an invalidated directory")
+	}
+}
+
+func TestIndex_FSMonitor(t *testing.T) {
+	for _, fsm := range []*FSMonitor{{Version: 1, Timestamp: 1234}, {Version: 2, Token: "token"}} {
+		idx := _fixtureIndex(3)
+		idx.SetFSMonitor(fsm)
+		idx.entries[1].FSMonitorValid = true
+		idx.entries[3].FSMonitorValid = true
+
+		decoded, _ := _roundTripIndex(t, idx)
+		if !reflect.DeepEqual(decoded.FSMonitor(), fsm) {
+			t.Errorf("FSMonitor() = %+v, want %+v", decoded.FSMonitor(), fsm)
+		}
+		if !reflect.DeepEqual(decoded.Entries(), idx.Entries()) {
+			t.Errorf("version %d: Entries() = %+v, want %+v", fsm.Version, decoded.Entries(), idx.Entries())
+		}
+	}
+}
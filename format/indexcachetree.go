@@ -0,0 +1,203 @@
+package format
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/kourge/ggit/core"
+)
+
+var indexCacheTreeSignature = [4]byte{'T', 'R', 'E', 'E'}
+
+// A CacheTree is a node of the cache tree, which is stored in the TREE
+// extension of an index. It records the SHA-1 of the tree object that a
+// directory in the index was last written out as, so that unchanged
+// directories need not be hashed again when the index is turned into trees.
+//
+// Name is the name of the directory relative to its parent, or an empty string
+// for the root. EntryCount is the number of index entries covered by this
+// directory, including the entries in its subdirectories, or -1 if the node is
+// invalid, in which case Sha1 must not be trusted. Subtrees holds the nodes of
+// the subdirectories.
+type CacheTree struct {
+	Name       string
+	EntryCount int
+	Subtrees   []*CacheTree
+	Sha1       core.Sha1
+}
+
+var _ core.EncodeDecoder = &CacheTree{}
+
+// Valid returns true if the SHA-1 of this node reflects the index entries
+// under it.
+func (tree *CacheTree) Valid() bool {
+	return tree.EntryCount >= 0
+}
+
+// Subtree returns the child node with the given name, or nil if there is none.
+func (tree *CacheTree) Subtree(name string) *CacheTree {
+	for _, subtree := range tree.Subtrees {
+		if subtree.Name == name {
+			return subtree
+		}
+	}
+	return nil
+}
+
+// AddSubtree returns the child node with the given name, creating it as an
+// invalid node at its proper position among its siblings if it does not exist.
+func (tree *CacheTree) AddSubtree(name string) *CacheTree {
+	i := 0
+	for ; i < len(tree.Subtrees); i++ {
+		if tree.Subtrees[i].Name == name {
+			return tree.Subtrees[i]
+		} else if cacheTreeNameLess(name, tree.Subtrees[i].Name) {
+			break
+		}
+	}
+
+	subtree := &CacheTree{Name: name, EntryCount: -1}
+	tree.Subtrees = append(tree.Subtrees, nil)
+	copy(tree.Subtrees[i+1:], tree.Subtrees[i:])
+	tree.Subtrees[i] = subtree
+	return subtree
+}
+
+// Lookup returns the node for the directory at the given slash-separated path
+// relative to this node, or nil if there is none. An empty path yields this
+// node itself.
+func (tree *CacheTree) Lookup(path string) *CacheTree {
+	if path == "" {
+		return tree
+	}
+
+	node := tree
+	for _, name := range strings.Split(path, "/") {
+		if node = node.Subtree(name); node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// Invalidate marks every node on the way to the entry at the given path as
+// invalid, since the trees they represent now differ. If the path itself names
+// a subtree, that subtree is dropped entirely.
+func (tree *CacheTree) Invalidate(path string) {
+	node := tree
+	for {
+		node.EntryCount = -1
+
+		slash := strings.IndexByte(path, '/')
+		if slash == -1 {
+			for i, subtree := range node.Subtrees {
+				if subtree.Name == path {
+					node.Subtrees = append(node.Subtrees[:i], node.Subtrees[i+1:]...)
+					break
+				}
+			}
+			return
+		}
+
+		if node = node.Subtree(path[:slash]); node == nil {
+			return
+		}
+		path = path[slash+1:]
+	}
+}
+
+// Reader returns an io.Reader that yields this node and all of its descendants
+// in the format of the TREE extension, without the extension header. Each node
+// is written as its name, a null byte, its entry count and number of subtrees
+// in ASCII separated by a space, a line feed, and its SHA-1 if it is valid.
+// Nodes are written in pre-order.
+func (tree *CacheTree) Reader() io.Reader {
+	buffer := new(bytes.Buffer)
+	tree.encode(buffer)
+	return buffer
+}
+
+func (tree *CacheTree) encode(buffer *bytes.Buffer) {
+	buffer.WriteString(tree.Name)
+	buffer.WriteByte(0)
+	buffer.WriteString(strconv.Itoa(tree.EntryCount))
+	buffer.WriteByte(' ')
+	buffer.WriteString(strconv.Itoa(len(tree.Subtrees)))
+	buffer.WriteByte('\n')
+	if tree.Valid() {
+		buffer.Write(tree.Sha1[:])
+	}
+
+	for _, subtree := range tree.Subtrees {
+		subtree.encode(buffer)
+	}
+}
+
+// Decode parses the data of a TREE extension into this node and its
+// descendants.
+func (tree *CacheTree) Decode(reader io.Reader) error {
+	r := bufio.NewReader(reader)
+	if err := tree.decode(r); err != nil {
+		return err
+	}
+
+	if _, err := r.ReadByte(); err != io.EOF {
+		return Errorf("trailing data after cache tree")
+	}
+	return nil
+}
+
+func (tree *CacheTree) decode(r *bufio.Reader) error {
+	name, err := r.ReadString(0)
+	if err != nil {
+		return err
+	}
+	tree.Name = name[:len(name)-1]
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	counts := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 2)
+	if len(counts) != 2 {
+		return Errorf("malformed cache tree line %q", line)
+	}
+	if tree.EntryCount, err = strconv.Atoi(counts[0]); err != nil {
+		return err
+	}
+	subtreeCount, err := strconv.Atoi(counts[1])
+	if err != nil {
+		return err
+	} else if subtreeCount < 0 {
+		return Errorf("negative subtree count in cache tree")
+	}
+
+	if tree.Valid() {
+		if _, err := io.ReadFull(r, tree.Sha1[:]); err != nil {
+			return err
+		}
+	}
+
+	tree.Subtrees = nil
+	for i := 0; i < subtreeCount; i++ {
+		subtree := &CacheTree{}
+		if err := subtree.decode(r); err != nil {
+			return err
+		}
+		tree.Subtrees = append(tree.Subtrees, subtree)
+	}
+
+	return nil
+}
+
+// cacheTreeNameLess orders subtrees the way Git does: shorter names first, and
+// names of the same length bytewise.
+func cacheTreeNameLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
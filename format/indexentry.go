@@ -1,11 +1,107 @@
 package format
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"strings"
 
 	"github.com/kourge/ggit/core"
 )
 
+// An IndexEntryStage is the merge stage of an index entry. A path that is not
+// in conflict only has an entry at IndexStageNormal. A path that is in
+// conflict has no entry at IndexStageNormal, but up to one entry at each of
+// the other stages.
+type IndexEntryStage uint8
+
+const (
+	IndexStageNormal IndexEntryStage = iota
+	IndexStageBase
+	IndexStageOurs
+	IndexStageTheirs
+)
+
+// IndexEntryStat holds the file system metadata that Git records for each
+// index entry. It is used to tell whether a file in the working tree may have
+// changed since it was last staged without hashing its content again. All
+// fields are truncated to 32 bits, as they are in the index file.
+type IndexEntryStat struct {
+	CtimeSecs     uint32
+	CtimeNanosecs uint32
+	MtimeSecs     uint32
+	MtimeNanosecs uint32
+	Dev           uint32
+	Ino           uint32
+	Uid           uint32
+	Gid           uint32
+	FileSize      uint32
+}
+
+// An IndexEntry represents a single file that is staged in an index.
+//
+// Path is the slash-separated path of the file relative to the root of the
+// working tree. Mode and Sha1 describe the blob that is staged, and Stage is
+// the merge stage of the entry.
+//
+// AssumeValid is a bool that, when set to true, tells Git to assume that the
+// file has not changed in the working tree. SkipWorktree is a bool that, when
+// set to true, tells Git that the file is intentionally absent from the
+// working tree, as with sparse checkouts. IntentToAdd is a bool that, when set
+// to true, marks the entry as having been added with `git add -N`, in which
+// case Sha1 is that of an empty blob. SkipWorktree and IntentToAdd require at
+// least version 3 of the index file format.
+//
+// FSMonitorValid is a bool that, when set to true, tells Git that the file
+// system monitor has reported no change to the file since the time recorded in
+// the fsmonitor extension of the index. It is stored in that extension rather
+// than in the entry itself, and is only written out if the index has one.
+type IndexEntry struct {
+	IndexEntryStat
+	Mode           core.GitMode
+	Sha1           core.Sha1
+	Stage          IndexEntryStage
+	AssumeValid    bool
+	SkipWorktree   bool
+	IntentToAdd    bool
+	FSMonitorValid bool
+	Path           string
+}
+
+// Extended returns true if this entry can only be written out with extended
+// flags, which requires at least version 3 of the index file format.
+func (entry *IndexEntry) Extended() bool {
+	return entry.SkipWorktree || entry.IntentToAdd
+}
+
+// Less returns true if this entry sorts before other in an index, i.e. if its
+// path is bytewise smaller, or if the paths are the same and its stage is
+// lower.
+func (entry *IndexEntry) Less(other *IndexEntry) bool {
+	if entry.Path != other.Path {
+		return entry.Path < other.Path
+	}
+	return entry.Stage < other.Stage
+}
+
+// ValidateIndexPath returns an error if the given path cannot be stored in an
+// index, i.e. if it is empty, absolute, has a trailing slash, or has an empty,
+// ".", ".." or ".git" component.
+func ValidateIndexPath(path string) error {
+	if path == "" {
+		return Errorf("empty path cannot be stored in the index")
+	}
+	for _, component := range strings.Split(path, "/") {
+		switch strings.ToLower(component) {
+		case "", ".", "..", ".git":
+			return Errorf("invalid path '%s'", path)
+		}
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
 type indexEntryHeaderV2 struct {
 	CtimeSecs     uint32
 	CtimeNanosecs uint32
@@ -21,59 +117,206 @@ type indexEntryHeaderV2 struct {
 	Flags         indexEntryHeaderV2Flag
 }
 
-func (hv2 indexEntryHeaderV2) IndexEntryHeaderSize() int {
-	return binary.Size(hv2)
-}
-
 type indexEntryHeaderV2Flag uint16
 
+const (
+	indexEntryAssumeValidFlag indexEntryHeaderV2Flag = 1 << 15
+	indexEntryExtendedFlag    indexEntryHeaderV2Flag = 1 << 14
+	indexEntryStageMask       indexEntryHeaderV2Flag = 3 << 12
+	indexEntryNameLengthMask  indexEntryHeaderV2Flag = 0xfff
+)
+
 func (f indexEntryHeaderV2Flag) AssumeValid() bool {
-	return (f >> 15) == 1
+	return f&indexEntryAssumeValidFlag != 0
 }
 
 func (f indexEntryHeaderV2Flag) Extended() bool {
-	return (f >> 14) == 1
+	return f&indexEntryExtendedFlag != 0
 }
 
-type indexEntryStage uint8
-
-func (f indexEntryHeaderV2Flag) Stage() indexEntryStage {
-	return indexEntryStage((f >> 12) & 2)
+func (f indexEntryHeaderV2Flag) Stage() IndexEntryStage {
+	return IndexEntryStage((f & indexEntryStageMask) >> 12)
 }
 
 // 12-bit
 func (f indexEntryHeaderV2Flag) NameLength() uint16 {
-	return uint16(f) & 0xfff
+	return uint16(f & indexEntryNameLengthMask)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
-type indexEntryHeaderV3 struct {
-	indexEntryHeaderV2
-	V3Flags indexEntryHeaderV3Flag
-}
-
-func (hv3 indexEntryHeaderV3) IndexEntryHeaderSize() int {
-	return binary.Size(hv3)
-}
-
 type indexEntryHeaderV3Flag uint16
 
+const (
+	indexEntrySkipWorktreeFlag indexEntryHeaderV3Flag = 1 << 14
+	indexEntryIntentToAddFlag  indexEntryHeaderV3Flag = 1 << 13
+)
+
 func (f indexEntryHeaderV3Flag) SkipWorktree() bool {
-	return (f >> 14) == 1
+	return f&indexEntrySkipWorktreeFlag != 0
 }
 
 func (f indexEntryHeaderV3Flag) IntentToAdd() bool {
-	return (f >> 13) == 1
+	return f&indexEntryIntentToAddFlag != 0
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
-type indexEntryHeader interface {
-	IndexEntryHeaderSize() int
+// decodeIndexEntry reads a single entry in the given version of the index file
+// format. previousPath is the path of the entry before it, against which the
+// path is compressed in version 4.
+func decodeIndexEntry(r *bufio.Reader, version uint32, previousPath string) (IndexEntry, error) {
+	header := indexEntryHeaderV2{}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return IndexEntry{}, err
+	}
+	headerSize := binary.Size(header)
+
+	var v3Flags indexEntryHeaderV3Flag
+	if header.Flags.Extended() {
+		if version < 3 {
+			return IndexEntry{}, Errorf("extended flags are not allowed in a version %d index", version)
+		}
+		if err := binary.Read(r, binary.BigEndian, &v3Flags); err != nil {
+			return IndexEntry{}, err
+		}
+		headerSize += binary.Size(v3Flags)
+	}
+
+	entry := IndexEntry{
+		IndexEntryStat: IndexEntryStat{
+			CtimeSecs:     header.CtimeSecs,
+			CtimeNanosecs: header.CtimeNanosecs,
+			MtimeSecs:     header.MtimeSecs,
+			MtimeNanosecs: header.MtimeNanosecs,
+			Dev:           header.Dev,
+			Ino:           header.Ino,
+			Uid:           header.Uid,
+			Gid:           header.Gid,
+			FileSize:      header.FileSize,
+		},
+		Mode:         header.Mode,
+		Sha1:         header.Sha1,
+		Stage:        header.Flags.Stage(),
+		AssumeValid:  header.Flags.AssumeValid(),
+		SkipWorktree: v3Flags.SkipWorktree(),
+		IntentToAdd:  v3Flags.IntentToAdd(),
+	}
+
+	var err error
+	if version >= 4 {
+		entry.Path, err = decodeIndexEntryCompressedPath(r, previousPath)
+	} else {
+		entry.Path, err = decodeIndexEntryPaddedPath(r, headerSize)
+	}
+	return entry, err
+}
+
+// decodeIndexEntryPaddedPath reads a null-terminated path name that is padded
+// with null bytes so that the whole entry, including its header of the given
+// size, is a multiple of eight bytes long, as found in index versions 2 and 3.
+func decodeIndexEntryPaddedPath(r *bufio.Reader, headerSize int) (string, error) {
+	pathName, err := r.ReadString(0)
+	if err != nil {
+		return "", err
+	}
+
+	totalRead := headerSize + len(pathName)
+	nearestMultiple := roundUpToNearestMultipleOfEight(totalRead)
+	paddingSize := nearestMultiple - totalRead
+	for i := 1; i <= paddingSize; i++ {
+		if c, err := r.ReadByte(); err != nil {
+			return "", err
+		} else if c != 0 {
+			return "", Errorf("path name padding is not null byte")
+		}
+	}
+
+	return pathName[:len(pathName)-1], nil
+}
+
+// decodeIndexEntryCompressedPath reads a path name as found in index version
+// 4, where it is encoded as the number of bytes to remove from the end of the
+// previous path name, followed by the null-terminated string to append to what
+// remains. The number is a variable-length integer in the same encoding as an
+// OFS_DELTA base offset.
+func decodeIndexEntryCompressedPath(r *bufio.Reader, previousPath string) (string, error) {
+	strip, err := decodePackEntryBaseOffset(r)
+	if err != nil {
+		return "", err
+	} else if strip > int64(len(previousPath)) {
+		return "", Errorf("cannot remove %d bytes from path %q", strip, previousPath)
+	}
+
+	suffix, err := r.ReadString(0)
+	if err != nil {
+		return "", err
+	}
+
+	return previousPath[:len(previousPath)-int(strip)] + suffix[:len(suffix)-1], nil
 }
 
-type indexEntry struct {
-	indexEntryHeader
-	pathName string
+func roundUpToNearestMultipleOfEight(i int) int {
+	return (i + 8 - 1) & ^(8 - 1)
+}
+
+// encode writes this entry to buffer in the given version of the index file
+// format. In version 4, the path name is compressed against previousPath.
+func (entry *IndexEntry) encode(buffer *bytes.Buffer, version uint32, previousPath string) {
+	nameLength := len(entry.Path)
+	if nameLength > int(indexEntryNameLengthMask) {
+		nameLength = int(indexEntryNameLengthMask)
+	}
+	flags := indexEntryHeaderV2Flag(nameLength) | indexEntryHeaderV2Flag(entry.Stage&3)<<12
+	if entry.AssumeValid {
+		flags |= indexEntryAssumeValidFlag
+	}
+	if entry.Extended() {
+		flags |= indexEntryExtendedFlag
+	}
+
+	start := buffer.Len()
+	binary.Write(buffer, binary.BigEndian, indexEntryHeaderV2{
+		CtimeSecs:     entry.CtimeSecs,
+		CtimeNanosecs: entry.CtimeNanosecs,
+		MtimeSecs:     entry.MtimeSecs,
+		MtimeNanosecs: entry.MtimeNanosecs,
+		Dev:           entry.Dev,
+		Ino:           entry.Ino,
+		Mode:          entry.Mode,
+		Uid:           entry.Uid,
+		Gid:           entry.Gid,
+		FileSize:      entry.FileSize,
+		Sha1:          entry.Sha1,
+		Flags:         flags,
+	})
+
+	if entry.Extended() {
+		var v3Flags indexEntryHeaderV3Flag
+		if entry.SkipWorktree {
+			v3Flags |= indexEntrySkipWorktreeFlag
+		}
+		if entry.IntentToAdd {
+			v3Flags |= indexEntryIntentToAddFlag
+		}
+		binary.Write(buffer, binary.BigEndian, v3Flags)
+	}
+
+	if version >= 4 {
+		common := 0
+		for common < len(previousPath) && common < len(entry.Path) &&
+			previousPath[common] == entry.Path[common] {
+			common++
+		}
+		buffer.Write(encodePackEntryBaseOffset(int64(len(previousPath) - common)))
+		buffer.WriteString(entry.Path[common:])
+		buffer.WriteByte(0)
+		return
+	}
+
+	buffer.WriteString(entry.Path)
+	buffer.WriteByte(0)
+	for (buffer.Len()-start)%8 != 0 {
+		buffer.WriteByte(0)
+	}
 }
@@ -0,0 +1,32 @@
+package format
+
+import (
+	"os"
+)
+
+// NewIndexEntryStat returns the stat data that Git records in an index entry
+// for a file in the working tree, given the result of os.Lstat on it. On
+// platforms where the result carries no such information, only the
+// modification time and the size are filled in.
+func NewIndexEntryStat(info os.FileInfo) IndexEntryStat {
+	mtime := info.ModTime()
+	stat := IndexEntryStat{
+		CtimeSecs:     uint32(mtime.Unix()),
+		CtimeNanosecs: uint32(mtime.Nanosecond()),
+		MtimeSecs:     uint32(mtime.Unix()),
+		MtimeNanosecs: uint32(mtime.Nanosecond()),
+		FileSize:      uint32(info.Size()),
+	}
+	fillIndexEntryStat(&stat, info)
+	return stat
+}
+
+// Matches returns true if the file that other was taken from looks unchanged
+// since this stat data was recorded, comparing the same fields that Git does
+// by default: the modification and change times, the inode number, the owner,
+// and the size. The device number is left out, since it is unstable on some
+// file systems.
+func (stat IndexEntryStat) Matches(other IndexEntryStat) bool {
+	stat.Dev, other.Dev = 0, 0
+	return stat == other
+}
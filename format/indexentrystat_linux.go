@@ -0,0 +1,19 @@
+package format
+
+import (
+	"os"
+	"syscall"
+)
+
+func fillIndexEntryStat(stat *IndexEntryStat, info os.FileInfo) {
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	stat.CtimeSecs = uint32(sys.Ctim.Sec)
+	stat.CtimeNanosecs = uint32(sys.Ctim.Nsec)
+	stat.Dev = uint32(sys.Dev)
+	stat.Ino = uint32(sys.Ino)
+	stat.Uid = sys.Uid
+	stat.Gid = sys.Gid
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package format
+
+import (
+	"os"
+)
+
+func fillIndexEntryStat(stat *IndexEntryStat, info os.FileInfo) {}
@@ -1,5 +1,11 @@
 package format
 
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
 type indexExtensionHeader struct {
 	Signature [4]byte
 	Size      uint32
@@ -14,3 +20,14 @@ func (h indexExtensionHeader) Optional() bool {
 	c := h.Signature[0]
 	return c >= 'A' && c <= 'Z'
 }
+
+// writeIndexExtension writes an extension with the given signature, whose data
+// is yielded by reader, to buffer.
+func writeIndexExtension(buffer *bytes.Buffer, signature [4]byte, reader io.Reader) {
+	data := new(bytes.Buffer)
+	data.ReadFrom(reader)
+
+	header := indexExtensionHeader{signature, uint32(data.Len())}
+	binary.Write(buffer, binary.BigEndian, header)
+	buffer.Write(data.Bytes())
+}
@@ -0,0 +1,79 @@
+package format
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+var indexFSMonitorSignature = [4]byte{'F', 'S', 'M', 'N'}
+
+// An FSMonitor is the content of the FSMN extension of an index, which records
+// when a file system monitor was last queried for changes to the working tree.
+// Which entries are known to be unchanged since then is recorded in the
+// FSMonitorValid field of each entry.
+//
+// Version is either 1 or 2. In version 1, Timestamp is the time of the last
+// query in nanoseconds since the Unix epoch. In version 2, Token is an opaque
+// string that the file system monitor returned instead.
+type FSMonitor struct {
+	Version   uint32
+	Timestamp uint64
+	Token     string
+}
+
+// encode writes this extension to buffer, without the extension header. dirty
+// has a bit set for each entry of the index that is not FSMonitorValid. The
+// extension is made of Version as a 32-bit integer, then either Timestamp as a
+// 64-bit integer or Token terminated by a null byte, then the size of the
+// bitmap as a 32-bit integer and the bitmap itself in EWAH form, all of them
+// big-endian.
+func (fsm *FSMonitor) encode(buffer *bytes.Buffer, dirty *EWAHBitmap) {
+	binary.Write(buffer, binary.BigEndian, fsm.Version)
+	if fsm.Version == 1 {
+		binary.Write(buffer, binary.BigEndian, fsm.Timestamp)
+	} else {
+		buffer.WriteString(fsm.Token)
+		buffer.WriteByte(0)
+	}
+
+	bitmap := new(bytes.Buffer)
+	bitmap.ReadFrom(dirty.Reader())
+	binary.Write(buffer, binary.BigEndian, uint32(bitmap.Len()))
+	buffer.Write(bitmap.Bytes())
+}
+
+// decode parses the data of an FSMN extension and returns the bitmap of dirty
+// entries that it holds.
+func (fsm *FSMonitor) decode(reader io.Reader) (*EWAHBitmap, error) {
+	r := bufio.NewReader(reader)
+	if err := binary.Read(r, binary.BigEndian, &fsm.Version); err != nil {
+		return nil, err
+	}
+
+	switch fsm.Version {
+	case 1:
+		if err := binary.Read(r, binary.BigEndian, &fsm.Timestamp); err != nil {
+			return nil, err
+		}
+	case 2:
+		token, err := readNullTerminatedString(r)
+		if err != nil {
+			return nil, err
+		}
+		fsm.Token = token
+	default:
+		return nil, Errorf("unsupported fsmonitor extension version %d", fsm.Version)
+	}
+
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	dirty := &EWAHBitmap{}
+	if err := dirty.Decode(io.LimitReader(r, int64(size))); err != nil {
+		return nil, err
+	}
+	return dirty, nil
+}
@@ -0,0 +1,125 @@
+package format
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/kourge/ggit/core"
+)
+
+var indexResolveUndoSignature = [4]byte{'R', 'E', 'U', 'C'}
+
+// A ResolveUndoEntry records the conflicted stages of a path as they were
+// right before the conflict was resolved, so that the conflict can be
+// restored later on. Modes and Sha1s are indexed by stage minus one, i.e. the
+// first element holds IndexStageBase. A stage that was absent has a mode of
+// zero.
+type ResolveUndoEntry struct {
+	Path  string
+	Modes [3]core.GitMode
+	Sha1s [3]core.Sha1
+}
+
+// A ResolveUndo is the content of the REUC extension of an index, which is a
+// list of ResolveUndoEntry values sorted by path.
+type ResolveUndo []ResolveUndoEntry
+
+var _ core.EncodeDecoder = &ResolveUndo{}
+
+// Reader returns an io.Reader that yields the entries in the format of the
+// REUC extension, without the extension header. Each entry is written as its
+// path, a null byte, each of the three modes in ASCII octal terminated by a
+// null byte, and the SHA-1 of each stage whose mode is not zero.
+func (reuc *ResolveUndo) Reader() io.Reader {
+	buffer := new(bytes.Buffer)
+	for _, entry := range *reuc {
+		buffer.WriteString(entry.Path)
+		buffer.WriteByte(0)
+		for _, mode := range entry.Modes {
+			buffer.WriteString(strconv.FormatUint(uint64(mode), 8))
+			buffer.WriteByte(0)
+		}
+		for i, mode := range entry.Modes {
+			if mode != 0 {
+				buffer.Write(entry.Sha1s[i][:])
+			}
+		}
+	}
+	return buffer
+}
+
+// Decode parses the data of a REUC extension.
+func (reuc *ResolveUndo) Decode(reader io.Reader) error {
+	r := bufio.NewReader(reader)
+	*reuc = nil
+
+	for {
+		path, err := r.ReadString(0)
+		if err == io.EOF && path == "" {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		entry := ResolveUndoEntry{Path: path[:len(path)-1]}
+		for i := range entry.Modes {
+			mode, err := r.ReadString(0)
+			if err != nil {
+				return err
+			}
+			m, err := strconv.ParseUint(mode[:len(mode)-1], 8, 32)
+			if err != nil {
+				return err
+			}
+			entry.Modes[i] = core.GitMode(m)
+		}
+		for i, mode := range entry.Modes {
+			if mode == 0 {
+				continue
+			}
+			if _, err := io.ReadFull(r, entry.Sha1s[i][:]); err != nil {
+				return err
+			}
+		}
+
+		*reuc = append(*reuc, entry)
+	}
+}
+
+// search returns the position of the entry with the given path and whether it
+// exists. If it does not, the position is where it would be inserted.
+func (reuc ResolveUndo) search(path string) (int, bool) {
+	i := sort.Search(len(reuc), func(i int) bool {
+		return reuc[i].Path >= path
+	})
+	return i, i < len(reuc) && reuc[i].Path == path
+}
+
+// record stores the stages among the given entries, replacing any entry that
+// already exists for their path.
+func (reuc *ResolveUndo) record(path string, stages []IndexEntry) {
+	entry := ResolveUndoEntry{Path: path}
+	recorded := false
+	for _, stage := range stages {
+		if stage.Stage != IndexStageNormal {
+			entry.Modes[stage.Stage-1] = stage.Mode
+			entry.Sha1s[stage.Stage-1] = stage.Sha1
+			recorded = true
+		}
+	}
+	if !recorded {
+		return
+	}
+
+	i, found := reuc.search(path)
+	if found {
+		(*reuc)[i] = entry
+		return
+	}
+	*reuc = append(*reuc, ResolveUndoEntry{})
+	copy((*reuc)[i+1:], (*reuc)[i:])
+	(*reuc)[i] = entry
+}
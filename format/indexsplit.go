@@ -0,0 +1,227 @@
+package format
+
+import (
+	"bytes"
+
+	"github.com/kourge/ggit/core"
+)
+
+var indexLinkSignature = [4]byte{'l', 'i', 'n', 'k'}
+
+// A splitIndex holds the state of an index that is split, i.e. that only
+// stores the entries that differ from a shared index file named
+// "sharedindex.<sha1>" and refers to the latter with a link extension.
+//
+// Until the shared index is merged in, shared is nil, the entries of the index
+// are those found in the file, and deletions and replacements are the bitmaps
+// found in the link extension. Once it is merged in, the entries of the index
+// are complete and the bitmaps are computed anew whenever it is written out,
+// except that the entries of the shared index that replacements marks keep
+// being replaced, as they do in Git.
+type splitIndex struct {
+	sharedSha1   core.Sha1
+	shared       *Index
+	deletions    *EWAHBitmap
+	replacements *EWAHBitmap
+}
+
+// encode writes the link extension to buffer, without the extension header.
+// It is made of the SHA-1 of the shared index, followed by two EWAH bitmaps in
+// which the nth bit stands for the nth entry of the shared index. The first
+// marks the entries that are deleted. The second marks the entries that are
+// replaced by the entries at the start of the split index, in order, whose
+// paths are left empty since they are the same as those they replace.
+func (split *splitIndex) encode(buffer *bytes.Buffer) {
+	buffer.Write(split.sharedSha1[:])
+	if split.deletions == nil && split.replacements == nil {
+		return
+	}
+	buffer.ReadFrom(split.deletions.Reader())
+	buffer.ReadFrom(split.replacements.Reader())
+}
+
+// decodeIndexLink parses the data of a link extension.
+func decodeIndexLink(data []byte) (*splitIndex, error) {
+	if len(data) < len(core.Sha1{}) {
+		return nil, Errorf("link extension is %d bytes long, too short for a SHA-1", len(data))
+	}
+
+	split := &splitIndex{sharedSha1: core.Sha1FromByteSlice(data[:len(core.Sha1{})])}
+	r := bytes.NewReader(data[len(core.Sha1{}):])
+	if r.Len() == 0 {
+		split.deletions, split.replacements = NewEWAHBitmap(), NewEWAHBitmap()
+		return split, nil
+	}
+
+	split.deletions, split.replacements = &EWAHBitmap{}, &EWAHBitmap{}
+	if err := split.deletions.Decode(r); err != nil {
+		return nil, err
+	} else if err := split.replacements.Decode(r); err != nil {
+		return nil, err
+	} else if r.Len() != 0 {
+		return nil, Errorf("trailing data after link extension")
+	}
+	return split, nil
+}
+
+// SharedIndex returns the SHA-1 of the shared index that this index is split
+// from, and whether this index is split at all.
+func (idx *Index) SharedIndex() (core.Sha1, bool) {
+	if idx.split == nil {
+		return core.Sha1{}, false
+	}
+	return idx.split.sharedSha1, true
+}
+
+// MergeSharedIndex completes an index that was decoded from a split index file
+// with the entries of the shared index it refers to, which must have been
+// decoded from the file "sharedindex.<sha1>" next to it, where <sha1> is what
+// SharedIndex returns. Until then, the index only holds the entries that differ
+// from the shared index, and the entries that replace entries of the shared
+// index have empty paths. The index is written out as a split index against
+// the same shared index afterwards.
+func (idx *Index) MergeSharedIndex(shared *Index) error {
+	split := idx.split
+	if split == nil {
+		return Errorf("index is not split")
+	} else if split.shared != nil {
+		return Errorf("shared index %s is already merged", split.sharedSha1)
+	} else if sha := shared.Sha1(); sha != split.sharedSha1 {
+		return Errorf("shared index is %s, expected %s", sha, split.sharedSha1)
+	} else if shared.split != nil {
+		return Errorf("shared index %s is itself split", split.sharedSha1)
+	}
+
+	n := len(shared.entries)
+	if split.deletions.Size() > n || split.replacements.Size() > n {
+		return Errorf("link extension refers to entries past the %d in shared index %s", n, split.sharedSha1)
+	}
+
+	entries := make([]IndexEntry, n)
+	copy(entries, shared.entries)
+	own := idx.entries
+	replaced := 0
+
+	var err error
+	split.replacements.Each(func(i int) {
+		switch {
+		case err != nil:
+		case split.deletions.Get(i):
+			err = Errorf("shared index entry %d is both replaced and deleted", i)
+		case replaced >= len(own):
+			err = Errorf("link extension replaces more entries than the index has")
+		case own[replaced].Path != "":
+			err = Errorf("replacement entry %d has a path, expected none", replaced)
+		default:
+			entry := own[replaced]
+			entry.Path = entries[i].Path
+			entries[i] = entry
+			replaced++
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	idx.entries = entries[:0]
+	for i, entry := range entries {
+		if !split.deletions.Get(i) {
+			idx.entries = append(idx.entries, entry)
+		}
+	}
+
+	for _, entry := range own[replaced:] {
+		if entry.Path == "" {
+			return Errorf("split index entry has no path")
+		}
+		i, found := idx.search(entry.Path, entry.Stage)
+		if found {
+			idx.entries[i] = entry
+			continue
+		}
+		idx.entries = append(idx.entries, IndexEntry{})
+		copy(idx.entries[i+1:], idx.entries[i:])
+		idx.entries[i] = entry
+	}
+
+	split.shared = shared
+	split.deletions = nil
+	return idx.applyFSMonitorDirty()
+}
+
+// SetSharedIndex makes this index be written out as a split index against the
+// given shared index, which must already be written out as the file
+// "sharedindex.<sha1>", where <sha1> is its Sha1. Shared index files are
+// written out without any extension. Passing nil makes this index be written
+// out in full again.
+func (idx *Index) SetSharedIndex(shared *Index) error {
+	if shared == nil {
+		if idx.split != nil && idx.split.shared == nil {
+			return Errorf("shared index %s must be merged before the index is unsplit", idx.split.sharedSha1)
+		}
+		idx.split = nil
+		return nil
+	}
+
+	if idx.split != nil && idx.split.shared == nil {
+		return Errorf("shared index %s must be merged before it is replaced", idx.split.sharedSha1)
+	} else if shared.split != nil {
+		return Errorf("shared index %s is itself split", shared.Sha1())
+	}
+	idx.split = &splitIndex{sharedSha1: shared.Sha1(), shared: shared}
+	return nil
+}
+
+// splitEntries returns the entries to be written out to a split index file and
+// the link extension to go with them. Each entry of the shared index that is
+// absent from this index is deleted, and each one that differs from the entry
+// with the same path and stage in this index, or that was replaced when the
+// index was decoded, is replaced by it. The entries
+// of this index that are absent from the shared index follow the
+// replacements.
+func (idx *Index) splitEntries() ([]IndexEntry, *splitIndex) {
+	split := idx.split
+	if split.shared == nil {
+		return idx.entries, split
+	}
+
+	link := &splitIndex{
+		sharedSha1:   split.sharedSha1,
+		deletions:    NewEWAHBitmap(),
+		replacements: NewEWAHBitmap(),
+	}
+	var replacements, additions []IndexEntry
+
+	base := split.shared.entries
+	i, j := 0, 0
+	for i < len(base) || j < len(idx.entries) {
+		switch {
+		case j == len(idx.entries) || (i < len(base) && base[i].Less(&idx.entries[j])):
+			link.deletions.Set(i)
+			i++
+		case i == len(base) || idx.entries[j].Less(&base[i]):
+			additions = append(additions, idx.entries[j])
+			j++
+		default:
+			if !indexEntriesEqual(&base[i], &idx.entries[j]) ||
+				(split.replacements != nil && split.replacements.Get(i)) {
+				link.replacements.Set(i)
+				entry := idx.entries[j]
+				entry.Path = ""
+				replacements = append(replacements, entry)
+			}
+			i++
+			j++
+		}
+	}
+
+	return append(replacements, additions...), link
+}
+
+// indexEntriesEqual returns true if both entries would be written out the same
+// way, disregarding FSMonitorValid, which lives in an extension.
+func indexEntriesEqual(a, b *IndexEntry) bool {
+	x, y := *a, *b
+	x.FSMonitorValid, y.FSMonitorValid = false, false
+	return x == y
+}
@@ -0,0 +1,330 @@
+package format
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+
+	"github.com/kourge/ggit/core"
+)
+
+var indexUntrackedCacheSignature = [4]byte{'U', 'N', 'T', 'R'}
+
+// UntrackedCacheShowOtherDirectories is the bit of UntrackedCache.DirFlags
+// that tells Git to list a directory with no tracked files in it as a whole
+// instead of listing each untracked file under it, as `git status` does by
+// default.
+const UntrackedCacheShowOtherDirectories uint32 = 1 << 1
+
+// An UntrackedCache is the content of the UNTR extension of an index. It
+// records the untracked files found in each directory of the working tree,
+// along with enough about the directory and the exclude files in effect to
+// tell whether the list is still accurate, so that `git status` need not scan
+// directories that have not changed.
+//
+// Ident describes the environment that the cache was created in, i.e. the
+// location of the working tree and the operating system, and the cache is
+// only used in an identical environment. InfoExcludeStat and InfoExcludeSha1
+// describe $GIT_DIR/info/exclude, and ExcludesFileStat and ExcludesFileSha1
+// describe the file that core.excludesFile names. A zero SHA-1 means that the
+// file does not exist. DirFlags holds the flags of the directory walk that
+// the cache is valid for. ExcludePerDir is the name of the exclude file that
+// is read in each directory, which is usually ".gitignore". Root is the root
+// of the working tree, or nil if no directory has been cached yet.
+type UntrackedCache struct {
+	Ident            string
+	InfoExcludeStat  IndexEntryStat
+	ExcludesFileStat IndexEntryStat
+	DirFlags         uint32
+	InfoExcludeSha1  core.Sha1
+	ExcludesFileSha1 core.Sha1
+	ExcludePerDir    string
+	Root             *UntrackedCacheDir
+}
+
+// An UntrackedCacheDir is a directory in an untracked cache.
+//
+// Name is the name of the directory relative to its parent, or an empty
+// string for the root. Untracked holds the names of the untracked files and
+// directories directly under it, and Dirs holds the subdirectories that were
+// scanned. Valid is a bool that is true if Untracked is accurate as of the
+// time recorded in Stat. CheckOnly is a bool that is true if the directory was
+// only scanned to tell whether it has any untracked file at all. ExcludeSha1
+// is the SHA-1 of the blob that the exclude file in this directory hashed to,
+// or a zero SHA-1 if it was not read.
+type UntrackedCacheDir struct {
+	Name        string
+	Untracked   []string
+	Dirs        []*UntrackedCacheDir
+	Valid       bool
+	CheckOnly   bool
+	Stat        IndexEntryStat
+	ExcludeSha1 core.Sha1
+}
+
+var _ core.EncodeDecoder = &UntrackedCache{}
+
+// Lookup returns the directory at the given slash-separated path, or nil if it
+// is not in the cache. An empty path yields the root.
+func (uc *UntrackedCache) Lookup(path string) *UntrackedCacheDir {
+	dir := uc.Root
+	if path == "" || dir == nil {
+		return dir
+	}
+
+	for _, name := range strings.Split(path, "/") {
+		if dir = dir.Subdir(name); dir == nil {
+			return nil
+		}
+	}
+	return dir
+}
+
+// Subdir returns the subdirectory with the given name, or nil if there is
+// none.
+func (dir *UntrackedCacheDir) Subdir(name string) *UntrackedCacheDir {
+	for _, subdir := range dir.Dirs {
+		if subdir.Name == name {
+			return subdir
+		}
+	}
+	return nil
+}
+
+// Invalidate marks the directory that the file at the given path is in as
+// invalid, since its list of untracked files may have changed when the file
+// was added to or removed from the index. When DirFlags includes
+// UntrackedCacheShowOtherDirectories, a directory may be listed as untracked in
+// its parent, so every directory on the way to the file is invalidated.
+func (uc *UntrackedCache) Invalidate(path string) {
+	dir := uc.Root
+	showOtherDirectories := uc.DirFlags&UntrackedCacheShowOtherDirectories != 0
+	for dir != nil {
+		slash := strings.IndexByte(path, '/')
+		if slash == -1 || showOtherDirectories {
+			dir.invalidate()
+		}
+		if slash == -1 {
+			return
+		}
+
+		dir = dir.Subdir(path[:slash])
+		path = path[slash+1:]
+	}
+}
+
+func (dir *UntrackedCacheDir) invalidate() {
+	dir.Valid = false
+	dir.CheckOnly = false
+	dir.Untracked = nil
+}
+
+// Reader returns an io.Reader that yields this cache in the format of the UNTR
+// extension, without the extension header.
+//
+// The header of the extension is made of the length of Ident as a
+// variable-length integer, Ident itself, the stat data of both exclude files,
+// DirFlags, the SHA-1 of both exclude files, and ExcludePerDir terminated by a
+// null byte. It is followed by the number of directories as a variable-length
+// integer. If there is any, the directories come next in pre-order, each as
+// its number of untracked entries and subdirectories, its name, and the names
+// of its untracked entries, the latter two terminated by null bytes. Then come
+// three EWAH bitmaps in which the nth bit stands for the nth directory: the
+// first tells whether it is valid, the second whether it is check-only, and
+// the third whether its exclude SHA-1 is present. They are followed by the
+// stat data of each valid directory, the exclude SHA-1 of each directory that
+// has one, and a null byte.
+func (uc *UntrackedCache) Reader() io.Reader {
+	buffer := new(bytes.Buffer)
+	buffer.Write(encodePackEntryBaseOffset(int64(len(uc.Ident))))
+	buffer.WriteString(uc.Ident)
+	binary.Write(buffer, binary.BigEndian, uc.InfoExcludeStat)
+	binary.Write(buffer, binary.BigEndian, uc.ExcludesFileStat)
+	binary.Write(buffer, binary.BigEndian, uc.DirFlags)
+	buffer.Write(uc.InfoExcludeSha1[:])
+	buffer.Write(uc.ExcludesFileSha1[:])
+	buffer.WriteString(uc.ExcludePerDir)
+	buffer.WriteByte(0)
+
+	if uc.Root == nil {
+		buffer.Write(encodePackEntryBaseOffset(0))
+		return buffer
+	}
+
+	w := &untrackedCacheWriter{
+		dirs:      new(bytes.Buffer),
+		stats:     new(bytes.Buffer),
+		sha1s:     new(bytes.Buffer),
+		valid:     NewEWAHBitmap(),
+		checkOnly: NewEWAHBitmap(),
+		sha1Valid: NewEWAHBitmap(),
+	}
+	w.write(uc.Root)
+
+	buffer.Write(encodePackEntryBaseOffset(int64(w.count)))
+	buffer.ReadFrom(w.dirs)
+	buffer.ReadFrom(w.valid.Reader())
+	buffer.ReadFrom(w.checkOnly.Reader())
+	buffer.ReadFrom(w.sha1Valid.Reader())
+	buffer.ReadFrom(w.stats)
+	buffer.ReadFrom(w.sha1s)
+	buffer.WriteByte(0)
+	return buffer
+}
+
+type untrackedCacheWriter struct {
+	count                       int
+	dirs, stats, sha1s          *bytes.Buffer
+	valid, checkOnly, sha1Valid *EWAHBitmap
+}
+
+func (w *untrackedCacheWriter) write(dir *UntrackedCacheDir) {
+	i := w.count
+	w.count++
+
+	untracked := dir.Untracked
+	if dir.Valid {
+		w.valid.Set(i)
+		binary.Write(w.stats, binary.BigEndian, dir.Stat)
+		if dir.CheckOnly {
+			w.checkOnly.Set(i)
+		}
+	} else {
+		untracked = nil
+	}
+	if dir.ExcludeSha1 != (core.Sha1{}) {
+		w.sha1Valid.Set(i)
+		w.sha1s.Write(dir.ExcludeSha1[:])
+	}
+
+	w.dirs.Write(encodePackEntryBaseOffset(int64(len(untracked))))
+	w.dirs.Write(encodePackEntryBaseOffset(int64(len(dir.Dirs))))
+	w.dirs.WriteString(dir.Name)
+	w.dirs.WriteByte(0)
+	for _, name := range untracked {
+		w.dirs.WriteString(name)
+		w.dirs.WriteByte(0)
+	}
+
+	for _, subdir := range dir.Dirs {
+		w.write(subdir)
+	}
+}
+
+// Decode parses the data of an UNTR extension.
+func (uc *UntrackedCache) Decode(reader io.Reader) error {
+	r := bufio.NewReader(reader)
+
+	identLength, err := decodePackEntryBaseOffset(r)
+	if err != nil {
+		return err
+	}
+	ident := make([]byte, identLength)
+	if _, err := io.ReadFull(r, ident); err != nil {
+		return err
+	}
+	uc.Ident = string(ident)
+
+	for _, field := range []interface{}{
+		&uc.InfoExcludeStat,
+		&uc.ExcludesFileStat,
+		&uc.DirFlags,
+		&uc.InfoExcludeSha1,
+		&uc.ExcludesFileSha1,
+	} {
+		if err := binary.Read(r, binary.BigEndian, field); err != nil {
+			return err
+		}
+	}
+	if uc.ExcludePerDir, err = readNullTerminatedString(r); err != nil {
+		return err
+	}
+
+	count, err := decodePackEntryBaseOffset(r)
+	if err != nil {
+		return err
+	}
+	uc.Root = nil
+	if count == 0 {
+		return nil
+	}
+
+	var dirs []*UntrackedCacheDir
+	if uc.Root, err = decodeUntrackedCacheDir(r, &dirs); err != nil {
+		return err
+	} else if int64(len(dirs)) != count {
+		return Errorf("untracked cache has %d directories, expected %d", len(dirs), count)
+	}
+
+	var valid, checkOnly, sha1Valid EWAHBitmap
+	for _, bitmap := range []*EWAHBitmap{&valid, &checkOnly, &sha1Valid} {
+		if err := bitmap.Decode(r); err != nil {
+			return err
+		}
+		if bitmap.Size() > len(dirs) {
+			return Errorf("untracked cache bitmap refers to directory %d of %d", bitmap.Size()-1, len(dirs))
+		}
+	}
+
+	checkOnly.Each(func(i int) {
+		dirs[i].CheckOnly = true
+	})
+	err = nil
+	valid.Each(func(i int) {
+		dirs[i].Valid = true
+		if err == nil {
+			err = binary.Read(r, binary.BigEndian, &dirs[i].Stat)
+		}
+	})
+	sha1Valid.Each(func(i int) {
+		if err == nil {
+			_, err = io.ReadFull(r, dirs[i].ExcludeSha1[:])
+		}
+	})
+	return err
+}
+
+// decodeUntrackedCacheDir reads a directory and its subdirectories, appending
+// each of them to dirs in pre-order.
+func decodeUntrackedCacheDir(r *bufio.Reader, dirs *[]*UntrackedCacheDir) (*UntrackedCacheDir, error) {
+	untrackedCount, err := decodePackEntryBaseOffset(r)
+	if err != nil {
+		return nil, err
+	}
+	dirCount, err := decodePackEntryBaseOffset(r)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := &UntrackedCacheDir{}
+	*dirs = append(*dirs, dir)
+	if dir.Name, err = readNullTerminatedString(r); err != nil {
+		return nil, err
+	}
+	for i := int64(0); i < untrackedCount; i++ {
+		name, err := readNullTerminatedString(r)
+		if err != nil {
+			return nil, err
+		}
+		dir.Untracked = append(dir.Untracked, name)
+	}
+
+	for i := int64(0); i < dirCount; i++ {
+		subdir, err := decodeUntrackedCacheDir(r, dirs)
+		if err != nil {
+			return nil, err
+		}
+		dir.Dirs = append(dir.Dirs, subdir)
+	}
+	return dir, nil
+}
+
+func readNullTerminatedString(r *bufio.Reader) (string, error) {
+	s, err := r.ReadString(0)
+	if err != nil {
+		return "", err
+	}
+	return s[:len(s)-1], nil
+}
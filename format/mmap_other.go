@@ -0,0 +1,25 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package format
+
+import (
+	"io"
+	"os"
+)
+
+// mmapFile reads the first size bytes of the given file into memory, since
+// memory mapping is not supported on this platform.
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(io.NewSectionReader(file, 0, int64(size)), data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// munmap releases a mapping that was returned by mmapFile, which is a no-op on
+// this platform.
+func munmap(data []byte) error {
+	return nil
+}
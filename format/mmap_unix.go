@@ -0,0 +1,27 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package format
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the first size bytes of the given file into memory read-only.
+// The file may be closed once it has been mapped. The mapping must be released
+// with munmap.
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	return syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// munmap releases a mapping that was returned by mmapFile.
+func munmap(data []byte) error {
+	if data == nil {
+		return nil
+	}
+	return syscall.Munmap(data)
+}
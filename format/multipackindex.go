@@ -0,0 +1,506 @@
+package format
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/kourge/ggit/core"
+)
+
+var ErrObjectNotInMultiPackIndex = errors.New("object not found in multi-pack-index")
+
+var multiPackIndexSignature = [4]byte{'M', 'I', 'D', 'X'}
+
+const multiPackIndexLargeOffset uint32 = 0x80000000
+
+var (
+	multiPackIndexChunkPackNames    = [4]byte{'P', 'N', 'A', 'M'}
+	multiPackIndexChunkFanout       = [4]byte{'O', 'I', 'D', 'F'}
+	multiPackIndexChunkOids         = [4]byte{'O', 'I', 'D', 'L'}
+	multiPackIndexChunkOffsets      = [4]byte{'O', 'O', 'F', 'F'}
+	multiPackIndexChunkLargeOffsets = [4]byte{'L', 'O', 'F', 'F'}
+	multiPackIndexChunkRevIndex     = [4]byte{'R', 'I', 'D', 'X'}
+)
+
+type multiPackIndexHeader struct {
+	Signature   [4]byte // == multiPackIndexSignature
+	Version     uint8   // == 1
+	HashVersion uint8   // == 1, i.e. SHA-1
+	ChunkCount  uint8
+	BaseCount   uint8 // == 0
+	PackCount   uint32
+}
+
+type multiPackIndexChunkEntry struct {
+	Id     [4]byte
+	Offset uint64
+}
+
+// multiPackIndexOffset locates an object within one of the packs. If the most
+// significant bit of Offset is set and the multi-pack-index has a table of
+// 64-bit offsets, the remaining bits are an index into that table instead.
+type multiPackIndexOffset struct {
+	Pack   uint32
+	Offset uint32
+}
+
+// multiPackIndexObject is an object that is about to be recorded in a
+// multi-pack-index, along with the pack chosen for it.
+type multiPackIndexObject struct {
+	sha1      core.Sha1
+	pack      uint32
+	preferred bool
+	offset    int64
+}
+
+// A MultiPackIndexPack is a pack that is to be covered by a multi-pack-index,
+// identified by the file name of its pack index, such as "pack-<sha>.idx".
+type MultiPackIndexPack struct {
+	Name  string
+	Index PackIndex
+}
+
+// A MultiPackIndex is the in-memory representation of a multi-pack-index file,
+// which indexes the objects of many packs at once, so that an object can be
+// found with a single binary search rather than one search per pack. Every
+// object is recorded against exactly one of the packs that contain it.
+//
+// The packs covered are numbered by the order of their names, and the objects
+// are sorted by their SHA-1. A multi-pack-index may also carry a reverse index
+// that lists the objects in pseudo-pack order: the objects of the preferred
+// pack come first, followed by those of every other pack in turn, each sorted
+// by their offset within their pack.
+//
+// For more information on the multi-pack-index format, see:
+// https://git-scm.com/docs/gitformat-pack#_multi_pack_index_midx_files_have_the_following_format
+type MultiPackIndex struct {
+	packNames    []string
+	fanout       [256]uint32
+	oids         []core.Sha1
+	offsets      []multiPackIndexOffset
+	largeOffsets []uint64
+	revIndex     []uint32
+	sha1         core.Sha1
+}
+
+var _ core.EncodeDecoder = &MultiPackIndex{}
+
+// MultiPackIndexAtPath attempts to open the file at the given path and decode
+// it into a MultiPackIndex.
+func MultiPackIndexAtPath(path string) (*MultiPackIndex, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	midx := &MultiPackIndex{}
+	if err := midx.Decode(file); err != nil {
+		return nil, err
+	}
+
+	return midx, nil
+}
+
+// NewMultiPackIndex builds a multi-pack-index that covers the given packs, all
+// of which must have distinct names. The packs are given in order of
+// preference: an object that is in more than one pack is recorded against the
+// first pack that contains it, and the first pack is the preferred pack of the
+// reverse index, which is always included.
+func NewMultiPackIndex(packs []MultiPackIndexPack) (*MultiPackIndex, error) {
+	midx := &MultiPackIndex{}
+	ids := make(map[string]uint32, len(packs))
+	for _, pack := range packs {
+		if _, exists := ids[pack.Name]; exists {
+			return nil, Errorf("pack %s is listed more than once", pack.Name)
+		}
+		ids[pack.Name] = 0
+		midx.packNames = append(midx.packNames, pack.Name)
+	}
+	sort.Strings(midx.packNames)
+	for i, name := range midx.packNames {
+		ids[name] = uint32(i)
+	}
+
+	chosen := make(map[core.Sha1]multiPackIndexObject)
+	for rank, pack := range packs {
+		for _, entry := range pack.Index.Entries() {
+			if _, exists := chosen[entry.Sha1()]; !exists {
+				offset, err := entryOffset(entry)
+				if err != nil {
+					return nil, err
+				}
+				chosen[entry.Sha1()] = multiPackIndexObject{entry.Sha1(), ids[pack.Name], rank == 0, offset}
+			}
+		}
+	}
+
+	objects := make([]multiPackIndexObject, 0, len(chosen))
+	largeOffsetNeeded := false
+	for _, o := range chosen {
+		objects = append(objects, o)
+		if o.offset > 0xffffffff {
+			largeOffsetNeeded = true
+		}
+	}
+	sort.Sort(multiPackIndexObjectsBySha1(objects))
+
+	midx.oids = make([]core.Sha1, len(objects))
+	midx.offsets = make([]multiPackIndexOffset, len(objects))
+	for i, o := range objects {
+		midx.oids[i] = o.sha1
+		midx.fanout[o.sha1[0]] += 1
+
+		midx.offsets[i].Pack = o.pack
+		if largeOffsetNeeded && o.offset > 0x7fffffff {
+			midx.offsets[i].Offset = multiPackIndexLargeOffset | uint32(len(midx.largeOffsets))
+			midx.largeOffsets = append(midx.largeOffsets, uint64(o.offset))
+		} else {
+			midx.offsets[i].Offset = uint32(o.offset)
+		}
+	}
+	for i := 1; i < len(midx.fanout); i++ {
+		midx.fanout[i] += midx.fanout[i-1]
+	}
+
+	midx.revIndex = make([]uint32, len(objects))
+	for i := range midx.revIndex {
+		midx.revIndex[i] = uint32(i)
+	}
+	sort.Sort(multiPackIndexPseudoPackOrder{midx.revIndex, objects})
+
+	midx.sha1 = sha1.Sum(midx.body())
+	return midx, nil
+}
+
+// Sha1 returns the checksum of this multi-pack-index.
+func (midx *MultiPackIndex) Sha1() core.Sha1 {
+	return midx.sha1
+}
+
+// PackNames returns the names of the pack indices of the packs covered by this
+// multi-pack-index, in sorted order. The position of a name is the number by
+// which the pack is referred to.
+func (midx *MultiPackIndex) PackNames() []string {
+	return midx.packNames
+}
+
+// Size returns the number of objects in this multi-pack-index.
+func (midx *MultiPackIndex) Size() int {
+	return len(midx.oids)
+}
+
+// Objects returns a sorted slice of the objects in this multi-pack-index.
+func (midx *MultiPackIndex) Objects() []core.Sha1 {
+	return midx.oids
+}
+
+// Position returns the position of the object with the given SHA-1 among all
+// the objects in this multi-pack-index. If the object is not found, the bool
+// returned is false.
+func (midx *MultiPackIndex) Position(sha core.Sha1) (uint32, bool) {
+	lower := uint32(0)
+	if sha[0] != 0x00 {
+		lower = midx.fanout[int(sha[0])-1]
+	}
+	upper := midx.fanout[int(sha[0])]
+	if upper > uint32(len(midx.oids)) || lower > upper {
+		return 0, false
+	}
+	oids := midx.oids[lower:upper]
+
+	i := sort.Search(len(oids), func(i int) bool {
+		return oids[i].Compare(sha) >= 0
+	})
+	if i < len(oids) && oids[i] == sha {
+		return lower + uint32(i), true
+	}
+	return 0, false
+}
+
+// Lookup returns the number of the pack that holds the object with the given
+// SHA-1 and the offset of the object within that pack. If the object is not in
+// this multi-pack-index, the error ErrObjectNotInMultiPackIndex is returned.
+func (midx *MultiPackIndex) Lookup(sha core.Sha1) (uint32, int64, error) {
+	pos, found := midx.Position(sha)
+	if !found {
+		return 0, 0, ErrObjectNotInMultiPackIndex
+	}
+	return midx.EntryAt(pos)
+}
+
+// EntryAt returns the number of the pack that holds the object at the given
+// position and the offset of the object within that pack.
+func (midx *MultiPackIndex) EntryAt(pos uint32) (uint32, int64, error) {
+	if pos >= uint32(len(midx.oids)) {
+		return 0, 0, Errorf("%d is not a valid multi-pack-index position", pos)
+	}
+
+	entry := midx.offsets[pos]
+	offset := int64(entry.Offset)
+	if midx.largeOffsets != nil && entry.Offset&multiPackIndexLargeOffset != 0 {
+		i := entry.Offset &^ multiPackIndexLargeOffset
+		if i >= uint32(len(midx.largeOffsets)) {
+			return 0, 0, Errorf("multi-pack-index large offset %d is out of range", i)
+		}
+		offset = int64(midx.largeOffsets[i])
+	}
+	if entry.Pack >= uint32(len(midx.packNames)) {
+		return 0, 0, Errorf("multi-pack-index pack %d is out of range", entry.Pack)
+	}
+	return entry.Pack, offset, nil
+}
+
+// PseudoPackOrder returns the positions of the objects in this multi-pack-index
+// in pseudo-pack order, as recorded by its reverse index. If it does not carry
+// a reverse index, nil is returned.
+func (midx *MultiPackIndex) PseudoPackOrder() []uint32 {
+	return midx.revIndex
+}
+
+// Reader returns an io.Reader that yields this multi-pack-index in its on-disk
+// format, followed by its checksum.
+func (midx *MultiPackIndex) Reader() io.Reader {
+	body := midx.body()
+	hash := sha1.Sum(body)
+	return io.MultiReader(bytes.NewReader(body), bytes.NewReader(hash[:]))
+}
+
+type multiPackIndexChunk struct {
+	id   [4]byte
+	data interface{}
+}
+
+func (midx *MultiPackIndex) chunks() []multiPackIndexChunk {
+	names := new(bytes.Buffer)
+	for _, name := range midx.packNames {
+		names.WriteString(name)
+		names.WriteByte(0)
+	}
+	for names.Len()%4 != 0 {
+		names.WriteByte(0)
+	}
+
+	chunks := []multiPackIndexChunk{
+		{multiPackIndexChunkPackNames, names.Bytes()},
+		{multiPackIndexChunkFanout, midx.fanout},
+		{multiPackIndexChunkOids, midx.oids},
+		{multiPackIndexChunkOffsets, midx.offsets},
+	}
+	if len(midx.largeOffsets) != 0 {
+		chunks = append(chunks, multiPackIndexChunk{multiPackIndexChunkLargeOffsets, midx.largeOffsets})
+	}
+	if midx.revIndex != nil {
+		chunks = append(chunks, multiPackIndexChunk{multiPackIndexChunkRevIndex, midx.revIndex})
+	}
+	return chunks
+}
+
+// body serializes everything in this multi-pack-index except for the trailing
+// checksum.
+func (midx *MultiPackIndex) body() []byte {
+	chunks := midx.chunks()
+	header := multiPackIndexHeader{
+		Signature:   multiPackIndexSignature,
+		Version:     1,
+		HashVersion: 1,
+		ChunkCount:  uint8(len(chunks)),
+		PackCount:   uint32(len(midx.packNames)),
+	}
+
+	offset := uint64(binary.Size(header) + (len(chunks)+1)*binary.Size(multiPackIndexChunkEntry{}))
+	table := make([]multiPackIndexChunkEntry, 0, len(chunks)+1)
+	for _, chunk := range chunks {
+		table = append(table, multiPackIndexChunkEntry{chunk.id, offset})
+		offset += uint64(binary.Size(chunk.data))
+	}
+	table = append(table, multiPackIndexChunkEntry{[4]byte{}, offset})
+
+	buffer := new(bytes.Buffer)
+	for _, data := range []interface{}{header, table} {
+		if err := binary.Write(buffer, binary.BigEndian, data); err != nil {
+			core.Die(err)
+		}
+	}
+	for _, chunk := range chunks {
+		if err := binary.Write(buffer, binary.BigEndian, chunk.data); err != nil {
+			core.Die(err)
+		}
+	}
+	return buffer.Bytes()
+}
+
+// Decode reads a multi-pack-index file from reader. The trailing checksum is
+// verified. Chunks that are not understood, such as the list of bitmapped
+// packs, are skipped.
+func (midx *MultiPackIndex) Decode(reader io.Reader) error {
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	} else if len(content) < sha1.Size {
+		return io.ErrUnexpectedEOF
+	}
+
+	body, trailer := content[:len(content)-sha1.Size], content[len(content)-sha1.Size:]
+	if actual := core.Sha1(sha1.Sum(body)); actual != core.Sha1FromByteSlice(trailer) {
+		return Errorf("multi-pack-index SHA-1 is %s, expected %s", actual, core.Sha1FromByteSlice(trailer))
+	}
+	midx.sha1 = core.Sha1FromByteSlice(trailer)
+
+	r := bytes.NewReader(body)
+	header := multiPackIndexHeader{}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	if header.Signature != multiPackIndexSignature {
+		return Errorf("%v is not a valid multi-pack-index header", header.Signature)
+	} else if header.Version != 1 {
+		return Errorf("%d is not a valid multi-pack-index version", header.Version)
+	} else if header.HashVersion != 1 {
+		return Errorf("multi-pack-index hash version %d is not supported", header.HashVersion)
+	} else if header.BaseCount != 0 {
+		return Errorf("incremental multi-pack-index chains are not supported")
+	}
+
+	table := make([]multiPackIndexChunkEntry, int(header.ChunkCount)+1)
+	if err := binary.Read(r, binary.BigEndian, table); err != nil {
+		return err
+	}
+
+	chunks := make(map[[4]byte][]byte)
+	for i := 0; i < int(header.ChunkCount); i++ {
+		start, end := table[i].Offset, table[i+1].Offset
+		if start > end || end > uint64(len(body)) {
+			return Errorf("multi-pack-index chunk %q is out of bounds", table[i].Id[:])
+		}
+		chunks[table[i].Id] = body[start:end]
+	}
+
+	readChunk := func(id [4]byte, data interface{}) error {
+		chunk, exists := chunks[id]
+		if !exists {
+			return Errorf("multi-pack-index is missing chunk %q", id[:])
+		}
+		return binary.Read(bytes.NewReader(chunk), binary.BigEndian, data)
+	}
+
+	names, exists := chunks[multiPackIndexChunkPackNames]
+	if !exists {
+		return Errorf("multi-pack-index is missing chunk %q", multiPackIndexChunkPackNames[:])
+	}
+	midx.packNames = make([]string, 0, header.PackCount)
+	for i := uint32(0); i < header.PackCount; i++ {
+		end := bytes.IndexByte(names, 0)
+		if end == -1 {
+			return Errorf("multi-pack-index names %d packs, expected %d", i, header.PackCount)
+		}
+		name := string(names[:end])
+		if i > 0 && strings.Compare(midx.packNames[i-1], name) >= 0 {
+			return Errorf("multi-pack-index pack names are out of order: %s before %s", midx.packNames[i-1], name)
+		}
+		midx.packNames = append(midx.packNames, name)
+		names = names[end+1:]
+	}
+
+	if err := readChunk(multiPackIndexChunkFanout, &midx.fanout); err != nil {
+		return err
+	}
+
+	for i := 1; i < len(midx.fanout); i++ {
+		if midx.fanout[i] < midx.fanout[i-1] {
+			return Errorf("multi-pack-index fanout is not monotonic at %d", i)
+		}
+	}
+
+	// Every chunk of per-object data must hold exactly as many entries as the
+	// fanout counts, which is checked before anything is allocated for them.
+	n := int(midx.fanout[255])
+	for _, chunk := range []struct {
+		id       [4]byte
+		width    int
+		optional bool
+	}{
+		{multiPackIndexChunkOids, len(core.Sha1{}), false},
+		{multiPackIndexChunkOffsets, binary.Size(multiPackIndexOffset{}), false},
+		{multiPackIndexChunkRevIndex, 4, true},
+	} {
+		data, exists := chunks[chunk.id]
+		if !exists && chunk.optional {
+			continue
+		} else if exists && uint64(len(data)) != uint64(n)*uint64(chunk.width) {
+			return Errorf("multi-pack-index chunk %q has %d bytes, expected %d entries", chunk.id[:], len(data), n)
+		}
+	}
+
+	midx.oids = make([]core.Sha1, n)
+	midx.offsets = make([]multiPackIndexOffset, n)
+	if err := readChunk(multiPackIndexChunkOids, midx.oids); err != nil {
+		return err
+	}
+	if err := readChunk(multiPackIndexChunkOffsets, midx.offsets); err != nil {
+		return err
+	}
+
+	if chunk, exists := chunks[multiPackIndexChunkLargeOffsets]; exists {
+		midx.largeOffsets = make([]uint64, len(chunk)/8)
+		if err := binary.Read(bytes.NewReader(chunk), binary.BigEndian, midx.largeOffsets); err != nil {
+			return err
+		}
+	}
+	if _, exists := chunks[multiPackIndexChunkRevIndex]; exists {
+		midx.revIndex = make([]uint32, n)
+		if err := readChunk(multiPackIndexChunkRevIndex, midx.revIndex); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// A slice type that satisfies sort.Interface so that the objects of a
+// multi-pack-index can be sorted by their SHA-1.
+type multiPackIndexObjectsBySha1 []multiPackIndexObject
+
+func (objects multiPackIndexObjectsBySha1) Len() int {
+	return len(objects)
+}
+
+func (objects multiPackIndexObjectsBySha1) Less(i, j int) bool {
+	return objects[i].sha1.Compare(objects[j].sha1) < 0
+}
+
+func (objects multiPackIndexObjectsBySha1) Swap(i, j int) {
+	objects[i], objects[j] = objects[j], objects[i]
+}
+
+// multiPackIndexPseudoPackOrder satisfies sort.Interface so that positions
+// into objects can be sorted in pseudo-pack order.
+type multiPackIndexPseudoPackOrder struct {
+	positions []uint32
+	objects   []multiPackIndexObject
+}
+
+func (order multiPackIndexPseudoPackOrder) Len() int {
+	return len(order.positions)
+}
+
+func (order multiPackIndexPseudoPackOrder) Less(i, j int) bool {
+	a, b := order.objects[order.positions[i]], order.objects[order.positions[j]]
+	if a.preferred != b.preferred {
+		return a.preferred
+	} else if a.pack != b.pack {
+		return a.pack < b.pack
+	}
+	return a.offset < b.offset
+}
+
+func (order multiPackIndexPseudoPackOrder) Swap(i, j int) {
+	order.positions[i], order.positions[j] = order.positions[j], order.positions[i]
+}
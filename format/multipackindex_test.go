@@ -0,0 +1,103 @@
+package format
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kourge/ggit/core"
+)
+
+func _fixturePackIndex(offsets map[core.Sha1]int64) *PackIndexV2 {
+	var entries []PackIndexEntry
+	for sha, offset := range offsets {
+		entries = append(entries, packIndexEntry{offset: offset, sha1: sha})
+	}
+	return NewPackIndexV2(entries, core.Sha1{})
+}
+
+func TestMultiPackIndex(t *testing.T) {
+	a, b, c, d := core.Sha1{0x10}, core.Sha1{0x20}, core.Sha1{0x30}, core.Sha1{0xf0}
+	packs := []MultiPackIndexPack{
+		{"pack-2.idx", _fixturePackIndex(map[core.Sha1]int64{b: 12, d: 1 << 33})},
+		{"pack-1.idx", _fixturePackIndex(map[core.Sha1]int64{a: 12, b: 40, c: 0x80000000})},
+	}
+
+	midx, err := NewMultiPackIndex(packs)
+	if err != nil {
+		t.Fatalf("NewMultiPackIndex() returned error %v", err)
+	}
+
+	decoded := &MultiPackIndex{}
+	if err := decoded.Decode(midx.Reader()); err != nil {
+		t.Fatalf("midx.Decode() returned error %v", err)
+	} else if decoded.Sha1() != midx.Sha1() {
+		t.Errorf("midx.Decode() yielded checksum %s, want %s", decoded.Sha1(), midx.Sha1())
+	}
+
+	if names := decoded.PackNames(); len(names) != 2 || names[0] != "pack-1.idx" || names[1] != "pack-2.idx" {
+		t.Errorf("midx.PackNames() = %v", names)
+	}
+	if decoded.Size() != 4 {
+		t.Errorf("midx.Size() = %d, want 4", decoded.Size())
+	}
+
+	for sha, expected := range map[core.Sha1]struct {
+		pack   uint32
+		offset int64
+	}{
+		a: {0, 12},
+		b: {1, 12},
+		c: {0, 0x80000000},
+		d: {1, 1 << 33},
+	} {
+		pack, offset, err := decoded.Lookup(sha)
+		if err != nil || pack != expected.pack || offset != expected.offset {
+			t.Errorf("midx.Lookup(%s) = %d, %d, %v, want %d, %d", sha, pack, offset, err, expected.pack, expected.offset)
+		}
+	}
+	if _, _, err := decoded.Lookup(core.Sha1{0x40}); err != ErrObjectNotInMultiPackIndex {
+		t.Errorf("midx.Lookup() returned error %v, want %v", err, ErrObjectNotInMultiPackIndex)
+	}
+
+	// The objects of the preferred pack, pack-2, come first in pseudo-pack
+	// order, followed by those of pack-1, each by offset.
+	expected := []core.Sha1{b, d, a, c}
+	order := decoded.PseudoPackOrder()
+	if len(order) != len(expected) {
+		t.Fatalf("midx.PseudoPackOrder() = %v", order)
+	}
+	for i, pos := range order {
+		if sha := decoded.Objects()[pos]; sha != expected[i] {
+			t.Errorf("object %d in pseudo-pack order is %s, want %s", i, sha, expected[i])
+		}
+	}
+
+	if _, err := NewMultiPackIndex(append(packs, packs[0])); err == nil {
+		t.Errorf("NewMultiPackIndex() of a duplicate pack did not return an error")
+	}
+
+	corrupt := new(bytes.Buffer)
+	corrupt.ReadFrom(midx.Reader())
+	corrupt.Bytes()[20] ^= 0xff
+	if err := (&MultiPackIndex{}).Decode(corrupt); err == nil {
+		t.Errorf("midx.Decode() of a corrupt file did not return an error")
+	}
+
+	// A fanout that disagrees with the other chunks is rejected on decode,
+	// and one that is out of range never makes Position panic.
+	for _, fanout := range []func(f *[256]uint32){
+		func(f *[256]uint32) { f[255] = 1 << 30 },
+		func(f *[256]uint32) { f[0x20] = 0 },
+	} {
+		bad := *midx
+		fanout(&bad.fanout)
+		if err := (&MultiPackIndex{}).Decode(bad.Reader()); err == nil {
+			t.Errorf("midx.Decode() with a bad fanout did not return an error")
+		}
+	}
+	broken := *decoded
+	broken.fanout[0x30] = 1000
+	if pos, found := broken.Position(c); found {
+		t.Errorf("midx.Position() with an out-of-range fanout = %d", pos)
+	}
+}
@@ -1,12 +1,19 @@
 package format
 
 import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
 	"encoding/binary"
 	"errors"
 	"io"
+	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/kourge/ggit/core"
 )
@@ -19,11 +26,51 @@ var (
 // A Pack is a set of objects that have been compressed into one file.
 // Accessing any object stored in that file (called the "pack file") is sped
 // up by a companion file called the "pack index".
+//
+// Objects in a pack may be stored as deltas against other objects. A delta
+// whose base resides in the same pack is resolved transparently. A REF_DELTA
+// whose base is not in this pack, as is the case with thin packs, can only be
+// resolved if BaseResolver is set.
+//
+// Once it has been opened, a Pack is safe for concurrent use: entries are read
+// from the pack file at their offsets with ReadAt rather than by seeking a
+// shared file position, and the reverse index and the bitmap are loaded once
+// under a lock. Open, Close, and setting BaseResolver or Cache must not
+// happen concurrently with anything else.
 type Pack struct {
 	packPath string
 	idxPath  string
 	file     *os.File
 	idx      PackIndex
+
+	// mutex guards the lazy loading of rev and bitmap.
+	mutex  sync.Mutex
+	rev    *PackReverseIndex
+	bitmap *PackBitmap
+
+	BaseResolver DeltaBaseResolver
+	Cache        PackCache
+}
+
+// A DeltaBaseResolver looks up an object by its SHA-1 outside of a pack. It is
+// used to find the base of a REF_DELTA entry that does not reside in the pack
+// being read.
+type DeltaBaseResolver func(sha core.Sha1) (core.Object, error)
+
+// A PackCache holds the resolved content of pack entries, keyed by the pack
+// and the offset of the entry within it, so that objects that are read again,
+// and above all the bases that deltas are applied to, need not be inflated and
+// resolved again every time. The content that is added to a PackCache and
+// handed out by it must never be modified. A PackCache must be safe for
+// concurrent use.
+type PackCache interface {
+	// Get returns the type and content of the entry at the given offset in
+	// the given pack, if they are cached.
+	Get(p *Pack, offset int64) (PackedObjectType, []byte, bool)
+
+	// Add adds the type and content of the entry at the given offset in the
+	// given pack to the cache.
+	Add(p *Pack, offset int64, t PackedObjectType, data []byte)
 }
 
 // NewPack returns a Pack at the given path. The path can be a path to the
@@ -38,9 +85,13 @@ func NewPack(path string) *Pack {
 	return &Pack{packPath: path}
 }
 
-// Open attempts to open this pack's pack file and its pack index. The pack file
-// header and the pack index are verified by header checks and SHA-1 checksum
-// matching.  The entire pack index is also parsed and loaded on Open.
+// Open attempts to open this pack's pack file and its pack index. Only the
+// signature of the pack file header is verified. A v2 pack index is mapped into
+// memory rather than being copied, and as in Git, only its size is checked
+// against the number of objects that it claims to hold, so an offset that it
+// records out of range is only reported once the object is looked up. A v1
+// pack index is decoded and verified in full. Either way, the pack must be
+// closed once it is no longer used.
 func (p *Pack) Open() error {
 	if p.file != nil {
 		return ErrPackFileAlreadyOpen
@@ -63,14 +114,11 @@ func (p *Pack) Open() error {
 	}
 
 	// Load the corresponding index.
-	if idxFile, err := os.Open(p.idxPath); err != nil {
-		return err
-	} else if idx, err := PackIndexFromReader(idxFile); err != nil {
+	idx, err := PackIndexAtPath(p.idxPath)
+	if err != nil {
 		return err
-	} else {
-		p.idx = idx
-		idxFile.Close()
 	}
+	p.idx = idx
 
 	return nil
 }
@@ -96,38 +144,393 @@ func verifyPack(reader io.Reader) error {
 	return nil
 }
 
-// Close closes the pack file associated with this Pack. If the pack file has
-// never been opened in the first place, nothing happens.
+// Close closes the pack file associated with this Pack and releases its pack
+// index. If the pack file has never been opened in the first place, nothing
+// happens.
 func (p *Pack) Close() error {
+	if closer, ok := p.idx.(io.Closer); ok {
+		closer.Close()
+	}
 	if p.file == nil {
 		return nil
 	}
 	return p.file.Close()
 }
 
+// Path returns the path of the pack file of this pack.
+func (p *Pack) Path() string {
+	return p.packPath
+}
+
+// IndexPath returns the path of the pack index of this pack.
+func (p *Pack) IndexPath() string {
+	return p.idxPath
+}
+
+// Index returns the pack index of this pack, which is only available once the
+// pack has been opened.
+func (p *Pack) Index() PackIndex {
+	return p.idx
+}
+
+// ReverseIndex returns the reverse index of this pack, which lists its objects
+// in the order in which they appear in the pack file. It is read from the
+// ".rev" file next to the pack file if there is one, and is otherwise computed
+// from the pack index. Either way, it is only loaded once.
+func (p *Pack) ReverseIndex() (*PackReverseIndex, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.rev != nil {
+		return p.rev, nil
+	}
+
+	packfileSha1, _, err := p.trailer()
+	if err != nil {
+		return nil, err
+	}
+
+	rev, err := PackReverseIndexAtPath(p.basePath() + ".rev")
+	if os.IsNotExist(err) {
+		rev, err = NewPackReverseIndex(p.idx, packfileSha1), nil
+	}
+	if err != nil {
+		return nil, err
+	} else if rev.PackfileSha1() != packfileSha1 {
+		return nil, Errorf("reverse index is for pack %s, not %s", rev.PackfileSha1(), packfileSha1)
+	} else if rev.Size() != p.idx.Size() {
+		return nil, Errorf("reverse index has %d objects, pack index has %d", rev.Size(), p.idx.Size())
+	}
+	for _, pos := range rev.positions {
+		if pos >= uint32(p.idx.Size()) {
+			return nil, Errorf("reverse index names position %d, pack index has %d objects", pos, p.idx.Size())
+		}
+	}
+
+	p.rev = rev
+	return rev, nil
+}
+
+// EntrySizeAt returns the number of bytes that the entry at the given offset
+// takes up in the pack file, including its header. For an object stored as a
+// delta, this is the size of the compressed delta rather than the size of the
+// object. If no entry starts at that offset, the error ErrObjectNotFoundInPack
+// is returned.
+func (p *Pack) EntrySizeAt(offset int64) (int64, error) {
+	rev, err := p.ReverseIndex()
+	if err != nil {
+		return 0, err
+	}
+
+	pos, found := rev.PackPosition(p.idx, offset)
+	if !found {
+		return 0, ErrObjectNotFoundInPack
+	}
+
+	_, size, err := p.trailer()
+	if err != nil {
+		return 0, err
+	}
+	return rev.EntrySize(p.idx, pos, size)
+}
+
+// Bitmap returns the pack bitmap of this pack, which is read from the ".bitmap"
+// file next to the pack file and only loaded once. If the pack has no bitmap,
+// an error that satisfies os.IsNotExist is returned.
+func (p *Pack) Bitmap() (*PackBitmap, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.bitmap != nil {
+		return p.bitmap, nil
+	}
+
+	packfileSha1, _, err := p.trailer()
+	if err != nil {
+		return nil, err
+	}
+
+	bitmap, err := PackBitmapAtPath(p.basePath() + ".bitmap")
+	if err != nil {
+		return nil, err
+	} else if bitmap.PackfileSha1() != packfileSha1 {
+		return nil, Errorf("pack bitmap is for pack %s, not %s", bitmap.PackfileSha1(), packfileSha1)
+	}
+
+	p.bitmap = bitmap
+	return bitmap, nil
+}
+
+// ReachableObjects returns a sorted slice of the objects that are reachable
+// from any of the given commits, as told by the pack bitmap of this pack, so
+// that no commits or trees need to be read. Every one of the commits must have
+// a bitmap of its own. If one of them is not in this pack at all, the error
+// ErrObjectNotFoundInPack is returned.
+func (p *Pack) ReachableObjects(tips []core.Sha1) ([]core.Sha1, error) {
+	bitmap, err := p.Bitmap()
+	if err != nil {
+		return nil, err
+	}
+	rev, err := p.ReverseIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	reachable := NewEWAHBitmap()
+	for _, tip := range tips {
+		pos, found := p.idx.Position(tip)
+		if !found {
+			return nil, ErrObjectNotFoundInPack
+		}
+		b, found := bitmap.Bitmap(uint32(pos))
+		if !found {
+			return nil, Errorf("commit %s has no bitmap", tip)
+		}
+		reachable = reachable.Or(b)
+	}
+
+	positions := make([]int, 0, reachable.Count())
+	var outOfRange error
+	reachable.Each(func(i int) {
+		pos, err := rev.IndexPosition(uint32(i))
+		if err != nil {
+			outOfRange = err
+			return
+		}
+		positions = append(positions, int(pos))
+	})
+	if outOfRange != nil {
+		return nil, outOfRange
+	}
+	sort.Ints(positions)
+
+	objects := make([]core.Sha1, len(positions))
+	for i, pos := range positions {
+		objects[i] = p.idx.EntryAt(pos).Sha1()
+	}
+	return objects, nil
+}
+
+// basePath returns the path of the pack file without its extension, which is
+// shared by all of the files that accompany it.
+func (p *Pack) basePath() string {
+	return strings.TrimSuffix(p.packPath, ".pack")
+}
+
+// trailer returns the checksum that ends the pack file, along with the size of
+// the pack file.
+func (p *Pack) trailer() (core.Sha1, int64, error) {
+	info, err := p.file.Stat()
+	if err != nil {
+		return core.Sha1{}, 0, err
+	}
+
+	size := info.Size()
+	var sha core.Sha1
+	if size < int64(len(sha)) {
+		return core.Sha1{}, 0, io.ErrUnexpectedEOF
+	}
+	if _, err := p.file.ReadAt(sha[:], size-int64(len(sha))); err != nil {
+		return core.Sha1{}, 0, err
+	}
+	return sha, size, nil
+}
+
 // Objects returns a slice of sorted SHA-1 checksums of the objects in this
 // pack.
 func (p *Pack) Objects() []core.Sha1 {
 	return p.idx.Objects()
 }
 
+// Size returns the number of objects in this pack.
+func (p *Pack) Size() int {
+	return p.idx.Size()
+}
+
+// HasObject returns true if the object with the given SHA-1 is in this pack.
+func (p *Pack) HasObject(sha core.Sha1) bool {
+	return p.idx.EntryForSha1(sha) != nil
+}
+
 // ObjectBySha1 returns the object corresponding to the given sha. If the object
 // does not exist in this pack, nil is returned for the object and the error
 // ErrObjectNotFoundInPack is returned. If there was an error in seeking in the
 // pack file or decoding the pack entry within, nil is returned for the object
 // along with the error that occurred.
+//
+// If the object is stored as a delta, its entire delta chain is resolved, and
+// the object returned is of the same type as the base at the end of the chain.
 func (p *Pack) ObjectBySha1(sha core.Sha1) (core.Object, error) {
-	if entry := p.idx.EntryForSha1(sha); entry == nil {
+	entry := p.idx.EntryForSha1(sha)
+	if entry == nil {
 		return nil, ErrObjectNotFoundInPack
-	} else if _, err := p.file.Seek(entry.Offset(), 0); err != nil {
+	}
+
+	offset, err := entryOffset(entry)
+	if err != nil {
+		return nil, err
+	}
+	t, data, err := p.unpackAt(offset)
+	if err != nil {
 		return nil, err
 	}
 
-	entry := &packEntry{}
-	err := entry.Decode(p.file)
+	object, err := core.NewObjectOfType(t.String())
 	if err != nil {
 		return nil, err
 	}
+	if err := object.Decode(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+
+	return object, nil
+}
+
+// OpenObject returns the type and size of the object corresponding to the
+// given sha, along with a reader of its content. If the object does not exist
+// in this pack, the error ErrObjectNotFoundInPack is returned.
+//
+// An object that is not stored as a delta is inflated lazily as the reader is
+// read from, so that its content is never held in memory in its entirety. An
+// object stored as a delta cannot be reconstructed without its base, so its
+// delta chain is resolved in full up front, as ObjectBySha1 does. Either way,
+// this pack must remain open until the reader has been closed.
+func (p *Pack) OpenObject(sha core.Sha1) (PackedObjectType, int64, io.ReadCloser, error) {
+	entry := p.idx.EntryForSha1(sha)
+	if entry == nil {
+		return PackedObjectNone, 0, nil, ErrObjectNotFoundInPack
+	}
+
+	offset, err := entryOffset(entry)
+	if err != nil {
+		return PackedObjectNone, 0, nil, err
+	}
+	r := bufio.NewReader(p.sectionAt(offset))
+	header := &packEntry{}
+	if err := header.decodeHeader(r); err != nil {
+		return PackedObjectNone, 0, nil, err
+	}
+
+	if header.IsDelta() {
+		t, data, err := p.unpackAt(offset)
+		if err != nil {
+			return PackedObjectNone, 0, nil, err
+		}
+		return t, int64(len(data)), ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	content, err := zlib.NewReader(r)
+	if err != nil {
+		return PackedObjectNone, 0, nil, err
+	}
+	return header.packEntryHeader.Type(), header.size.Int64(), content, nil
+}
+
+// entryAt decodes the pack entry located at the given offset in the pack file.
+func (p *Pack) entryAt(offset int64) (*packEntry, error) {
+	if offset < 0 {
+		return nil, Errorf("%d is not a valid pack offset", offset)
+	}
+
+	entry := &packEntry{}
+	if err := entry.Decode(bufio.NewReader(p.sectionAt(offset))); err != nil {
+		return nil, err
+	}
 
 	return entry, nil
 }
+
+// sectionAt returns a reader of the pack file that starts at the given offset
+// and reads with ReadAt, so that it does not disturb, nor is disturbed by, any
+// other reader of the same file.
+func (p *Pack) sectionAt(offset int64) *io.SectionReader {
+	return io.NewSectionReader(p.file, offset, math.MaxInt64-offset)
+}
+
+// unpackAt returns the type and the fully resolved content of the object whose
+// entry is located at the given offset. Deltas are followed until an entry
+// that is not a delta is found, and the deltas collected along the way are
+// then applied in reverse order. REF_DELTA bases that cannot be found in this
+// pack are looked up through BaseResolver.
+//
+// If Cache is set, the walk stops at the first entry whose content is cached,
+// and the content of every entry that had to be resolved is added to it.
+func (p *Pack) unpackAt(offset int64) (PackedObjectType, []byte, error) {
+	var chain []*packEntry
+	var offsets []int64
+	var t PackedObjectType
+	var data []byte
+	visited := make(map[int64]bool)
+
+	for resolved := false; !resolved; {
+		if visited[offset] {
+			return PackedObjectNone, nil, Errorf("delta chain at offset %d is cyclic", offset)
+		}
+		visited[offset] = true
+
+		if p.Cache != nil {
+			if cachedType, cached, found := p.Cache.Get(p, offset); found {
+				t, data = cachedType, cached
+				break
+			}
+		}
+
+		entry, err := p.entryAt(offset)
+		if err != nil {
+			return PackedObjectNone, nil, err
+		}
+
+		switch entry.packEntryHeader.Type() {
+		case PackedObjectOfsDelta:
+			if entry.baseOffset <= 0 || entry.baseOffset >= offset {
+				return PackedObjectNone, nil, Errorf("invalid ofs_delta base offset at %d", offset)
+			}
+			chain = append(chain, entry)
+			offsets = append(offsets, offset)
+			offset -= entry.baseOffset
+		case PackedObjectRefDelta:
+			chain = append(chain, entry)
+			offsets = append(offsets, offset)
+			if base := p.idx.EntryForSha1(entry.baseSha1); base != nil {
+				if offset, err = entryOffset(base); err != nil {
+					return PackedObjectNone, nil, err
+				}
+				continue
+			}
+
+			if p.BaseResolver == nil {
+				return PackedObjectNone, nil, Errorf("ref_delta base %s not found in pack", entry.baseSha1)
+			}
+			base, err := p.BaseResolver(entry.baseSha1)
+			if err != nil {
+				return PackedObjectNone, nil, err
+			}
+
+			buffer := new(bytes.Buffer)
+			if _, err := buffer.ReadFrom(base.Reader()); err != nil {
+				return PackedObjectNone, nil, err
+			}
+			t, data = PackedObjectTypeFromString(base.Type()), buffer.Bytes()
+			resolved = true
+		default:
+			t, data = entry.packEntryHeader.Type(), entry.data
+			resolved = true
+			if p.Cache != nil {
+				p.Cache.Add(p, offset, t, data)
+			}
+		}
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		result, err := ApplyDelta(data, chain[i].data)
+		if err != nil {
+			return PackedObjectNone, nil, err
+		}
+		data = result
+		if p.Cache != nil {
+			p.Cache.Add(p, offsets[i], t, data)
+		}
+	}
+
+	return t, data, nil
+}
@@ -0,0 +1,136 @@
+package format
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/kourge/ggit/core"
+)
+
+func TestPack_OpenObject(t *testing.T) {
+	objects := _fixturePackObjects()
+	pack, cleanup := _writeFixturePack(t, objects, PackOptions{})
+	defer cleanup()
+
+	for _, object := range objects {
+		sha := core.NewStream(object).Hash()
+		typ, size, r, err := pack.OpenObject(sha)
+		if err != nil {
+			t.Errorf("pack.OpenObject(%s) returned error %v", sha, err)
+			continue
+		}
+		content, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Errorf("reading object %s returned error %v", sha, err)
+		}
+
+		expected := object.(*core.Blob).Content
+		if typ != PackedObjectBlob || size != int64(len(expected)) || !bytes.Equal(content, expected) {
+			t.Errorf("pack.OpenObject(%s) = %v, %d, %q", sha, typ, size, content)
+		}
+	}
+
+	if _, _, _, err := pack.OpenObject(core.Sha1{1}); err != ErrObjectNotFoundInPack {
+		t.Errorf("pack.OpenObject() returned error %v, want %v", err, ErrObjectNotFoundInPack)
+	}
+}
+
+func TestPack_CorruptIndex(t *testing.T) {
+	objects := _fixturePackObjects()
+	pack, cleanup := _writeFixturePack(t, objects, PackOptions{})
+	defer cleanup()
+
+	// Point the first entry at a 64-bit offset that the pack index lacks. The
+	// pack index is mapped without being verified, so this goes unnoticed
+	// until the entry is looked up.
+	idx := pack.Index()
+	sha := idx.EntryAt(0).Sha1()
+	file, err := os.OpenFile(pack.IndexPath(), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := int64(8 + 256*4 + idx.Size()*(20+4))
+	if _, err := file.WriteAt([]byte{0x80, 0, 0, 5}, at); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	corrupt := NewPack(pack.Path())
+	if err := corrupt.Open(); err != nil {
+		t.Fatalf("pack.Open() returned error %v", err)
+	}
+	defer corrupt.Close()
+
+	if _, err := corrupt.ObjectBySha1(sha); err == nil {
+		t.Errorf("pack.ObjectBySha1(%s) returned no error", sha)
+	}
+	if _, _, _, err := corrupt.OpenObject(sha); err == nil {
+		t.Errorf("pack.OpenObject(%s) returned no error", sha)
+	}
+	if _, err := NewMultiPackIndex([]MultiPackIndexPack{{"fixture.pack", corrupt.Index()}}); err == nil {
+		t.Errorf("NewMultiPackIndex() returned no error")
+	}
+
+	rev := NewPackReverseIndex(corrupt.Index(), core.Sha1{})
+	if _, err := rev.EntrySize(corrupt.Index(), 0, 1<<20); err == nil {
+		t.Errorf("rev.EntrySize() returned no error")
+	}
+
+	other := idx.EntryAt(1).Sha1()
+	if object, err := corrupt.ObjectBySha1(other); err != nil || core.NewStream(object).Hash() != other {
+		t.Errorf("pack.ObjectBySha1(%s) = %v, %v", other, object, err)
+	}
+}
+
+func TestPack_Concurrent(t *testing.T) {
+	objects := _fixturePackObjects()
+	pack, cleanup := _writeFixturePack(t, objects, PackOptions{})
+	defer cleanup()
+
+	errs := make(chan error, 8)
+	for g := 0; g < cap(errs); g++ {
+		go func(g int) {
+			for i := 0; i < 20*len(objects); i++ {
+				object := objects[(i+g)%len(objects)]
+				sha := core.NewStream(object).Hash()
+				if actual, err := pack.ObjectBySha1(sha); err != nil {
+					errs <- err
+					return
+				} else if core.NewStream(actual).Hash() != sha {
+					errs <- Errorf("pack.ObjectBySha1(%s) returned another object", sha)
+					return
+				}
+
+				_, _, r, err := pack.OpenObject(sha)
+				if err != nil {
+					errs <- err
+					return
+				}
+				content, err := ioutil.ReadAll(r)
+				r.Close()
+				if err != nil {
+					errs <- err
+					return
+				} else if !bytes.Equal(content, object.(*core.Blob).Content) {
+					errs <- Errorf("pack.OpenObject(%s) read other content", sha)
+					return
+				}
+
+				if _, err := pack.EntrySizeAt(pack.Index().EntryForSha1(sha).Offset()); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(g)
+	}
+
+	for g := 0; g < cap(errs); g++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
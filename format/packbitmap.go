@@ -0,0 +1,332 @@
+package format
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/kourge/ggit/core"
+)
+
+var packBitmapSignature = [4]byte{'B', 'I', 'T', 'M'}
+
+// Options that may be set in the header of a pack bitmap.
+const (
+	// PackBitmapFullDAG is always set. It signifies that the bitmap of a commit
+	// covers every object reachable from it, not just those in the same pack.
+	PackBitmapFullDAG uint16 = 0x1
+
+	// PackBitmapHashCache signifies that the pack bitmap carries the name hash
+	// of every object in the pack, which is used to find delta candidates.
+	PackBitmapHashCache uint16 = 0x4
+
+	packBitmapLookupTable uint16 = 0x10
+)
+
+const (
+	// packBitmapMaxXorOffset is the furthest back that the bitmap of a commit
+	// may refer to the bitmap it was XORed with.
+	packBitmapMaxXorOffset = 160
+
+	// packBitmapXorSearch is how many preceding bitmaps are tried when looking
+	// for one to XOR a bitmap with, as Git does.
+	packBitmapXorSearch = 10
+)
+
+type packBitmapHeader struct {
+	Signature    [4]byte // == packBitmapSignature
+	Version      uint16  // == 1
+	Options      uint16
+	EntryCount   uint32
+	PackfileSha1 core.Sha1
+}
+
+type packBitmapEntryHeader struct {
+	Position  uint32
+	XorOffset uint8
+	Flags     uint8
+}
+
+// packBitmapCommit is the reachability bitmap of a single commit, which is
+// identified by its position in the pack index.
+type packBitmapCommit struct {
+	position uint32
+	flags    uint8
+	bitmap   *EWAHBitmap
+}
+
+// A PackBitmap is the in-memory representation of a pack bitmap index, the
+// ".bitmap" file that may accompany a pack and its index. For some of the
+// commits in the pack, it records which objects are reachable from them, so
+// that a set of objects to send or to keep can be computed without walking any
+// commits or trees. It also records which objects are of each type.
+//
+// Every bit in a bitmap stands for an object of the pack, in pack order, such
+// that the bit at position i stands for the object that is at position i in the
+// reverse index of the pack. Bitmaps are stored compressed as EWAHBitmaps, and
+// the bitmap of a commit may be stored XORed with that of a commit before it,
+// which makes the bitmaps of related commits compress well. Bitmaps are kept
+// resolved and uncompressed in memory.
+//
+// For more information on the pack bitmap format, see:
+// https://git-scm.com/docs/bitmap-format
+type PackBitmap struct {
+	options      uint16
+	packfileSha1 core.Sha1
+	types        [4]*EWAHBitmap
+	commits      []packBitmapCommit
+	byPosition   map[uint32]int
+	hashCache    []uint32
+	sha1         core.Sha1
+}
+
+var _ core.EncodeDecoder = &PackBitmap{}
+
+// PackBitmapAtPath attempts to open the file at the given path and decode it
+// into a PackBitmap.
+func PackBitmapAtPath(path string) (*PackBitmap, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	bitmap := &PackBitmap{}
+	if err := bitmap.Decode(file); err != nil {
+		return nil, err
+	}
+
+	return bitmap, nil
+}
+
+// NewPackBitmap builds a pack bitmap for the pack whose checksum is
+// packfileSha1. The bitmaps in types tell which objects are commits, trees,
+// blobs, and tags, and there must be one for each of those four types. The
+// bitmaps in commits are keyed by the position of their commit in the pack
+// index. If hashCache is not nil, it must hold the name hash of every object in
+// the pack, in pack index order.
+func NewPackBitmap(packfileSha1 core.Sha1, types map[PackedObjectType]*EWAHBitmap, commits map[uint32]*EWAHBitmap, hashCache []uint32) (*PackBitmap, error) {
+	bitmap := &PackBitmap{options: PackBitmapFullDAG, packfileSha1: packfileSha1, hashCache: hashCache}
+	if hashCache != nil {
+		bitmap.options |= PackBitmapHashCache
+	}
+
+	if len(types) != len(bitmap.types) {
+		return nil, Errorf("pack bitmap needs %d type bitmaps, got %d", len(bitmap.types), len(types))
+	}
+	for t, b := range types {
+		if t < PackedObjectCommit || t > PackedObjectTag || b == nil {
+			return nil, Errorf("%v is not a valid pack bitmap type", t)
+		}
+		bitmap.types[t-PackedObjectCommit] = b
+	}
+
+	positions := make([]int, 0, len(commits))
+	for position := range commits {
+		positions = append(positions, int(position))
+	}
+	sort.Ints(positions)
+	bitmap.byPosition = make(map[uint32]int, len(positions))
+	for i, position := range positions {
+		bitmap.byPosition[uint32(position)] = i
+		bitmap.commits = append(bitmap.commits, packBitmapCommit{position: uint32(position), bitmap: commits[uint32(position)]})
+	}
+
+	bitmap.sha1 = sha1.Sum(bitmap.body())
+	return bitmap, nil
+}
+
+// Options returns the options set in the header of this pack bitmap, such as
+// PackBitmapFullDAG and PackBitmapHashCache.
+func (bitmap *PackBitmap) Options() uint16 {
+	return bitmap.options
+}
+
+// PackfileSha1 returns the SHA-1 checksum of the pack file that this pack
+// bitmap describes.
+func (bitmap *PackBitmap) PackfileSha1() core.Sha1 {
+	return bitmap.packfileSha1
+}
+
+// TypeBitmap returns the bitmap of the objects of the given type, which must be
+// one of commit, tree, blob, or tag. For any other type, nil is returned.
+func (bitmap *PackBitmap) TypeBitmap(t PackedObjectType) *EWAHBitmap {
+	if t < PackedObjectCommit || t > PackedObjectTag {
+		return nil
+	}
+	return bitmap.types[t-PackedObjectCommit]
+}
+
+// Commits returns the positions in the pack index of the commits that have a
+// bitmap, in the order in which they are stored.
+func (bitmap *PackBitmap) Commits() []uint32 {
+	positions := make([]uint32, len(bitmap.commits))
+	for i, commit := range bitmap.commits {
+		positions[i] = commit.position
+	}
+	return positions
+}
+
+// Bitmap returns the bitmap of the objects reachable from the commit at the
+// given position in the pack index. If that commit has no bitmap, the bool
+// returned is false.
+func (bitmap *PackBitmap) Bitmap(indexPos uint32) (*EWAHBitmap, bool) {
+	i, exists := bitmap.byPosition[indexPos]
+	if !exists {
+		return nil, false
+	}
+	return bitmap.commits[i].bitmap, true
+}
+
+// HashCache returns the name hash of every object in the pack, in pack index
+// order. If this pack bitmap carries no hash cache, nil is returned.
+func (bitmap *PackBitmap) HashCache() []uint32 {
+	return bitmap.hashCache
+}
+
+// Reader returns an io.Reader that yields this pack bitmap in its on-disk
+// format, followed by its checksum. The bitmap of each commit is XORed with
+// that of one of the commits right before it whenever doing so makes it
+// smaller.
+func (bitmap *PackBitmap) Reader() io.Reader {
+	body := bitmap.body()
+	hash := sha1.Sum(body)
+	return io.MultiReader(bytes.NewReader(body), bytes.NewReader(hash[:]))
+}
+
+// body serializes everything in this pack bitmap except for the trailing
+// checksum.
+func (bitmap *PackBitmap) body() []byte {
+	header := packBitmapHeader{
+		Signature:    packBitmapSignature,
+		Version:      1,
+		Options:      bitmap.options,
+		EntryCount:   uint32(len(bitmap.commits)),
+		PackfileSha1: bitmap.packfileSha1,
+	}
+
+	buffer := new(bytes.Buffer)
+	if err := binary.Write(buffer, binary.BigEndian, header); err != nil {
+		core.Die(err)
+	}
+	for _, b := range bitmap.types {
+		buffer.ReadFrom(b.Reader())
+	}
+
+	for i, commit := range bitmap.commits {
+		best := encodeEWAHBitmap(commit.bitmap)
+		xorOffset := 0
+		for offset := 1; offset <= packBitmapXorSearch && offset <= i; offset++ {
+			candidate := encodeEWAHBitmap(commit.bitmap.Xor(bitmap.commits[i-offset].bitmap))
+			if len(candidate) < len(best) {
+				best, xorOffset = candidate, offset
+			}
+		}
+
+		entry := packBitmapEntryHeader{commit.position, uint8(xorOffset), commit.flags}
+		if err := binary.Write(buffer, binary.BigEndian, entry); err != nil {
+			core.Die(err)
+		}
+		buffer.Write(best)
+	}
+
+	if bitmap.options&PackBitmapHashCache != 0 {
+		if err := binary.Write(buffer, binary.BigEndian, bitmap.hashCache); err != nil {
+			core.Die(err)
+		}
+	}
+	return buffer.Bytes()
+}
+
+func encodeEWAHBitmap(b *EWAHBitmap) []byte {
+	buffer := new(bytes.Buffer)
+	buffer.ReadFrom(b.Reader())
+	return buffer.Bytes()
+}
+
+// Decode reads a pack bitmap from reader. The trailing checksum is verified,
+// and bitmaps that were XORed with others are resolved. A lookup table, which
+// only serves to load bitmaps lazily, is skipped, and is not written back out
+// by Reader.
+func (bitmap *PackBitmap) Decode(reader io.Reader) error {
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	} else if len(content) < sha1.Size {
+		return io.ErrUnexpectedEOF
+	}
+
+	body, trailer := content[:len(content)-sha1.Size], content[len(content)-sha1.Size:]
+	if actual := core.Sha1(sha1.Sum(body)); actual != core.Sha1FromByteSlice(trailer) {
+		return Errorf("pack bitmap SHA-1 is %s, expected %s", actual, core.Sha1FromByteSlice(trailer))
+	}
+	bitmap.sha1 = core.Sha1FromByteSlice(trailer)
+
+	r := bytes.NewReader(body)
+	header := packBitmapHeader{}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return err
+	} else if header.Signature != packBitmapSignature {
+		return Errorf("%v is not a valid pack bitmap header", header.Signature)
+	} else if header.Version != 1 {
+		return Errorf("%d is not a valid pack bitmap version", header.Version)
+	} else if header.Options&PackBitmapFullDAG == 0 {
+		return Errorf("pack bitmap options %#x are not supported", header.Options)
+	}
+	bitmap.options = header.Options &^ packBitmapLookupTable
+	bitmap.packfileSha1 = header.PackfileSha1
+
+	for i := range bitmap.types {
+		bitmap.types[i] = &EWAHBitmap{}
+		if err := bitmap.types[i].Decode(r); err != nil {
+			return err
+		}
+	}
+
+	bitmap.commits = make([]packBitmapCommit, header.EntryCount)
+	bitmap.byPosition = make(map[uint32]int, header.EntryCount)
+	for i := range bitmap.commits {
+		entry := packBitmapEntryHeader{}
+		if err := binary.Read(r, binary.BigEndian, &entry); err != nil {
+			return err
+		}
+		b := &EWAHBitmap{}
+		if err := b.Decode(r); err != nil {
+			return err
+		}
+
+		if entry.XorOffset > 0 {
+			if entry.XorOffset > packBitmapMaxXorOffset || int(entry.XorOffset) > i {
+				return Errorf("pack bitmap entry %d has invalid XOR offset %d", i, entry.XorOffset)
+			}
+			b = b.Xor(bitmap.commits[i-int(entry.XorOffset)].bitmap)
+		}
+		if _, exists := bitmap.byPosition[entry.Position]; exists {
+			return Errorf("pack bitmap has more than one bitmap for position %d", entry.Position)
+		}
+		bitmap.commits[i] = packBitmapCommit{entry.Position, entry.Flags, b}
+		bitmap.byPosition[entry.Position] = i
+	}
+
+	remaining := r.Len()
+	if header.Options&packBitmapLookupTable != 0 {
+		remaining -= int(header.EntryCount) * (4 + 8 + 4)
+	}
+	if header.Options&PackBitmapHashCache != 0 {
+		if remaining < 0 || remaining%4 != 0 {
+			return Errorf("pack bitmap hash cache of %d bytes is malformed", remaining)
+		}
+		bitmap.hashCache = make([]uint32, remaining/4)
+		if err := binary.Read(r, binary.BigEndian, bitmap.hashCache); err != nil {
+			return err
+		}
+	} else if remaining != 0 {
+		return Errorf("pack bitmap has %d unexpected bytes at its end", remaining)
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package format
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/kourge/ggit/core"
+)
+
+func TestPackBitmap(t *testing.T) {
+	types := map[PackedObjectType]*EWAHBitmap{
+		PackedObjectCommit: NewEWAHBitmap(0, 1, 2),
+		PackedObjectTree:   NewEWAHBitmap(3, 4),
+		PackedObjectBlob:   NewEWAHBitmap(5, 6, 7),
+		PackedObjectTag:    NewEWAHBitmap(),
+	}
+	commits := map[uint32]*EWAHBitmap{
+		2: NewEWAHBitmap(0, 3, 5),
+		0: NewEWAHBitmap(0, 1, 3, 4, 5, 6),
+		1: NewEWAHBitmap(0, 1, 2, 3, 4, 5, 6, 7),
+	}
+	for i := 64; i < 64*40; i += 3 {
+		for _, b := range commits {
+			b.Set(i)
+		}
+	}
+	hashCache := []uint32{1, 2, 3, 4, 5, 6, 7, 8}
+
+	bitmap, err := NewPackBitmap(core.Sha1{0xab}, types, commits, hashCache)
+	if err != nil {
+		t.Fatalf("NewPackBitmap() returned error %v", err)
+	}
+
+	encoded := new(bytes.Buffer)
+	encoded.ReadFrom(bitmap.Reader())
+	decoded := &PackBitmap{}
+	if err := decoded.Decode(bytes.NewReader(encoded.Bytes())); err != nil {
+		t.Fatalf("bitmap.Decode() returned error %v", err)
+	}
+
+	if decoded.Options() != PackBitmapFullDAG|PackBitmapHashCache {
+		t.Errorf("bitmap.Options() = %#x", decoded.Options())
+	}
+	if decoded.PackfileSha1() != (core.Sha1{0xab}) {
+		t.Errorf("bitmap.PackfileSha1() = %s", decoded.PackfileSha1())
+	}
+	if !reflect.DeepEqual(decoded.Commits(), []uint32{0, 1, 2}) {
+		t.Errorf("bitmap.Commits() = %v", decoded.Commits())
+	}
+	if !reflect.DeepEqual(decoded.HashCache(), hashCache) {
+		t.Errorf("bitmap.HashCache() = %v", decoded.HashCache())
+	}
+
+	positions := func(b *EWAHBitmap) []int {
+		var result []int
+		b.Each(func(i int) { result = append(result, i) })
+		return result
+	}
+	for typ, expected := range types {
+		if actual := decoded.TypeBitmap(typ); actual == nil || !reflect.DeepEqual(positions(actual), positions(expected)) {
+			t.Errorf("bitmap.TypeBitmap(%v) = %v", typ, actual)
+		}
+	}
+	for pos, expected := range commits {
+		if actual, found := decoded.Bitmap(pos); !found || !reflect.DeepEqual(positions(actual), positions(expected)) {
+			t.Errorf("bitmap.Bitmap(%d) = %v, %v", pos, actual, found)
+		}
+	}
+	if _, found := decoded.Bitmap(3); found {
+		t.Errorf("bitmap.Bitmap(3) found a bitmap")
+	}
+
+	// The bitmaps of the three commits share most of their bits, so all but
+	// the first should have been XORed with the one before it.
+	raw := 0
+	for _, b := range commits {
+		raw += len(encodeEWAHBitmap(b))
+	}
+	if encoded.Len() >= raw {
+		t.Errorf("encoded bitmap takes up %d bytes, more than its %d bytes of raw bitmaps", encoded.Len(), raw)
+	}
+
+	if _, err := NewPackBitmap(core.Sha1{}, map[PackedObjectType]*EWAHBitmap{PackedObjectCommit: NewEWAHBitmap()}, nil, nil); err == nil {
+		t.Errorf("NewPackBitmap() with missing type bitmaps returned no error")
+	}
+}
+
+func TestPack_ReachableObjects(t *testing.T) {
+	pack, cleanup := _writeFixturePack(t, _fixturePackObjects(), PackOptions{})
+	defer cleanup()
+
+	rev, err := pack.ReverseIndex()
+	if err != nil {
+		t.Fatalf("pack.ReverseIndex() returned error %v", err)
+	}
+
+	// Pretend that the first object of the pack is a commit from which the
+	// objects at the first three positions in the pack are reachable.
+	var indexPositions []int
+	reachable := NewEWAHBitmap()
+	for packPos := uint32(0); packPos < 3; packPos++ {
+		reachable.Set(int(packPos))
+		indexPos, _ := rev.IndexPosition(packPos)
+		indexPositions = append(indexPositions, int(indexPos))
+	}
+	tipPos, _ := rev.IndexPosition(0)
+	tip := pack.Index().EntryAt(int(tipPos)).Sha1()
+
+	bitmap, err := NewPackBitmap(rev.PackfileSha1(), map[PackedObjectType]*EWAHBitmap{
+		PackedObjectCommit: NewEWAHBitmap(),
+		PackedObjectTree:   NewEWAHBitmap(),
+		PackedObjectBlob:   NewEWAHBitmap(0, 1, 2),
+		PackedObjectTag:    NewEWAHBitmap(),
+	}, map[uint32]*EWAHBitmap{tipPos: reachable}, nil)
+	if err != nil {
+		t.Fatalf("NewPackBitmap() returned error %v", err)
+	}
+
+	if _, err := pack.ReachableObjects([]core.Sha1{tip}); !os.IsNotExist(err) {
+		t.Errorf("pack.ReachableObjects() without a bitmap returned error %v", err)
+	}
+
+	file, err := os.Create(pack.basePath() + ".bitmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(file, bitmap.Reader())
+	file.Close()
+
+	objects, err := pack.ReachableObjects([]core.Sha1{tip})
+	if err != nil {
+		t.Fatalf("pack.ReachableObjects() returned error %v", err)
+	}
+	sort.Ints(indexPositions)
+	var expected []core.Sha1
+	for _, pos := range indexPositions {
+		expected = append(expected, pack.Index().EntryAt(pos).Sha1())
+	}
+	if !reflect.DeepEqual(objects, expected) {
+		t.Errorf("pack.ReachableObjects() = %v, want %v", objects, expected)
+	}
+
+	other := expected[0]
+	if other == tip {
+		other = expected[1]
+	}
+	if _, err := pack.ReachableObjects([]core.Sha1{other}); err == nil {
+		t.Errorf("pack.ReachableObjects() of an object without a bitmap returned no error")
+	}
+	if _, err := pack.ReachableObjects([]core.Sha1{{1}}); err != ErrObjectNotFoundInPack {
+		t.Errorf("pack.ReachableObjects() returned error %v, want %v", err, ErrObjectNotFoundInPack)
+	}
+}
@@ -4,41 +4,77 @@ import (
 	"bufio"
 	"bytes"
 	"io"
+	"sort"
 	"strings"
 
 	"github.com/kourge/ggit/core"
 )
 
+// packedRefsHeaderPrefix starts the optional first line of a packed refs file,
+// which lists the traits of the file separated by spaces.
+const packedRefsHeaderPrefix = "# pack-refs with:"
+
 // The PackedRefs type represents the on-disk format used when multiple loose
 // refs are packed into one file.
+//
+// Refs holds the refs in the order that they appear in the file. The remaining
+// fields are the traits that the header of the file advertises.
+// Peeled is a bool that indicates that every ref under "refs/tags/" that
+// points to an annotated tag is followed by its peeled value. FullyPeeled is a
+// bool that indicates the same for every ref, regardless of its name. Sorted
+// is a bool that indicates that Refs is sorted by name, in which case lookups
+// use a binary search.
 type PackedRefs struct {
-	Refs []Ref
+	Refs        []Ref
+	Peeled      bool
+	FullyPeeled bool
+	Sorted      bool
 }
 
 var _ core.EncodeDecoder = &PackedRefs{}
 
-// Reader returns an io.Reader that yields refs in packed form.
+// Reader returns an io.Reader that yields refs in packed form. The header
+// lists the traits that are set, and is omitted if none is. Every ref with a
+// peeled value is followed by a line of the form "^<sha1>".
 func (p *PackedRefs) Reader() io.Reader {
-	readers := make([]io.Reader, len(p.Refs)*4+1)
-	readers[0] = strings.NewReader("# pack-refs with: peeled fully-peeled \n")
-
-	for i, ref := range p.Refs {
-		readers[i*4+1] = ref.Sha1.Reader()
-		readers[i*4+2] = bytes.NewReader([]byte{' '})
-		readers[i*4+3] = strings.NewReader(ref.Name)
-		readers[i*4+4] = bytes.NewReader([]byte{'\n'})
+	buffer := new(bytes.Buffer)
+	if p.Peeled || p.FullyPeeled || p.Sorted {
+		buffer.WriteString(packedRefsHeaderPrefix)
+		for _, trait := range []struct {
+			name string
+			set  bool
+		}{{"peeled", p.Peeled}, {"fully-peeled", p.FullyPeeled}, {"sorted", p.Sorted}} {
+			if trait.set {
+				buffer.WriteString(" " + trait.name)
+			}
+		}
+		buffer.WriteString(" \n")
 	}
 
-	return io.MultiReader(readers...)
+	for _, ref := range p.Refs {
+		buffer.WriteString(ref.Sha1.String())
+		buffer.WriteByte(' ')
+		buffer.WriteString(ref.Name)
+		buffer.WriteByte('\n')
+		if !ref.Peeled.IsEmpty() {
+			buffer.WriteByte('^')
+			buffer.WriteString(ref.Peeled.String())
+			buffer.WriteByte('\n')
+		}
+	}
+
+	return buffer
 }
 
 // Decode reads from an io.Reader, presumably a packed refs file, and parses
-// all the refs within it, ignoring comments and whitespace.
+// all the refs within it, ignoring comments and whitespace. A line of the form
+// "^<sha1>" records the peeled value of the ref on the line before it. The
+// traits are taken from the header, if the first line is one.
 func (p *PackedRefs) Decode(reader io.Reader) error {
 	r := bufio.NewReader(reader)
 
 	atEof := false
-	for !atEof {
+	for first := true; !atEof; first = false {
 		line, err := r.ReadString('\n')
 		if err == io.EOF {
 			atEof = true
@@ -46,6 +82,20 @@ func (p *PackedRefs) Decode(reader io.Reader) error {
 			return err
 		}
 
+		if first && strings.HasPrefix(line, packedRefsHeaderPrefix) {
+			for _, trait := range strings.Fields(line[len(packedRefsHeaderPrefix):]) {
+				switch trait {
+				case "peeled":
+					p.Peeled = true
+				case "fully-peeled":
+					p.FullyPeeled = true
+				case "sorted":
+					p.Sorted = true
+				}
+			}
+			continue
+		}
+
 		if pound := strings.IndexRune(line, '#'); pound != -1 {
 			line = line[:pound]
 		}
@@ -55,7 +105,22 @@ func (p *PackedRefs) Decode(reader io.Reader) error {
 			continue
 		}
 
+		if strings.HasPrefix(line, "^") {
+			if len(p.Refs) == 0 {
+				return Errorf("peeled line without a ref in packed refs: %s", line)
+			}
+			peeled, err := core.Sha1FromString(line[1:])
+			if err != nil {
+				return err
+			}
+			p.Refs[len(p.Refs)-1].Peeled = peeled
+			continue
+		}
+
 		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return Errorf("malformed line in packed refs: %s", line)
+		}
 		sha1, name := parts[0], parts[1]
 
 		hash, err := core.Sha1FromString(sha1)
@@ -69,14 +134,44 @@ func (p *PackedRefs) Decode(reader io.Reader) error {
 	return nil
 }
 
-// Sha1ForName returns the Sha1 of the packed ref with the given name, or an
-// empty Sha1 if no packed ref of that name exists.
-func (p *PackedRefs) Sha1ForName(name string) core.Sha1 {
+// Lookup returns the packed ref with the given name and whether it exists.
+// When Sorted is true, a binary search is used, and otherwise every ref is
+// visited in turn.
+func (p *PackedRefs) Lookup(name string) (Ref, bool) {
+	if p.Sorted {
+		i := sort.Search(len(p.Refs), func(i int) bool {
+			return p.Refs[i].Name >= name
+		})
+		if i < len(p.Refs) && p.Refs[i].Name == name {
+			return p.Refs[i], true
+		}
+		return Ref{}, false
+	}
+
 	for _, ref := range p.Refs {
 		if ref.Name == name {
-			return ref.Sha1
+			return ref, true
 		}
 	}
+	return Ref{}, false
+}
+
+// Sha1ForName returns the Sha1 of the packed ref with the given name, or an
+// empty Sha1 if no packed ref of that name exists.
+func (p *PackedRefs) Sha1ForName(name string) core.Sha1 {
+	ref, _ := p.Lookup(name)
+	return ref.Sha1
+}
+
+// IsPeeled returns true if the peeled value of the given packed ref is known,
+// i.e. if either it has one or the traits guarantee that it would have one if
+// it pointed to an annotated tag.
+func (p *PackedRefs) IsPeeled(ref Ref) bool {
+	return !ref.Peeled.IsEmpty() || p.FullyPeeled || (p.Peeled && strings.HasPrefix(ref.Name, "refs/tags/"))
+}
 
-	return core.Sha1{}
+// Sort sorts Refs by name and sets Sorted.
+func (p *PackedRefs) Sort() {
+	sort.Sort(RefSlice(p.Refs))
+	p.Sorted = true
 }
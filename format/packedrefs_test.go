@@ -0,0 +1,77 @@
+package format
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// A packed-refs file written by `git pack-refs --all`.
+const _fixturePackedRefs = "# pack-refs with: peeled fully-peeled sorted \n" +
+	"5bb15ae450a1401f37f692eb7aa6fa202100bfd5 refs/heads/master\n" +
+	"b3cb0d27c4556a8a176930754ff9de2842424130 refs/heads/topic\n" +
+	"5bb15ae450a1401f37f692eb7aa6fa202100bfd5 refs/tags/light\n" +
+	"5523147ced53ad4d79415615897384c127b98746 refs/tags/v1\n" +
+	"^5bb15ae450a1401f37f692eb7aa6fa202100bfd5\n"
+
+func TestPackedRefs_Decode(t *testing.T) {
+	packed := &PackedRefs{}
+	if err := packed.Decode(strings.NewReader(_fixturePackedRefs)); err != nil {
+		t.Fatalf("Decode() returned error %v", err)
+	}
+
+	if !packed.Peeled || !packed.FullyPeeled || !packed.Sorted {
+		t.Errorf("Decode() yielded traits %+v", packed)
+	}
+	if len(packed.Refs) != 4 {
+		t.Fatalf("Decode() yielded %d refs, want 4", len(packed.Refs))
+	}
+
+	v1, ok := packed.Lookup("refs/tags/v1")
+	if !ok || v1.Sha1.String() != "5523147ced53ad4d79415615897384c127b98746" ||
+		v1.Peeled.String() != "5bb15ae450a1401f37f692eb7aa6fa202100bfd5" {
+		t.Errorf("Lookup() = %+v, %v", v1, ok)
+	}
+	if light, ok := packed.Lookup("refs/tags/light"); !ok || !light.Peeled.IsEmpty() || !packed.IsPeeled(light) {
+		t.Errorf("Lookup() = %+v, %v", light, ok)
+	}
+	for _, name := range []string{"refs/heads/maste", "refs/heads/master/x", "refs/tags/v2", ""} {
+		if _, ok := packed.Lookup(name); ok {
+			t.Errorf("Lookup(%q) found a ref", name)
+		}
+	}
+
+	encoded := new(bytes.Buffer)
+	encoded.ReadFrom(packed.Reader())
+	if encoded.String() != _fixturePackedRefs {
+		t.Errorf("Reader() yielded %q, want %q", encoded.String(), _fixturePackedRefs)
+	}
+
+	if err := (&PackedRefs{}).Decode(strings.NewReader("^5bb15ae450a1401f37f692eb7aa6fa202100bfd5\n")); err == nil {
+		t.Errorf("Decode() of a stray peeled line returned no error")
+	}
+}
+
+func TestPackedRefs_Sort(t *testing.T) {
+	packed := &PackedRefs{}
+	packed.Decode(strings.NewReader(_fixturePackedRefs))
+	packed.Refs[0], packed.Refs[3] = packed.Refs[3], packed.Refs[0]
+	packed.Sorted, packed.Peeled = false, false
+
+	if _, ok := packed.Lookup("refs/heads/master"); !ok {
+		t.Errorf("Lookup() of an unsorted ref failed")
+	}
+	if packed.IsPeeled(packed.Refs[1]) != true {
+		t.Errorf("IsPeeled() = false with the fully-peeled trait")
+	}
+
+	packed.Sort()
+	for i, name := range []string{"refs/heads/master", "refs/heads/topic", "refs/tags/light", "refs/tags/v1"} {
+		if packed.Refs[i].Name != name {
+			t.Errorf("Sort() put %s at %d, want %s", packed.Refs[i].Name, i, name)
+		}
+	}
+	if !packed.Sorted {
+		t.Errorf("Sort() did not set Sorted")
+	}
+}
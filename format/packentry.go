@@ -19,29 +19,24 @@ type packEntryHeader struct {
 	packEntryFlag
 }
 
+// A packEntry is a single entry within a pack file. If the entry is a delta,
+// then data holds the delta instructions rather than the object content, and
+// the base is identified by either baseOffset or baseSha1, depending on the
+// kind of delta.
 type packEntry struct {
 	packEntryHeader
-	size  *util.VariableSize
-	data  []byte
-	sha1  core.Sha1
-	crc32 core.Crc32
+	size       *util.VariableSize
+	data       []byte
+	sha1       core.Sha1
+	crc32      core.Crc32
+	baseOffset int64
+	baseSha1   core.Sha1
 }
 
 var _ core.Object = &packEntry{}
 
 func (entry *packEntry) Type() string {
-	switch entry.packEntryHeader.Type() {
-	case PackedObjectCommit:
-		return "commit"
-	case PackedObjectTree:
-		return "tree"
-	case PackedObjectBlob:
-		return "blob"
-	case PackedObjectTag:
-		return "tag"
-	default:
-		return "unknown"
-	}
+	return entry.packEntryHeader.Type().String()
 }
 
 func (entry *packEntry) Size() int {
@@ -53,10 +48,38 @@ func (entry *packEntry) Reader() io.Reader {
 }
 
 func (entry *packEntry) Decode(reader io.Reader) error {
+	if err := entry.decodeHeader(reader); err != nil {
+		return err
+	}
+
+	r, err := zlib.NewReader(reader)
+	if err != nil {
+		return err
+	}
+
+	buffer := new(bytes.Buffer)
+	crc32 := crc32.NewIEEE()
+	w := io.MultiWriter(buffer, crc32)
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+
+	entry.crc32 = core.Crc32FromByteSlice(crc32.Sum(nil))
+	entry.data = buffer.Bytes()
+
+	return nil
+}
+
+// decodeHeader reads the type and size of this entry and, if it is a delta,
+// the location of its base, leaving the reader at the start of the compressed
+// data.
+func (entry *packEntry) decodeHeader(reader io.Reader) error {
 	header := &(entry.packEntryHeader)
-	if err := binary.Read(reader, binary.BigEndian, header); err != nil {
+	var flag byte
+	if err := binary.Read(reader, binary.BigEndian, &flag); err != nil {
 		return err
 	}
+	header.packEntryFlag = packEntryFlag(flag)
 
 	size0 := header.Size0()
 	entry.size = util.NewVariableSize(0)
@@ -72,34 +95,57 @@ func (entry *packEntry) Decode(reader io.Reader) error {
 
 	switch entry.packEntryHeader.Type() {
 	case PackedObjectCommit, PackedObjectTree, PackedObjectBlob, PackedObjectTag:
-		if entry.size.Cmp(BigMaxInt64) > 0 {
-			return Errorf("pack object size %d is too big", entry.size)
-		}
-		r, err := zlib.NewReader(reader)
+	case PackedObjectOfsDelta:
+		offset, err := decodePackEntryBaseOffset(reader)
 		if err != nil {
 			return err
 		}
-
-		buffer := new(bytes.Buffer)
-		crc32 := crc32.NewIEEE()
-		w := io.MultiWriter(buffer, crc32)
-		if _, err := io.Copy(w, r); err != nil {
+		entry.baseOffset = offset
+	case PackedObjectRefDelta:
+		if _, err := io.ReadFull(reader, entry.baseSha1[:]); err != nil {
 			return err
 		}
-
-		entry.crc32 = core.Crc32FromByteSlice(crc32.Sum(nil))
-		entry.data = buffer.Bytes()
-	case PackedObjectOfsDelta:
-		return Errorf("ofs_delta objects not yet supported")
-	case PackedObjectRefDelta:
-		return Errorf("ref_delta objects not yet supported")
 	default:
-		return Errorf("%d is not a valid pack object type", entry.Type())
+		return Errorf("%d is not a valid pack object type", entry.packEntryHeader.Type())
+	}
+
+	if entry.size.Cmp(BigMaxInt64) > 0 {
+		return Errorf("pack object size %d is too big", entry.size)
 	}
 
 	return nil
 }
 
+// IsDelta returns true if this entry is either an OFS_DELTA or a REF_DELTA.
+func (entry *packEntry) IsDelta() bool {
+	t := entry.packEntryHeader.Type()
+	return t == PackedObjectOfsDelta || t == PackedObjectRefDelta
+}
+
+// decodePackEntryBaseOffset reads the negative offset that follows the header
+// of an OFS_DELTA entry. Unlike the sizes used elsewhere in pack files, this
+// number is stored most significant part first, and each continuation adds one
+// to the value so far so that no two encodings represent the same offset.
+func decodePackEntryBaseOffset(reader io.Reader) (int64, error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(reader, b); err != nil {
+		return 0, err
+	}
+
+	offset := int64(b[0] & 0x7f)
+	for b[0]&0x80 != 0 {
+		if _, err := io.ReadFull(reader, b); err != nil {
+			return 0, err
+		}
+		offset = ((offset + 1) << 7) | int64(b[0]&0x7f)
+		if offset < 0 {
+			return 0, Errorf("ofs_delta base offset overflows")
+		}
+	}
+
+	return offset, nil
+}
+
 type packEntryFlag byte
 
 func (f packEntryFlag) SizeExtension() bool {
@@ -125,3 +171,43 @@ const (
 	PackedObjectOfsDelta PackedObjectType = 6
 	PackedObjectRefDelta PackedObjectType = 7
 )
+
+// String returns the object type name that corresponds to this packed object
+// type, such as "blob" or "commit". Delta types yield "ofs_delta" and
+// "ref_delta", and any other value yields "unknown".
+func (t PackedObjectType) String() string {
+	switch t {
+	case PackedObjectCommit:
+		return "commit"
+	case PackedObjectTree:
+		return "tree"
+	case PackedObjectBlob:
+		return "blob"
+	case PackedObjectTag:
+		return "tag"
+	case PackedObjectOfsDelta:
+		return "ofs_delta"
+	case PackedObjectRefDelta:
+		return "ref_delta"
+	default:
+		return "unknown"
+	}
+}
+
+// PackedObjectTypeFromString returns the packed object type that corresponds
+// to the given object type name. PackedObjectNone is returned if the name is
+// not that of a blob, tree, commit, or tag.
+func PackedObjectTypeFromString(s string) PackedObjectType {
+	switch s {
+	case "commit":
+		return PackedObjectCommit
+	case "tree":
+		return PackedObjectTree
+	case "blob":
+		return PackedObjectBlob
+	case "tag":
+		return PackedObjectTag
+	default:
+		return PackedObjectNone
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"os"
 
 	"github.com/kourge/ggit/core"
 )
@@ -32,6 +33,15 @@ type PackIndex interface {
 
 	// Entries returns a slice that represents entries in the pack index.
 	Entries() []PackIndexEntry
+
+	// Position returns the position of the given object in the pack index,
+	// where entries are sorted by SHA-1. If the given object is not found in
+	// the pack index, the bool returned is false.
+	Position(object core.Sha1) (int, bool)
+
+	// EntryAt returns the entry at the given position in the pack index. If the
+	// position is out of range, nil is returned.
+	EntryAt(pos int) PackIndexEntry
 }
 
 // PackIndexEntry represents an entry within a pack index. An entry is consisted
@@ -46,6 +56,16 @@ type PackIndexEntry interface {
 	Crc32() core.Crc32
 }
 
+// entryOffset returns the offset of the given pack index entry, or an error if
+// the pack index records an offset for it that is out of range.
+func entryOffset(entry PackIndexEntry) (int64, error) {
+	offset := entry.Offset()
+	if offset < 0 {
+		return 0, Errorf("pack index records an invalid offset for %s", entry.Sha1())
+	}
+	return offset, nil
+}
+
 // PackIndexFromReader examines the given io.Reader, detects the right version
 // of the pack index format, and decodes the stream.
 func PackIndexFromReader(reader io.Reader) (idx PackIndex, err error) {
@@ -62,3 +82,65 @@ func PackIndexFromReader(reader io.Reader) (idx PackIndex, err error) {
 	err = idx.Decode(r)
 	return idx, err
 }
+
+// PackIndexAtPath opens the pack index at the given path and detects the right
+// version of the pack index format. A v2 pack index is mapped into memory, as
+// is done by PackIndexV2AtPath, and must be closed once it is no longer used;
+// a v1 pack index is decoded in its entirety.
+func PackIndexAtPath(path string) (PackIndex, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(packIndexV2HeaderMagic))
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return nil, err
+	} else if bytes.Equal(magic, packIndexV2HeaderMagic[:]) {
+		return PackIndexV2AtPath(path)
+	}
+
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	return PackIndexFromReader(file)
+}
+
+// packIndexEntry is a plain PackIndexEntry, used when building a pack index
+// from scratch.
+type packIndexEntry struct {
+	offset int64
+	sha1   core.Sha1
+	crc32  core.Crc32
+}
+
+var _ PackIndexEntry = packIndexEntry{}
+
+func (e packIndexEntry) Offset() int64 {
+	return e.offset
+}
+
+func (e packIndexEntry) Sha1() core.Sha1 {
+	return e.sha1
+}
+
+func (e packIndexEntry) Crc32() core.Crc32 {
+	return e.crc32
+}
+
+// A slice type that satisfies sort.Interface so that pack index entries can be
+// sorted by the SHA-1 of their objects.
+type packIndexEntriesBySha1 []PackIndexEntry
+
+func (entries packIndexEntriesBySha1) Len() int {
+	return len(entries)
+}
+
+func (entries packIndexEntriesBySha1) Less(i, j int) bool {
+	return entries[i].Sha1().Compare(entries[j].Sha1()) < 0
+}
+
+func (entries packIndexEntriesBySha1) Swap(i, j int) {
+	entries[i], entries[j] = entries[j], entries[i]
+}
@@ -109,6 +109,16 @@ func (idx *PackIndexV1) Objects() []core.Sha1 {
 // given object. If the given object is not found in the pack index, nil is
 // returned.
 func (idx *PackIndexV1) EntryForSha1(object core.Sha1) PackIndexEntry {
+	pos, found := idx.Position(object)
+	if !found {
+		return nil
+	}
+	return packIndexV1EntryWrapper{&idx.entries[pos]}
+}
+
+// Position returns the position of the given object in the pack index. If the
+// given object is not found in the pack index, the bool returned is false.
+func (idx *PackIndexV1) Position(object core.Sha1) (int, bool) {
 	lower := 0
 	if object[0] != 0x00 {
 		lower = int(idx.Fanout[int(object[0])-1])
@@ -120,11 +130,20 @@ func (idx *PackIndexV1) EntryForSha1(object core.Sha1) PackIndexEntry {
 		return entries[i].ObjectName.Compare(object) >= 0
 	})
 
-	if pos == len(entries) {
-		return nil
+	if pos == len(entries) || entries[pos].ObjectName != object {
+		return 0, false
 	}
 
-	return packIndexV1EntryWrapper{&idx.entries[pos+lower]}
+	return pos + lower, true
+}
+
+// EntryAt returns the entry at the given position in the pack index. If the
+// position is out of range, nil is returned.
+func (idx *PackIndexV1) EntryAt(pos int) PackIndexEntry {
+	if pos < 0 || pos >= len(idx.entries) {
+		return nil
+	}
+	return packIndexV1EntryWrapper{&idx.entries[pos]}
 }
 
 // Entries returns a slice that represents entries in this pack index.
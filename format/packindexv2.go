@@ -1,11 +1,15 @@
 package format
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/binary"
 	"errors"
 	"io"
+	"io/ioutil"
+	"os"
 	"sort"
+	"sync"
 
 	"github.com/kourge/ggit/core"
 )
@@ -38,26 +42,148 @@ type packIndexV2Header struct {
 // For more information on the pack and pack index format, see:
 // https://www.kernel.org/pub/software/scm/git/docs/technical/pack-format.txt
 type PackIndexV2 struct {
-	packIndexV2Header
-	objectNames    []core.Sha1 // sorted
-	crc32Checksums []core.Crc32
-	offsets        []uint32
-	higherOffsets  []uint64
-	packfileSha1   core.Sha1
-	packIndexSha1  core.Sha1
+	// data holds the pack index in its on-disk format, including the trailing
+	// checksums. The other byte slices are views into it.
+	data          []byte
+	mapped        bool
+	fanout        []byte
+	objectNames   []byte
+	crc32s        []byte
+	offsets       []byte
+	higherOffsets []byte
+
+	objects     []core.Sha1
+	objectsOnce sync.Once
 }
 
 var _ PackIndex = &PackIndexV2{}
+var _ core.Encoder = &PackIndexV2{}
+
+// NewPackIndexV2 builds a v2 pack index out of the given entries, which need
+// not be sorted, and the SHA-1 checksum of the pack file that they describe.
+func NewPackIndexV2(entries []PackIndexEntry, packfileSha1 core.Sha1) *PackIndexV2 {
+	sorted := make([]PackIndexEntry, len(entries))
+	copy(sorted, entries)
+	sort.Sort(packIndexEntriesBySha1(sorted))
+
+	header := packIndexV2Header{Magic: packIndexV2HeaderMagic, Version: 2}
+	objectNames := make([]core.Sha1, len(sorted))
+	crc32s := make([]core.Crc32, len(sorted))
+	offsets := make([]uint32, len(sorted))
+	var higherOffsets []uint64
+
+	for i, entry := range sorted {
+		sha := entry.Sha1()
+		objectNames[i] = sha
+		crc32s[i] = entry.Crc32()
+		header.Fanout[sha[0]] += 1
+
+		if offset := entry.Offset(); offset > 0x7fffffff {
+			offsets[i] = uint32(len(higherOffsets)) | (1 << 31)
+			higherOffsets = append(higherOffsets, uint64(offset))
+		} else {
+			offsets[i] = uint32(offset)
+		}
+	}
 
-func (idx *PackIndexV2) Decode(reader io.Reader) error {
-	hash := sha1.New()
-	r := io.TeeReader(reader, hash)
+	for i := 1; i < len(header.Fanout); i++ {
+		header.Fanout[i] += header.Fanout[i-1]
+	}
+
+	buffer := new(bytes.Buffer)
+	for _, data := range []interface{}{header, objectNames, crc32s, offsets, higherOffsets, packfileSha1} {
+		if err := binary.Write(buffer, binary.BigEndian, data); err != nil {
+			core.Die(err)
+		}
+	}
+	hash := sha1.Sum(buffer.Bytes())
+	buffer.Write(hash[:])
+
+	idx := &PackIndexV2{}
+	if err := idx.parse(buffer.Bytes(), true); err != nil {
+		core.Die(err)
+	}
+	return idx
+}
+
+// PackIndexV2AtPath maps the v2 pack index at the given path into memory, so
+// that its fan-out table, object names, and offsets are read straight from the
+// file rather than being copied, and only the parts of it that are looked at
+// are ever read from disk. On platforms that do not support memory mapping,
+// the file is read into memory instead. As in Git, only the size of the file
+// is checked against the number of objects that it claims to hold: neither its
+// checksum nor its offsets are verified, as that would mean reading all of it.
+// A 64-bit offset that is out of range is reported by Offset as -1. Use Decode
+// to verify a pack index in full. The pack index must be closed with Close
+// once it is no longer used, after which none of its methods may be called.
+func PackIndexV2AtPath(path string) (*PackIndexV2, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
 
-	header := &(idx.packIndexV2Header)
-	if err := binary.Read(r, binary.BigEndian, header); err != nil {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, err := mmapFile(file, int(info.Size()))
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &PackIndexV2{mapped: true}
+	if err := idx.parse(data, false); err != nil {
+		munmap(data)
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Close releases the memory that this pack index was mapped into, if it was
+// opened with PackIndexV2AtPath. Otherwise, nothing happens.
+func (idx *PackIndexV2) Close() error {
+	if !idx.mapped {
+		return nil
+	}
+	idx.mapped = false
+	return munmap(idx.data)
+}
+
+// Reader returns an io.Reader that yields this pack index in its on-disk
+// format, followed by the SHA-1 checksum of everything before it.
+func (idx *PackIndexV2) Reader() io.Reader {
+	return bytes.NewReader(idx.data)
+}
+
+// PackfileSha1 returns the SHA-1 checksum of the pack file that this pack
+// index describes.
+func (idx *PackIndexV2) PackfileSha1() core.Sha1 {
+	return core.Sha1FromByteSlice(idx.data[len(idx.data)-2*sha1.Size : len(idx.data)-sha1.Size])
+}
+
+// Decode reads a v2 pack index from reader in its entirety. The checksum of
+// the pack index is verified.
+func (idx *PackIndexV2) Decode(reader io.Reader) error {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
 		return err
 	}
+	return idx.parse(data, true)
+}
 
+// parse checks that data is a well-formed v2 pack index and sets up the views
+// into it. Unless verify is true, the table of 64-bit offsets is taken to be
+// whatever lies between the 32-bit offsets and the trailing checksums, and
+// neither the offsets nor the checksum are checked.
+func (idx *PackIndexV2) parse(data []byte, verify bool) error {
+	headerSize := binary.Size(packIndexV2Header{})
+	if len(data) < headerSize+2*sha1.Size {
+		return io.ErrUnexpectedEOF
+	}
+
+	header := &packIndexV2Header{}
+	binary.Read(bytes.NewReader(data[:headerSize]), binary.BigEndian, header)
 	if header.Magic != packIndexV2HeaderMagic {
 		return errors.New("invalid pack index header")
 	}
@@ -65,81 +191,135 @@ func (idx *PackIndexV2) Decode(reader io.Reader) error {
 		return Errorf("unexpected pack index header version %d", header.Version)
 	}
 
-	entryCount := int(header.Fanout[255])
+	idx.data = data
+	idx.fanout = data[8:headerSize]
+	entryCount := int(idx.fanoutAt(255))
 
-	idx.objectNames = make([]core.Sha1, entryCount)
-	if err := binary.Read(r, binary.BigEndian, idx.objectNames); err != nil {
-		return err
+	section := func(start, size int) ([]byte, error) {
+		if size < 0 || start+size > len(data)-2*sha1.Size {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return data[start : start+size], nil
 	}
 
-	idx.crc32Checksums = make([]core.Crc32, entryCount)
-	if err := binary.Read(r, binary.BigEndian, idx.crc32Checksums); err != nil {
+	var err error
+	start := headerSize
+	if idx.objectNames, err = section(start, entryCount*sha1.Size); err != nil {
 		return err
 	}
-
-	idx.offsets = make([]uint32, entryCount)
-	if err := binary.Read(r, binary.BigEndian, idx.offsets); err != nil {
+	start += len(idx.objectNames)
+	if idx.crc32s, err = section(start, entryCount*4); err != nil {
+		return err
+	}
+	start += len(idx.crc32s)
+	if idx.offsets, err = section(start, entryCount*4); err != nil {
 		return err
 	}
+	start += len(idx.offsets)
 
-	higherOffsetCount := 0
-	for _, offset := range idx.offsets {
-		if (offset >> 31) == 1 {
-			higherOffsetCount += 1
+	if !verify {
+		idx.higherOffsets = data[start : len(data)-2*sha1.Size]
+		if len(idx.higherOffsets)%8 != 0 || (len(idx.higherOffsets) > 0 && len(idx.higherOffsets) > (entryCount-1)*8) {
+			return Errorf("pack index has %d unexpected bytes", len(idx.higherOffsets))
 		}
+		return nil
 	}
 
-	idx.higherOffsets = make([]uint64, higherOffsetCount)
-	if err := binary.Read(r, binary.BigEndian, idx.higherOffsets); err != nil {
-		return err
+	higherOffsetCount, highestIndex := 0, -1
+	for i := 0; i < entryCount; i++ {
+		if offset := binary.BigEndian.Uint32(idx.offsets[4*i:]); (offset >> 31) == 1 {
+			higherOffsetCount += 1
+			if index := int(offset & 0x7fffffff); index > highestIndex {
+				highestIndex = index
+			}
+		}
 	}
-
-	if err := binary.Read(r, binary.BigEndian, &idx.packfileSha1); err != nil {
-		return err
+	if highestIndex >= higherOffsetCount {
+		return Errorf("pack index refers to 64-bit offset %d of %d", highestIndex, higherOffsetCount)
 	}
-
-	if err := binary.Read(reader, binary.BigEndian, &idx.packIndexSha1); err != nil {
+	if idx.higherOffsets, err = section(start, higherOffsetCount*8); err != nil {
 		return err
 	}
+	start += len(idx.higherOffsets)
+	if start+2*sha1.Size != len(data) {
+		return Errorf("pack index has %d unexpected bytes", len(data)-start-2*sha1.Size)
+	}
 
-	actualSha1 := core.Sha1FromByteSlice(hash.Sum(nil))
-	if idx.packIndexSha1 != actualSha1 {
-		return Errorf("pack index SHA-1 is %s, expected %s", actualSha1, idx.packIndexSha1)
+	expected := core.Sha1FromByteSlice(data[len(data)-sha1.Size:])
+	actualSha1 := core.Sha1(sha1.Sum(data[:len(data)-sha1.Size]))
+	if expected != actualSha1 {
+		return Errorf("pack index SHA-1 is %s, expected %s", actualSha1, expected)
 	}
 
 	return nil
 }
 
+func (idx *PackIndexV2) fanoutAt(i int) uint32 {
+	return binary.BigEndian.Uint32(idx.fanout[4*i:])
+}
+
+func (idx *PackIndexV2) objectNameAt(pos int) []byte {
+	return idx.objectNames[pos*sha1.Size : (pos+1)*sha1.Size]
+}
+
 // Size returns the number of objects present in the pack index.
 func (idx *PackIndexV2) Size() int {
-	return len(idx.objectNames)
+	return len(idx.objectNames) / sha1.Size
 }
 
-// Objects returns a sorted slice of objects present in the pack index.
+// Objects returns a sorted slice of objects present in the pack index. The
+// slice is only built the first time it is asked for.
 func (idx *PackIndexV2) Objects() []core.Sha1 {
-	return idx.objectNames
+	idx.objectsOnce.Do(func() {
+		idx.objects = make([]core.Sha1, idx.Size())
+		for i := range idx.objects {
+			copy(idx.objects[i][:], idx.objectNameAt(i))
+		}
+	})
+	return idx.objects
 }
 
 // EntryForSha1 returns a PackIndexEntry whose Sha1() value matches that of the
 // given object. If the given object is not found in the pack index, nil is
 // returned.
 func (idx *PackIndexV2) EntryForSha1(object core.Sha1) PackIndexEntry {
+	pos, found := idx.Position(object)
+	if !found {
+		return nil
+	}
+	return packIndexV2Entry{idx: idx, pos: pos}
+}
+
+// Position returns the position of the given object in the pack index. If the
+// given object is not found in the pack index, the bool returned is false.
+func (idx *PackIndexV2) Position(object core.Sha1) (int, bool) {
 	lower := 0
 	if object[0] != 0x00 {
-		lower = int(idx.Fanout[int(object[0])-1])
+		lower = int(idx.fanoutAt(int(object[0]) - 1))
+	}
+	upper := int(idx.fanoutAt(int(object[0])))
+	if upper > idx.Size() || lower > upper {
+		return 0, false
 	}
-	upper := int(idx.Fanout[int(object[0])])
-	entries := idx.objectNames[lower:upper]
 
-	pos := sort.Search(len(entries), func(i int) bool {
-		return entries[i].Compare(object) >= 0
+	pos := sort.Search(upper-lower, func(i int) bool {
+		return bytes.Compare(idx.objectNameAt(lower+i), object[:]) >= 0
 	})
 
-	if pos == len(entries) {
-		return nil
+	if pos == upper-lower || !bytes.Equal(idx.objectNameAt(lower+pos), object[:]) {
+		return 0, false
 	}
 
-	return packIndexV2Entry{idx: idx, pos: pos + lower}
+	return pos + lower, true
+}
+
+// EntryAt returns the entry at the given position in the pack index. If the
+// position is out of range, nil is returned.
+func (idx *PackIndexV2) EntryAt(pos int) PackIndexEntry {
+	if pos < 0 || pos >= idx.Size() {
+		return nil
+	}
+	return packIndexV2Entry{idx: idx, pos: pos}
 }
 
 type packIndexV2Entry struct {
@@ -149,21 +329,33 @@ type packIndexV2Entry struct {
 
 var _ PackIndexEntry = packIndexV2Entry{}
 
+// Offset returns the offset of this entry into the pack. If the most
+// significant bit of the 32-bit offset is set, the remaining bits are an index
+// into the table of 64-bit offsets. If that index is out of range, which can
+// only happen with a pack index that was not verified, -1 is returned.
 func (e packIndexV2Entry) Offset() int64 {
-	return int64(e.idx.offsets[e.pos])
+	offset := binary.BigEndian.Uint32(e.idx.offsets[4*e.pos:])
+	if (offset >> 31) == 1 {
+		i := int(offset & 0x7fffffff)
+		if i >= len(e.idx.higherOffsets)/8 {
+			return -1
+		}
+		return int64(binary.BigEndian.Uint64(e.idx.higherOffsets[8*i:]))
+	}
+	return int64(offset)
 }
 
 func (e packIndexV2Entry) Sha1() core.Sha1 {
-	return e.idx.objectNames[e.pos]
+	return core.Sha1FromByteSlice(e.idx.objectNameAt(e.pos))
 }
 
 func (e packIndexV2Entry) Crc32() core.Crc32 {
-	return e.idx.crc32Checksums[e.pos]
+	return core.Crc32FromByteSlice(e.idx.crc32s[4*e.pos : 4*e.pos+4])
 }
 
 // Entries returns a slice that represents entries in this pack index.
 func (idx *PackIndexV2) Entries() []PackIndexEntry {
-	entries := make([]PackIndexEntry, len(idx.objectNames))
+	entries := make([]PackIndexEntry, idx.Size())
 	for i := 0; i < len(entries); i++ {
 		entries[i] = packIndexV2Entry{idx: idx, pos: i}
 	}
@@ -0,0 +1,209 @@
+package format
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/kourge/ggit/core"
+)
+
+var packReverseIndexSignature = [4]byte{'R', 'I', 'D', 'X'}
+
+type packReverseIndexHeader struct {
+	Signature [4]byte // == packReverseIndexSignature
+	Version   uint32  // == 1
+	HashId    uint32  // == 1, i.e. SHA-1
+}
+
+// A PackReverseIndex is the in-memory representation of a pack reverse index,
+// the ".rev" file that accompanies a pack and its index. Whereas a pack index
+// lists objects by SHA-1, a reverse index lists them in pack order, that is,
+// by their offset within the pack. Each object is given as its position in
+// the pack index, so the two together map the position of an object in the
+// pack to its SHA-1 and offset, and the other way around. This makes it cheap
+// to find where the entry after a given entry starts, and thereby how many
+// bytes an entry takes up in the pack.
+//
+// For more information on the reverse index format, see:
+// https://git-scm.com/docs/gitformat-pack#_pack_rev_files_have_the_format
+type PackReverseIndex struct {
+	positions    []uint32
+	packfileSha1 core.Sha1
+	sha1         core.Sha1
+}
+
+var _ core.EncodeDecoder = &PackReverseIndex{}
+
+// PackReverseIndexAtPath attempts to open the file at the given path and
+// decode it into a PackReverseIndex.
+func PackReverseIndexAtPath(path string) (*PackReverseIndex, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rev := &PackReverseIndex{}
+	if err := rev.Decode(file); err != nil {
+		return nil, err
+	}
+
+	return rev, nil
+}
+
+// NewPackReverseIndex builds the reverse index of the pack that is described
+// by the given pack index and whose checksum is packfileSha1.
+func NewPackReverseIndex(idx PackIndex, packfileSha1 core.Sha1) *PackReverseIndex {
+	order := packIndexPositionsByOffset{
+		positions: make([]uint32, idx.Size()),
+		offsets:   make([]int64, idx.Size()),
+	}
+	for i := range order.positions {
+		order.positions[i] = uint32(i)
+		order.offsets[i] = idx.EntryAt(i).Offset()
+	}
+	sort.Sort(order)
+
+	rev := &PackReverseIndex{positions: order.positions, packfileSha1: packfileSha1}
+	rev.sha1 = sha1.Sum(rev.body())
+	return rev
+}
+
+// Size returns the number of objects in this reverse index.
+func (rev *PackReverseIndex) Size() int {
+	return len(rev.positions)
+}
+
+// PackfileSha1 returns the SHA-1 checksum of the pack file that this reverse
+// index describes.
+func (rev *PackReverseIndex) PackfileSha1() core.Sha1 {
+	return rev.packfileSha1
+}
+
+// IndexPosition returns the position in the pack index of the object at the
+// given position in pack order.
+func (rev *PackReverseIndex) IndexPosition(packPos uint32) (uint32, error) {
+	if packPos >= uint32(len(rev.positions)) {
+		return 0, Errorf("%d is not a valid pack position", packPos)
+	}
+	return rev.positions[packPos], nil
+}
+
+// PackPosition returns the position in pack order of the object at the given
+// offset, using the given pack index to look up offsets. If no object starts
+// at that offset, the bool returned is false.
+func (rev *PackReverseIndex) PackPosition(idx PackIndex, offset int64) (uint32, bool) {
+	i := sort.Search(len(rev.positions), func(i int) bool {
+		return idx.EntryAt(int(rev.positions[i])).Offset() >= offset
+	})
+	if i < len(rev.positions) && idx.EntryAt(int(rev.positions[i])).Offset() == offset {
+		return uint32(i), true
+	}
+	return 0, false
+}
+
+// EntrySize returns the number of bytes that the entry at the given position in
+// pack order takes up in a pack of the given size, including its header. The
+// entry ends where the next entry begins, or where the trailing checksum of
+// the pack begins if it is the last entry.
+func (rev *PackReverseIndex) EntrySize(idx PackIndex, packPos uint32, packSize int64) (int64, error) {
+	indexPos, err := rev.IndexPosition(packPos)
+	if err != nil {
+		return 0, err
+	}
+
+	start, err := entryOffset(idx.EntryAt(int(indexPos)))
+	if err != nil {
+		return 0, err
+	}
+	end := packSize - sha1.Size
+	if next := packPos + 1; next < uint32(len(rev.positions)) {
+		if end, err = entryOffset(idx.EntryAt(int(rev.positions[next]))); err != nil {
+			return 0, err
+		}
+	}
+	return end - start, nil
+}
+
+// Reader returns an io.Reader that yields this reverse index in its on-disk
+// format, followed by its checksum.
+func (rev *PackReverseIndex) Reader() io.Reader {
+	body := rev.body()
+	hash := sha1.Sum(body)
+	return io.MultiReader(bytes.NewReader(body), bytes.NewReader(hash[:]))
+}
+
+// body serializes everything in this reverse index up to and including the
+// pack file checksum.
+func (rev *PackReverseIndex) body() []byte {
+	header := packReverseIndexHeader{packReverseIndexSignature, 1, 1}
+	buffer := new(bytes.Buffer)
+	for _, data := range []interface{}{header, rev.positions, rev.packfileSha1} {
+		if err := binary.Write(buffer, binary.BigEndian, data); err != nil {
+			core.Die(err)
+		}
+	}
+	return buffer.Bytes()
+}
+
+// Decode reads a reverse index from reader. The trailing checksum is verified.
+// The number of objects is implied by the size of the file.
+func (rev *PackReverseIndex) Decode(reader io.Reader) error {
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	header := packReverseIndexHeader{}
+	headerSize := binary.Size(header)
+	if len(content) < headerSize+2*sha1.Size || (len(content)-headerSize)%4 != 0 {
+		return Errorf("reverse index of %d bytes is malformed", len(content))
+	}
+
+	body, trailer := content[:len(content)-sha1.Size], content[len(content)-sha1.Size:]
+	if actual := core.Sha1(sha1.Sum(body)); actual != core.Sha1FromByteSlice(trailer) {
+		return Errorf("reverse index SHA-1 is %s, expected %s", actual, core.Sha1FromByteSlice(trailer))
+	}
+	rev.sha1 = core.Sha1FromByteSlice(trailer)
+
+	r := bytes.NewReader(body)
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return err
+	} else if header.Signature != packReverseIndexSignature {
+		return Errorf("%v is not a valid reverse index header", header.Signature)
+	} else if header.Version != 1 {
+		return Errorf("%d is not a valid reverse index version", header.Version)
+	} else if header.HashId != 1 {
+		return Errorf("reverse index hash id %d is not supported", header.HashId)
+	}
+
+	rev.positions = make([]uint32, (len(body)-headerSize-sha1.Size)/4)
+	if err := binary.Read(r, binary.BigEndian, rev.positions); err != nil {
+		return err
+	}
+	return binary.Read(r, binary.BigEndian, &rev.packfileSha1)
+}
+
+// packIndexPositionsByOffset satisfies sort.Interface so that positions in a
+// pack index can be sorted by the offsets of their objects.
+type packIndexPositionsByOffset struct {
+	positions []uint32
+	offsets   []int64
+}
+
+func (order packIndexPositionsByOffset) Len() int {
+	return len(order.positions)
+}
+
+func (order packIndexPositionsByOffset) Less(i, j int) bool {
+	return order.offsets[order.positions[i]] < order.offsets[order.positions[j]]
+}
+
+func (order packIndexPositionsByOffset) Swap(i, j int) {
+	order.positions[i], order.positions[j] = order.positions[j], order.positions[i]
+}
@@ -0,0 +1,109 @@
+package format
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"testing"
+
+	"github.com/kourge/ggit/core"
+)
+
+func TestPackReverseIndex(t *testing.T) {
+	a, b, c := core.Sha1{0x10}, core.Sha1{0x20}, core.Sha1{0x30}
+	idx := _fixturePackIndex(map[core.Sha1]int64{a: 300, b: 12, c: 1 << 33})
+	rev := NewPackReverseIndex(idx, core.Sha1{0xab})
+
+	decoded := &PackReverseIndex{}
+	if err := decoded.Decode(rev.Reader()); err != nil {
+		t.Fatalf("rev.Decode() returned error %v", err)
+	} else if decoded.PackfileSha1() != (core.Sha1{0xab}) {
+		t.Errorf("rev.PackfileSha1() = %s", decoded.PackfileSha1())
+	}
+
+	for packPos, expected := range []uint32{1, 0, 2} {
+		if actual, err := decoded.IndexPosition(uint32(packPos)); err != nil || actual != expected {
+			t.Errorf("rev.IndexPosition(%d) = %d, %v, want %d", packPos, actual, err, expected)
+		}
+	}
+	if _, err := decoded.IndexPosition(3); err == nil {
+		t.Errorf("rev.IndexPosition(3) returned no error")
+	}
+
+	if pos, found := decoded.PackPosition(idx, 300); !found || pos != 1 {
+		t.Errorf("rev.PackPosition(300) = %d, %v, want 1", pos, found)
+	}
+	if _, found := decoded.PackPosition(idx, 301); found {
+		t.Errorf("rev.PackPosition(301) found an object")
+	}
+	if size, err := decoded.EntrySize(idx, 0, 1<<34); err != nil || size != 288 {
+		t.Errorf("rev.EntrySize(0) = %d, %v, want 288", size, err)
+	}
+	if size, err := decoded.EntrySize(idx, 2, 1<<34); err != nil || size != 1<<33-20 {
+		t.Errorf("rev.EntrySize(2) = %d, %v, want %d", size, err, int64(1<<33-20))
+	}
+
+	corrupt := new(bytes.Buffer)
+	corrupt.ReadFrom(rev.Reader())
+	corrupt.Bytes()[12] ^= 0xff
+	if err := decoded.Decode(corrupt); err == nil {
+		t.Errorf("rev.Decode() of a corrupt reverse index returned no error")
+	}
+}
+
+func TestPack_EntrySizeAt(t *testing.T) {
+	pack, cleanup := _writeFixturePack(t, _fixturePackObjects(), PackOptions{})
+	defer cleanup()
+
+	info, err := os.Stat(pack.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total := int64(0)
+	for _, entry := range pack.Index().Entries() {
+		size, err := pack.EntrySizeAt(entry.Offset())
+		if err != nil {
+			t.Fatalf("pack.EntrySizeAt(%d) returned error %v", entry.Offset(), err)
+		}
+		total += size
+	}
+	if expected := info.Size() - 12 - 20; total != expected {
+		t.Errorf("entries take up %d bytes in total, want %d", total, expected)
+	}
+
+	if _, err := pack.EntrySizeAt(1); err != ErrObjectNotFoundInPack {
+		t.Errorf("pack.EntrySizeAt(1) returned error %v, want %v", err, ErrObjectNotFoundInPack)
+	}
+}
+
+func TestPack_ReverseIndex_OutOfRange(t *testing.T) {
+	pack, cleanup := _writeFixturePack(t, _fixturePackObjects(), PackOptions{})
+	defer cleanup()
+
+	packfileSha1, _, err := pack.trailer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	positions := make([]uint32, pack.Index().Size())
+	positions[0] = uint32(len(positions))
+	rev := &PackReverseIndex{positions: positions, packfileSha1: packfileSha1}
+	rev.sha1 = sha1.Sum(rev.body())
+
+	file, err := os.Create(pack.basePath() + ".rev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.ReadFrom(rev.Reader())
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pack.ReverseIndex(); err == nil {
+		t.Errorf("pack.ReverseIndex() with an out-of-range position returned no error")
+	}
+	if _, err := pack.EntrySizeAt(12); err == nil {
+		t.Errorf("pack.EntrySizeAt() with an out-of-range reverse index returned no error")
+	}
+}
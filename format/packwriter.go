@@ -0,0 +1,305 @@
+package format
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/kourge/ggit/core"
+)
+
+const (
+	DefaultPackWindow = 10
+	DefaultPackDepth  = 50
+)
+
+// PackOptions contains all the possible options for WritePack.
+//
+// Window is the number of preceding objects that are considered as delta bases
+// for each object. If left unspecified as zero, it defaults to
+// DefaultPackWindow. A negative Window disables delta compression entirely.
+//
+// Depth is the maximum length of a delta chain. If left unspecified as zero, it
+// defaults to DefaultPackDepth.
+//
+// CompressionLevel is the zlib compression level used for each entry. If left
+// unspecified as zero, zlib.DefaultCompression is used.
+type PackOptions struct {
+	Window           int
+	Depth            int
+	CompressionLevel int
+}
+
+// packWriterObject is an object that is about to be written to a pack, along
+// with the delta chosen for it, if any.
+type packWriterObject struct {
+	sha1  core.Sha1
+	t     PackedObjectType
+	data  []byte
+	base  *packWriterObject
+	delta []byte
+	depth int
+	pos   int64
+}
+
+// WritePack writes the given objects to w in the pack file format and returns
+// the v2 pack index that describes the pack that was written. Duplicate
+// objects are only written once.
+//
+// Delta bases are chosen in the same spirit as `git pack-objects`: objects are
+// sorted by type and then by descending size, and each object is compared
+// against the objects within a sliding window that precedes it. The smallest
+// delta that is at most half as large as the object itself is kept. Because
+// bases always precede the objects deltified against them, every delta is
+// written as an OFS_DELTA.
+func WritePack(w io.Writer, objects []core.Object, o PackOptions) (*PackIndexV2, error) {
+	if o.Window == 0 {
+		o.Window = DefaultPackWindow
+	}
+	if o.Depth == 0 {
+		o.Depth = DefaultPackDepth
+	}
+	if o.CompressionLevel == 0 {
+		o.CompressionLevel = zlib.DefaultCompression
+	}
+
+	items, err := collectPackWriterObjects(objects)
+	if err != nil {
+		return nil, err
+	}
+	sort.Stable(packWriterObjectsByTypeAndSize(items))
+	findPackDeltas(items, o.Window, o.Depth)
+
+	hash := sha1.New()
+	counter := &countingWriter{W: io.MultiWriter(w, hash)}
+
+	header := packHeader{packHeaderSignature, 2, uint32(len(items))}
+	if err := binary.Write(counter, binary.BigEndian, header); err != nil {
+		return nil, err
+	}
+
+	entries := make([]PackIndexEntry, len(items))
+	for i, item := range items {
+		item.pos = counter.N
+		crc := crc32.NewIEEE()
+		entryWriter := io.MultiWriter(counter, crc)
+
+		t, data := item.t, item.data
+		if item.base != nil {
+			t, data = PackedObjectOfsDelta, item.delta
+		}
+
+		header := encodePackEntryHeader(t, int64(len(data)))
+		if item.base != nil {
+			header = append(header, encodePackEntryBaseOffset(item.pos-item.base.pos)...)
+		}
+		if _, err := entryWriter.Write(header); err != nil {
+			return nil, err
+		}
+
+		z, err := zlib.NewWriterLevel(entryWriter, o.CompressionLevel)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := z.Write(data); err != nil {
+			return nil, err
+		}
+		if err := z.Close(); err != nil {
+			return nil, err
+		}
+
+		entries[i] = packIndexEntry{
+			offset: item.pos,
+			sha1:   item.sha1,
+			crc32:  core.Crc32FromByteSlice(crc.Sum(nil)),
+		}
+	}
+
+	packfileSha1 := core.Sha1FromByteSlice(hash.Sum(nil))
+	if _, err := w.Write(packfileSha1[:]); err != nil {
+		return nil, err
+	}
+
+	return NewPackIndexV2(entries, packfileSha1), nil
+}
+
+// WriteObjectPack writes a pack that holds a single object of the given type
+// and size, whose content is read from r, and returns the v2 pack index that
+// describes it. Exactly size bytes are read from r, and an error is returned
+// if r yields fewer. The content is hashed and compressed as it is read, so it
+// is never held in memory in its entirety, which makes this suitable for
+// objects that are too big to be deltified anyway. Only the CompressionLevel
+// of the given options is taken into account.
+func WriteObjectPack(w io.Writer, t PackedObjectType, size int64, r io.Reader, o PackOptions) (*PackIndexV2, error) {
+	if o.CompressionLevel == 0 {
+		o.CompressionLevel = zlib.DefaultCompression
+	}
+
+	hash := sha1.New()
+	counter := &countingWriter{W: io.MultiWriter(w, hash)}
+
+	header := packHeader{packHeaderSignature, 2, 1}
+	if err := binary.Write(counter, binary.BigEndian, header); err != nil {
+		return nil, err
+	}
+
+	pos := counter.N
+	crc := crc32.NewIEEE()
+	entryWriter := io.MultiWriter(counter, crc)
+	if _, err := entryWriter.Write(encodePackEntryHeader(t, size)); err != nil {
+		return nil, err
+	}
+
+	z, err := zlib.NewWriterLevel(entryWriter, o.CompressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	objectHash := sha1.New()
+	fmt.Fprintf(objectHash, "%s %d\x00", t, size)
+	if _, err := io.CopyN(io.MultiWriter(z, objectHash), r, size); err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+
+	packfileSha1 := core.Sha1FromByteSlice(hash.Sum(nil))
+	if _, err := w.Write(packfileSha1[:]); err != nil {
+		return nil, err
+	}
+
+	entry := packIndexEntry{
+		offset: pos,
+		sha1:   core.Sha1FromByteSlice(objectHash.Sum(nil)),
+		crc32:  core.Crc32FromByteSlice(crc.Sum(nil)),
+	}
+	return NewPackIndexV2([]PackIndexEntry{entry}, packfileSha1), nil
+}
+
+// collectPackWriterObjects reads the content of each object and drops any
+// object that has already been seen.
+func collectPackWriterObjects(objects []core.Object) ([]*packWriterObject, error) {
+	items := make([]*packWriterObject, 0, len(objects))
+	seen := make(map[core.Sha1]bool)
+
+	for _, object := range objects {
+		t := PackedObjectTypeFromString(object.Type())
+		if t == PackedObjectNone {
+			return nil, Errorf("%s objects cannot be packed", object.Type())
+		}
+
+		sha := core.NewStream(object).Hash()
+		if seen[sha] {
+			continue
+		}
+		seen[sha] = true
+
+		buffer := new(bytes.Buffer)
+		if _, err := buffer.ReadFrom(object.Reader()); err != nil {
+			return nil, err
+		}
+
+		items = append(items, &packWriterObject{sha1: sha, t: t, data: buffer.Bytes()})
+	}
+
+	return items, nil
+}
+
+// findPackDeltas picks a delta base for each object among the window objects
+// of the same type that precede it. Objects already at the maximum depth are
+// never picked as bases.
+func findPackDeltas(items []*packWriterObject, window, depth int) {
+	if window < 0 {
+		return
+	}
+
+	for i, item := range items {
+		maxSize := len(item.data)/2 - 20
+		if maxSize <= 0 {
+			continue
+		}
+
+		for j := i - 1; j >= 0 && j >= i-window; j-- {
+			base := items[j]
+			if base.t != item.t {
+				break
+			} else if base.depth >= depth {
+				continue
+			}
+
+			delta := ComputeDelta(base.data, item.data)
+			if len(delta) < maxSize {
+				item.base, item.delta, item.depth = base, delta, base.depth+1
+				maxSize = len(delta)
+			}
+		}
+	}
+}
+
+// encodePackEntryHeader encodes the type and size of a pack entry. The first
+// byte holds the type and the lowest four bits of the size, and each
+// subsequent byte holds the next seven bits.
+func encodePackEntryHeader(t PackedObjectType, size int64) []byte {
+	c := byte(t)<<4 | byte(size&0xf)
+	size >>= 4
+
+	header := make([]byte, 0, 10)
+	for size != 0 {
+		header = append(header, c|0x80)
+		c = byte(size & 0x7f)
+		size >>= 7
+	}
+	return append(header, c)
+}
+
+// encodePackEntryBaseOffset is the inverse of decodePackEntryBaseOffset.
+func encodePackEntryBaseOffset(offset int64) []byte {
+	buffer := make([]byte, 10)
+	pos := len(buffer) - 1
+	buffer[pos] = byte(offset & 0x7f)
+	for offset >>= 7; offset != 0; offset >>= 7 {
+		offset -= 1
+		pos -= 1
+		buffer[pos] = byte(offset&0x7f) | 0x80
+	}
+	return buffer[pos:]
+}
+
+// countingWriter writes to W and keeps track of the number of bytes written.
+type countingWriter struct {
+	W io.Writer
+	N int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.W.Write(p)
+	c.N += int64(n)
+	return n, err
+}
+
+// A slice type that satisfies sort.Interface so that objects to be packed are
+// ordered by type and then by descending size, which places likely delta bases
+// in front of the objects that can be deltified against them.
+type packWriterObjectsByTypeAndSize []*packWriterObject
+
+func (items packWriterObjectsByTypeAndSize) Len() int {
+	return len(items)
+}
+
+func (items packWriterObjectsByTypeAndSize) Less(i, j int) bool {
+	if items[i].t != items[j].t {
+		return items[i].t < items[j].t
+	}
+	return len(items[i].data) > len(items[j].data)
+}
+
+func (items packWriterObjectsByTypeAndSize) Swap(i, j int) {
+	items[i], items[j] = items[j], items[i]
+}
@@ -0,0 +1,263 @@
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kourge/ggit/core"
+)
+
+func _fixturePackObjects() []core.Object {
+	var objects []core.Object
+	content := new(bytes.Buffer)
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(content, "line %d of a file that keeps growing\n", i)
+		objects = append(objects, &core.Blob{Content: append([]byte(nil), content.Bytes()...)})
+	}
+	objects = append(objects, &core.Blob{Content: []byte{}})
+	objects = append(objects, &core.Blob{Content: []byte("tiny")})
+	objects = append(objects, objects[0])
+	return objects
+}
+
+// _writeFixturePack writes the given objects into a pack and its index inside
+// a temporary directory and returns an opened Pack.
+func _writeFixturePack(t *testing.T, objects []core.Object, o PackOptions) (*Pack, func()) {
+	dir, err := ioutil.TempDir("", "ggit-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	packFile, err := os.Create(filepath.Join(dir, "fixture.pack"))
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	defer packFile.Close()
+
+	idx, err := WritePack(packFile, objects, o)
+	if err != nil {
+		cleanup()
+		t.Fatalf("WritePack() returned error %v", err)
+	}
+
+	idxFile, err := os.Create(filepath.Join(dir, "fixture.idx"))
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	defer idxFile.Close()
+	if _, err := io.Copy(idxFile, idx.Reader()); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	pack := NewPack(packFile.Name())
+	if err := pack.Open(); err != nil {
+		cleanup()
+		t.Fatalf("pack.Open() returned error %v", err)
+	}
+
+	return pack, func() {
+		pack.Close()
+		cleanup()
+	}
+}
+
+func TestWritePack(t *testing.T) {
+	objects := _fixturePackObjects()
+	pack, cleanup := _writeFixturePack(t, objects, PackOptions{})
+	defer cleanup()
+
+	if actual, expected := len(pack.Objects()), len(objects)-1; actual != expected {
+		t.Errorf("pack has %d objects, want %d", actual, expected)
+	}
+
+	deltas := 0
+	for _, object := range objects {
+		sha := core.NewStream(object).Hash()
+		actual, err := pack.ObjectBySha1(sha)
+		if err != nil {
+			t.Errorf("pack.ObjectBySha1(%s) returned error %v", sha, err)
+			continue
+		}
+		if hash := core.NewStream(actual).Hash(); hash != sha {
+			t.Errorf("pack.ObjectBySha1(%s) yielded object %s", sha, hash)
+		}
+
+		if entry, err := pack.entryAt(pack.idx.EntryForSha1(sha).Offset()); err != nil {
+			t.Errorf("pack.entryAt() returned error %v", err)
+		} else if entry.IsDelta() {
+			deltas += 1
+		}
+	}
+
+	if deltas == 0 {
+		t.Errorf("WritePack() did not produce any deltas")
+	}
+}
+
+func TestWritePack_NoDeltas(t *testing.T) {
+	objects := _fixturePackObjects()
+	pack, cleanup := _writeFixturePack(t, objects, PackOptions{Window: -1})
+	defer cleanup()
+
+	for _, sha := range pack.Objects() {
+		if entry, err := pack.entryAt(pack.idx.EntryForSha1(sha).Offset()); err != nil {
+			t.Errorf("pack.entryAt() returned error %v", err)
+		} else if entry.IsDelta() {
+			t.Errorf("object %s was deltified with a negative window", sha)
+		}
+	}
+}
+
+func TestWritePack_Depth(t *testing.T) {
+	objects := _fixturePackObjects()
+	pack, cleanup := _writeFixturePack(t, objects, PackOptions{Depth: 2})
+	defer cleanup()
+
+	for _, sha := range pack.Objects() {
+		depth := 0
+		offset := pack.idx.EntryForSha1(sha).Offset()
+		for {
+			entry, err := pack.entryAt(offset)
+			if err != nil {
+				t.Fatalf("pack.entryAt() returned error %v", err)
+			} else if !entry.IsDelta() {
+				break
+			}
+			depth += 1
+			offset -= entry.baseOffset
+		}
+
+		if depth > 2 {
+			t.Errorf("object %s has a delta chain of length %d, want at most 2", sha, depth)
+		}
+	}
+}
+
+func TestWriteObjectPack(t *testing.T) {
+	blob := &core.Blob{Content: bytes.Repeat([]byte("big file\n"), 10000)}
+	buffer := new(bytes.Buffer)
+	idx, err := WriteObjectPack(buffer, PackedObjectBlob, int64(blob.Size()), blob.Reader(), PackOptions{})
+	if err != nil {
+		t.Fatalf("WriteObjectPack() returned error %v", err)
+	}
+
+	sha := core.NewStream(blob).Hash()
+	if objects := idx.Objects(); len(objects) != 1 || objects[0] != sha {
+		t.Errorf("WriteObjectPack() indexed %v, want %v", objects, sha)
+	}
+	if _, err := WriteObjectPack(new(bytes.Buffer), PackedObjectBlob, int64(blob.Size()+1), blob.Reader(), PackOptions{}); err != io.ErrUnexpectedEOF {
+		t.Errorf("WriteObjectPack() of a short reader returned error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+
+	dir, err := ioutil.TempDir("", "ggit-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	idxBuffer := new(bytes.Buffer)
+	if _, err := idxBuffer.ReadFrom(idx.Reader()); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string][]byte{"big.pack": buffer.Bytes(), "big.idx": idxBuffer.Bytes()} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, os.FileMode(0644)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pack := NewPack(filepath.Join(dir, "big.pack"))
+	if err := pack.Open(); err != nil {
+		t.Fatalf("pack.Open() returned error %v", err)
+	}
+	defer pack.Close()
+	if object, err := pack.ObjectBySha1(sha); err != nil || core.NewStream(object).Hash() != sha {
+		t.Errorf("pack.ObjectBySha1(%s) = %v, %v", sha, object, err)
+	}
+}
+
+func TestPackIndexV2_Reader(t *testing.T) {
+	entries := []PackIndexEntry{
+		packIndexEntry{12, core.Sha1{0xff, 0x01}, core.Crc32{1, 2, 3, 4}},
+		packIndexEntry{1 << 33, core.Sha1{0x00, 0x02}, core.Crc32{5, 6, 7, 8}},
+		packIndexEntry{345, core.Sha1{0x7f, 0x03}, core.Crc32{9, 10, 11, 12}},
+	}
+	idx := NewPackIndexV2(entries, core.Sha1{0xaa})
+
+	decoded := &PackIndexV2{}
+	if err := decoded.Decode(idx.Reader()); err != nil {
+		t.Fatalf("idx.Decode() returned error %v", err)
+	}
+
+	for _, expected := range entries {
+		actual := decoded.EntryForSha1(expected.Sha1())
+		if actual == nil {
+			t.Errorf("idx.EntryForSha1(%s) = nil", expected.Sha1())
+		} else if actual.Offset() != expected.Offset() || actual.Crc32() != expected.Crc32() {
+			t.Errorf("idx.EntryForSha1(%s) = %v, want %v", expected.Sha1(), actual, expected)
+		}
+	}
+
+	if actual := decoded.EntryForSha1(core.Sha1{0x7f, 0x04}); actual != nil {
+		t.Errorf("idx.EntryForSha1() found an object that does not exist")
+	}
+}
+
+func TestPackIndexV2AtPath(t *testing.T) {
+	pack, cleanup := _writeFixturePack(t, _fixturePackObjects(), PackOptions{})
+	defer cleanup()
+
+	idx, err := PackIndexV2AtPath(pack.IndexPath())
+	if err != nil {
+		t.Fatalf("PackIndexV2AtPath() returned error %v", err)
+	}
+	defer idx.Close()
+
+	expected := pack.Index()
+	if idx.Size() != expected.Size() {
+		t.Fatalf("idx.Size() = %d, want %d", idx.Size(), expected.Size())
+	}
+	for i, sha := range expected.Objects() {
+		entry := idx.EntryForSha1(sha)
+		if entry == nil || entry.Offset() != expected.EntryAt(i).Offset() || entry.Crc32() != expected.EntryAt(i).Crc32() {
+			t.Errorf("idx.EntryForSha1(%s) = %v, want %v", sha, entry, expected.EntryAt(i))
+		}
+		if pos, found := idx.Position(sha); !found || pos != i {
+			t.Errorf("idx.Position(%s) = %d, %v, want %d", sha, pos, found, i)
+		}
+	}
+
+	content, err := ioutil.ReadFile(pack.IndexPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := filepath.Join(filepath.Dir(pack.IndexPath()), "corrupt.idx")
+
+	// The checksum is only verified when the pack index is decoded in full.
+	content[len(content)-1] ^= 0xff
+	if err := ioutil.WriteFile(corrupt, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if idx, err := PackIndexV2AtPath(corrupt); err != nil {
+		t.Errorf("PackIndexV2AtPath() of a pack index with a bad checksum returned error %v", err)
+	} else {
+		idx.Close()
+	}
+	if err := (&PackIndexV2{}).Decode(bytes.NewReader(content)); err == nil {
+		t.Errorf("Decode() of a pack index with a bad checksum returned no error")
+	}
+
+	if err := ioutil.WriteFile(corrupt, content[:len(content)-4], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PackIndexV2AtPath(corrupt); err == nil {
+		t.Errorf("PackIndexV2AtPath() of a truncated pack index returned no error")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/kourge/ggit/core"
 )
@@ -24,9 +25,15 @@ var (
 // which it points. This is a loose ref, but if it is not updated often, it ends
 // up wasting space. Git may take multiple refs and store them all in the same
 // file, producing packed refs.
+//
+// Peeled is the object that the ref ultimately points to if Sha1 names an
+// annotated tag, i.e. the first object found by following tags that is not a
+// tag itself. It is a zero SHA-1 if Sha1 does not name a tag or if the peeled
+// value is not known.
 type Ref struct {
-	Name string
-	Sha1 core.Sha1
+	Name   string
+	Sha1   core.Sha1
+	Peeled core.Sha1
 }
 
 var _ core.Decoder = &Ref{}
@@ -61,3 +68,46 @@ func (ref *Ref) Decode(reader io.Reader) error {
 
 	return nil
 }
+
+// ValidateRefName returns ErrInvalidRef if the given name cannot be used as the
+// full name of a ref, following the rules of `git check-ref-format`. A name
+// must either start with "refs/" or be a root ref such as HEAD or FETCH_HEAD,
+// i.e. consist of uppercase letters and underscores and be HEAD or end with
+// "_HEAD". No component may be empty, start with a dot or end with ".lock".
+// The name may not contain "..", "@{", ASCII control characters, spaces, or
+// any of "~^:?*[\", nor end with a dot.
+func ValidateRefName(name string) error {
+	if !strings.HasPrefix(name, "refs/") {
+		if name != "HEAD" && !strings.HasSuffix(name, "_HEAD") {
+			return ErrInvalidRef
+		}
+		for _, c := range name {
+			if (c < 'A' || c > 'Z') && c != '_' {
+				return ErrInvalidRef
+			}
+		}
+		return nil
+	}
+
+	if strings.HasSuffix(name, ".") || strings.Contains(name, "..") || strings.Contains(name, "@{") {
+		return ErrInvalidRef
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c < 0x20 || c == 0x7f || strings.IndexByte(" ~^:?*[\\", c) != -1 {
+			return ErrInvalidRef
+		}
+	}
+	for _, component := range strings.Split(name, "/") {
+		if component == "" || strings.HasPrefix(component, ".") || strings.HasSuffix(component, ".lock") {
+			return ErrInvalidRef
+		}
+	}
+	return nil
+}
+
+// RefSlice attaches the methods of sort.Interface to []Ref, sorting by name.
+type RefSlice []Ref
+
+func (refs RefSlice) Len() int           { return len(refs) }
+func (refs RefSlice) Less(i, j int) bool { return refs[i].Name < refs[j].Name }
+func (refs RefSlice) Swap(i, j int)      { refs[i], refs[j] = refs[j], refs[i] }
@@ -0,0 +1,170 @@
+package format
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/kourge/ggit/core"
+)
+
+// A ReflogEntry records a single change to a ref.
+//
+// Old and New are the values of the ref before and after the change, either
+// of which is a zero SHA-1 if the ref did not exist at that time. Committer is
+// the identity that made the change along with the time it was made. Message
+// describes the change, e.g. "commit: Fix typo", and must fit on a single
+// line.
+type ReflogEntry struct {
+	Old       core.Sha1
+	New       core.Sha1
+	Committer core.Person
+	Message   string
+}
+
+var _ core.EncodeDecoder = &ReflogEntry{}
+
+// Reader returns an io.Reader that yields this entry as a line of a reflog in
+// the form of "<old> <new> <committer>\t<message>\n". The tab is omitted when
+// Message is empty.
+func (entry *ReflogEntry) Reader() io.Reader {
+	buffer := new(bytes.Buffer)
+	buffer.WriteString(entry.Old.String())
+	buffer.WriteByte(' ')
+	buffer.WriteString(entry.New.String())
+	buffer.WriteByte(' ')
+	buffer.WriteString(entry.Committer.String())
+	if entry.Message != "" {
+		buffer.WriteByte('\t')
+		buffer.WriteString(entry.Message)
+	}
+	buffer.WriteByte('\n')
+	return buffer
+}
+
+// Decode parses a single line of a reflog, with or without its trailing
+// newline.
+func (entry *ReflogEntry) Decode(reader io.Reader) error {
+	r := bufio.NewReader(reader)
+	line, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	line = strings.TrimSuffix(line, "\n")
+
+	if len(line) < 82 || line[40] != ' ' || line[81] != ' ' {
+		return Errorf("malformed reflog entry: %q", line)
+	}
+	if entry.Old, err = core.Sha1FromString(line[:40]); err != nil {
+		return err
+	} else if entry.New, err = core.Sha1FromString(line[41:81]); err != nil {
+		return err
+	}
+
+	committer, message := line[82:], ""
+	if tab := strings.IndexByte(committer, '\t'); tab != -1 {
+		committer, message = committer[:tab], committer[tab+1:]
+	}
+	entry.Message = message
+	return entry.Committer.Decode(strings.NewReader(committer))
+}
+
+// A Reflog is the log of changes to a ref, as stored under "logs/" in a
+// repository. Entries are in the order they were made, oldest first.
+type Reflog struct {
+	Entries []ReflogEntry
+}
+
+var _ core.EncodeDecoder = &Reflog{}
+
+// Reader returns an io.Reader that yields every entry of this reflog, one per
+// line.
+func (reflog *Reflog) Reader() io.Reader {
+	readers := make([]io.Reader, len(reflog.Entries))
+	for i := range reflog.Entries {
+		readers[i] = reflog.Entries[i].Reader()
+	}
+	return io.MultiReader(readers...)
+}
+
+// Decode parses every line of a reflog. Blank lines are skipped, and so are
+// malformed ones, as Git does, so that a single corrupt entry does not make the
+// rest of the reflog unreadable.
+func (reflog *Reflog) Decode(reader io.Reader) error {
+	r := bufio.NewReader(reader)
+
+	reflog.Entries = nil
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		var entry ReflogEntry
+		if len(bytes.TrimSuffix(line, []byte{'\n'})) != 0 && entry.Decode(bytes.NewReader(line)) == nil {
+			reflog.Entries = append(reflog.Entries, entry)
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// Nth returns the value that the ref had n changes ago, which is what
+// "<ref>@{n}" refers to. Zero yields the value that the latest change set the
+// ref to. If n is exactly the number of entries, the value from before the
+// oldest change is returned, provided that the ref existed back then.
+// Otherwise, an error is returned if the reflog does not go back that far.
+func (reflog *Reflog) Nth(n int) (core.Sha1, error) {
+	count := len(reflog.Entries)
+	switch {
+	case n < 0:
+		return core.Sha1{}, Errorf("invalid reflog index %d", n)
+	case n < count:
+		return reflog.Entries[count-1-n].New, nil
+	case n == count && count > 0 && !reflog.Entries[0].Old.IsEmpty():
+		return reflog.Entries[0].Old, nil
+	}
+	return core.Sha1{}, Errorf("log only has %d entries", count)
+}
+
+// AtTime returns the value that the ref had at the given time, which is what
+// "<ref>@{<date>}" refers to, i.e. the value set by the latest change made no
+// later than t. If every change was made after t, the value from before the
+// oldest change is returned, provided that the ref existed back then. An error
+// is returned if the reflog is empty.
+func (reflog *Reflog) AtTime(t time.Time) (core.Sha1, error) {
+	if len(reflog.Entries) == 0 {
+		return core.Sha1{}, Errorf("log is empty")
+	}
+
+	for i := len(reflog.Entries) - 1; i >= 0; i-- {
+		if entry := reflog.Entries[i]; !entry.Committer.Time.After(t) {
+			return entry.New, nil
+		}
+	}
+
+	if oldest := reflog.Entries[0]; !oldest.Old.IsEmpty() {
+		return oldest.Old, nil
+	}
+	return reflog.Entries[0].New, nil
+}
+
+// Expire removes every entry that was made before the given time and returns
+// the number of entries removed. Equivalent to the --expire option of `git
+// reflog expire`.
+func (reflog *Reflog) Expire(before time.Time) int {
+	kept := reflog.Entries[:0]
+	for _, entry := range reflog.Entries {
+		if !entry.Committer.Time.Before(before) {
+			kept = append(kept, entry)
+		}
+	}
+
+	removed := len(reflog.Entries) - len(kept)
+	reflog.Entries = kept
+	return removed
+}
@@ -0,0 +1,88 @@
+package format
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kourge/ggit/core"
+)
+
+func _reflogSha1(c byte) core.Sha1 {
+	sha1, _ := core.Sha1FromString(strings.Repeat(string(c), 40))
+	return sha1
+}
+
+func TestReflog_Decode(t *testing.T) {
+	a, b := _reflogSha1('a'), _reflogSha1('b')
+	content := strings.Repeat("0", 40) + " " + a.String() + " Jane Doe <jane@example.com> 1400000000 +0200\tcommit (initial): a\n" +
+		a.String() + " " + b.String() + " Jane Doe <jane@example.com> 1400000060 -0700\n"
+
+	reflog := &Reflog{}
+	if err := reflog.Decode(strings.NewReader(content)); err != nil {
+		t.Fatalf("Decode() returned error %v", err)
+	}
+	if len(reflog.Entries) != 2 {
+		t.Fatalf("Decode() yielded %d entries, want 2", len(reflog.Entries))
+	}
+
+	first := reflog.Entries[0]
+	expected := core.NewPerson("Jane Doe", "jane@example.com", 1400000000, 2*60*60)
+	if !first.Old.IsEmpty() || first.New != a || !first.Committer.Equal(expected) || first.Message != "commit (initial): a" {
+		t.Errorf("Decode() yielded first entry %+v", first)
+	}
+	if second := reflog.Entries[1]; second.Old != a || second.New != b || second.Message != "" {
+		t.Errorf("Decode() yielded second entry %+v", second)
+	}
+
+	encoded := new(bytes.Buffer)
+	encoded.ReadFrom(reflog.Reader())
+	if encoded.String() != content {
+		t.Errorf("Reader() yielded %q, want %q", encoded.String(), content)
+	}
+
+	// Malformed lines are skipped rather than failing the whole reflog.
+	corrupt := "not a reflog\n" + content[:100] + "\n" + content
+	if err := reflog.Decode(strings.NewReader(corrupt)); err != nil {
+		t.Errorf("Decode() of a reflog with malformed lines returned error %v", err)
+	} else if len(reflog.Entries) != 2 || reflog.Entries[1].New != b {
+		t.Errorf("Decode() of a reflog with malformed lines yielded %+v", reflog.Entries)
+	}
+}
+
+func TestReflog_Nth(t *testing.T) {
+	a, b, c := _reflogSha1('a'), _reflogSha1('b'), _reflogSha1('c')
+	person := func(sec int64) core.Person { return core.NewPerson("Jane Doe", "jane@example.com", sec, 0) }
+	reflog := &Reflog{Entries: []ReflogEntry{
+		{Old: a, New: b, Committer: person(100)},
+		{Old: b, New: c, Committer: person(200)},
+	}}
+
+	for n, expected := range []core.Sha1{c, b, a} {
+		if actual, err := reflog.Nth(n); err != nil || actual != expected {
+			t.Errorf("Nth(%d) = %v, %v, want %v", n, actual, err, expected)
+		}
+	}
+	if _, err := reflog.Nth(3); err == nil {
+		t.Errorf("Nth(3) returned no error")
+	}
+
+	for _, test := range []struct {
+		sec      int64
+		expected core.Sha1
+	}{
+		{50, a},
+		{100, b},
+		{150, b},
+		{250, c},
+	} {
+		if actual, err := reflog.AtTime(time.Unix(test.sec, 0)); err != nil || actual != test.expected {
+			t.Errorf("AtTime(%d) = %v, %v, want %v", test.sec, actual, err, test.expected)
+		}
+	}
+
+	if removed := reflog.Expire(time.Unix(150, 0)); removed != 1 || len(reflog.Entries) != 1 || reflog.Entries[0].New != c {
+		t.Errorf("Expire() removed %d entries, leaving %+v", removed, reflog.Entries)
+	}
+}
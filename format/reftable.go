@@ -0,0 +1,752 @@
+package format
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/kourge/ggit/core"
+)
+
+var ErrReftableEntryTooBig = errors.New("reftable record does not fit in a block")
+
+var reftableMagic = [4]byte{'R', 'E', 'F', 'T'}
+
+const (
+	reftableBlockRef   byte = 'r'
+	reftableBlockLog   byte = 'g'
+	reftableBlockObj   byte = 'o'
+	reftableBlockIndex byte = 'i'
+
+	reftableValueDeletion byte = 0
+	reftableValueSha1     byte = 1
+	reftableValuePeeled   byte = 2
+	reftableValueSymref   byte = 3
+
+	reftableLogDeletion byte = 0
+	reftableLogUpdate   byte = 1
+
+	// reftableRestartInterval is the number of records between two restart
+	// points, i.e. records whose key is stored in full.
+	reftableRestartInterval = 16
+
+	// reftableIndexThreshold is the number of blocks that a section may have
+	// before an index is written for it.
+	reftableIndexThreshold = 3
+
+	// reftableHashIdSha1 is the hash ID that a version 2 header carries for
+	// SHA-1, i.e. "sha1" in ASCII.
+	reftableHashIdSha1 uint32 = 0x73686131
+
+	reftableHeaderSizeV1 = 24
+	reftableHeaderSizeV2 = 28
+	reftableFooterFields = 5*8 + 4
+
+	// DefaultReftableBlockSize is the block size that tables are written with
+	// when none is given, which is also what Git uses.
+	DefaultReftableBlockSize uint32 = 4096
+)
+
+// A ReftableRef is a ref record of a reftable.
+//
+// Name is the full name of the ref and UpdateIndex is the update index of the
+// transaction that last changed it. Deleted is a bool that is true if the
+// record is a tombstone that hides the ref in older tables of a stack. If
+// Target is not empty, the ref is a symbolic ref to the ref it names.
+// Otherwise, Sha1 is the object that the ref points to and Peeled is the
+// object that it peels to if Sha1 names an annotated tag, or a zero SHA-1 if it
+// does not.
+type ReftableRef struct {
+	Name        string
+	UpdateIndex uint64
+	Sha1        core.Sha1
+	Peeled      core.Sha1
+	Target      string
+	Deleted     bool
+}
+
+// A ReftableLog is a log record of a reftable, i.e. an entry in the reflog of
+// a ref.
+//
+// Name is the full name of the ref and UpdateIndex is the update index of the
+// transaction that changed it, which orders the entries of a reflog. Deleted is
+// a bool that is true if the record is a tombstone that hides the entry with
+// the same name and update index in older tables of a stack, in which case
+// ReflogEntry is left empty.
+type ReftableLog struct {
+	Name        string
+	UpdateIndex uint64
+	Deleted     bool
+	ReflogEntry
+}
+
+// key returns the key that this record is sorted by: the name of the ref and a
+// null byte, followed by the update index subtracted from the largest 64-bit
+// integer, so that the newest entry of each reflog comes first.
+func (log *ReftableLog) key() []byte {
+	key := make([]byte, len(log.Name)+1+8)
+	copy(key, log.Name)
+	binary.BigEndian.PutUint64(key[len(log.Name)+1:], ^uint64(0)-log.UpdateIndex)
+	return key
+}
+
+// ReftableOptions contains all the possible options for NewReftable.
+//
+// BlockSize is the size of the blocks of the table. It defaults to
+// DefaultReftableBlockSize and may be at most 16 MiB.
+//
+// MinUpdateIndex and MaxUpdateIndex are the range of update indices that the
+// table covers. If both are zero, they are computed from the records.
+type ReftableOptions struct {
+	BlockSize      uint32
+	MinUpdateIndex uint64
+	MaxUpdateIndex uint64
+}
+
+// A Reftable is a single table of the reftable format, which stores refs and
+// their reflogs in a file made of blocks of sorted, prefix-compressed records.
+// Each table covers a range of update indices and a table with a higher range
+// takes precedence over one with a lower range when several are stacked.
+//
+// A table is made of up to four sections, in order: ref blocks, obj blocks
+// that map abbreviated object IDs to the ref blocks that refer to them, and
+// zlib-compressed log blocks. Each section may be followed by index blocks
+// that map the last key of every block to its position, which the table uses
+// to seek. Lookups only decode the blocks they need.
+//
+// For more information on the reftable format, see:
+// https://git-scm.com/docs/reftable
+type Reftable struct {
+	data           []byte
+	version        uint8
+	headerSize     int
+	blockSize      uint32
+	minUpdateIndex uint64
+	maxUpdateIndex uint64
+
+	footerStart      int64
+	refIndexPosition uint64
+	objPosition      uint64
+	objIdLength      int
+	objIndexPosition uint64
+	logPosition      uint64
+	logIndexPosition uint64
+}
+
+var _ core.EncodeDecoder = &Reftable{}
+
+// ReftableAtPath reads and decodes the table in the file at the given path.
+func ReftableAtPath(path string) (*Reftable, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	table := &Reftable{}
+	if err := table.Decode(file); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// MinUpdateIndex returns the lowest update index that this table covers.
+func (t *Reftable) MinUpdateIndex() uint64 {
+	return t.minUpdateIndex
+}
+
+// MaxUpdateIndex returns the highest update index that this table covers.
+func (t *Reftable) MaxUpdateIndex() uint64 {
+	return t.maxUpdateIndex
+}
+
+// Size returns the size of this table in bytes.
+func (t *Reftable) Size() int {
+	return len(t.data)
+}
+
+// Reader returns an io.Reader that yields this table in the reftable format.
+func (t *Reftable) Reader() io.Reader {
+	return bytes.NewReader(t.data)
+}
+
+// Decode reads a table in the reftable format, in either version 1 or 2, and
+// checks its header and footer. Blocks are only decoded when a lookup needs
+// them.
+func (t *Reftable) Decode(reader io.Reader) error {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	} else if len(data) < reftableHeaderSizeV1 || !bytes.Equal(data[:4], reftableMagic[:]) {
+		return Errorf("not a reftable")
+	}
+
+	*t = Reftable{data: data, version: data[4]}
+	switch t.version {
+	case 1:
+		t.headerSize = reftableHeaderSizeV1
+	case 2:
+		t.headerSize = reftableHeaderSizeV2
+	default:
+		return Errorf("unsupported reftable version %d", t.version)
+	}
+
+	footerSize := t.headerSize + reftableFooterFields
+	if len(data) < t.headerSize+footerSize {
+		return Errorf("reftable is %d bytes long, too short for a header and footer", len(data))
+	}
+	header := data[:t.headerSize]
+	t.blockSize = uint32(getUint24(header[5:]))
+	t.minUpdateIndex = binary.BigEndian.Uint64(header[8:])
+	t.maxUpdateIndex = binary.BigEndian.Uint64(header[16:])
+	if t.version == 2 && binary.BigEndian.Uint32(header[24:]) != reftableHashIdSha1 {
+		return Errorf("reftable does not use SHA-1")
+	}
+
+	footer := data[len(data)-footerSize:]
+	t.footerStart = int64(len(data) - footerSize)
+	if !bytes.Equal(footer[:t.headerSize], header) {
+		return Errorf("reftable footer does not match its header")
+	} else if crc32.ChecksumIEEE(footer[:footerSize-4]) != binary.BigEndian.Uint32(footer[footerSize-4:]) {
+		return Errorf("reftable footer checksum mismatch")
+	}
+
+	fields := footer[t.headerSize:]
+	t.refIndexPosition = binary.BigEndian.Uint64(fields[0:])
+	obj := binary.BigEndian.Uint64(fields[8:])
+	t.objPosition, t.objIdLength = obj>>5, int(obj&0x1f)
+	if t.objPosition != 0 && (t.objIdLength == 0 || t.objIdLength > len(core.Sha1{})) {
+		return Errorf("reftable has an invalid object ID length of %d", t.objIdLength)
+	}
+	t.objIndexPosition = binary.BigEndian.Uint64(fields[16:])
+	t.logPosition = binary.BigEndian.Uint64(fields[24:])
+	t.logIndexPosition = binary.BigEndian.Uint64(fields[32:])
+	return nil
+}
+
+// Ref returns the record of the ref with the given name and whether there is
+// one. The record may be a tombstone.
+func (t *Reftable) Ref(name string) (ReftableRef, bool, error) {
+	var found ReftableRef
+	ok := false
+	err := t.iterate(reftableBlockRef, []byte(name), func(key []byte, valType byte, value []byte) (int, bool, error) {
+		if string(key) != name {
+			return 0, true, nil
+		}
+		ref, n, err := t.decodeRef(key, valType, value)
+		found, ok = ref, err == nil
+		return n, true, err
+	})
+	return found, ok, err
+}
+
+// Refs returns the records of every ref whose name starts with the given
+// prefix, sorted by name. Tombstones are included.
+func (t *Reftable) Refs(prefix string) ([]ReftableRef, error) {
+	var refs []ReftableRef
+	err := t.iterate(reftableBlockRef, []byte(prefix), func(key []byte, valType byte, value []byte) (int, bool, error) {
+		if !bytes.HasPrefix(key, []byte(prefix)) {
+			return 0, true, nil
+		}
+		ref, n, err := t.decodeRef(key, valType, value)
+		refs = append(refs, ref)
+		return n, false, err
+	})
+	return refs, err
+}
+
+// RefsForObject returns the records of every ref that points or peels to the
+// object with the given SHA-1, sorted by name. If the table has obj blocks,
+// only the ref blocks that they list are decoded.
+func (t *Reftable) RefsForObject(hash core.Sha1) ([]ReftableRef, error) {
+	matches := func(ref ReftableRef) bool {
+		return !ref.Deleted && ref.Target == "" && (ref.Sha1 == hash || ref.Peeled == hash)
+	}
+
+	if t.objPosition == 0 {
+		all, err := t.Refs("")
+		if err != nil {
+			return nil, err
+		}
+		var refs []ReftableRef
+		for _, ref := range all {
+			if matches(ref) {
+				refs = append(refs, ref)
+			}
+		}
+		return refs, nil
+	}
+
+	prefix := hash[:t.objIdLength]
+	var positions []uint64
+	err := t.iterate(reftableBlockObj, prefix, func(key []byte, valType byte, value []byte) (int, bool, error) {
+		if !bytes.Equal(key, prefix) {
+			return 0, true, nil
+		}
+		var n int
+		var err error
+		positions, n, err = decodeReftableObjPositions(valType, value)
+		return n, true, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []ReftableRef
+	for _, position := range positions {
+		block, err := t.blockAt(int64(position))
+		if err != nil {
+			return nil, err
+		} else if block.typ != reftableBlockRef {
+			return nil, Errorf("reftable obj record points to a block of type %q", block.typ)
+		}
+		err = block.each(block.recordsStart(), func(key []byte, valType byte, value []byte) (int, bool, error) {
+			ref, n, err := t.decodeRef(key, valType, value)
+			if err == nil && matches(ref) {
+				refs = append(refs, ref)
+			}
+			return n, false, err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+// Logs returns the log records of the ref with the given name, newest first.
+// If name is empty, the log records of every ref are returned, sorted by name
+// and then newest first. Tombstones are included.
+func (t *Reftable) Logs(name string) ([]ReftableLog, error) {
+	prefix := []byte(name)
+	if name != "" {
+		prefix = append(prefix, 0)
+	}
+	var logs []ReftableLog
+	err := t.iterate(reftableBlockLog, prefix, func(key []byte, valType byte, value []byte) (int, bool, error) {
+		if !bytes.HasPrefix(key, prefix) {
+			return 0, true, nil
+		}
+		log, n, err := decodeReftableLog(key, valType, value)
+		logs = append(logs, log)
+		return n, false, err
+	})
+	return logs, err
+}
+
+func (t *Reftable) decodeRef(key []byte, valType byte, value []byte) (ReftableRef, int, error) {
+	ref := ReftableRef{Name: string(key)}
+	r := bytes.NewReader(value)
+	delta, err := decodePackEntryBaseOffset(r)
+	if err != nil {
+		return ref, 0, err
+	}
+	ref.UpdateIndex = t.minUpdateIndex + uint64(delta)
+
+	switch valType {
+	case reftableValueDeletion:
+		ref.Deleted = true
+	case reftableValueSha1:
+		_, err = io.ReadFull(r, ref.Sha1[:])
+	case reftableValuePeeled:
+		if _, err = io.ReadFull(r, ref.Sha1[:]); err == nil {
+			_, err = io.ReadFull(r, ref.Peeled[:])
+		}
+	case reftableValueSymref:
+		ref.Target, err = readReftableString(r)
+	default:
+		err = Errorf("unknown reftable ref value type %d", valType)
+	}
+	return ref, len(value) - r.Len(), err
+}
+
+func decodeReftableLog(key []byte, valType byte, value []byte) (ReftableLog, int, error) {
+	var log ReftableLog
+	if len(key) < 9 || key[len(key)-9] != 0 {
+		return log, 0, Errorf("malformed reftable log key %q", key)
+	}
+	log.Name = string(key[:len(key)-9])
+	log.UpdateIndex = ^uint64(0) - binary.BigEndian.Uint64(key[len(key)-8:])
+
+	switch valType {
+	case reftableLogDeletion:
+		log.Deleted = true
+		return log, 0, nil
+	case reftableLogUpdate:
+	default:
+		return log, 0, Errorf("unknown reftable log value type %d", valType)
+	}
+
+	r := bytes.NewReader(value)
+	if _, err := io.ReadFull(r, log.Old[:]); err != nil {
+		return log, 0, err
+	} else if _, err := io.ReadFull(r, log.New[:]); err != nil {
+		return log, 0, err
+	}
+
+	name, err := readReftableString(r)
+	if err != nil {
+		return log, 0, err
+	}
+	email, err := readReftableString(r)
+	if err != nil {
+		return log, 0, err
+	}
+	sec, err := decodePackEntryBaseOffset(r)
+	if err != nil {
+		return log, 0, err
+	}
+	var tz int16
+	if err := binary.Read(r, binary.BigEndian, &tz); err != nil {
+		return log, 0, err
+	}
+	if log.Message, err = readReftableString(r); err != nil {
+		return log, 0, err
+	}
+	log.Message = strings.TrimSuffix(log.Message, "\n")
+
+	// The time zone is stored as the decimal number that Git prints, i.e.
+	// -0130 is stored as -130.
+	offset := (int(tz)/100*60 + int(tz)%100) * 60
+	log.Committer = core.NewPerson(name, email, sec, offset)
+	return log, len(value) - r.Len(), nil
+}
+
+func decodeReftableObjPositions(valType byte, value []byte) ([]uint64, int, error) {
+	r := bytes.NewReader(value)
+	count := int64(valType)
+	if valType == 0 {
+		var err error
+		if count, err = decodePackEntryBaseOffset(r); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var positions []uint64
+	var last uint64
+	for i := int64(0); i < count; i++ {
+		n, err := decodePackEntryBaseOffset(r)
+		if err != nil {
+			return nil, 0, err
+		}
+		last += uint64(n)
+		positions = append(positions, last)
+	}
+	return positions, len(value) - r.Len(), nil
+}
+
+func readReftableString(r *bytes.Reader) (string, error) {
+	length, err := decodePackEntryBaseOffset(r)
+	if err != nil {
+		return "", err
+	} else if length > int64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	s := make([]byte, length)
+	_, err = io.ReadFull(r, s)
+	return string(s), err
+}
+
+// A reftableBlock is a decoded block of a table. For the first block of a
+// table, data starts with the file header. The records of a log block are
+// inflated.
+type reftableBlock struct {
+	typ        byte
+	data       []byte
+	headerSize int
+	restarts   []int
+	next       int64
+}
+
+func (b *reftableBlock) recordsStart() int {
+	return b.headerSize + 4
+}
+
+// recordsEnd returns the offset at which the restart table starts.
+func (b *reftableBlock) recordsEnd() int {
+	return len(b.data) - 2 - 3*len(b.restarts)
+}
+
+// blockType returns the type of the block at the given position of the table,
+// or zero if there is no block there.
+func (t *Reftable) blockType(position int64) byte {
+	if position == 0 {
+		position += int64(t.headerSize)
+	}
+	if position+4 > t.footerStart {
+		return 0
+	}
+	return t.data[position]
+}
+
+// blockAt decodes the block at the given position of the table.
+func (t *Reftable) blockAt(position int64) (*reftableBlock, error) {
+	headerSize := 0
+	if position == 0 {
+		headerSize = t.headerSize
+	}
+	start := position + int64(headerSize)
+	if start+4 > t.footerStart {
+		return nil, Errorf("reftable block at %d is out of bounds", position)
+	}
+
+	block := &reftableBlock{typ: t.data[start], headerSize: headerSize}
+	length := int64(getUint24(t.data[start+1:]))
+	if length < int64(headerSize)+4+2 {
+		return nil, Errorf("reftable block at %d is too short", position)
+	}
+
+	if block.typ == reftableBlockLog {
+		input := bytes.NewReader(t.data[start+4 : t.footerStart])
+		z, err := zlib.NewReader(input)
+		if err != nil {
+			return nil, err
+		}
+		block.data = make([]byte, length)
+		copy(block.data, t.data[position:start+4])
+		if _, err := io.ReadFull(z, block.data[headerSize+4:]); err != nil {
+			return nil, err
+		}
+		// Reading past the end makes the reader consume and verify the checksum.
+		if n, err := z.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			return nil, Errorf("reftable log block at %d is longer than declared", position)
+		} else if err := z.Close(); err != nil {
+			return nil, err
+		}
+		block.next = t.footerStart - int64(input.Len())
+	} else {
+		if position+length > t.footerStart {
+			return nil, Errorf("reftable block at %d is out of bounds", position)
+		}
+		block.data = t.data[position : position+length]
+		block.next = position + length
+		padded := position + int64(t.blockSize)
+		if t.blockSize > 0 && padded <= t.footerStart && (block.next == t.footerStart || t.data[block.next] == 0) {
+			block.next = padded
+		}
+	}
+
+	count := int(binary.BigEndian.Uint16(block.data[len(block.data)-2:]))
+	restartsStart := len(block.data) - 2 - 3*count
+	if count == 0 || restartsStart < block.recordsStart() {
+		return nil, Errorf("reftable block at %d has a malformed restart table", position)
+	}
+	block.restarts = make([]int, count)
+	for i := range block.restarts {
+		block.restarts[i] = getUint24(block.data[restartsStart+3*i:])
+		if block.restarts[i] < block.recordsStart() || block.restarts[i] >= restartsStart {
+			return nil, Errorf("reftable block at %d has a restart point out of bounds", position)
+		}
+	}
+	return block, nil
+}
+
+// reftableVisitor is called with the key, the value type and the remaining
+// bytes of the block, starting at the value, of each record in turn. It
+// returns the length of the value and whether iteration should stop.
+type reftableVisitor func(key []byte, valType byte, value []byte) (int, bool, error)
+
+// errReftableStop is returned by each when a visitor stops the iteration.
+var errReftableStop = errors.New("stop")
+
+// each visits the records of this block, starting at the record at the given
+// offset, which must be a restart point.
+func (b *reftableBlock) each(offset int, visit reftableVisitor) error {
+	end := b.recordsEnd()
+	var key []byte
+	for offset < end {
+		r := bytes.NewReader(b.data[offset:end])
+		prefixLength, err := decodePackEntryBaseOffset(r)
+		if err != nil {
+			return err
+		}
+		suffixAndType, err := decodePackEntryBaseOffset(r)
+		if err != nil {
+			return err
+		}
+		suffixLength := suffixAndType >> 3
+		if prefixLength > int64(len(key)) || suffixLength > int64(r.Len()) {
+			return Errorf("malformed reftable record at %d", offset)
+		}
+		suffix := make([]byte, suffixLength)
+		r.Read(suffix)
+		key = append(key[:prefixLength:prefixLength], suffix...)
+
+		valueStart := end - r.Len()
+		n, stop, err := visit(key, byte(suffixAndType&0x7), b.data[valueStart:end])
+		if err != nil {
+			return err
+		} else if stop {
+			return errReftableStop
+		}
+		offset = valueStart + n
+	}
+	return nil
+}
+
+// restartKey returns the key of the record at the given restart point.
+func (b *reftableBlock) restartKey(offset int) []byte {
+	var key []byte
+	b.each(offset, func(k []byte, valType byte, value []byte) (int, bool, error) {
+		key = k
+		return 0, true, nil
+	})
+	return key
+}
+
+// seek returns the offset of the last restart point whose key is not greater
+// than the given key, or the first restart point if there is none.
+func (b *reftableBlock) seek(key []byte) int {
+	i := sort.Search(len(b.restarts), func(i int) bool {
+		return bytes.Compare(b.restartKey(b.restarts[i]), key) > 0
+	})
+	if i == 0 {
+		return b.restarts[0]
+	}
+	return b.restarts[i-1]
+}
+
+// firstAtLeast calls visit for each record of this block whose key is not less
+// than the given key, until it stops the iteration. It returns whether any
+// such record was found.
+func (b *reftableBlock) firstAtLeast(key []byte, visit reftableVisitor) (bool, error) {
+	found := false
+	err := b.each(b.seek(key), func(k []byte, valType byte, value []byte) (int, bool, error) {
+		if bytes.Compare(k, key) < 0 {
+			return reftableSkip(b, valType, value)
+		}
+		found = true
+		return visit(k, valType, value)
+	})
+	if err == errReftableStop {
+		err = nil
+	}
+	return found, err
+}
+
+// reftableSkip returns the length of a value that is skipped over.
+func reftableSkip(b *reftableBlock, valType byte, value []byte) (int, bool, error) {
+	var n int
+	var err error
+	switch b.typ {
+	case reftableBlockRef:
+		_, n, err = (&Reftable{}).decodeRef(nil, valType, value)
+	case reftableBlockLog:
+		_, n, err = decodeReftableLog(make([]byte, 9), valType, value)
+	case reftableBlockObj:
+		_, n, err = decodeReftableObjPositions(valType, value)
+	case reftableBlockIndex:
+		r := bytes.NewReader(value)
+		_, err = decodePackEntryBaseOffset(r)
+		n = len(value) - r.Len()
+	}
+	return n, false, err
+}
+
+// sectionStart returns the position of the first block of the section of the
+// given type and the position of its root index, or -1 if the table has no such
+// section.
+func (t *Reftable) sectionStart(typ byte) (int64, uint64, error) {
+	switch typ {
+	case reftableBlockRef:
+		if t.blockType(0) != reftableBlockRef {
+			return -1, 0, nil
+		}
+		return 0, t.refIndexPosition, nil
+	case reftableBlockObj:
+		if t.objPosition == 0 {
+			return -1, 0, nil
+		}
+		return int64(t.objPosition), t.objIndexPosition, nil
+	case reftableBlockLog:
+		// A table without refs starts with its log blocks, at position zero.
+		if t.logPosition == 0 && t.blockType(0) != reftableBlockLog {
+			return -1, 0, nil
+		}
+		return int64(t.logPosition), t.logIndexPosition, nil
+	}
+	return -1, 0, Errorf("unknown reftable block type %q", typ)
+}
+
+// iterate visits the records of the section of the given type in order,
+// starting at the first record whose key is not less than the given key,
+// until the visitor stops the iteration. The index of the section is used to
+// find the block to start at if there is one.
+func (t *Reftable) iterate(typ byte, key []byte, visit reftableVisitor) error {
+	position, index, err := t.sectionStart(typ)
+	if err != nil || position < 0 {
+		return err
+	}
+
+	if index != 0 {
+		if position, err = t.seekIndex(int64(index), key); err != nil || position < 0 {
+			return err
+		}
+	}
+
+	for started := false; t.blockType(position) == typ; {
+		block, err := t.blockAt(position)
+		if err != nil {
+			return err
+		}
+
+		if started {
+			err = block.each(block.recordsStart(), visit)
+		} else {
+			started, err = block.firstAtLeast(key, visit)
+		}
+		if err == errReftableStop {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		position = block.next
+	}
+	return nil
+}
+
+// seekIndex descends the index whose root starts at the given position to the
+// block that holds the first record whose key is not less than the given key,
+// and returns its position, or -1 if every key is less.
+func (t *Reftable) seekIndex(position int64, key []byte) (int64, error) {
+	for position < t.footerStart {
+		block, err := t.blockAt(position)
+		if err != nil {
+			return -1, err
+		} else if block.typ != reftableBlockIndex {
+			return position, nil
+		}
+
+		next := int64(-1)
+		_, err = block.firstAtLeast(key, func(k []byte, valType byte, value []byte) (int, bool, error) {
+			r := bytes.NewReader(value)
+			offset, err := decodePackEntryBaseOffset(r)
+			next = offset
+			return len(value) - r.Len(), true, err
+		})
+		if err != nil {
+			return -1, err
+		} else if next >= 0 {
+			position = next
+		} else {
+			// The key is past this block of the root index; try the next one.
+			position = block.next
+		}
+	}
+	return -1, nil
+}
+
+func getUint24(b []byte) int {
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+}
+
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v>>16), byte(v>>8), byte(v)
+}
@@ -0,0 +1,166 @@
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/kourge/ggit/core"
+)
+
+func reftableTestSha1(i int) core.Sha1 {
+	hash, _ := core.Sha1FromString(fmt.Sprintf("%040x", 0x1000+i*0x10001))
+	return hash
+}
+
+func TestReftable_RoundTrip(t *testing.T) {
+	master, _ := core.Sha1FromString("5bb15ae450a1401f37f692eb7aa6fa202100bfd5")
+	tag, _ := core.Sha1FromString("5523147ced53ad4d79415615897384c127b98746")
+	committer := core.NewPerson("A U Thor", "author@example.com", 1400000000, -7*3600)
+
+	refs := []ReftableRef{
+		{Name: "refs/tags/v1", UpdateIndex: 2, Sha1: tag, Peeled: master},
+		{Name: "HEAD", UpdateIndex: 1, Target: "refs/heads/master"},
+		{Name: "refs/heads/master", UpdateIndex: 2, Sha1: master},
+		{Name: "refs/heads/gone", UpdateIndex: 2, Deleted: true},
+	}
+	logs := []ReftableLog{
+		{Name: "refs/heads/master", UpdateIndex: 1, ReflogEntry: ReflogEntry{New: tag, Committer: committer, Message: "commit (initial): one"}},
+		{Name: "refs/heads/master", UpdateIndex: 2, ReflogEntry: ReflogEntry{Old: tag, New: master, Committer: committer, Message: "commit: two"}},
+		{Name: "refs/heads/gone", UpdateIndex: 2, Deleted: true},
+	}
+
+	table, err := NewReftable(refs, logs, ReftableOptions{})
+	if err != nil {
+		t.Fatalf("NewReftable() returned error %v", err)
+	}
+	if table.MinUpdateIndex() != 1 || table.MaxUpdateIndex() != 2 {
+		t.Errorf("NewReftable() covers %d..%d, want 1..2", table.MinUpdateIndex(), table.MaxUpdateIndex())
+	}
+
+	decoded := &Reftable{}
+	if err := decoded.Decode(table.Reader()); err != nil {
+		t.Fatalf("Decode() returned error %v", err)
+	}
+
+	all, err := decoded.Refs("")
+	if err != nil {
+		t.Fatalf("Refs() returned error %v", err)
+	}
+	want := []ReftableRef{refs[1], refs[3], refs[2], refs[0]}
+	if len(all) != len(want) {
+		t.Fatalf("Refs() = %+v, want %+v", all, want)
+	}
+	for i := range want {
+		if all[i] != want[i] {
+			t.Errorf("Refs()[%d] = %+v, want %+v", i, all[i], want[i])
+		}
+	}
+
+	if ref, ok, err := decoded.Ref("refs/heads/master"); err != nil || !ok || ref.Sha1 != master {
+		t.Errorf("Ref() = %+v, %v, %v", ref, ok, err)
+	}
+	if _, ok, err := decoded.Ref("refs/heads/mast"); err != nil || ok {
+		t.Errorf("Ref() of a missing ref = %v, %v", ok, err)
+	}
+	if tags, err := decoded.Refs("refs/tags/"); err != nil || len(tags) != 1 || tags[0].Name != "refs/tags/v1" {
+		t.Errorf("Refs(\"refs/tags/\") = %+v, %v", tags, err)
+	}
+	if found, err := decoded.RefsForObject(master); err != nil || len(found) != 2 {
+		t.Errorf("RefsForObject() = %+v, %v", found, err)
+	}
+
+	masterLogs, err := decoded.Logs("refs/heads/master")
+	if err != nil {
+		t.Fatalf("Logs() returned error %v", err)
+	} else if len(masterLogs) != 2 {
+		t.Fatalf("Logs() = %+v, want 2 entries", masterLogs)
+	}
+	if latest := masterLogs[0]; latest.UpdateIndex != 2 || latest.New != master || latest.Message != "commit: two" ||
+		!latest.Committer.Equal(committer) || latest.Committer.String() != committer.String() {
+		t.Errorf("Logs()[0] = %+v", latest)
+	}
+	if gone, err := decoded.Logs("refs/heads/gone"); err != nil || len(gone) != 1 || !gone[0].Deleted {
+		t.Errorf("Logs() of a deleted ref = %+v, %v", gone, err)
+	}
+
+	var encoded bytes.Buffer
+	encoded.ReadFrom(decoded.Reader())
+	if !bytes.Equal(encoded.Bytes(), table.data) {
+		t.Errorf("Reader() did not yield the decoded table")
+	}
+
+	corrupt := append([]byte(nil), table.data...)
+	corrupt[len(corrupt)-5] ^= 0xff
+	if err := (&Reftable{}).Decode(bytes.NewReader(corrupt)); err == nil {
+		t.Errorf("Decode() of a corrupt footer returned no error")
+	}
+}
+
+func TestReftable_Index(t *testing.T) {
+	var refs []ReftableRef
+	var logs []ReftableLog
+	for i := 0; i < 2000; i++ {
+		name := fmt.Sprintf("refs/heads/branch-%05d", i)
+		refs = append(refs, ReftableRef{Name: name, UpdateIndex: 1, Sha1: reftableTestSha1(i)})
+		logs = append(logs, ReftableLog{Name: name, UpdateIndex: 1, ReflogEntry: ReflogEntry{New: reftableTestSha1(i), Message: "branch: Created"}})
+	}
+
+	table, err := NewReftable(refs, logs, ReftableOptions{BlockSize: 256})
+	if err != nil {
+		t.Fatalf("NewReftable() returned error %v", err)
+	}
+	if table.refIndexPosition == 0 || table.objPosition == 0 || table.logIndexPosition == 0 {
+		t.Errorf("NewReftable() wrote no index: ref %d, obj %d, log %d",
+			table.refIndexPosition, table.objPosition, table.logIndexPosition)
+	}
+
+	for _, i := range []int{0, 1, 15, 16, 17, 999, 1998, 1999} {
+		name := fmt.Sprintf("refs/heads/branch-%05d", i)
+		if ref, ok, err := table.Ref(name); err != nil || !ok || ref.Sha1 != reftableTestSha1(i) {
+			t.Errorf("Ref(%q) = %+v, %v, %v", name, ref, ok, err)
+		}
+		if found, err := table.RefsForObject(reftableTestSha1(i)); err != nil || len(found) != 1 || found[0].Name != name {
+			t.Errorf("RefsForObject(%d) = %+v, %v", i, found, err)
+		}
+		if found, err := table.Logs(name); err != nil || len(found) != 1 || found[0].New != reftableTestSha1(i) {
+			t.Errorf("Logs(%q) = %+v, %v", name, found, err)
+		}
+	}
+	for _, name := range []string{"refs/heads/branch-02000", "refs/heads/a", "refs/heads/z", "refs/tags/v1"} {
+		if _, ok, err := table.Ref(name); err != nil || ok {
+			t.Errorf("Ref(%q) of a missing ref = %v, %v", name, ok, err)
+		}
+	}
+
+	if found, err := table.Refs("refs/heads/branch-019"); err != nil || len(found) != 100 {
+		t.Errorf("Refs() with a prefix returned %d refs, %v", len(found), err)
+	}
+	if all, err := table.Refs(""); err != nil || len(all) != len(refs) {
+		t.Errorf("Refs() returned %d refs, %v", len(all), err)
+	}
+	if all, err := table.Logs(""); err != nil || len(all) != len(logs) {
+		t.Errorf("Logs() returned %d logs, %v", len(all), err)
+	}
+}
+
+func TestReftable_Empty(t *testing.T) {
+	table, err := NewReftable(nil, nil, ReftableOptions{MinUpdateIndex: 3, MaxUpdateIndex: 3})
+	if err != nil {
+		t.Fatalf("NewReftable() returned error %v", err)
+	}
+	if refs, err := table.Refs(""); err != nil || len(refs) != 0 {
+		t.Errorf("Refs() = %+v, %v", refs, err)
+	}
+	if logs, err := table.Logs(""); err != nil || len(logs) != 0 {
+		t.Errorf("Logs() = %+v, %v", logs, err)
+	}
+
+	onlyLogs, err := NewReftable(nil, []ReftableLog{{Name: "HEAD", UpdateIndex: 1}}, ReftableOptions{})
+	if err != nil {
+		t.Fatalf("NewReftable() returned error %v", err)
+	}
+	if logs, err := onlyLogs.Logs("HEAD"); err != nil || len(logs) != 1 {
+		t.Errorf("Logs() of a table without refs = %+v, %v", logs, err)
+	}
+}
@@ -0,0 +1,512 @@
+package format
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var ErrReftableLocked = errors.New("reftable stack is locked")
+
+const (
+	// ReftableListName is the name of the file that lists the tables of a
+	// stack, oldest first.
+	ReftableListName = "tables.list"
+
+	// reftableCompactionFactor is the factor by which each table of a stack is
+	// kept larger than the table above it. A stack whose sizes do not form
+	// such a geometric sequence is compacted after each addition.
+	reftableCompactionFactor = 2
+)
+
+// A ReftableStack is the stack of tables in which a repository that uses the
+// reftable backend stores its refs and reflogs, usually in the "reftable"
+// directory of the repository. The file "tables.list" names the tables of the
+// stack, oldest first, and a table takes precedence over the tables below it:
+// the newest record of a ref determines its value, and a tombstone hides the
+// records below it.
+//
+// Every update adds a table to the top of the stack, after which the stack is
+// compacted just enough to keep the size of each table at least twice the size
+// of the table above it, so that the number of tables stays logarithmic in the
+// number of updates.
+//
+// BlockSize is the block size that new tables are written with. If left
+// unspecified as zero, DefaultReftableBlockSize is used.
+type ReftableStack struct {
+	BlockSize uint32
+
+	dir    string
+	names  []string
+	tables []*Reftable
+	list   os.FileInfo // of the list of tables as last read, if it existed
+}
+
+// OpenReftableStack reads the stack of tables in the given directory. A
+// directory without a "tables.list" file holds an empty stack.
+func OpenReftableStack(dir string) (*ReftableStack, error) {
+	s := &ReftableStack{dir: dir}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the list of tables again, which picks up the tables that other
+// processes have added since.
+func (s *ReftableStack) Reload() error {
+	names, list, err := s.readList()
+	if err != nil {
+		return err
+	}
+
+	tables := make([]*Reftable, len(names))
+	for i, name := range names {
+		if i < len(s.names) && s.names[i] == name {
+			tables[i] = s.tables[i]
+			continue
+		}
+		if tables[i], err = ReftableAtPath(filepath.Join(s.dir, name)); err != nil {
+			return err
+		}
+	}
+	s.names, s.tables, s.list = names, tables, list
+	return nil
+}
+
+// Refresh reloads this stack if the list of tables has changed since it was
+// last read, and does nothing otherwise. Like Git, it judges whether the list
+// has changed by the identity, size and modification time of the file, so
+// that a stack that is up to date costs a single stat to refresh.
+func (s *ReftableStack) Refresh() error {
+	list, err := os.Stat(filepath.Join(s.dir, ReftableListName))
+	if os.IsNotExist(err) {
+		list = nil
+	} else if err != nil {
+		return err
+	}
+
+	if list == nil && s.list == nil {
+		return nil
+	} else if list != nil && s.list != nil && os.SameFile(list, s.list) &&
+		list.Size() == s.list.Size() && list.ModTime().Equal(s.list.ModTime()) {
+		return nil
+	}
+	return s.Reload()
+}
+
+// Clone returns a copy of this stack that can be reloaded, added to and
+// compacted independently of it. The tables that are already open are shared,
+// as they are never modified once read.
+func (s *ReftableStack) Clone() *ReftableStack {
+	clone := *s
+	clone.names = append([]string(nil), s.names...)
+	clone.tables = append([]*Reftable(nil), s.tables...)
+	return &clone
+}
+
+// readList reads the names of the tables from the list of tables, along with
+// the FileInfo of the list, which is nil if it does not exist.
+func (s *ReftableStack) readList() ([]string, os.FileInfo, error) {
+	file, err := os.Open(filepath.Join(s.dir, ReftableListName))
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	list, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	var names []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if name := scanner.Text(); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, list, scanner.Err()
+}
+
+// Tables returns the names of the tables of this stack, oldest first.
+func (s *ReftableStack) Tables() []string {
+	return append([]string(nil), s.names...)
+}
+
+// NextUpdateIndex returns the update index that the next table added to this
+// stack receives.
+func (s *ReftableStack) NextUpdateIndex() uint64 {
+	if len(s.tables) == 0 {
+		return 1
+	}
+	return s.tables[len(s.tables)-1].MaxUpdateIndex() + 1
+}
+
+// Ref returns the current record of the ref with the given name and whether
+// the ref exists.
+func (s *ReftableStack) Ref(name string) (ReftableRef, bool, error) {
+	for i := len(s.tables) - 1; i >= 0; i-- {
+		ref, ok, err := s.tables[i].Ref(name)
+		if err != nil {
+			return ReftableRef{}, false, err
+		} else if ok {
+			return ref, !ref.Deleted, nil
+		}
+	}
+	return ReftableRef{}, false, nil
+}
+
+// Refs returns the current records of every ref whose name starts with the
+// given prefix, sorted by name. Deleted refs are left out.
+func (s *ReftableStack) Refs(prefix string) ([]ReftableRef, error) {
+	records, err := s.mergeRefs(0, len(s.tables), prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []ReftableRef
+	for _, ref := range records {
+		if !ref.Deleted {
+			refs = append(refs, ref)
+		}
+	}
+	return refs, nil
+}
+
+// Logs returns the reflog of the ref with the given name, newest first. If
+// name is empty, the reflogs of every ref are returned, sorted by name. Entries
+// hidden by tombstones are left out.
+func (s *ReftableStack) Logs(name string) ([]ReftableLog, error) {
+	records, err := s.mergeLogs(0, len(s.tables), name)
+	if err != nil {
+		return nil, err
+	}
+
+	var logs []ReftableLog
+	for _, log := range records {
+		if !log.Deleted {
+			logs = append(logs, log)
+		}
+	}
+	return logs, nil
+}
+
+// mergeRefs returns the newest record of every ref with the given prefix in
+// the tables in the range [start, end), sorted by name.
+func (s *ReftableStack) mergeRefs(start, end int, prefix string) ([]ReftableRef, error) {
+	seen := make(map[string]bool)
+	var refs []ReftableRef
+	for i := end - 1; i >= start; i-- {
+		records, err := s.tables[i].Refs(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range records {
+			if !seen[ref.Name] {
+				seen[ref.Name] = true
+				refs = append(refs, ref)
+			}
+		}
+	}
+	sort.Sort(reftableRefsByName(refs))
+	return refs, nil
+}
+
+// mergeLogs returns the newest log record for every ref and update index in
+// the tables in the range [start, end), sorted by name and then newest first.
+func (s *ReftableStack) mergeLogs(start, end int, name string) ([]ReftableLog, error) {
+	type key struct {
+		name        string
+		updateIndex uint64
+	}
+	seen := make(map[key]bool)
+	var logs []ReftableLog
+	for i := end - 1; i >= start; i-- {
+		records, err := s.tables[i].Logs(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, log := range records {
+			if k := (key{log.Name, log.UpdateIndex}); !seen[k] {
+				seen[k] = true
+				logs = append(logs, log)
+			}
+		}
+	}
+	sort.Sort(reftableLogsByKey(logs))
+	return logs, nil
+}
+
+// Add adds a table to the top of this stack. The file "tables.list.lock" is
+// held throughout, and ErrReftableLocked is returned if it already exists.
+// Once the lock is taken, the stack is reloaded and write is called with the
+// update index that the new table receives, so that it can check the current
+// values of refs before it returns the records of the table. If write returns
+// no records, no table is added.
+//
+// Once the table has been added and the lock released, the stack is compacted
+// as needed. Failure to compact is not an error, as the stack can be compacted
+// later.
+func (s *ReftableStack) Add(write func(s *ReftableStack, updateIndex uint64) ([]ReftableRef, []ReftableLog, error)) error {
+	lock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	if err := s.Reload(); err != nil {
+		return err
+	}
+	updateIndex := s.NextUpdateIndex()
+	refs, logs, err := write(s, updateIndex)
+	if err != nil {
+		return err
+	} else if len(refs) == 0 && len(logs) == 0 {
+		return nil
+	}
+
+	table, err := NewReftable(refs, logs, ReftableOptions{
+		BlockSize:      s.BlockSize,
+		MinUpdateIndex: updateIndex,
+		MaxUpdateIndex: updateIndex,
+	})
+	if err != nil {
+		return err
+	}
+	name, err := s.writeTable(table)
+	if err != nil {
+		return err
+	}
+
+	names := append(s.Tables(), name)
+	if err := s.commitList(lock, names); err != nil {
+		os.Remove(filepath.Join(s.dir, name))
+		return err
+	}
+	s.names, s.tables = names, append(s.tables, table)
+
+	s.AutoCompact()
+	return nil
+}
+
+// AutoCompact compacts the segment of this stack that keeps its tables from
+// forming a geometric sequence, if there is one. See the documentation on
+// ReftableStack for more details.
+func (s *ReftableStack) AutoCompact() error {
+	lock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	if err := s.Reload(); err != nil {
+		return err
+	}
+	return s.autoCompactLocked(lock)
+}
+
+// CompactAll merges every table of this stack into a single table, dropping
+// tombstones along the way.
+func (s *ReftableStack) CompactAll() error {
+	lock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	if err := s.Reload(); err != nil {
+		return err
+	}
+	return s.compactLocked(lock, 0, len(s.tables))
+}
+
+func (s *ReftableStack) autoCompactLocked(lock *reftableLock) error {
+	sizes := make([]uint64, len(s.tables))
+	for i, table := range s.tables {
+		sizes[i] = uint64(table.Size() - (table.headerSize - 1))
+	}
+	start, end := suggestReftableCompaction(sizes, reftableCompactionFactor)
+	if end-start < 2 {
+		return nil
+	}
+	return s.compactLocked(lock, start, end)
+}
+
+// suggestReftableCompaction returns the range [start, end) of tables that need
+// to be merged for the given sizes, oldest first, to form a geometric sequence
+// with the given factor, in the same way that Git does. An empty range is
+// returned if they already form one.
+func suggestReftableCompaction(sizes []uint64, factor uint64) (int, int) {
+	if len(sizes) <= 1 {
+		return 0, 0
+	}
+
+	// Find the newest table that is too large compared to the one below it.
+	// Merging tables from there downwards restores the sequence.
+	i := len(sizes) - 1
+	end := 0
+	var total uint64
+	for ; i > 0; i-- {
+		if sizes[i-1] < sizes[i]*factor {
+			end, total = i+1, sizes[i]
+			break
+		}
+	}
+	if end == 0 {
+		return 0, 0
+	}
+
+	// Each table below is compared against the accumulated size of the tables
+	// above it, as the segment is merged from its end backwards.
+	start := end - 1
+	for ; i > 0; i-- {
+		current := total
+		total += sizes[i-1]
+		if sizes[i-1] >= current*factor {
+			break
+		}
+		start = i - 1
+	}
+	return start, end
+}
+
+// compactLocked merges the tables in the range [start, end) into a single
+// table. Tombstones are dropped when the range starts at the bottom of the
+// stack, as there is nothing left for them to hide.
+func (s *ReftableStack) compactLocked(lock *reftableLock, start, end int) error {
+	if end-start < 1 || (end-start == 1 && start != 0) {
+		return nil
+	}
+
+	refs, err := s.mergeRefs(start, end, "")
+	if err != nil {
+		return err
+	}
+	logs, err := s.mergeLogs(start, end, "")
+	if err != nil {
+		return err
+	}
+	if start == 0 {
+		live := refs[:0]
+		for _, ref := range refs {
+			if !ref.Deleted {
+				live = append(live, ref)
+			}
+		}
+		refs = live
+		liveLogs := logs[:0]
+		for _, log := range logs {
+			if !log.Deleted {
+				liveLogs = append(liveLogs, log)
+			}
+		}
+		logs = liveLogs
+	}
+
+	table, err := NewReftable(refs, logs, ReftableOptions{
+		BlockSize:      s.BlockSize,
+		MinUpdateIndex: s.tables[start].MinUpdateIndex(),
+		MaxUpdateIndex: s.tables[end-1].MaxUpdateIndex(),
+	})
+	if err != nil {
+		return err
+	}
+	name, err := s.writeTable(table)
+	if err != nil {
+		return err
+	}
+
+	names := append(append(append([]string(nil), s.names[:start]...), name), s.names[end:]...)
+	tables := append(append(append([]*Reftable(nil), s.tables[:start]...), table), s.tables[end:]...)
+	if err := s.commitList(lock, names); err != nil {
+		os.Remove(filepath.Join(s.dir, name))
+		return err
+	}
+
+	for _, old := range s.names[start:end] {
+		os.Remove(filepath.Join(s.dir, old))
+	}
+	s.names, s.tables = names, tables
+	return nil
+}
+
+// reftableLock is the lock file of the list of tables. It is held until it is
+// either released or renamed over the list.
+type reftableLock struct {
+	file *os.File
+	held bool
+}
+
+func (l *reftableLock) release() {
+	if l.held {
+		l.file.Close()
+		os.Remove(l.file.Name())
+		l.held = false
+	}
+}
+
+// lock creates the lock file of the list of tables.
+func (s *ReftableStack) lock() (*reftableLock, error) {
+	if err := os.MkdirAll(s.dir, os.FileMode(0755)); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(s.dir, ReftableListName+".lock")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(0644))
+	if os.IsExist(err) {
+		return nil, ErrReftableLocked
+	} else if err != nil {
+		return nil, err
+	}
+	return &reftableLock{file: file, held: true}, nil
+}
+
+// commitList writes the given names of tables to the lock file and renames it
+// over the list of tables, which releases the lock.
+func (s *ReftableStack) commitList(lock *reftableLock, names []string) error {
+	var buffer bytes.Buffer
+	for _, name := range names {
+		buffer.WriteString(name + "\n")
+	}
+
+	if _, err := lock.file.Write(buffer.Bytes()); err != nil {
+		return err
+	} else if err := lock.file.Close(); err != nil {
+		return err
+	} else if err := os.Rename(lock.file.Name(), filepath.Join(s.dir, ReftableListName)); err != nil {
+		return err
+	}
+	lock.held = false
+	return nil
+}
+
+// writeTable writes the given table to a new file in the directory of this
+// stack, named after its range of update indices, and returns its name.
+func (s *ReftableStack) writeTable(table *Reftable) (string, error) {
+	temp, err := ioutil.TempFile(s.dir, "tmp_table")
+	if err != nil {
+		return "", err
+	}
+	_, err = temp.ReadFrom(table.Reader())
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return "", err
+	}
+
+	name := fmt.Sprintf("0x%012x-0x%012x-%08x.ref", table.MinUpdateIndex(), table.MaxUpdateIndex(), rand.Uint32())
+	if err := os.Rename(temp.Name(), filepath.Join(s.dir, name)); err != nil {
+		os.Remove(temp.Name())
+		return "", err
+	}
+	return name, nil
+}
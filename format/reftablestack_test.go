@@ -0,0 +1,149 @@
+package format
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSuggestReftableCompaction(t *testing.T) {
+	for _, test := range []struct {
+		sizes      []uint64
+		start, end int
+	}{
+		{nil, 0, 0},
+		{[]uint64{100}, 0, 0},
+		{[]uint64{512, 256, 128, 64}, 0, 0},
+		{[]uint64{512, 256, 128, 100}, 0, 4},
+		{[]uint64{1000, 256, 128, 100}, 1, 4},
+		{[]uint64{512, 64, 64, 64}, 1, 4},
+		{[]uint64{64, 64, 64, 64}, 0, 4},
+		{[]uint64{2048, 1024, 100, 64}, 2, 4},
+		{[]uint64{4096, 100, 1024, 512}, 1, 3},
+	} {
+		start, end := suggestReftableCompaction(test.sizes, reftableCompactionFactor)
+		if start != test.start || end != test.end {
+			t.Errorf("suggestReftableCompaction(%v) = [%d, %d), want [%d, %d)",
+				test.sizes, start, end, test.start, test.end)
+		}
+	}
+}
+
+func TestReftableStack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reftable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stack, err := OpenReftableStack(dir)
+	if err != nil {
+		t.Fatalf("OpenReftableStack() returned error %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		err := stack.Add(func(s *ReftableStack, updateIndex uint64) ([]ReftableRef, []ReftableLog, error) {
+			if updateIndex != uint64(i+1) {
+				t.Errorf("Add() gave update index %d, want %d", updateIndex, i+1)
+			}
+			refs := []ReftableRef{{Name: "refs/heads/master", UpdateIndex: updateIndex, Sha1: reftableTestSha1(i)}}
+			if i%2 == 0 {
+				refs = append(refs, ReftableRef{Name: fmt.Sprintf("refs/tags/v%d", i), UpdateIndex: updateIndex, Sha1: reftableTestSha1(i)})
+			}
+			logs := []ReftableLog{{Name: "refs/heads/master", UpdateIndex: updateIndex, ReflogEntry: ReflogEntry{Old: reftableTestSha1(i - 1), New: reftableTestSha1(i)}}}
+			return refs, logs, nil
+		})
+		if err != nil {
+			t.Fatalf("Add() returned error %v", err)
+		}
+	}
+
+	if n := len(stack.Tables()); n > 5 {
+		t.Errorf("Add() left %d tables after auto-compaction", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ReftableListName+".lock")); !os.IsNotExist(err) {
+		t.Errorf("Add() left the lock behind")
+	}
+
+	err = stack.Add(func(s *ReftableStack, updateIndex uint64) ([]ReftableRef, []ReftableLog, error) {
+		return []ReftableRef{{Name: "refs/tags/v0", UpdateIndex: updateIndex, Deleted: true}},
+			[]ReftableLog{{Name: "refs/heads/master", UpdateIndex: 1, Deleted: true}}, nil
+	})
+	if err != nil {
+		t.Fatalf("Add() returned error %v", err)
+	}
+
+	reopened, err := OpenReftableStack(dir)
+	if err != nil {
+		t.Fatalf("OpenReftableStack() returned error %v", err)
+	}
+	check := func(stack *ReftableStack) {
+		if ref, ok, err := stack.Ref("refs/heads/master"); err != nil || !ok || ref.Sha1 != reftableTestSha1(19) {
+			t.Errorf("Ref() = %+v, %v, %v", ref, ok, err)
+		}
+		if _, ok, err := stack.Ref("refs/tags/v0"); err != nil || ok {
+			t.Errorf("Ref() of a deleted ref = %v, %v", ok, err)
+		}
+		if tags, err := stack.Refs("refs/tags/"); err != nil || len(tags) != 9 || tags[0].Name != "refs/tags/v10" {
+			t.Errorf("Refs() = %+v, %v", tags, err)
+		}
+		logs, err := stack.Logs("refs/heads/master")
+		if err != nil || len(logs) != 19 {
+			t.Fatalf("Logs() returned %d entries, %v", len(logs), err)
+		}
+		if logs[0].UpdateIndex != 20 || logs[18].UpdateIndex != 2 {
+			t.Errorf("Logs() = %+v", logs)
+		}
+	}
+	check(reopened)
+
+	if err := reopened.CompactAll(); err != nil {
+		t.Fatalf("CompactAll() returned error %v", err)
+	}
+	if n := len(reopened.Tables()); n != 1 {
+		t.Errorf("CompactAll() left %d tables", n)
+	}
+	check(reopened)
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf("CompactAll() left %d files behind", len(files))
+	}
+	refs, _ := reopened.tables[0].Refs("")
+	logs, _ := reopened.tables[0].Logs("")
+	if len(refs) != 10 || len(logs) != 19 {
+		t.Errorf("CompactAll() kept %d refs and %d logs, want no tombstones", len(refs), len(logs))
+	}
+
+	clone := reopened.Clone()
+	err = clone.Add(func(s *ReftableStack, updateIndex uint64) ([]ReftableRef, []ReftableLog, error) {
+		return []ReftableRef{{Name: "refs/heads/topic", UpdateIndex: updateIndex, Sha1: reftableTestSha1(0)}}, nil, nil
+	})
+	if err != nil {
+		t.Fatalf("Add() returned error %v", err)
+	}
+	if n := len(reopened.Tables()); n != 1 {
+		t.Errorf("Add() to a clone changed the original stack to %d tables", n)
+	}
+	for _, stale := range []*ReftableStack{stack, reopened} {
+		if err := stale.Refresh(); err != nil {
+			t.Fatalf("Refresh() returned error %v", err)
+		}
+		if !reflect.DeepEqual(stale.Tables(), clone.Tables()) {
+			t.Errorf("Refresh() gave tables %v, want %v", stale.Tables(), clone.Tables())
+		}
+	}
+	table := reopened.tables[0]
+	if err := reopened.Refresh(); err != nil || reopened.tables[0] != table {
+		t.Errorf("Refresh() of an up-to-date stack reopened its tables: %v", err)
+	}
+
+	lock, _ := os.Create(filepath.Join(dir, ReftableListName+".lock"))
+	lock.Close()
+	if err := reopened.CompactAll(); err != ErrReftableLocked {
+		t.Errorf("CompactAll() with a held lock returned %v", err)
+	}
+}
@@ -0,0 +1,427 @@
+package format
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"sort"
+
+	"github.com/kourge/ggit/core"
+)
+
+// reftableWriterRecord is a record that is about to be written to a block.
+type reftableWriterRecord struct {
+	key     []byte
+	valType byte
+	value   []byte
+}
+
+// reftableBlockWriter accumulates the records of a single block. The restart
+// table and the block length are filled in by finish.
+type reftableBlockWriter struct {
+	typ        byte
+	position   int64
+	headerSize int
+	limit      int
+	data       []byte
+	restarts   []int
+	lastKey    []byte
+	entries    int
+}
+
+// add appends a record to the block with its key prefix-compressed against the
+// key of the previous record, unless the record is a restart point. It returns
+// false if the record would not fit within the block.
+func (b *reftableBlockWriter) add(record reftableWriterRecord) bool {
+	restart := b.entries%reftableRestartInterval == 0
+	prefix := 0
+	if !restart {
+		for prefix < len(b.lastKey) && prefix < len(record.key) && b.lastKey[prefix] == record.key[prefix] {
+			prefix++
+		}
+	}
+
+	encoded := encodePackEntryBaseOffset(int64(prefix))
+	encoded = append(encoded, encodePackEntryBaseOffset(int64(len(record.key)-prefix)<<3|int64(record.valType))...)
+	encoded = append(encoded, record.key[prefix:]...)
+	encoded = append(encoded, record.value...)
+
+	restarts := len(b.restarts)
+	if restart {
+		restarts++
+	}
+	if b.limit > 0 && len(b.data)+len(encoded)+3*restarts+2 > b.limit {
+		return false
+	}
+
+	if restart {
+		b.restarts = append(b.restarts, len(b.data))
+	}
+	b.data = append(b.data, encoded...)
+	b.lastKey = record.key
+	b.entries++
+	return true
+}
+
+// finish appends the restart table and returns the block as it is stored in
+// the table: log blocks are compressed and other blocks are padded to the given
+// block size.
+func (b *reftableBlockWriter) finish(blockSize int) ([]byte, error) {
+	for _, restart := range b.restarts {
+		var offset [3]byte
+		putUint24(offset[:], restart)
+		b.data = append(b.data, offset[:]...)
+	}
+	var count [2]byte
+	binary.BigEndian.PutUint16(count[:], uint16(len(b.restarts)))
+	b.data = append(b.data, count[:]...)
+	putUint24(b.data[b.headerSize+1:], len(b.data))
+
+	if b.typ != reftableBlockLog {
+		if padding := blockSize - len(b.data); padding > 0 {
+			b.data = append(b.data, make([]byte, padding)...)
+		}
+		return b.data, nil
+	}
+
+	buffer := bytes.NewBuffer(append([]byte(nil), b.data[:b.headerSize+4]...))
+	z := zlib.NewWriter(buffer)
+	if _, err := z.Write(b.data[b.headerSize+4:]); err != nil {
+		return nil, err
+	} else if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// reftableWriter lays out the sections of a table one block at a time.
+type reftableWriter struct {
+	buffer    bytes.Buffer
+	header    []byte
+	blockSize int
+}
+
+func (w *reftableWriter) newBlock(typ byte) *reftableBlockWriter {
+	b := &reftableBlockWriter{typ: typ, position: int64(w.buffer.Len()), limit: w.blockSize}
+	if b.position == 0 {
+		b.headerSize = len(w.header)
+		b.data = append(b.data, w.header...)
+	}
+	b.data = append(b.data, typ, 0, 0, 0)
+	return b
+}
+
+// writeBlocks writes the given records into as many blocks of the given type
+// as they need, calling placed with the index of each record and the position
+// of the block it went into. It returns an index record for each block. Log
+// records that do not fit in an empty block get a block of their own, while
+// other records that do not are an error.
+func (w *reftableWriter) writeBlocks(typ byte, records []reftableWriterRecord, placed func(int, int64)) ([]reftableWriterRecord, error) {
+	var index []reftableWriterRecord
+	flush := func(b *reftableBlockWriter) error {
+		data, err := b.finish(w.blockSize)
+		if err != nil {
+			return err
+		}
+		w.buffer.Write(data)
+		index = append(index, reftableWriterRecord{b.lastKey, 0, encodePackEntryBaseOffset(b.position)})
+		return nil
+	}
+
+	var b *reftableBlockWriter
+	for i, record := range records {
+		if b != nil && !b.add(record) {
+			if err := flush(b); err != nil {
+				return nil, err
+			}
+			b = nil
+		}
+		if b == nil {
+			b = w.newBlock(typ)
+			if !b.add(record) {
+				if typ != reftableBlockLog {
+					return nil, ErrReftableEntryTooBig
+				}
+				b.limit = 0
+				b.add(record)
+			}
+		}
+		if placed != nil {
+			placed(i, b.position)
+		}
+	}
+	if b != nil {
+		if err := flush(b); err != nil {
+			return nil, err
+		}
+	}
+	return index, nil
+}
+
+// writeSection writes the given records as a section of the given type,
+// followed by as many levels of index blocks as it takes for the root level to
+// have no more than reftableIndexThreshold entries. It returns the position of
+// the first block of the section and the position of the root index, or zero if
+// no index was needed.
+func (w *reftableWriter) writeSection(typ byte, records []reftableWriterRecord, placed func(int, int64)) (uint64, uint64, error) {
+	position := uint64(w.buffer.Len())
+	index, err := w.writeBlocks(typ, records, placed)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var root uint64
+	for len(index) > reftableIndexThreshold {
+		root = uint64(w.buffer.Len())
+		if index, err = w.writeBlocks(reftableBlockIndex, index, nil); err != nil {
+			return 0, 0, err
+		}
+	}
+	return position, root, nil
+}
+
+// NewReftable writes a table that holds the given ref and log records, which
+// need not be sorted, but may not contain two records for the same ref or two
+// log records for the same ref and update index. The update index of every ref
+// record must lie within the range of the table, whereas log records may fall
+// outside of it, as a tombstone refers to the entry that it hides by its update
+// index. See the documentation on ReftableOptions for more details.
+//
+// The table is laid out the way Git lays it out: ref blocks, followed by obj
+// blocks if the ref blocks needed an index, followed by log blocks, with an
+// index after each section that spans more than a few blocks. Every object that
+// a ref points or peels to is listed in the obj blocks.
+func NewReftable(refs []ReftableRef, logs []ReftableLog, o ReftableOptions) (*Reftable, error) {
+	if o.BlockSize == 0 {
+		o.BlockSize = DefaultReftableBlockSize
+	} else if o.BlockSize >= 1<<24 {
+		return nil, Errorf("reftable block size %d is too large", o.BlockSize)
+	}
+
+	refs = append([]ReftableRef(nil), refs...)
+	sort.Sort(reftableRefsByName(refs))
+	logs = append([]ReftableLog(nil), logs...)
+	sort.Sort(reftableLogsByKey(logs))
+
+	if o.MinUpdateIndex == 0 && o.MaxUpdateIndex == 0 {
+		o.MinUpdateIndex = ^uint64(0)
+		for _, ref := range refs {
+			o.MinUpdateIndex, o.MaxUpdateIndex = widenRange(o.MinUpdateIndex, o.MaxUpdateIndex, ref.UpdateIndex)
+		}
+		for _, log := range logs {
+			o.MinUpdateIndex, o.MaxUpdateIndex = widenRange(o.MinUpdateIndex, o.MaxUpdateIndex, log.UpdateIndex)
+		}
+		if o.MinUpdateIndex > o.MaxUpdateIndex {
+			o.MinUpdateIndex = 0
+		}
+	}
+
+	refRecords := make([]reftableWriterRecord, len(refs))
+	for i, ref := range refs {
+		if i > 0 && refs[i-1].Name == ref.Name {
+			return nil, Errorf("duplicate reftable ref record for %s", ref.Name)
+		} else if ref.UpdateIndex < o.MinUpdateIndex || ref.UpdateIndex > o.MaxUpdateIndex {
+			return nil, Errorf("update index %d of %s is out of range", ref.UpdateIndex, ref.Name)
+		}
+		refRecords[i] = encodeReftableRef(ref, o.MinUpdateIndex)
+	}
+
+	logRecords := make([]reftableWriterRecord, len(logs))
+	for i := range logs {
+		log := &logs[i]
+		if i > 0 && logs[i-1].Name == log.Name && logs[i-1].UpdateIndex == log.UpdateIndex {
+			return nil, Errorf("duplicate reftable log record for %s at %d", log.Name, log.UpdateIndex)
+		}
+		logRecords[i] = encodeReftableLog(log)
+	}
+
+	header := make([]byte, reftableHeaderSizeV1)
+	copy(header, reftableMagic[:])
+	header[4] = 1
+	putUint24(header[5:], int(o.BlockSize))
+	binary.BigEndian.PutUint64(header[8:], o.MinUpdateIndex)
+	binary.BigEndian.PutUint64(header[16:], o.MaxUpdateIndex)
+
+	w := &reftableWriter{header: header, blockSize: int(o.BlockSize)}
+
+	objects := make(map[core.Sha1][]int64)
+	addObject := func(hash core.Sha1, position int64) {
+		positions := objects[hash]
+		if hash.IsEmpty() || (len(positions) > 0 && positions[len(positions)-1] == position) {
+			return
+		}
+		objects[hash] = append(positions, position)
+	}
+	_, refIndex, err := w.writeSection(reftableBlockRef, refRecords, func(i int, position int64) {
+		if ref := refs[i]; !ref.Deleted && ref.Target == "" {
+			addObject(ref.Sha1, position)
+			addObject(ref.Peeled, position)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var objPosition, objIndex uint64
+	objIdLength := 0
+	if refIndex != 0 && len(objects) > 0 {
+		var objRecords []reftableWriterRecord
+		objRecords, objIdLength = encodeReftableObjs(objects)
+		if objPosition, objIndex, err = w.writeSection(reftableBlockObj, objRecords, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	var logPosition, logIndex uint64
+	if len(logRecords) > 0 {
+		if logPosition, logIndex, err = w.writeSection(reftableBlockLog, logRecords, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if w.buffer.Len() == 0 {
+		w.buffer.Write(header)
+	}
+	footer := append([]byte(nil), header...)
+	for _, field := range []uint64{refIndex, objPosition<<5 | uint64(objIdLength), objIndex, logPosition, logIndex} {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], field)
+		footer = append(footer, b[:]...)
+	}
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(footer))
+	footer = append(footer, crc[:]...)
+	w.buffer.Write(footer)
+
+	table := &Reftable{}
+	if err := table.Decode(&w.buffer); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+func widenRange(min, max, value uint64) (uint64, uint64) {
+	if value < min {
+		min = value
+	}
+	if value > max {
+		max = value
+	}
+	return min, max
+}
+
+func encodeReftableRef(ref ReftableRef, minUpdateIndex uint64) reftableWriterRecord {
+	record := reftableWriterRecord{key: []byte(ref.Name)}
+	record.value = encodePackEntryBaseOffset(int64(ref.UpdateIndex - minUpdateIndex))
+	switch {
+	case ref.Deleted:
+		record.valType = reftableValueDeletion
+	case ref.Target != "":
+		record.valType = reftableValueSymref
+		record.value = appendReftableString(record.value, ref.Target)
+	case !ref.Peeled.IsEmpty():
+		record.valType = reftableValuePeeled
+		record.value = append(record.value, ref.Sha1[:]...)
+		record.value = append(record.value, ref.Peeled[:]...)
+	default:
+		record.valType = reftableValueSha1
+		record.value = append(record.value, ref.Sha1[:]...)
+	}
+	return record
+}
+
+func encodeReftableLog(log *ReftableLog) reftableWriterRecord {
+	record := reftableWriterRecord{key: log.key()}
+	if log.Deleted {
+		record.valType = reftableLogDeletion
+		return record
+	}
+
+	record.valType = reftableLogUpdate
+	record.value = append(record.value, log.Old[:]...)
+	record.value = append(record.value, log.New[:]...)
+	record.value = appendReftableString(record.value, log.Committer.Name)
+	record.value = appendReftableString(record.value, log.Committer.Email)
+
+	sec := log.Committer.Unix()
+	if sec < 0 {
+		sec = 0
+	}
+	record.value = append(record.value, encodePackEntryBaseOffset(sec)...)
+	_, offset := log.Committer.Zone()
+	minutes := offset / 60
+	var tz [2]byte
+	binary.BigEndian.PutUint16(tz[:], uint16(int16(minutes/60*100+minutes%60)))
+	record.value = append(record.value, tz[:]...)
+
+	message := log.Message
+	if message != "" {
+		message += "\n"
+	}
+	record.value = appendReftableString(record.value, message)
+	return record
+}
+
+// encodeReftableObjs returns an obj record for each of the given objects along
+// with the length of the abbreviated object IDs that serve as their keys, which
+// is the shortest length that keeps every key unique.
+func encodeReftableObjs(objects map[core.Sha1][]int64) ([]reftableWriterRecord, int) {
+	hashes := make([]core.Sha1, 0, len(objects))
+	for hash := range objects {
+		hashes = append(hashes, hash)
+	}
+	sort.Sort(core.Sha1Slice(hashes))
+
+	common := 0
+	for i := 1; i < len(hashes); i++ {
+		n := 0
+		for n < len(hashes[i]) && hashes[i-1][n] == hashes[i][n] {
+			n++
+		}
+		if n > common {
+			common = n
+		}
+	}
+	length := common + 1
+
+	records := make([]reftableWriterRecord, len(hashes))
+	for i, hash := range hashes {
+		positions := objects[hash]
+		record := reftableWriterRecord{key: append([]byte(nil), hash[:length]...)}
+		if len(positions) < 8 {
+			record.valType = byte(len(positions))
+		} else {
+			record.value = encodePackEntryBaseOffset(int64(len(positions)))
+		}
+		last := int64(0)
+		for _, position := range positions {
+			record.value = append(record.value, encodePackEntryBaseOffset(position-last)...)
+			last = position
+		}
+		records[i] = record
+	}
+	return records, length
+}
+
+func appendReftableString(b []byte, s string) []byte {
+	b = append(b, encodePackEntryBaseOffset(int64(len(s)))...)
+	return append(b, s...)
+}
+
+type reftableRefsByName []ReftableRef
+
+func (refs reftableRefsByName) Len() int           { return len(refs) }
+func (refs reftableRefsByName) Less(i, j int) bool { return refs[i].Name < refs[j].Name }
+func (refs reftableRefsByName) Swap(i, j int)      { refs[i], refs[j] = refs[j], refs[i] }
+
+type reftableLogsByKey []ReftableLog
+
+func (logs reftableLogsByKey) Len() int { return len(logs) }
+func (logs reftableLogsByKey) Less(i, j int) bool {
+	if logs[i].Name != logs[j].Name {
+		return logs[i].Name < logs[j].Name
+	}
+	return logs[i].UpdateIndex > logs[j].UpdateIndex
+}
+func (logs reftableLogsByKey) Swap(i, j int) { logs[i], logs[j] = logs[j], logs[i] }
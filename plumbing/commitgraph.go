@@ -0,0 +1,152 @@
+package plumbing
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+)
+
+// CommitGraph loads the commit graph of this repository, which is either
+// a split commit graph chain or a single commit graph file. If the repository
+// has no commit graph, an error satisfying os.IsNotExist is returned.
+func (repo *Repository) CommitGraph() (*format.CommitGraph, error) {
+	return format.OpenCommitGraph(filepath.Join(repo.path, "objects"))
+}
+
+// WriteCommitGraphOptions contains all the possible options for
+// WriteCommitGraph.
+//
+// Tips is a slice of SHA-1 checksums of the commits from which reachable
+// commits are collected. Annotated tags are peeled to the commits they point
+// to.
+//
+// Split is a bool that, when set to true, causes the commits that are not yet
+// in the existing commit graph to be written as a new layer on top of it in
+// a split commit graph chain. Otherwise, a single commit graph file holding
+// every reachable commit replaces any existing commit graph.
+type WriteCommitGraphOptions struct {
+	Tips  []core.Sha1
+	Split bool
+}
+
+// WriteCommitGraph builds a commit graph out of all the commits reachable from
+// the given tips and writes it to this repository. Equivalent to
+// `git commit-graph write`. See the documentation on WriteCommitGraphOptions
+// for more details. The commit graph returned is the one that was written.
+func (repo *Repository) WriteCommitGraph(o WriteCommitGraphOptions) (*format.CommitGraph, error) {
+	objectsDir := filepath.Join(repo.path, "objects")
+
+	var base *format.CommitGraph
+	if o.Split {
+		if existing, err := repo.CommitGraph(); err == nil {
+			base = existing
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	commits, err := repo.reachableCommits(o.Tips, base)
+	if err != nil {
+		return nil, err
+	}
+
+	if !o.Split {
+		graph, err := format.NewCommitGraph(commits, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		path := filepath.Join(objectsDir, "info", "commit-graph")
+		if err := writeFileAtomically(path, graph.Reader(), DefaultObjectFileMode); err != nil {
+			return nil, err
+		}
+		return graph, os.RemoveAll(filepath.Join(objectsDir, "info", "commit-graphs"))
+	}
+
+	if base != nil && len(commits) == 0 {
+		return base, nil
+	}
+
+	// A single commit graph file becomes the bottom-most layer of the chain.
+	// It is copied into place and only removed once the chain that refers to
+	// the copy has been written, so that the repository is never left without
+	// a usable commit graph.
+	single := filepath.Join(objectsDir, "info", "commit-graph")
+	retireSingle := false
+	if base != nil && base.Base() == nil {
+		if file, err := os.Open(single); err == nil {
+			err := writeFileAtomically(format.CommitGraphLayerPath(objectsDir, base.Sha1()), file, DefaultObjectFileMode)
+			file.Close()
+			if err != nil {
+				return nil, err
+			}
+			retireSingle = true
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	graph, err := format.NewCommitGraph(commits, base)
+	if err != nil {
+		return nil, err
+	}
+
+	layerPath := format.CommitGraphLayerPath(objectsDir, graph.Sha1())
+	if err := writeFileAtomically(layerPath, graph.Reader(), DefaultObjectFileMode); err != nil {
+		return nil, err
+	}
+
+	chain := &format.CommitGraphChain{}
+	for g := graph; g != nil; g = g.Base() {
+		chain.Layers = append([]core.Sha1{g.Sha1()}, chain.Layers...)
+	}
+	chainPath := filepath.Join(objectsDir, "info", "commit-graphs", "commit-graph-chain")
+	if err := writeFileAtomically(chainPath, chain.Reader(), DefaultObjectFileMode); err != nil {
+		return nil, err
+	}
+
+	if retireSingle {
+		if err := os.Remove(single); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return graph, nil
+}
+
+// reachableCommits collects every commit reachable from the given tips that
+// is not already in the given commit graph, which may be nil.
+func (repo *Repository) reachableCommits(tips []core.Sha1, graph *format.CommitGraph) (map[core.Sha1]*core.Commit, error) {
+	commits := make(map[core.Sha1]*core.Commit)
+	queue := make([]core.Sha1, len(tips))
+	copy(queue, tips)
+
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+
+		if _, seen := commits[hash]; seen {
+			continue
+		} else if _, inGraph := graph.Position(hash); inGraph {
+			continue
+		}
+
+		object, err := repo.ObjectBySha1(hash)
+		if err != nil {
+			return nil, err
+		}
+
+		switch object := object.(type) {
+		case *core.Commit:
+			commits[hash] = object
+			queue = append(queue, object.Parents()...)
+		case *core.Tag:
+			queue = append(queue, object.Object())
+		default:
+			return nil, Errorf("%s is a %s, not a commit", hash, object.Type())
+		}
+	}
+
+	return commits, nil
+}
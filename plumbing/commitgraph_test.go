@@ -0,0 +1,83 @@
+package plumbing
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+)
+
+func TestRepository_WriteCommitGraph(t *testing.T) {
+	repo, c, cleanup := _fixtureRevWalkRepo(t)
+	defer cleanup()
+
+	objectsDir := filepath.Join(repo.Path(), "objects")
+	single := filepath.Join(objectsDir, "info", "commit-graph")
+	chainPath := filepath.Join(objectsDir, "info", "commit-graphs", "commit-graph-chain")
+
+	if _, err := repo.CommitGraph(); !os.IsNotExist(err) {
+		t.Fatalf("CommitGraph() without a commit graph returned error %v", err)
+	}
+
+	written, err := repo.WriteCommitGraph(WriteCommitGraphOptions{Tips: []core.Sha1{c["a3"]}})
+	if err != nil {
+		t.Fatalf("WriteCommitGraph() returned error %v", err)
+	}
+	graph, err := repo.CommitGraph()
+	if err != nil {
+		t.Fatalf("CommitGraph() returned error %v", err)
+	} else if graph.Sha1() != written.Sha1() || graph.Len() != 3 || graph.Base() != nil {
+		t.Errorf("CommitGraph() has %d commits in layer %s, want 3 in %s", graph.Len(), graph.Sha1(), written.Sha1())
+	}
+
+	// A split write that fails partway leaves the single file in place.
+	if err := os.MkdirAll(chainPath, os.FileMode(0755)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.WriteCommitGraph(WriteCommitGraphOptions{Tips: []core.Sha1{c["m"]}, Split: true}); err == nil {
+		t.Errorf("WriteCommitGraph() with an unwritable chain should fail")
+	}
+	if graph, err := format.CommitGraphAtPath(single); err != nil || graph.Len() != 3 {
+		t.Errorf("single commit graph after a failed split write: %v", err)
+	}
+	if err := os.Remove(chainPath); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err = repo.WriteCommitGraph(WriteCommitGraphOptions{Tips: []core.Sha1{c["m"]}, Split: true})
+	if err != nil {
+		t.Fatalf("WriteCommitGraph() with Split returned error %v", err)
+	}
+	if _, err := os.Stat(single); !os.IsNotExist(err) {
+		t.Errorf("single commit graph still exists after a split write: %v", err)
+	}
+	graph, err = repo.CommitGraph()
+	if err != nil {
+		t.Fatalf("CommitGraph() returned error %v", err)
+	} else if graph.Sha1() != written.Sha1() || graph.Len() != 6 || graph.Base() == nil || graph.Base().Len() != 3 {
+		t.Errorf("CommitGraph() after a split write has %d commits", graph.Len())
+	}
+	for name, hash := range c {
+		if _, found := graph.Position(hash); !found {
+			t.Errorf("commit %s is missing from the commit graph", name)
+		}
+	}
+
+	// With nothing new to add, a split write leaves the chain alone.
+	if again, err := repo.WriteCommitGraph(WriteCommitGraphOptions{Tips: []core.Sha1{c["m"]}, Split: true}); err != nil || again.Sha1() != graph.Sha1() {
+		t.Errorf("WriteCommitGraph() with nothing new = %v, %v", again, err)
+	}
+
+	// A write without Split collapses the chain back into a single file.
+	if _, err := repo.WriteCommitGraph(WriteCommitGraphOptions{Tips: []core.Sha1{c["m"]}}); err != nil {
+		t.Fatalf("WriteCommitGraph() returned error %v", err)
+	}
+	if _, err := os.Stat(chainPath); !os.IsNotExist(err) {
+		t.Errorf("commit graph chain still exists after a single write: %v", err)
+	}
+	if graph, err := repo.CommitGraph(); err != nil || graph.Len() != 6 || graph.Base() != nil {
+		t.Errorf("CommitGraph() after a single write = %v, %v", graph, err)
+	}
+}
@@ -1,7 +1,13 @@
 package plumbing
 
 import (
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
 
 	"github.com/kourge/ggit/core"
 )
@@ -13,3 +19,132 @@ const (
 
 // Errorf is a wrapper around errors.New(fmt.Sprintf(format, rest...)).
 var Errorf = core.Errorf
+
+// writeFileAtomically drains reader into a temporary file in the same
+// directory as path and then renames the temporary file to path, so that
+// readers never observe a partially written file. The directory is created if
+// it does not exist yet.
+func writeFileAtomically(path string, reader io.Reader, mode os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, os.FileMode(0755)); err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(dir, "tmp_"+filepath.Base(path)+"_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := io.Copy(file, reader); err != nil {
+		return err
+	} else if err := file.Chmod(mode); err != nil {
+		return err
+	} else if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// writeFileWithLock writes the content yielded by reader to path by way of
+// Git's lock file protocol: the content is first written to "<path>.lock",
+// which is created exclusively, and the lock file is then renamed to path. If
+// the lock file already exists, another process is presumed to be updating
+// path, and an error is returned without touching either file.
+func writeFileWithLock(path string, reader io.Reader, mode os.FileMode) error {
+	lockPath := path + ".lock"
+	file, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if os.IsExist(err) {
+		return Errorf("unable to create '%s': file exists", lockPath)
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		os.Remove(lockPath)
+		return err
+	} else if err := file.Close(); err != nil {
+		os.Remove(lockPath)
+		return err
+	}
+
+	if err := os.Rename(lockPath, path); err != nil {
+		os.Remove(lockPath)
+		return err
+	}
+	return nil
+}
+
+// copyExactly copies exactly n bytes from src to dst. An error is returned if
+// src yields fewer or more than n bytes.
+func copyExactly(dst io.Writer, src io.Reader, n int64) error {
+	if _, err := io.CopyN(dst, src, n); err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	return expectEOF(src, n)
+}
+
+// expectEOF returns an error unless src, which has already yielded the n
+// bytes it was expected to, is exhausted.
+func expectEOF(src io.Reader, n int64) error {
+	var b [1]byte
+	for {
+		if m, err := src.Read(b[:]); m > 0 {
+			return Errorf("reader yields more than %d bytes", n)
+		} else if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// runBatch calls fn once for every index from 0 up to n, from at most workers
+// goroutines at once, and waits for all of them to return. If workers is not
+// positive, runtime.GOMAXPROCS(0) goroutines are used. Once fn returns an
+// error, no more calls are started, and the error returned for the lowest
+// index is returned.
+func runBatch(n int, workers int, fn func(i int) error) error {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > n {
+		workers = n
+	}
+
+	var (
+		next     int64 = -1
+		failed   int32
+		mutex    sync.Mutex
+		firstErr error
+		firstI   = n
+		wg       sync.WaitGroup
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&failed) == 0 {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n {
+					return
+				}
+				if err := fn(i); err != nil {
+					mutex.Lock()
+					if i < firstI {
+						firstI, firstErr = i, err
+					}
+					mutex.Unlock()
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
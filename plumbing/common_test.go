@@ -0,0 +1,92 @@
+package plumbing
+
+import (
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kourge/ggit/core"
+)
+
+// _fixtureRepo creates an empty repository in a temporary directory. The
+// returned function removes the directory.
+func _fixtureRepo(t *testing.T) (*Repository, func()) {
+	dir, err := ioutil.TempDir("", "ggit-repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"hooks", "info", "objects/pack", "refs/heads", "refs/tags"} {
+		if err := os.MkdirAll(filepath.Join(dir, name), os.FileMode(0755)); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+
+	repo := NewRepository(dir)
+	return repo, func() {
+		repo.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// _writeFixtureObject writes the given object into the repository as a loose
+// object and returns its SHA-1.
+func _writeFixtureObject(t *testing.T, repo *Repository, object core.Object) core.Sha1 {
+	stream := core.NewStream(object)
+	hash := stream.Hash()
+
+	prefix, rest := hash.Split(2)
+	dir := filepath.Join(repo.Path(), "objects", prefix)
+	if err := os.MkdirAll(dir, os.FileMode(0755)); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Create(filepath.Join(dir, rest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	writer := zlib.NewWriter(file)
+	if _, err := io.Copy(writer, stream.Reader()); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return hash
+}
+
+// _writeFixtureCommit writes a commit whose tree holds a single file with the
+// given name and content. The commit is dated sec seconds past a fixed epoch.
+func _writeFixtureCommit(
+	t *testing.T,
+	repo *Repository,
+	parents []core.Sha1,
+	name, content string,
+	sec int64,
+) core.Sha1 {
+	blob := _writeFixtureObject(t, repo, &core.Blob{Content: []byte(content)})
+	tree := _writeFixtureObject(t, repo, core.NewTree([]core.TreeEntry{
+		{Mode: core.GitModeRegular | core.GitModeReadWritable, Name: name, Sha1: blob},
+	}))
+
+	person := core.NewPerson("Jane Doe", "jane@example.com", 1400000000+sec, 0)
+	return _writeFixtureObject(t, repo, core.NewCommit(tree, parents, person, person, name))
+}
+
+// _writeFixtureRef writes a loose ref with the given name and content.
+func _writeFixtureRef(t *testing.T, repo *Repository, name, content string) {
+	path := filepath.Join(repo.Path(), name)
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0755)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content+"\n"), os.FileMode(0644)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,15 +1,19 @@
 package plumbing
 
 import (
-	"compress/zlib"
+	"crypto/sha1"
 	"errors"
+	"fmt"
 	"io"
-	"os"
-	"path/filepath"
 
 	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
 )
 
+// DefaultBigFileThreshold is the size past which a blob is considered big when
+// core.bigFileThreshold is not configured.
+const DefaultBigFileThreshold int64 = 512 << 20
+
 // HashObjectOptions contains all the possible options for HashObject.
 //
 // Type is a string that is a Git object type, such as blob, tree, commit, or
@@ -18,17 +22,32 @@ import (
 // Reader is an io.Reader that represents the byte stream that is to be treated
 // as the hashed object's content. An error is returned if Reader is nil.
 //
+// Size is the number of bytes that Reader yields, if known in advance. When it
+// is positive and Type is blob, the content is hashed and, if Write is true,
+// compressed in a single pass as it is read, so that it is never held in
+// memory in its entirety. An error is returned if Reader yields a different
+// number of bytes. If left unspecified as zero, the content is read into
+// memory and decoded first.
+//
 // Write is a bool that, when set to true, also causes the hashed object to be
 // written to the specified Repo.
 //
 // Repo is a string that is a path to a repository. It is required when Write is
 // true. An error is returned if Write is true and Repo is either unspecified or
 // not a valid repository.
+//
+// PackBigFiles is a bool that, when set to true along with Write, causes a blob
+// whose Size exceeds the core.bigFileThreshold of Repo to be written straight
+// into a pack of its own rather than as a loose object, as `git add` does. The
+// threshold defaults to DefaultBigFileThreshold. As with loose objects, no pack
+// is written if the blob is already in the repository.
 type HashObjectOptions struct {
-	Type   string
-	Reader io.Reader
-	Write  bool
-	Repo   string
+	Type         string
+	Reader       io.Reader
+	Size         int64
+	Write        bool
+	Repo         string
+	PackBigFiles bool
 }
 
 // HashObject calculates the hash for a potential Git object. Equivalent to
@@ -53,48 +72,95 @@ func HashObject(o HashObjectOptions) (hash core.Sha1, err error) {
 		return core.Sha1{}, Errorf("%v is not a valid Type", o.Type)
 	}
 
+	if o.Size > 0 && o.Type == "blob" {
+		return hashObjectStream(o)
+	}
+
 	if err := object.Decode(o.Reader); err != nil {
 		return core.Sha1{}, err
 	}
-	stream := core.NewStream(object)
-	hash = stream.Hash()
+	hash = core.NewStream(object).Hash()
 
 	if !o.Write {
 		return
 	}
 
-	if o.Repo == "" {
-		return hash, errors.New("must specify Repo")
+	repo, err := hashObjectRepo(o)
+	if err != nil {
+		return hash, err
 	}
-	repo := NewRepository(o.Repo)
-	if !repo.IsValid() {
-		return hash, Errorf("not a repo: %s", o.Repo)
+	defer repo.Close()
+	return repo.WriteObject(object)
+}
+
+// errObjectExists aborts the writing of a pack by hashObjectStream when the
+// object that it holds turns out to be in the repository already.
+var errObjectExists = errors.New("object already exists")
+
+// hashObjectStream is the counterpart of HashObject for content of a known
+// size, which is read exactly once.
+func hashObjectStream(o HashObjectOptions) (core.Sha1, error) {
+	if !o.Write {
+		h := sha1.New()
+		fmt.Fprintf(h, "%s %d\x00", o.Type, o.Size)
+		if err := copyExactly(h, o.Reader, o.Size); err != nil {
+			return core.Sha1{}, err
+		}
+		return core.Sha1FromByteSlice(h.Sum(nil)), nil
 	}
 
-	first, rest := hash.Split(2)
-	slot := filepath.Join(o.Repo, "objects", first)
-	if err := os.MkdirAll(slot, os.FileMode(0755)); err != nil {
-		return hash, err
+	repo, err := hashObjectRepo(o)
+	if err != nil {
+		return core.Sha1{}, err
 	}
+	defer repo.Close()
 
-	filepath := filepath.Join(slot, rest)
-	if _, err := os.Stat(filepath); os.IsExist(err) {
-		// If an object with this SHA-1 already exists, there is no need to
-		// write it again.
-		return hash, nil
+	if o.PackBigFiles && o.Size > repo.bigFileThreshold() {
+		var hash core.Sha1
+		_, err := repo.writePack(func(w io.Writer) (*format.PackIndexV2, error) {
+			idx, err := format.WriteObjectPack(w, format.PackedObjectTypeFromString(o.Type), o.Size, o.Reader, format.PackOptions{
+				CompressionLevel: DefaultZlibCompressionLevel,
+			})
+			if err != nil {
+				return nil, err
+			} else if err := expectEOF(o.Reader, o.Size); err != nil {
+				return nil, err
+			}
+			hash = idx.Objects()[0]
+			if found, err := repo.ObjectStore().Has(hash); err != nil {
+				return nil, err
+			} else if found {
+				return nil, errObjectExists
+			}
+			return idx, nil
+		})
+		if err == errObjectExists {
+			err = nil
+		}
+		return hash, err
 	}
 
-	file, err := os.Create(filepath)
-	defer file.Close()
+	return repo.ObjectStore().(*FilesystemObjectStore).putStream(o.Type, o.Size, o.Reader)
+}
 
-	writer, err := zlib.NewWriterLevel(file, DefaultZlibCompressionLevel)
-	if err != nil {
-		return hash, nil
+// hashObjectRepo returns the repository that HashObject writes to.
+func hashObjectRepo(o HashObjectOptions) (*Repository, error) {
+	if o.Repo == "" {
+		return nil, errors.New("must specify Repo")
 	}
-	defer writer.Close()
-
-	io.Copy(writer, stream.Reader())
-	file.Chmod(os.FileMode(0444))
+	repo := NewRepository(o.Repo)
+	if !repo.IsValid() {
+		return nil, Errorf("not a repo: %s", o.Repo)
+	}
+	return repo, nil
+}
 
-	return
+// bigFileThreshold returns the size past which a blob is considered big, as
+// configured by core.bigFileThreshold.
+func (repo *Repository) bigFileThreshold() int64 {
+	c, err := repo.Config()
+	if err != nil {
+		return DefaultBigFileThreshold
+	}
+	return configInt(c, "core", "bigFileThreshold", DefaultBigFileThreshold)
 }
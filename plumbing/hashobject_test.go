@@ -0,0 +1,87 @@
+package plumbing
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kourge/ggit/core"
+)
+
+func TestHashObject(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	blob := &core.Blob{Content: []byte("hello\n")}
+	expected := core.NewStream(blob).Hash()
+	for _, size := range []int64{0, int64(blob.Size())} {
+		hash, err := HashObject(HashObjectOptions{Reader: bytes.NewReader(blob.Content), Size: size, Write: true, Repo: repo.Path()})
+		if err != nil || hash != expected {
+			t.Errorf("HashObject() with Size %d = %v, %v, want %v", size, hash, err, expected)
+		}
+	}
+	if object, err := repo.LooseObjectBySha1(expected); err != nil || !bytes.Equal(object.(*core.Blob).Content, blob.Content) {
+		t.Errorf("LooseObjectBySha1() = %v, %v", object, err)
+	}
+
+	for _, size := range []int64{int64(blob.Size()) - 1, int64(blob.Size()) + 1} {
+		if _, err := HashObject(HashObjectOptions{Reader: bytes.NewReader(blob.Content), Size: size}); err == nil {
+			t.Errorf("HashObject() with Size %d of %d bytes did not return an error", size, blob.Size())
+		}
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(repo.Path(), "objects", "tmp_obj_*")); len(leftovers) != 0 {
+		t.Errorf("HashObject() left temporary files %v behind", leftovers)
+	}
+}
+
+func TestHashObject_PackBigFiles(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	if err := ioutil.WriteFile(filepath.Join(repo.Path(), "config"), []byte("[core]\n\tbigFileThreshold = 1k\n"), os.FileMode(0644)); err != nil {
+		t.Fatal(err)
+	}
+
+	small := &core.Blob{Content: bytes.Repeat([]byte{'a'}, 1024)}
+	big := &core.Blob{Content: bytes.Repeat([]byte{'b'}, 1025)}
+	for _, blob := range []*core.Blob{small, big} {
+		hash, err := HashObject(HashObjectOptions{
+			Reader:       bytes.NewReader(blob.Content),
+			Size:         int64(blob.Size()),
+			Write:        true,
+			Repo:         repo.Path(),
+			PackBigFiles: true,
+		})
+		if err != nil || hash != core.NewStream(blob).Hash() {
+			t.Errorf("HashObject() of %d bytes = %v, %v", blob.Size(), hash, err)
+		}
+	}
+
+	if _, err := repo.LooseObjectBySha1(core.NewStream(small).Hash()); err != nil {
+		t.Errorf("LooseObjectBySha1() of a small blob returned error %v", err)
+	}
+	if object, err := repo.PackedObjectBySha1(core.NewStream(big).Hash()); err != nil || !bytes.Equal(object.(*core.Blob).Content, big.Content) {
+		t.Errorf("PackedObjectBySha1() of a big blob = %v, %v", object, err)
+	}
+
+	// A big blob that is already in the repository is not packed again.
+	loose := &core.Blob{Content: bytes.Repeat([]byte{'c'}, 1025)}
+	_writeFixtureObject(t, repo, loose)
+	for _, blob := range []*core.Blob{big, loose} {
+		hash, err := HashObject(HashObjectOptions{
+			Reader:       bytes.NewReader(blob.Content),
+			Size:         int64(blob.Size()),
+			Write:        true,
+			Repo:         repo.Path(),
+			PackBigFiles: true,
+		})
+		if err != nil || hash != core.NewStream(blob).Hash() {
+			t.Errorf("HashObject() of an existing blob = %v, %v", hash, err)
+		}
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(repo.Path(), "objects", "pack")); len(files) != 2 {
+		t.Errorf("HashObject() of existing blobs left %d files in the pack directory, want 2", len(files))
+	}
+}
@@ -0,0 +1,92 @@
+package plumbing
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/kourge/ggit/format"
+)
+
+// MultiPackIndexName is the name of the multi-pack-index file within the
+// "objects/pack" directory.
+const MultiPackIndexName = "multi-pack-index"
+
+// MultiPackIndex loads the multi-pack-index of this repository. If the
+// repository has none, or if it does not store its objects in the filesystem,
+// an error satisfying os.IsNotExist is returned.
+func (repo *Repository) MultiPackIndex() (*format.MultiPackIndex, error) {
+	if store, ok := repo.ObjectStore().(*FilesystemObjectStore); ok {
+		return store.MultiPackIndex()
+	}
+	return nil, os.ErrNotExist
+}
+
+// WriteMultiPackIndex builds a multi-pack-index that covers every pack of this
+// repository and writes it to "objects/pack/multi-pack-index", replacing any
+// existing one. Equivalent to `git multi-pack-index write`. As with Git, an
+// object that is in more than one pack is recorded against the most recently
+// modified pack that holds it, which is also the preferred pack. The
+// multi-pack-index returned is the one that was written.
+func (repo *Repository) WriteMultiPackIndex() (*format.MultiPackIndex, error) {
+	packDir := filepath.Join(repo.path, "objects", "pack")
+	packs, err := listPacks(filepath.Join(repo.path, "objects"))
+	if err != nil {
+		return nil, err
+	}
+
+	items := make(multiPackIndexPacksByModTime, 0, len(packs))
+	for _, pack := range packs {
+		info, err := os.Stat(pack.Path())
+		if err != nil {
+			return nil, err
+		} else if err := pack.Open(); err != nil {
+			pack.Close()
+			return nil, err
+		}
+		defer pack.Close()
+		idx := pack.Index()
+
+		items = append(items, multiPackIndexPack{
+			MultiPackIndexPack: format.MultiPackIndexPack{Name: filepath.Base(pack.IndexPath()), Index: idx},
+			modTime:            info.ModTime().UnixNano(),
+		})
+	}
+	sort.Stable(items)
+
+	midxPacks := make([]format.MultiPackIndexPack, len(items))
+	for i, item := range items {
+		midxPacks[i] = item.MultiPackIndexPack
+	}
+	midx, err := format.NewMultiPackIndex(midxPacks)
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(packDir, MultiPackIndexName)
+	if err := writeFileWithLock(path, midx.Reader(), DefaultObjectFileMode); err != nil {
+		return nil, err
+	}
+	return midx, nil
+}
+
+type multiPackIndexPack struct {
+	format.MultiPackIndexPack
+	modTime int64
+}
+
+// A slice type that satisfies sort.Interface so that packs are ordered from
+// the most recently modified to the least recently modified.
+type multiPackIndexPacksByModTime []multiPackIndexPack
+
+func (packs multiPackIndexPacksByModTime) Len() int {
+	return len(packs)
+}
+
+func (packs multiPackIndexPacksByModTime) Less(i, j int) bool {
+	return packs[i].modTime > packs[j].modTime
+}
+
+func (packs multiPackIndexPacksByModTime) Swap(i, j int) {
+	packs[i], packs[j] = packs[j], packs[i]
+}
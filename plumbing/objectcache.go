@@ -0,0 +1,167 @@
+package plumbing
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/kourge/ggit/format"
+)
+
+// DefaultDeltaBaseCacheLimit is the number of bytes of inflated objects that a
+// Repository keeps in its ObjectCache when core.deltaBaseCacheLimit is not
+// configured. It is the same as that of Git.
+const DefaultDeltaBaseCacheLimit int64 = 96 << 20
+
+// An ObjectCache is a size-bounded cache of the inflated content of packed
+// objects, keyed by their pack and their offset within it. It is consulted
+// whenever a packed object is read, so that objects that are read again, and
+// above all the bases that deltas are applied to, need not be inflated and
+// resolved again every time, such as when walking history. When the content
+// that is cached grows past the limit, the least recently used entries are
+// evicted. An ObjectCache is safe for concurrent use.
+type ObjectCache struct {
+	mutex   sync.Mutex
+	limit   int64
+	size    int64
+	entries map[objectCacheKey]*list.Element
+	lru     *list.List // of *objectCacheEntry, most recently used first
+	stats   ObjectCacheStats
+}
+
+var _ format.PackCache = &ObjectCache{}
+
+type objectCacheKey struct {
+	pack   *format.Pack
+	offset int64
+}
+
+type objectCacheEntry struct {
+	key  objectCacheKey
+	t    format.PackedObjectType
+	data []byte
+}
+
+// ObjectCacheStats describes how an ObjectCache has fared since it was
+// created.
+//
+// Hits and Misses count the lookups that found an entry and that did not.
+// Evictions counts the entries that were dropped to stay within the limit.
+// Entries and Size are the number of entries and bytes that are cached at the
+// moment, and Limit is the number of bytes that may be cached.
+type ObjectCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Size      int64
+	Limit     int64
+}
+
+// NewObjectCache returns an empty ObjectCache that holds up to limit bytes of
+// content. A limit that is not positive disables the cache.
+func NewObjectCache(limit int64) *ObjectCache {
+	return &ObjectCache{
+		limit:   limit,
+		entries: make(map[objectCacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Get returns the type and content of the entry at the given offset in the
+// given pack, if they are cached, and marks the entry as the most recently
+// used one.
+func (c *ObjectCache) Get(p *format.Pack, offset int64) (format.PackedObjectType, []byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, found := c.entries[objectCacheKey{p, offset}]
+	if !found {
+		c.stats.Misses++
+		return format.PackedObjectNone, nil, false
+	}
+
+	c.stats.Hits++
+	c.lru.MoveToFront(element)
+	entry := element.Value.(*objectCacheEntry)
+	return entry.t, entry.data, true
+}
+
+// Add caches the type and content of the entry at the given offset in the given
+// pack, evicting the least recently used entries to make room. Content that is
+// larger than the limit on its own is not cached.
+func (c *ObjectCache) Add(p *format.Pack, offset int64, t format.PackedObjectType, data []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.limit <= 0 || int64(len(data)) > c.limit {
+		return
+	}
+
+	key := objectCacheKey{p, offset}
+	if element, found := c.entries[key]; found {
+		c.lru.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&objectCacheEntry{key, t, data})
+	c.size += int64(len(data))
+	c.evict()
+}
+
+// Limit returns the number of bytes of content that this cache may hold.
+func (c *ObjectCache) Limit() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.limit
+}
+
+// SetLimit changes the number of bytes of content that this cache may hold,
+// evicting the least recently used entries right away if it holds more than
+// that. A limit that is not positive disables the cache.
+func (c *ObjectCache) SetLimit(limit int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.limit = limit
+	c.evict()
+}
+
+// Stats returns the statistics of this cache as of now.
+func (c *ObjectCache) Stats() ObjectCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.Size = c.size
+	stats.Limit = c.limit
+	return stats
+}
+
+// removePack drops every entry of the given pack, which is about to be closed.
+func (c *ObjectCache) removePack(p *format.Pack) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for element := c.lru.Front(); element != nil; {
+		next := element.Next()
+		if entry := element.Value.(*objectCacheEntry); entry.key.pack == p {
+			c.lru.Remove(element)
+			delete(c.entries, entry.key)
+			c.size -= int64(len(entry.data))
+		}
+		element = next
+	}
+}
+
+// evict drops the least recently used entries until the content that is cached
+// fits within the limit. The cache must be locked.
+func (c *ObjectCache) evict() {
+	for c.size > c.limit && c.lru.Len() > 0 {
+		entry := c.lru.Remove(c.lru.Back()).(*objectCacheEntry)
+		delete(c.entries, entry.key)
+		c.size -= int64(len(entry.data))
+		c.stats.Evictions++
+	}
+}
@@ -0,0 +1,106 @@
+package plumbing
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+)
+
+func TestObjectCache(t *testing.T) {
+	p := format.NewPack("fixture.pack")
+	cache := NewObjectCache(10)
+
+	if _, _, found := cache.Get(p, 1); found {
+		t.Errorf("Get() on an empty cache found an entry")
+	}
+	cache.Add(p, 1, format.PackedObjectBlob, []byte("abcd"))
+	cache.Add(p, 2, format.PackedObjectTree, []byte("efgh"))
+	if typ, data, found := cache.Get(p, 1); !found || typ != format.PackedObjectBlob || string(data) != "abcd" {
+		t.Errorf("Get() = %v, %q, %v", typ, data, found)
+	}
+
+	// Offset 2 is now the least recently used entry, so it is the one that is
+	// evicted to make room for offset 3.
+	cache.Add(p, 3, format.PackedObjectBlob, []byte("ijkl"))
+	if _, _, found := cache.Get(p, 2); found {
+		t.Errorf("least recently used entry was not evicted")
+	}
+	if _, _, found := cache.Get(p, 1); !found {
+		t.Errorf("recently used entry was evicted")
+	}
+
+	// Content larger than the limit is never cached.
+	cache.Add(p, 4, format.PackedObjectBlob, bytes.Repeat([]byte("x"), 11))
+	if _, _, found := cache.Get(p, 4); found {
+		t.Errorf("content larger than the limit was cached")
+	}
+
+	expected := ObjectCacheStats{Hits: 2, Misses: 3, Evictions: 1, Entries: 2, Size: 8, Limit: 10}
+	if actual := cache.Stats(); actual != expected {
+		t.Errorf("Stats() = %+v, want %+v", actual, expected)
+	}
+
+	cache.SetLimit(4)
+	if stats := cache.Stats(); stats.Entries != 1 || stats.Size != 4 || stats.Evictions != 2 {
+		t.Errorf("Stats() after SetLimit(4) = %+v", stats)
+	}
+	if _, _, found := cache.Get(p, 1); !found {
+		t.Errorf("SetLimit() evicted the most recently used entry")
+	}
+
+	cache.SetLimit(0)
+	cache.Add(p, 5, format.PackedObjectBlob, nil)
+	if stats := cache.Stats(); stats.Entries != 0 || stats.Size != 0 || cache.Limit() != 0 {
+		t.Errorf("Stats() of a disabled cache = %+v", stats)
+	}
+}
+
+func TestRepository_ObjectCache(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	if err := ioutil.WriteFile(filepath.Join(repo.Path(), "config"), []byte("[core]\n\tdeltaBaseCacheLimit = 64k\n"), os.FileMode(0644)); err != nil {
+		t.Fatal(err)
+	}
+
+	content := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 100)
+	base := _writeFixtureObject(t, repo, &core.Blob{Content: []byte(content)})
+	delta := _writeFixtureObject(t, repo, &core.Blob{Content: []byte(content + "and then some\n")})
+	if _, err := repo.PackObjects([]core.Sha1{base, delta}, format.PackOptions{}); err != nil {
+		t.Fatalf("PackObjects() returned error %v", err)
+	}
+
+	cache := repo.ObjectCache()
+	if cache == nil {
+		t.Fatalf("ObjectCache() returned nil")
+	} else if limit := cache.Limit(); limit != 64<<10 {
+		t.Errorf("Limit() = %d, want %d", limit, 64<<10)
+	}
+
+	// Reading a delta resolves and caches both it and its base, so neither is
+	// inflated again when it is read a second time.
+	for i := 0; i < 2; i++ {
+		for _, hash := range []core.Sha1{delta, base} {
+			if _, err := repo.PackedObjectBySha1(hash); err != nil {
+				t.Fatalf("PackedObjectBySha1() returned error %v", err)
+			}
+		}
+	}
+	stats := cache.Stats()
+	if stats.Entries != 2 || stats.Hits != 3 {
+		t.Errorf("Stats() after reading twice = %+v, want 2 entries and 3 hits", stats)
+	}
+
+	if err := repo.Close(); err != nil {
+		t.Errorf("Close() returned error %v", err)
+	}
+	if stats := cache.Stats(); stats.Entries != 0 || stats.Size != 0 {
+		t.Errorf("Stats() after Close() = %+v, want no entries", stats)
+	}
+}
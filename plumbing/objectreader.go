@@ -0,0 +1,135 @@
+package plumbing
+
+import (
+	"bufio"
+	"compress/zlib"
+	"crypto/sha1"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/kourge/ggit/core"
+)
+
+var ErrObjectHashMismatch = errors.New("object content does not match its SHA-1")
+
+// An objectReader reads the content of an object from an underlying reader
+// while hashing it. Once the number of bytes declared by the object header has
+// been read, the hash is compared against the SHA-1 that the object was looked
+// up by, and ErrObjectHashMismatch is returned in place of io.EOF if the two
+// differ. Content that ends early yields io.ErrUnexpectedEOF.
+type objectReader struct {
+	r         io.Reader
+	hash      hash.Hash
+	expected  core.Sha1
+	remaining int64
+	closers   []io.Closer
+}
+
+var _ io.ReadCloser = &objectReader{}
+
+// newObjectReader returns an objectReader for an object with the given type,
+// size, and SHA-1 whose content is read from r. The given closers are closed
+// when the objectReader is closed.
+func newObjectReader(t string, size int64, r io.Reader, expected core.Sha1, closers ...io.Closer) *objectReader {
+	h := sha1.New()
+	io.WriteString(h, t+" "+strconv.FormatInt(size, 10)+"\x00")
+	return &objectReader{r: r, hash: h, expected: expected, remaining: size, closers: closers}
+}
+
+func (reader *objectReader) Read(p []byte) (int, error) {
+	if reader.remaining <= 0 {
+		if core.Sha1FromByteSlice(reader.hash.Sum(nil)) != reader.expected {
+			return 0, ErrObjectHashMismatch
+		}
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > reader.remaining {
+		p = p[:reader.remaining]
+	}
+	n, err := reader.r.Read(p)
+	reader.hash.Write(p[:n])
+	reader.remaining -= int64(n)
+
+	if err == io.EOF {
+		if reader.remaining > 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// Close closes everything that the content is read from.
+func (reader *objectReader) Close() error {
+	var err error
+	for i := len(reader.closers) - 1; i >= 0; i-- {
+		if e := reader.closers[i].Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// openObject opens the object with the given SHA-1 in the given store. A store
+// that can read objects without decoding them in their entirety does so by
+// implementing a method named Open; for any other store, the object is read
+// with Get.
+func openObject(store ObjectStore, hash core.Sha1) (string, int64, io.ReadCloser, error) {
+	if opener, ok := store.(interface {
+		Open(hash core.Sha1) (string, int64, io.ReadCloser, error)
+	}); ok {
+		return opener.Open(hash)
+	}
+
+	object, err := store.Get(hash)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return object.Type(), int64(object.Size()), ioutil.NopCloser(object.Reader()), nil
+}
+
+// openLooseObject opens the loose object file at the given path and returns
+// the type and size found in its header, along with a reader that inflates the
+// rest of the file as it is read and verifies it against the given SHA-1.
+func openLooseObject(path string, expected core.Sha1) (string, int64, io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", 0, nil, ErrObjectNotFoundInRepo
+	} else if err != nil {
+		return "", 0, nil, err
+	}
+
+	z, err := zlib.NewReader(file)
+	if err != nil {
+		file.Close()
+		return "", 0, nil, err
+	}
+	r := bufio.NewReader(z)
+
+	t, err := r.ReadString(' ')
+	if err != nil {
+		z.Close()
+		file.Close()
+		return "", 0, nil, err
+	}
+	sizeString, err := r.ReadString(0)
+	if err != nil {
+		z.Close()
+		file.Close()
+		return "", 0, nil, err
+	}
+	size, err := strconv.ParseInt(sizeString[:len(sizeString)-1], 10, 64)
+	if err != nil {
+		z.Close()
+		file.Close()
+		return "", 0, nil, err
+	}
+
+	t = t[:len(t)-1]
+	return t, size, newObjectReader(t, size, r, expected, file, z), nil
+}
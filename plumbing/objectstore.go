@@ -0,0 +1,666 @@
+package plumbing
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+)
+
+var ErrObjectStoreReadOnly = errors.New("object store is read-only")
+
+// An ObjectStore is a database of Git objects, each of which is keyed by its
+// SHA-1. A Repository reads and writes every object through one.
+type ObjectStore interface {
+	// Has returns true if the object with the given SHA-1 is in the store.
+	Has(hash core.Sha1) (bool, error)
+
+	// Get returns the object with the given SHA-1. If the object is not in the
+	// store, the error ErrObjectNotFoundInRepo is returned.
+	Get(hash core.Sha1) (core.Object, error)
+
+	// Put adds the given object to the store, unless it is already there, and
+	// returns its SHA-1. A store that cannot be written to returns the error
+	// ErrObjectStoreReadOnly.
+	Put(object core.Object) (core.Sha1, error)
+
+	// Iterate calls fn once with the SHA-1 of every object in the store, in no
+	// particular order. If fn returns an error, the iteration stops and the
+	// error is returned.
+	Iterate(fn func(hash core.Sha1) error) error
+
+	// Size returns the number of objects in the store.
+	Size() (int, error)
+}
+
+// sha1sWithPrefix returns the SHA-1 checksums of the objects in the given store
+// whose hexadecimal representation starts with the given prefix. A store that
+// can look up prefixes faster than by iterating over every object does so by
+// implementing a method of the same name.
+func sha1sWithPrefix(store ObjectStore, prefix string) ([]core.Sha1, error) {
+	if searcher, ok := store.(interface {
+		Sha1sWithPrefix(prefix string) ([]core.Sha1, error)
+	}); ok {
+		return searcher.Sha1sWithPrefix(prefix)
+	}
+
+	var hashes []core.Sha1
+	err := store.Iterate(func(hash core.Sha1) error {
+		if strings.HasPrefix(hash.String(), prefix) {
+			hashes = append(hashes, hash)
+		}
+		return nil
+	})
+	return hashes, err
+}
+
+// A FilesystemObjectStore is an ObjectStore backed by an "objects" directory
+// laid out the way Git lays it out: loose objects are zlib-compressed files
+// under a subdirectory named after the first two hexadecimal digits of their
+// SHA-1, and packed objects reside in the packs under "pack/". New objects are
+// written as loose objects.
+//
+// Objects are also read from the alternate object directories that are listed
+// in "info/alternates", one per line, as Git does for repositories cloned with
+// --reference or --shared. Relative paths are relative to the "objects"
+// directory, and the alternates of an alternate are honored as well, up to a
+// depth of maxAlternateDepth. Objects are never written to an alternate. As in
+// Git, the alternates are resolved once, the first time that they are needed,
+// and changes to "info/alternates" after that are not picked up.
+//
+// The packs of the store and its alternates are kept open between lookups
+// and are reloaded whenever a "pack" directory changes, so a store should be
+// closed with Close once it is no longer used. The objects that are read from
+// them are kept in an ObjectCache, whose limit is DefaultDeltaBaseCacheLimit
+// unless it is changed. A FilesystemObjectStore is safe
+// for concurrent use, except for Close.
+type FilesystemObjectStore struct {
+	dir string
+
+	// alternateDirs are the alternate object directories that are consulted
+	// before the ones listed in "info/alternates".
+	alternateDirs []string
+
+	// isAlternate is true for the store of an alternate object directory, whose
+	// own alternates have already been taken into account by the store that
+	// it is an alternate of.
+	isAlternate bool
+
+	// alternates holds this store followed by a store for each of its
+	// alternates once they have been resolved.
+	alternates      []*FilesystemObjectStore
+	alternatesMutex sync.Mutex
+
+	// packs keeps the packs of this store open between lookups, and objects
+	// keeps what has been read from them. Both are shared with the stores of
+	// its alternates.
+	packs   *packCache
+	objects *ObjectCache
+}
+
+var _ ObjectStore = &FilesystemObjectStore{}
+
+// NewFilesystemObjectStore returns a FilesystemObjectStore for the "objects"
+// directory at the given path.
+func NewFilesystemObjectStore(dir string) *FilesystemObjectStore {
+	s := &FilesystemObjectStore{dir: filepath.Clean(dir), objects: NewObjectCache(DefaultDeltaBaseCacheLimit)}
+	s.packs = newPackCache(s.Get, s.objects)
+	return s
+}
+
+// ObjectCache returns the cache of the objects that are read from the packs of
+// this store and its alternates.
+func (s *FilesystemObjectStore) ObjectCache() *ObjectCache {
+	return s.objects
+}
+
+// Close closes the packs that this store keeps open. A pack that is still
+// being read from, such as by a reader returned by Open, is closed once the
+// reader is closed. The store must not be used after it is closed.
+func (s *FilesystemObjectStore) Close() error {
+	return s.packs.close()
+}
+
+// maxAlternateDepth is the maximum depth of alternates of alternates that is
+// followed, which is the same as that of Git.
+const maxAlternateDepth = 5
+
+// Dir returns the path of the "objects" directory of this store.
+func (s *FilesystemObjectStore) Dir() string {
+	return s.dir
+}
+
+// Alternates returns the paths of the alternate object directories of this
+// store, in the order in which they are searched, after following the
+// alternates of each alternate. Directories that do not exist are left out.
+func (s *FilesystemObjectStore) Alternates() ([]string, error) {
+	stores, err := s.stores()
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, store := range stores[1:] {
+		dirs = append(dirs, store.dir)
+	}
+	return dirs, nil
+}
+
+// resolveAlternates reads "info/alternates" and those of every alternate in
+// turn, and returns the paths of the alternate object directories of this
+// store. See Alternates.
+func (s *FilesystemObjectStore) resolveAlternates() ([]string, error) {
+	if s.isAlternate {
+		return nil, nil
+	}
+
+	self, err := filepath.Abs(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{self: true}
+	var dirs []string
+
+	var link func(dir string, depth int) error
+	link = func(dir string, depth int) error {
+		if abs, err := filepath.Abs(dir); err != nil {
+			return err
+		} else if dir = abs; seen[dir] {
+			return nil
+		}
+		seen[dir] = true
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil
+		}
+		dirs = append(dirs, dir)
+
+		if depth >= maxAlternateDepth {
+			return nil
+		}
+		nested, err := readAlternates(dir)
+		if err != nil {
+			return err
+		}
+		for _, alternate := range nested {
+			if err := link(alternate, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, dir := range s.alternateDirs {
+		if err := link(dir, 1); err != nil {
+			return nil, err
+		}
+	}
+	listed, err := readAlternates(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range listed {
+		if err := link(dir, 1); err != nil {
+			return nil, err
+		}
+	}
+	return dirs, nil
+}
+
+// readAlternates returns the paths listed in the "info/alternates" file of the
+// given object directory, with relative paths resolved against it. Blank
+// lines and comments are skipped, and paths in double quotes are unquoted.
+func readAlternates(dir string) ([]string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, "info", "alternates"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		path := unquoteAlternate(line)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		dirs = append(dirs, filepath.Clean(path))
+	}
+	return dirs, nil
+}
+
+// unquoteAlternate removes the C-style quoting that Git applies to paths that
+// contain unusual characters, if the given path is quoted.
+func unquoteAlternate(path string) string {
+	if strings.HasPrefix(path, "\"") {
+		if unquoted, err := strconv.Unquote(path); err == nil {
+			return unquoted
+		}
+	}
+	return path
+}
+
+// alternateObjectDirectoriesFromEnv returns the object directories listed in
+// GIT_ALTERNATE_OBJECT_DIRECTORIES, which are separated like the entries of
+// PATH. Relative paths are relative to the current directory.
+func alternateObjectDirectoriesFromEnv() []string {
+	var dirs []string
+	for _, dir := range filepath.SplitList(os.Getenv("GIT_ALTERNATE_OBJECT_DIRECTORIES")) {
+		if dir != "" {
+			dirs = append(dirs, unquoteAlternate(dir))
+		}
+	}
+	return dirs
+}
+
+// stores returns this store followed by a store for each of its alternates,
+// which are resolved on the first call.
+func (s *FilesystemObjectStore) stores() ([]*FilesystemObjectStore, error) {
+	s.alternatesMutex.Lock()
+	defer s.alternatesMutex.Unlock()
+
+	if s.alternates != nil {
+		return s.alternates, nil
+	}
+	alternates, err := s.resolveAlternates()
+	if err != nil {
+		return nil, err
+	}
+
+	stores := []*FilesystemObjectStore{s}
+	for _, dir := range alternates {
+		stores = append(stores, &FilesystemObjectStore{dir: dir, isAlternate: true, packs: s.packs, objects: s.objects})
+	}
+	s.alternates = stores
+	return stores, nil
+}
+
+func (s *FilesystemObjectStore) loosePath(hash core.Sha1) string {
+	prefix, rest := hash.Split(2)
+	return filepath.Join(s.dir, prefix, rest)
+}
+
+// Has returns true if the object with the given SHA-1 is either a loose object
+// or in one of the packs of this store or one of its alternates.
+func (s *FilesystemObjectStore) Has(hash core.Sha1) (bool, error) {
+	stores, err := s.stores()
+	if err != nil {
+		return false, err
+	}
+
+	for _, store := range stores {
+		if found, err := store.hasLocal(hash); err != nil || found {
+			return found, err
+		}
+	}
+	return false, nil
+}
+
+func (s *FilesystemObjectStore) hasLocal(hash core.Sha1) (bool, error) {
+	if _, err := os.Stat(s.loosePath(hash)); err == nil {
+		return true, nil
+	}
+
+	return s.packs.has(s.dir, hash)
+}
+
+// Get returns the object with the given SHA-1. Loose objects are searched
+// first, followed by every pack in turn, and then the alternates of this store
+// are searched in the same manner.
+func (s *FilesystemObjectStore) Get(hash core.Sha1) (core.Object, error) {
+	stores, err := s.stores()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, store := range stores {
+		object, err := store.LooseObject(hash)
+		if err == ErrObjectNotFoundInRepo {
+			object, err = store.PackedObject(hash)
+		}
+		if err != ErrObjectNotFoundInRepo {
+			return object, err
+		}
+	}
+	return nil, ErrObjectNotFoundInRepo
+}
+
+// Open returns the type and size of the object with the given SHA-1, along
+// with a reader of its content that verifies the content against the SHA-1 as
+// it is read. The store and its alternates are searched in the same order as
+// Get does. Loose objects and packed objects that are not deltas are inflated
+// lazily as the reader is read from. The reader must be closed once done.
+func (s *FilesystemObjectStore) Open(hash core.Sha1) (string, int64, io.ReadCloser, error) {
+	stores, err := s.stores()
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	for _, store := range stores {
+		t, size, r, err := openLooseObject(store.loosePath(hash), hash)
+		if err == ErrObjectNotFoundInRepo {
+			t, size, r, err = store.openPackedObject(hash)
+		}
+		if err != ErrObjectNotFoundInRepo {
+			return t, size, r, err
+		}
+	}
+	return "", 0, nil, ErrObjectNotFoundInRepo
+}
+
+func (s *FilesystemObjectStore) openPackedObject(hash core.Sha1) (string, int64, io.ReadCloser, error) {
+	cp, err := s.packs.find(s.dir, hash)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	t, size, r, err := cp.pack.OpenObject(hash)
+	if err != nil {
+		cp.Close()
+		return "", 0, nil, err
+	}
+	return t.String(), size, newObjectReader(t.String(), size, r, hash, cp, r), nil
+}
+
+// LooseObject returns the loose object with the given SHA-1. If the object in
+// question is packed or does not exist, the error ErrObjectNotFoundInRepo is
+// returned. Alternates are not searched.
+func (s *FilesystemObjectStore) LooseObject(hash core.Sha1) (core.Object, error) {
+	file, err := os.Open(s.loosePath(hash))
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFoundInRepo
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r, err := zlib.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := &core.Stream{}
+	if err := stream.Decode(r); err != nil {
+		return nil, err
+	}
+
+	return stream.Object(), nil
+}
+
+// PackedObject returns the packed object with the given SHA-1. If the object in
+// question is loose or does not exist, the error ErrObjectNotFoundInRepo is
+// returned. Alternates are not searched. Objects stored as deltas are resolved,
+// and bases of REF_DELTA entries that live outside of their pack are looked up
+// with Get.
+func (s *FilesystemObjectStore) PackedObject(hash core.Sha1) (core.Object, error) {
+	cp, err := s.packs.find(s.dir, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer cp.Close()
+
+	object, err := cp.pack.ObjectBySha1(hash)
+	if err == format.ErrObjectNotFoundInPack {
+		return nil, ErrObjectNotFoundInRepo
+	}
+	return object, err
+}
+
+// Put writes the given object as a loose object, unless an object with the
+// same SHA-1 already exists in loose form, and returns its SHA-1.
+func (s *FilesystemObjectStore) Put(object core.Object) (core.Sha1, error) {
+	stream := core.NewStream(object)
+	hash := stream.Hash()
+
+	path := s.loosePath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+
+	buffer := new(bytes.Buffer)
+	writer, err := zlib.NewWriterLevel(buffer, DefaultZlibCompressionLevel)
+	if err != nil {
+		return hash, err
+	}
+	if _, err := io.Copy(writer, stream.Reader()); err != nil {
+		return hash, err
+	} else if err := writer.Close(); err != nil {
+		return hash, err
+	}
+
+	return hash, writeFileAtomically(path, buffer, DefaultObjectFileMode)
+}
+
+// putStream writes an object of the given type and size, whose content is read
+// from r, as a loose object and returns its SHA-1. The content is hashed and
+// compressed in one pass into a temporary file, which is then renamed into
+// place unless an object with the same SHA-1 already exists.
+func (s *FilesystemObjectStore) putStream(t string, size int64, r io.Reader) (core.Sha1, error) {
+	if err := os.MkdirAll(s.dir, os.FileMode(0755)); err != nil {
+		return core.Sha1{}, err
+	}
+	file, err := ioutil.TempFile(s.dir, "tmp_obj_")
+	if err != nil {
+		return core.Sha1{}, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	writer, err := zlib.NewWriterLevel(file, DefaultZlibCompressionLevel)
+	if err != nil {
+		return core.Sha1{}, err
+	}
+	h := sha1.New()
+	w := io.MultiWriter(writer, h)
+	fmt.Fprintf(w, "%s %d\x00", t, size)
+	if err := copyExactly(w, r, size); err != nil {
+		return core.Sha1{}, err
+	} else if err := writer.Close(); err != nil {
+		return core.Sha1{}, err
+	} else if err := file.Chmod(DefaultObjectFileMode); err != nil {
+		return core.Sha1{}, err
+	} else if err := file.Close(); err != nil {
+		return core.Sha1{}, err
+	}
+
+	hash := core.Sha1FromByteSlice(h.Sum(nil))
+	if found, err := s.Has(hash); err != nil || found {
+		return hash, err
+	}
+
+	path := s.loosePath(hash)
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0755)); err != nil {
+		return hash, err
+	}
+	return hash, os.Rename(file.Name(), path)
+}
+
+// Iterate calls fn with the SHA-1 of every loose object and then with that of
+// every packed object that has not been visited yet, first for this store and
+// then for each of its alternates.
+func (s *FilesystemObjectStore) Iterate(fn func(hash core.Sha1) error) error {
+	stores, err := s.stores()
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[core.Sha1]bool)
+	for _, store := range stores {
+		if err := store.iterateLocal(seen, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FilesystemObjectStore) iterateLocal(seen map[core.Sha1]bool, fn func(hash core.Sha1) error) error {
+	err := s.eachLooseObject("", func(hash core.Sha1) error {
+		if seen[hash] {
+			return nil
+		}
+		seen[hash] = true
+		return fn(hash)
+	})
+	if err != nil {
+		return err
+	}
+
+	lists, err := s.packs.objects(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, objects := range lists {
+		for _, hash := range objects {
+			if seen[hash] {
+				continue
+			}
+			seen[hash] = true
+			if err := fn(hash); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Size returns the number of distinct objects in this store and its
+// alternates, loose or packed.
+func (s *FilesystemObjectStore) Size() (int, error) {
+	n := 0
+	err := s.Iterate(func(hash core.Sha1) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// Sha1sWithPrefix returns the SHA-1 checksums of all the objects in this store
+// and its alternates, loose or packed, whose hexadecimal representation starts
+// with the given prefix. The prefix must be at least two characters long, so
+// that only one directory of loose objects needs to be read.
+func (s *FilesystemObjectStore) Sha1sWithPrefix(prefix string) ([]core.Sha1, error) {
+	if len(prefix) < 2 {
+		return nil, Errorf("SHA-1 prefix %q is too short", prefix)
+	}
+	stores, err := s.stores()
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[core.Sha1]bool)
+	for _, store := range stores {
+		if err := store.sha1sWithPrefixLocal(prefix, found); err != nil {
+			return nil, err
+		}
+	}
+
+	hashes := make([]core.Sha1, 0, len(found))
+	for hash := range found {
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+func (s *FilesystemObjectStore) sha1sWithPrefixLocal(prefix string, found map[core.Sha1]bool) error {
+	err := s.eachLooseObject(prefix, func(hash core.Sha1) error {
+		found[hash] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	lists, err := s.packs.objects(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, objects := range lists {
+		i := sort.Search(len(objects), func(i int) bool {
+			return objects[i].String() >= prefix
+		})
+		for ; i < len(objects) && strings.HasPrefix(objects[i].String(), prefix); i++ {
+			found[objects[i]] = true
+		}
+	}
+	return nil
+}
+
+// eachLooseObject calls fn with the SHA-1 of every loose object whose
+// hexadecimal representation starts with the given prefix. Only the directory
+// that matches the prefix is read if the prefix is at least two characters
+// long.
+func (s *FilesystemObjectStore) eachLooseObject(prefix string, fn func(hash core.Sha1) error) error {
+	var dirs []string
+	if len(prefix) >= 2 {
+		dirs = []string{prefix[:2]}
+	} else {
+		infos, err := ioutil.ReadDir(s.dir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, info := range infos {
+			if name := info.Name(); info.IsDir() && len(name) == 2 && strings.HasPrefix(name, prefix) {
+				dirs = append(dirs, name)
+			}
+		}
+	}
+
+	for _, dir := range dirs {
+		infos, err := ioutil.ReadDir(filepath.Join(s.dir, dir))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			name := dir + info.Name()
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			if hash, err := core.Sha1FromString(name); err == nil {
+				if err := fn(hash); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Packs returns a slice of all the packs in this store, none of which has been
+// opened. A store without a "pack" directory has no packs.
+func (s *FilesystemObjectStore) Packs() ([]*format.Pack, error) {
+	return listPacks(s.dir)
+}
+
+// MultiPackIndex loads the multi-pack-index of this store, which resides at
+// "pack/multi-pack-index". If there is none, an error satisfying os.IsNotExist
+// is returned.
+func (s *FilesystemObjectStore) MultiPackIndex() (*format.MultiPackIndex, error) {
+	return format.MultiPackIndexAtPath(filepath.Join(s.dir, "pack", MultiPackIndexName))
+}
+
+func readDirNames(path string) ([]string, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	return dir.Readdirnames(0)
+}
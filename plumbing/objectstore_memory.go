@@ -0,0 +1,91 @@
+package plumbing
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/kourge/ggit/core"
+)
+
+// A MemoryObjectStore is an ObjectStore that keeps every object in memory,
+// which makes it suitable for tests and for objects that are never meant to be
+// persisted. Objects are kept in their encoded form, so that an object that is
+// changed after Put or Get does not change what is stored. A MemoryObjectStore
+// is safe for concurrent use.
+type MemoryObjectStore struct {
+	mutex   sync.RWMutex
+	objects map[core.Sha1][]byte
+}
+
+var _ ObjectStore = &MemoryObjectStore{}
+
+// NewMemoryObjectStore returns an empty MemoryObjectStore.
+func NewMemoryObjectStore() *MemoryObjectStore {
+	return &MemoryObjectStore{objects: make(map[core.Sha1][]byte)}
+}
+
+// Has returns true if the object with the given SHA-1 has been put into this
+// store.
+func (s *MemoryObjectStore) Has(hash core.Sha1) (bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	_, ok := s.objects[hash]
+	return ok, nil
+}
+
+// Get decodes and returns the object with the given SHA-1.
+func (s *MemoryObjectStore) Get(hash core.Sha1) (core.Object, error) {
+	s.mutex.RLock()
+	data, ok := s.objects[hash]
+	s.mutex.RUnlock()
+	if !ok {
+		return nil, ErrObjectNotFoundInRepo
+	}
+
+	stream := &core.Stream{}
+	if err := stream.Decode(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return stream.Object(), nil
+}
+
+// Put encodes the given object and stores it under its SHA-1.
+func (s *MemoryObjectStore) Put(object core.Object) (core.Sha1, error) {
+	stream := core.NewStream(object)
+	hash := stream.Hash()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.objects[hash]; !ok {
+		s.objects[hash] = stream.Bytes()
+	}
+	return hash, nil
+}
+
+// Iterate calls fn with the SHA-1 of every object in this store. The objects
+// that are put into the store while it iterates may or may not be visited.
+func (s *MemoryObjectStore) Iterate(fn func(hash core.Sha1) error) error {
+	s.mutex.RLock()
+	hashes := make([]core.Sha1, 0, len(s.objects))
+	for hash := range s.objects {
+		hashes = append(hashes, hash)
+	}
+	s.mutex.RUnlock()
+
+	for _, hash := range hashes {
+		if err := fn(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Size returns the number of objects in this store.
+func (s *MemoryObjectStore) Size() (int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return len(s.objects), nil
+}
@@ -0,0 +1,108 @@
+package plumbing
+
+import (
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+)
+
+// A PackObjectStore is a read-only ObjectStore backed by a single pack and its
+// index, such as a pack that has just been fetched. The pack stays open until
+// Close is called. Objects stored as deltas against bases that are not in the
+// pack can only be read if the BaseResolver of the pack is set. A
+// PackObjectStore is safe for concurrent use, except for Close.
+type PackObjectStore struct {
+	pack *format.Pack
+}
+
+var _ ObjectStore = &PackObjectStore{}
+
+// NewPackObjectStore opens the pack at the given path, which can be a path to
+// the pack file itself or to its index, and returns a PackObjectStore for it.
+func NewPackObjectStore(path string) (*PackObjectStore, error) {
+	pack := format.NewPack(path)
+	if err := pack.Open(); err != nil {
+		pack.Close()
+		return nil, err
+	}
+	return &PackObjectStore{pack: pack}, nil
+}
+
+// Pack returns the pack that backs this store.
+func (s *PackObjectStore) Pack() *format.Pack {
+	return s.pack
+}
+
+// Close closes the pack that backs this store.
+func (s *PackObjectStore) Close() error {
+	return s.pack.Close()
+}
+
+// Has returns true if the object with the given SHA-1 is in the pack.
+func (s *PackObjectStore) Has(hash core.Sha1) (bool, error) {
+	return s.pack.HasObject(hash), nil
+}
+
+// Get returns the object with the given SHA-1, resolving deltas as needed.
+func (s *PackObjectStore) Get(hash core.Sha1) (core.Object, error) {
+	object, err := s.pack.ObjectBySha1(hash)
+	if err == format.ErrObjectNotFoundInPack {
+		return nil, ErrObjectNotFoundInRepo
+	}
+	return object, err
+}
+
+// Open returns the type and size of the object with the given SHA-1, along
+// with a reader of its content that verifies the content against the SHA-1 as
+// it is read. Objects that are not deltas are inflated lazily. The reader must
+// be closed before the store is.
+func (s *PackObjectStore) Open(hash core.Sha1) (string, int64, io.ReadCloser, error) {
+	t, size, r, err := s.pack.OpenObject(hash)
+	if err == format.ErrObjectNotFoundInPack {
+		return "", 0, nil, ErrObjectNotFoundInRepo
+	} else if err != nil {
+		return "", 0, nil, err
+	}
+	return t.String(), size, newObjectReader(t.String(), size, r, hash, r), nil
+}
+
+// Put always returns the error ErrObjectStoreReadOnly, as a pack cannot be
+// added to.
+func (s *PackObjectStore) Put(object core.Object) (core.Sha1, error) {
+	return core.Sha1{}, ErrObjectStoreReadOnly
+}
+
+// Iterate calls fn with the SHA-1 of every object in the pack, in ascending
+// order.
+func (s *PackObjectStore) Iterate(fn func(hash core.Sha1) error) error {
+	for _, hash := range s.pack.Objects() {
+		if err := fn(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Size returns the number of objects in the pack.
+func (s *PackObjectStore) Size() (int, error) {
+	return s.pack.Size(), nil
+}
+
+// Sha1sWithPrefix returns the SHA-1 checksums of the objects in the pack whose
+// hexadecimal representation starts with the given prefix, found by a binary
+// search over the index.
+func (s *PackObjectStore) Sha1sWithPrefix(prefix string) ([]core.Sha1, error) {
+	objects := s.pack.Objects()
+	i := sort.Search(len(objects), func(i int) bool {
+		return objects[i].String() >= prefix
+	})
+
+	var hashes []core.Sha1
+	for ; i < len(objects) && strings.HasPrefix(objects[i].String(), prefix); i++ {
+		hashes = append(hashes, objects[i])
+	}
+	return hashes, nil
+}
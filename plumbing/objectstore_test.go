@@ -0,0 +1,375 @@
+package plumbing
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+)
+
+func _testObjectStore(t *testing.T, store ObjectStore, present, absent core.Sha1) {
+	if ok, err := store.Has(present); err != nil || !ok {
+		t.Errorf("Has(%v) = %v, %v", present, ok, err)
+	}
+	if ok, err := store.Has(absent); err != nil || ok {
+		t.Errorf("Has(%v) = %v, %v", absent, ok, err)
+	}
+	if object, err := store.Get(present); err != nil || core.NewStream(object).Hash() != present {
+		t.Errorf("Get(%v) = %v, %v", present, object, err)
+	}
+	if _, err := store.Get(absent); err != ErrObjectNotFoundInRepo {
+		t.Errorf("Get(%v) returned error %v, want %v", absent, err, ErrObjectNotFoundInRepo)
+	}
+
+	seen := make(map[core.Sha1]int)
+	if err := store.Iterate(func(hash core.Sha1) error {
+		seen[hash]++
+		return nil
+	}); err != nil {
+		t.Errorf("Iterate() returned error %v", err)
+	}
+	for hash, n := range seen {
+		if n != 1 {
+			t.Errorf("Iterate() visited %v %d times", hash, n)
+		}
+	}
+	if size, err := store.Size(); err != nil || size != len(seen) || seen[present] != 1 {
+		t.Errorf("Size() = %d, %v, with %d objects visited", size, err, len(seen))
+	}
+
+	stop := Errorf("stop")
+	if err := store.Iterate(func(hash core.Sha1) error { return stop }); err != stop {
+		t.Errorf("Iterate() returned error %v, want %v", err, stop)
+	}
+}
+
+func TestMemoryObjectStore(t *testing.T) {
+	store := NewMemoryObjectStore()
+	blob := &core.Blob{Content: []byte("hello\n")}
+	hash, err := store.Put(blob)
+	if err != nil {
+		t.Fatalf("Put() returned error %v", err)
+	}
+	blob.Content[0] = 'j'
+
+	_testObjectStore(t, store, hash, core.NewStream(blob).Hash())
+	if object, _ := store.Get(hash); string(object.(*core.Blob).Content) != "hello\n" {
+		t.Errorf("Get() returned an object that was changed after Put()")
+	}
+
+	repo := NewRepositoryWithObjectStore("/nonexistent", store)
+	tree, _ := repo.WriteObject(core.NewTree([]core.TreeEntry{
+		{Mode: core.GitModeRegular | core.GitModeReadWritable, Name: "a", Sha1: hash},
+	}))
+	person := core.NewPerson("Jane Doe", "jane@example.com", 1400000000, 0)
+	a, err := repo.WriteObject(core.NewCommit(tree, nil, person, person, "a"))
+	if err != nil {
+		t.Fatalf("WriteObject() returned error %v", err)
+	}
+	if size, _ := store.Size(); size != 3 {
+		t.Errorf("Size() = %d after writing a commit, want 3", size)
+	}
+	if hashes, err := repo.Sha1sWithPrefix(a.String()[:7]); err != nil || len(hashes) != 1 || hashes[0] != a {
+		t.Errorf("Sha1sWithPrefix() = %v, %v", hashes, err)
+	}
+	if commit, err := repo.ObjectBySha1(a); err != nil || commit.Type() != "commit" {
+		t.Errorf("ObjectBySha1() = %v, %v", commit, err)
+	}
+	if _, err := repo.LooseObjectBySha1(a); err != ErrObjectNotFoundInRepo {
+		t.Errorf("LooseObjectBySha1() returned error %v", err)
+	}
+}
+
+func TestFilesystemObjectStore(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	a := _writeFixtureCommit(t, repo, nil, "a", "a\n", 0)
+	b := _writeFixtureCommit(t, repo, []core.Sha1{a}, "b", "b\n", 1)
+	if _, err := repo.PackObjects([]core.Sha1{a, b}, format.PackOptions{}); err != nil {
+		t.Fatalf("PackObjects() returned error %v", err)
+	}
+
+	store, ok := repo.ObjectStore().(*FilesystemObjectStore)
+	if !ok {
+		t.Fatalf("ObjectStore() = %T, want a FilesystemObjectStore", repo.ObjectStore())
+	}
+	_testObjectStore(t, store, b, core.Sha1{1})
+	if size, _ := store.Size(); size != 6 {
+		t.Errorf("Size() = %d, want 6", size)
+	}
+
+	hash, err := store.Put(&core.Blob{Content: []byte("c\n")})
+	if err != nil {
+		t.Fatalf("Put() returned error %v", err)
+	}
+	if _, err := repo.LooseObjectBySha1(hash); err != nil {
+		t.Errorf("LooseObjectBySha1() of a new object returned error %v", err)
+	}
+}
+
+func TestFilesystemObjectStore_Alternates(t *testing.T) {
+	shared, cleanupShared := _fixtureRepo(t)
+	defer cleanupShared()
+	base, cleanupBase := _fixtureRepo(t)
+	defer cleanupBase()
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	a := _writeFixtureCommit(t, shared, nil, "a", "a\n", 0)
+	if _, err := shared.PackObjects([]core.Sha1{a}, format.PackOptions{}); err != nil {
+		t.Fatalf("PackObjects() returned error %v", err)
+	}
+	b := _writeFixtureCommit(t, base, []core.Sha1{a}, "b", "b\n", 1)
+	c := _writeFixtureCommit(t, repo, []core.Sha1{b}, "c", "c\n", 2)
+
+	// The repository refers to base by a relative path, which in turn refers
+	// to shared by an absolute path, and back to the repository itself.
+	relative, err := filepath.Rel(filepath.Join(repo.Path(), "objects"), filepath.Join(base.Path(), "objects"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range map[string]string{
+		filepath.Join(repo.Path(), "objects", "info", "alternates"): "# comment\n" + relative + "\n\nmissing\n",
+		filepath.Join(base.Path(), "objects", "info", "alternates"): filepath.Join(shared.Path(), "objects") + "\n" + filepath.Join(repo.Path(), "objects") + "\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0755)); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), os.FileMode(0644)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repo.Close() // Alternates are only resolved once per object store.
+	store := repo.ObjectStore().(*FilesystemObjectStore)
+	if dirs, err := store.Alternates(); err != nil || len(dirs) != 2 {
+		t.Errorf("Alternates() = %v, %v", dirs, err)
+	}
+	_testObjectStore(t, store, a, core.Sha1{1})
+	for _, hash := range []core.Sha1{a, b, c} {
+		if _, err := repo.ObjectBySha1(hash); err != nil {
+			t.Errorf("ObjectBySha1(%v) returned error %v", hash, err)
+		}
+	}
+	if size, _ := store.Size(); size != 9 {
+		t.Errorf("Size() = %d, want 9", size)
+	}
+	if hashes, err := repo.Sha1sWithPrefix(a.String()[:6]); err != nil || len(hashes) != 1 {
+		t.Errorf("Sha1sWithPrefix() = %v, %v", hashes, err)
+	}
+	if _, err := repo.LooseObjectBySha1(b); err != ErrObjectNotFoundInRepo {
+		t.Errorf("LooseObjectBySha1() of an object in an alternate returned error %v", err)
+	}
+
+	// GIT_ALTERNATE_OBJECT_DIRECTORIES adds alternates to a repository that
+	// has none of its own.
+	other, cleanupOther := _fixtureRepo(t)
+	defer cleanupOther()
+	if _, err := other.ObjectBySha1(b); err != ErrObjectNotFoundInRepo {
+		t.Errorf("ObjectBySha1() returned error %v, want %v", err, ErrObjectNotFoundInRepo)
+	}
+	os.Setenv("GIT_ALTERNATE_OBJECT_DIRECTORIES", filepath.Join(base.Path(), "objects"))
+	defer os.Unsetenv("GIT_ALTERNATE_OBJECT_DIRECTORIES")
+	other.Close() // The variable is only read when the object store is created.
+	for _, hash := range []core.Sha1{a, b, c} {
+		if _, err := other.ObjectBySha1(hash); err != nil {
+			t.Errorf("ObjectBySha1(%v) with GIT_ALTERNATE_OBJECT_DIRECTORIES returned error %v", hash, err)
+		}
+	}
+}
+
+func TestRepository_OpenObject(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	big := &core.Blob{Content: bytes.Repeat([]byte("0123456789abcdef"), 1<<16)}
+	loose := _writeFixtureObject(t, repo, big)
+	a := _writeFixtureCommit(t, repo, nil, "a", "a\n", 0)
+	if _, err := repo.PackObjects([]core.Sha1{a}, format.PackOptions{}); err != nil {
+		t.Fatalf("PackObjects() returned error %v", err)
+	}
+	commit, err := repo.ObjectBySha1(a)
+	if err != nil {
+		t.Fatalf("ObjectBySha1() returned error %v", err)
+	}
+
+	for hash, expected := range map[core.Sha1]core.Object{loose: big, a: commit} {
+		typ, size, r, err := repo.OpenObject(hash)
+		if err != nil {
+			t.Errorf("OpenObject(%v) returned error %v", hash, err)
+			continue
+		}
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("reading %v returned error %v", hash, err)
+		} else if err := r.Close(); err != nil {
+			t.Errorf("closing %v returned error %v", hash, err)
+		}
+
+		want, _ := ioutil.ReadAll(expected.Reader())
+		if typ != expected.Type() || size != int64(len(want)) || !bytes.Equal(content, want) {
+			t.Errorf("OpenObject(%v) = %q, %d, with %d bytes of content", hash, typ, size, len(content))
+		}
+	}
+
+	if _, _, _, err := repo.OpenObject(core.Sha1{1}); err != ErrObjectNotFoundInRepo {
+		t.Errorf("OpenObject() returned error %v, want %v", err, ErrObjectNotFoundInRepo)
+	}
+
+	// An object whose content does not match its name is reported once its
+	// content has been read.
+	store := repo.ObjectStore().(*FilesystemObjectStore)
+	corrupt := core.Sha1{1}
+	if err := os.MkdirAll(filepath.Dir(store.loosePath(corrupt)), os.FileMode(0755)); err != nil {
+		t.Fatal(err)
+	} else if err := os.Rename(store.loosePath(loose), store.loosePath(corrupt)); err != nil {
+		t.Fatal(err)
+	}
+	_, _, r, err := repo.OpenObject(corrupt)
+	if err != nil {
+		t.Fatalf("OpenObject() of a corrupt object returned error %v", err)
+	}
+	defer r.Close()
+	if _, err := ioutil.ReadAll(r); err != ErrObjectHashMismatch {
+		t.Errorf("reading a corrupt object returned error %v, want %v", err, ErrObjectHashMismatch)
+	}
+}
+
+func TestRepository_MultiPackIndex(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	var commits []core.Sha1
+	for i, name := range []string{"a", "b", "c"} {
+		commit := _writeFixtureCommit(t, repo, commits, name, name+"\n", int64(i))
+		commits = append(commits, commit)
+		if _, err := repo.PackObjects([]core.Sha1{commit}, format.PackOptions{}); err != nil {
+			t.Fatalf("PackObjects() returned error %v", err)
+		}
+	}
+	packs, _ := filepath.Glob(filepath.Join(repo.Path(), "objects", "pack", "*.idx"))
+	for _, commit := range commits {
+		os.RemoveAll(filepath.Dir(repo.ObjectStore().(*FilesystemObjectStore).loosePath(commit)))
+	}
+
+	if _, err := repo.MultiPackIndex(); !os.IsNotExist(err) {
+		t.Errorf("MultiPackIndex() without one returned error %v", err)
+	}
+	midx, err := repo.WriteMultiPackIndex()
+	if err != nil {
+		t.Fatalf("WriteMultiPackIndex() returned error %v", err)
+	} else if len(midx.PackNames()) != len(packs) || midx.Size() != len(packs) {
+		t.Errorf("WriteMultiPackIndex() covered %v with %d objects", midx.PackNames(), midx.Size())
+	}
+	if loaded, err := repo.MultiPackIndex(); err != nil || loaded.Sha1() != midx.Sha1() {
+		t.Errorf("MultiPackIndex() = %v, %v", loaded, err)
+	}
+
+	// A pack that is written after the multi-pack-index is still searched.
+	d := _writeFixtureCommit(t, repo, commits, "d", "d\n", 3)
+	if _, err := repo.PackObjects([]core.Sha1{d}, format.PackOptions{}); err != nil {
+		t.Fatalf("PackObjects() returned error %v", err)
+	}
+	commits = append(commits, d)
+
+	store := repo.ObjectStore().(*FilesystemObjectStore)
+	for _, commit := range commits {
+		if object, err := repo.PackedObjectBySha1(commit); err != nil || object.Type() != "commit" {
+			t.Errorf("PackedObjectBySha1(%v) = %v, %v", commit, object, err)
+		}
+		if found, err := store.Has(commit); err != nil || !found {
+			t.Errorf("Has(%v) = %v, %v", commit, found, err)
+		}
+		if hashes, err := repo.Sha1sWithPrefix(commit.String()[:8]); err != nil || len(hashes) != 1 {
+			t.Errorf("Sha1sWithPrefix() = %v, %v", hashes, err)
+		}
+	}
+	if _, err := repo.PackedObjectBySha1(core.Sha1{1}); err != ErrObjectNotFoundInRepo {
+		t.Errorf("PackedObjectBySha1() returned error %v, want %v", err, ErrObjectNotFoundInRepo)
+	}
+	if size, _ := store.Size(); size != 12 {
+		t.Errorf("Size() = %d, want 12", size)
+	}
+
+	// Should the multi-pack-index name packs that have since been removed, the
+	// remaining packs are searched instead, and a pack that fails to open is
+	// skipped.
+	packDir := filepath.Join(repo.Path(), "objects", "pack")
+	packPath := func(commit core.Sha1) string {
+		n, _, err := midx.Lookup(commit)
+		if err != nil {
+			t.Fatalf("Lookup(%v) returned error %v", commit, err)
+		}
+		return filepath.Join(packDir, strings.TrimSuffix(midx.PackNames()[n], ".idx"))
+	}
+	moved, removed := packPath(commits[0]), packPath(commits[1])
+	for _, ext := range []string{".pack", ".idx"} {
+		content, err := ioutil.ReadFile(moved + ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(packDir, "pack-moved"+ext), content, os.FileMode(0644)); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(packDir, "pack-corrupt"+ext), []byte("corrupt"), os.FileMode(0644)); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(moved + ext)
+		os.Remove(removed + ext)
+	}
+	if found, err := store.Has(commits[0]); err != nil || !found {
+		t.Errorf("Has() of an object in a moved pack = %v, %v", found, err)
+	}
+	if object, err := repo.PackedObjectBySha1(commits[0]); err != nil || object.Type() != "commit" {
+		t.Errorf("PackedObjectBySha1() of an object in a moved pack = %v, %v", object, err)
+	}
+	if found, err := store.Has(commits[1]); err != nil || found {
+		t.Errorf("Has() of an object in a removed pack = %v, %v", found, err)
+	}
+	if _, err := repo.PackedObjectBySha1(commits[1]); err != ErrObjectNotFoundInRepo {
+		t.Errorf("PackedObjectBySha1() of an object in a removed pack returned error %v, want %v", err, ErrObjectNotFoundInRepo)
+	}
+	if found, err := store.Has(d); err != nil || !found {
+		t.Errorf("Has(%v) = %v, %v", d, found, err)
+	}
+	if _, err := store.Size(); err != nil {
+		t.Errorf("Size() returned error %v", err)
+	}
+}
+
+func TestPackObjectStore(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	a := _writeFixtureCommit(t, repo, nil, "a", "a\n", 0)
+	pack, err := repo.PackObjects([]core.Sha1{a}, format.PackOptions{})
+	if err != nil {
+		t.Fatalf("PackObjects() returned error %v", err)
+	}
+	packs, _ := filepath.Glob(filepath.Join(repo.Path(), "objects", "pack", "*.pack"))
+	if len(packs) != 1 || pack == nil {
+		t.Fatalf("PackObjects() wrote packs %v", packs)
+	}
+
+	store, err := NewPackObjectStore(packs[0])
+	if err != nil {
+		t.Fatalf("NewPackObjectStore() returned error %v", err)
+	}
+	defer store.Close()
+
+	_testObjectStore(t, store, a, core.Sha1{1})
+	if _, err := store.Put(&core.Blob{}); err != ErrObjectStoreReadOnly {
+		t.Errorf("Put() returned error %v, want %v", err, ErrObjectStoreReadOnly)
+	}
+
+	packed := NewRepositoryWithObjectStore(repo.Path(), store)
+	if hashes, err := packed.Sha1sWithPrefix(a.String()[:4]); err != nil || len(hashes) != 1 {
+		t.Errorf("Sha1sWithPrefix() = %v, %v", hashes, err)
+	}
+}
@@ -0,0 +1,346 @@
+package plumbing
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+)
+
+// A packCache keeps the packs of one or more object directories open between
+// lookups, so that the "pack" directory is not listed and pack indices are not
+// loaded again for every object that is read. Before each lookup, the "pack"
+// directory is checked for changes by its modification time, and the packs
+// and the multi-pack-index in it are reloaded if it has changed. As the
+// modification time may not change when packs are added in quick succession,
+// a lookup that misses reloads the directory once more before giving up, as
+// Git does. Packs are only opened once they are needed, and as in Git, a pack
+// that cannot be opened by then, such as one that has disappeared after a
+// repack, is skipped.
+//
+// A packCache is safe for concurrent use. A pack that has been handed out is
+// kept open until it is released, even if it disappears from its directory in
+// the meantime.
+type packCache struct {
+	mutex       sync.Mutex
+	dirs        map[string]*packDir
+	resolver    format.DeltaBaseResolver
+	objectCache *ObjectCache
+	closed      bool
+}
+
+// packDir is what a packCache knows about the "pack" directory of one object
+// directory.
+type packDir struct {
+	modTime time.Time
+	midx    *format.MultiPackIndex
+
+	// packs holds every pack in the directory, keyed by the file name of its
+	// pack index, and uncovered holds those that are not covered by midx.
+	packs     map[string]*cachedPack
+	uncovered []*cachedPack
+}
+
+// A cachedPack is a pack held by a packCache. It counts the references to it
+// that have been handed out, and it is closed once it has been retired from
+// the cache and the last of those references has been released.
+type cachedPack struct {
+	cache   *packCache
+	pack    *format.Pack
+	opened  bool
+	refs    int
+	retired bool
+}
+
+// newPackCache returns an empty packCache whose packs look up the bases of
+// REF_DELTA entries that live outside of them with the given resolver, and keep
+// the objects that they resolve in the given ObjectCache.
+func newPackCache(resolver format.DeltaBaseResolver, objects *ObjectCache) *packCache {
+	return &packCache{dirs: make(map[string]*packDir), resolver: resolver, objectCache: objects}
+}
+
+// Close releases the reference to this pack that was handed out by the cache.
+func (cp *cachedPack) Close() error {
+	cp.cache.mutex.Lock()
+	defer cp.cache.mutex.Unlock()
+
+	cp.refs--
+	if cp.retired && cp.refs == 0 {
+		return cp.closePack()
+	}
+	return nil
+}
+
+// open opens this pack unless it has already been opened. The cache must be
+// locked.
+func (cp *cachedPack) open() error {
+	if cp.opened {
+		return nil
+	}
+	if err := cp.pack.Open(); err != nil {
+		cp.pack.Close()
+		cp.pack = format.NewPack(cp.pack.Path())
+		return err
+	}
+	cp.pack.BaseResolver = cp.cache.resolver
+	cp.pack.Cache = cp.cache.objectCache
+	cp.opened = true
+	return nil
+}
+
+// acquire opens this pack if need be and hands out a reference to it. The
+// cache must be locked.
+func (cp *cachedPack) acquire() (*cachedPack, error) {
+	if err := cp.open(); err != nil {
+		return nil, err
+	}
+	cp.refs++
+	return cp, nil
+}
+
+// retire removes this pack from the cache, closing it right away unless a
+// reference to it is still held. The cache must be locked.
+func (cp *cachedPack) retire() error {
+	cp.retired = true
+	if cp.refs == 0 {
+		return cp.closePack()
+	}
+	return nil
+}
+
+// closePack closes this pack and drops its objects from the ObjectCache.
+func (cp *cachedPack) closePack() error {
+	if !cp.opened {
+		return nil
+	}
+	cp.opened = false
+	cp.cache.objectCache.removePack(cp.pack)
+	return cp.pack.Close()
+}
+
+// load returns what is known about the "pack" directory of the given object
+// directory, reloading it first if it has changed since it was last loaded or
+// if force is true. The cache must be locked.
+func (c *packCache) load(objectsDir string, force bool) (*packDir, error) {
+	if c.closed {
+		return nil, Errorf("pack cache for %s is closed", objectsDir)
+	}
+
+	packDirPath := filepath.Join(objectsDir, "pack")
+	var modTime time.Time
+	if info, err := os.Stat(packDirPath); err == nil {
+		modTime = info.ModTime()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	d, exists := c.dirs[objectsDir]
+	if exists && !force && d.modTime.Equal(modTime) {
+		return d, nil
+	}
+
+	packs, err := listPacks(objectsDir)
+	if err != nil {
+		return nil, err
+	}
+	midx, err := format.MultiPackIndexAtPath(filepath.Join(packDirPath, MultiPackIndexName))
+	if os.IsNotExist(err) || len(packs) == 0 {
+		midx = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	reloaded := &packDir{modTime: modTime, midx: midx, packs: make(map[string]*cachedPack, len(packs))}
+	for _, pack := range packs {
+		name := filepath.Base(pack.IndexPath())
+		cp := &cachedPack{cache: c, pack: pack}
+		if exists && d.packs[name] != nil {
+			cp = d.packs[name]
+		}
+		reloaded.packs[name] = cp
+	}
+	if exists {
+		for name, cp := range d.packs {
+			if reloaded.packs[name] != cp {
+				cp.retire()
+			}
+		}
+	}
+
+	covered := make(map[string]bool)
+	if midx != nil {
+		for _, name := range midx.PackNames() {
+			covered[name] = true
+		}
+	}
+	for _, pack := range packs {
+		if name := filepath.Base(pack.IndexPath()); !covered[name] {
+			reloaded.uncovered = append(reloaded.uncovered, reloaded.packs[name])
+		}
+	}
+
+	c.dirs[objectsDir] = reloaded
+	return reloaded, nil
+}
+
+// find hands out a reference to the pack of the given object directory that
+// holds the object with the given SHA-1. The multi-pack-index is consulted
+// first, so that only the packs that it does not cover need to be searched one
+// by one. Should the multi-pack-index name a pack that no longer exists or
+// cannot be opened, every pack is searched instead. The reference must be
+// released by closing it.
+func (c *packCache) find(objectsDir string, hash core.Sha1) (*cachedPack, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, force := range []bool{false, true} {
+		d, err := c.load(objectsDir, force)
+		if err != nil {
+			return nil, err
+		}
+		if cp, err := d.find(hash); err != ErrObjectNotFoundInRepo {
+			return cp, err
+		}
+	}
+	return nil, ErrObjectNotFoundInRepo
+}
+
+// find is the counterpart of packCache.find for this directory as it is
+// currently known. The cache must be locked.
+func (d *packDir) find(hash core.Sha1) (*cachedPack, error) {
+	for _, cp := range d.candidates(hash) {
+		if cp.open() == nil && cp.pack.HasObject(hash) {
+			return cp.acquire()
+		}
+	}
+	return nil, ErrObjectNotFoundInRepo
+}
+
+// candidates returns the packs of this directory that have to be searched for
+// the object with the given SHA-1. If the multi-pack-index records the object
+// against a pack that can be opened, that pack is the only candidate, and if
+// the pack no longer exists or fails to open, every pack is. Otherwise, only
+// the packs that the multi-pack-index does not cover are candidates. The cache
+// must be locked.
+func (d *packDir) candidates(hash core.Sha1) []*cachedPack {
+	if d.midx == nil {
+		return d.uncovered
+	}
+	n, _, err := d.midx.Lookup(hash)
+	if err != nil {
+		return d.uncovered
+	}
+	if cp := d.packs[d.midx.PackNames()[n]]; cp != nil && cp.open() == nil {
+		return []*cachedPack{cp}
+	}
+
+	candidates := make([]*cachedPack, 0, len(d.packs))
+	for _, cp := range d.packs {
+		candidates = append(candidates, cp)
+	}
+	return candidates
+}
+
+// has returns true if the object with the given SHA-1 is in one of the packs of
+// the given object directory.
+func (c *packCache) has(objectsDir string, hash core.Sha1) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, force := range []bool{false, true} {
+		d, err := c.load(objectsDir, force)
+		if err != nil {
+			return false, err
+		}
+		if d.has(hash) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// has is the counterpart of packCache.has for this directory as it is
+// currently known. The cache must be locked.
+func (d *packDir) has(hash core.Sha1) bool {
+	for _, cp := range d.candidates(hash) {
+		if cp.open() == nil && cp.pack.HasObject(hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// objects returns sorted slices of SHA-1 checksums that together cover every
+// packed object of the given object directory: one for the multi-pack-index,
+// if there is one, and one for each pack that it does not cover.
+func (c *packCache) objects(objectsDir string) ([][]core.Sha1, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	d, err := c.load(objectsDir, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var lists [][]core.Sha1
+	if d.midx != nil {
+		lists = append(lists, d.midx.Objects())
+	}
+	for _, cp := range d.uncovered {
+		if cp.open() == nil {
+			lists = append(lists, cp.pack.Objects())
+		}
+	}
+	return lists, nil
+}
+
+// close retires every pack of this cache, so that each one is closed as soon
+// as it is no longer in use, and makes any further lookup fail.
+func (c *packCache) close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var err error
+	for _, d := range c.dirs {
+		for _, cp := range d.packs {
+			if e := cp.retire(); err == nil {
+				err = e
+			}
+		}
+	}
+	c.dirs = nil
+	c.closed = true
+	return err
+}
+
+// listPacks returns a slice of all the packs in the given object directory,
+// none of which has been opened. As in Git, packs are found through their
+// indices, and an index whose pack file is missing, such as one that is still
+// being written, is ignored. A directory without a "pack" directory has no
+// packs.
+func listPacks(objectsDir string) ([]*format.Pack, error) {
+	packPath := filepath.Join(objectsDir, "pack")
+	filenames, err := readDirNames(packPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	exists := make(map[string]bool, len(filenames))
+	for _, filename := range filenames {
+		exists[filename] = true
+	}
+
+	var packs []*format.Pack
+	for _, filename := range filenames {
+		if base := strings.TrimSuffix(filename, ".idx"); base != filename && exists[base+".pack"] {
+			packs = append(packs, format.NewPack(filepath.Join(packPath, base+".pack")))
+		}
+	}
+	return packs, nil
+}
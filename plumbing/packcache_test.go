@@ -0,0 +1,149 @@
+package plumbing
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+)
+
+func TestRepository_PackCache(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	a := _writeFixtureCommit(t, repo, nil, "a", "a\n", 0)
+	first, err := repo.PackObjects([]core.Sha1{a}, format.PackOptions{})
+	if err != nil {
+		t.Fatalf("PackObjects() returned error %v", err)
+	}
+	store := repo.ObjectStore().(*FilesystemObjectStore)
+	os.RemoveAll(filepath.Dir(store.loosePath(a)))
+
+	if store != repo.ObjectStore() {
+		t.Fatalf("ObjectStore() returned a different store the second time")
+	}
+
+	cached := func() map[string]*cachedPack {
+		store.packs.mutex.Lock()
+		defer store.packs.mutex.Unlock()
+		if d := store.packs.dirs[store.dir]; d != nil {
+			return d.packs
+		}
+		return nil
+	}
+
+	if _, err := repo.PackedObjectBySha1(a); err != nil {
+		t.Fatalf("PackedObjectBySha1() returned error %v", err)
+	}
+	firstName := filepath.Base(first.IndexPath())
+	held := cached()[firstName]
+	if held == nil || !held.opened || held.refs != 0 {
+		t.Fatalf("pack %s is not cached as open and unreferenced: %+v", firstName, held)
+	}
+	if _, err := repo.PackedObjectBySha1(a); err != nil || cached()[firstName] != held {
+		t.Errorf("second PackedObjectBySha1() did not reuse the cached pack: %v", err)
+	}
+
+	// A pack that is added later is picked up by the same repository.
+	b := _writeFixtureCommit(t, repo, []core.Sha1{a}, "b", "b\n", 1)
+	if _, err := repo.PackObjects([]core.Sha1{b}, format.PackOptions{}); err != nil {
+		t.Fatalf("PackObjects() returned error %v", err)
+	}
+	os.RemoveAll(filepath.Dir(store.loosePath(b)))
+	if _, err := repo.PackedObjectBySha1(b); err != nil {
+		t.Errorf("PackedObjectBySha1() of an object in a new pack returned error %v", err)
+	}
+	if n := len(cached()); n != 2 {
+		t.Errorf("%d packs are cached, want 2", n)
+	}
+
+	// A pack that is added without changing the modification time of the
+	// directory is found by reloading it after a miss, and an index whose pack
+	// is missing is ignored.
+	packDir := filepath.Join(store.dir, "pack")
+	keepModTime := func(change func()) {
+		info, err := os.Stat(packDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		change()
+		if err := os.Chtimes(packDir, info.ModTime(), info.ModTime()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := _writeFixtureCommit(t, repo, []core.Sha1{b}, "c", "c\n", 2)
+	keepModTime(func() {
+		third, err := repo.PackObjects([]core.Sha1{c}, format.PackOptions{})
+		if err != nil {
+			t.Fatalf("PackObjects() returned error %v", err)
+		}
+		idx, err := ioutil.ReadFile(third.IndexPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(packDir, "pack-orphan.idx"), idx, os.FileMode(0644)); err != nil {
+			t.Fatal(err)
+		}
+	})
+	os.RemoveAll(filepath.Dir(store.loosePath(c)))
+	if _, err := repo.PackedObjectBySha1(c); err != nil {
+		t.Errorf("PackedObjectBySha1() of an object in a pack added in the same instant returned error %v", err)
+	}
+	if n := len(cached()); n != 3 {
+		t.Errorf("%d packs are cached, want 3", n)
+	}
+
+	// A pack that disappears before it is opened is skipped.
+	d := _writeFixtureCommit(t, repo, []core.Sha1{c}, "d", "d\n", 3)
+	fourth, err := repo.PackObjects([]core.Sha1{d}, format.PackOptions{})
+	if err != nil {
+		t.Fatalf("PackObjects() returned error %v", err)
+	}
+	store.packs.mutex.Lock()
+	store.packs.load(store.dir, true)
+	store.packs.mutex.Unlock()
+	keepModTime(func() {
+		os.Remove(fourth.Path())
+	})
+	if found, err := store.Has(core.Sha1{1}); err != nil || found {
+		t.Errorf("Has() with a vanished pack = %v, %v", found, err)
+	}
+	if _, err := store.Size(); err != nil {
+		t.Errorf("Size() with a vanished pack returned error %v", err)
+	}
+
+	// A pack that is removed while it is being read from stays open until the
+	// reader is closed.
+	_, _, r, err := repo.OpenObject(a)
+	if err != nil {
+		t.Fatalf("OpenObject() returned error %v", err)
+	}
+	for _, path := range []string{first.Path(), first.IndexPath()} {
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := repo.PackedObjectBySha1(a); err != ErrObjectNotFoundInRepo {
+		t.Errorf("PackedObjectBySha1() of an object in a removed pack returned error %v", err)
+	}
+	if !held.retired || !held.opened {
+		t.Errorf("removed pack that is still being read is %+v, want retired and open", held)
+	}
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Errorf("reading from a removed pack returned error %v", err)
+	}
+	r.Close()
+	if held.opened {
+		t.Errorf("removed pack is still open after its last reader was closed")
+	}
+
+	if err := repo.Close(); err != nil {
+		t.Errorf("Close() returned error %v", err)
+	}
+	if _, err := repo.PackedObjectBySha1(b); err != nil {
+		t.Errorf("PackedObjectBySha1() after Close() returned error %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package plumbing
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+)
+
+// PackObjects reads the objects with the given SHA-1 checksums from this
+// repository and writes them into a new pack file and a v2 pack index under
+// the repository's "objects/pack" directory. Equivalent to
+// `git pack-objects`. See the documentation on format.PackOptions for the
+// available options.
+//
+// Both files are first written to temporary files and are only renamed to
+// their final names, which are derived from the pack file checksum, once they
+// have been written in their entirety. The pack file is renamed first and the
+// pack index last, since packs are found through their indices, so that no
+// index ever appears without its pack. The Pack returned has not been opened.
+func (repo *Repository) PackObjects(hashes []core.Sha1, o format.PackOptions) (*format.Pack, error) {
+	objects := make([]core.Object, len(hashes))
+	for i, hash := range hashes {
+		object, err := repo.ObjectBySha1(hash)
+		if err != nil {
+			return nil, err
+		}
+		objects[i] = object
+	}
+
+	return repo.writePack(func(w io.Writer) (*format.PackIndexV2, error) {
+		return format.WritePack(w, objects, o)
+	})
+}
+
+// writePack calls write to write a pack into a temporary file under the
+// repository's "objects/pack" directory, writes the pack index that write
+// returns next to it, and then renames both to their final names, which are
+// derived from the pack file checksum. As Git does, the pack file is renamed
+// first and the pack index last, so that anything that finds packs through
+// their indices never sees an index whose pack does not exist yet. The Pack
+// returned has not been opened.
+func (repo *Repository) writePack(write func(w io.Writer) (*format.PackIndexV2, error)) (*format.Pack, error) {
+	packDir := filepath.Join(repo.path, "objects", "pack")
+	if err := os.MkdirAll(packDir, os.FileMode(0755)); err != nil {
+		return nil, err
+	}
+
+	packFile, err := ioutil.TempFile(packDir, "tmp_pack_")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(packFile.Name())
+	defer packFile.Close()
+
+	idx, err := write(packFile)
+	if err != nil {
+		return nil, err
+	}
+	idxFile, err := ioutil.TempFile(packDir, "tmp_idx_")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(idxFile.Name())
+	defer idxFile.Close()
+
+	if _, err := io.Copy(idxFile, idx.Reader()); err != nil {
+		return nil, err
+	}
+
+	base := filepath.Join(packDir, "pack-"+idx.PackfileSha1().String())
+	for _, item := range []struct {
+		file *os.File
+		path string
+	}{
+		{packFile, base + ".pack"},
+		{idxFile, base + ".idx"},
+	} {
+		if err := item.file.Chmod(DefaultObjectFileMode); err != nil {
+			return nil, err
+		} else if err := item.file.Close(); err != nil {
+			return nil, err
+		} else if err := os.Rename(item.file.Name(), item.path); err != nil {
+			return nil, err
+		}
+	}
+
+	return format.NewPack(base + ".pack"), nil
+}
@@ -0,0 +1,165 @@
+package plumbing
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+)
+
+// PackRefsOptions contains all the possible options for PackRefs.
+//
+// All is a bool that, when set to true, packs every loose ref under "refs/".
+// Otherwise, only the loose refs under "refs/tags/" are packed, along with
+// loose refs that already have a packed form, as they would otherwise shadow
+// it.
+//
+// NoPrune is a bool that, when set to true, leaves the loose refs in place once
+// they have been packed. Otherwise, they are deleted, as `git pack-refs` does
+// unless --no-prune is given.
+type PackRefsOptions struct {
+	All     bool
+	NoPrune bool
+}
+
+// PackRefs moves loose refs into the packed-refs file of this repository.
+// Equivalent to `git pack-refs`. See the documentation on PackRefsOptions for
+// more details.
+//
+// The packed-refs file is written the way Git writes it: sorted, and with the
+// peeled value of every ref that points to an annotated tag, so that it
+// advertises the peeled, fully-peeled and sorted traits. A ref that cannot be
+// peeled, such as one that points to a missing object, withdraws the
+// fully-peeled trait, and the peeled trait too if it is under "refs/tags/",
+// since the file can no longer vouch for its peeled value. Symbolic refs are
+// never packed. The file "packed-refs.lock" is held from the moment the
+// packed-refs file is read until the new one is renamed into place, and if it
+// already exists, ErrRefLocked is returned. Each loose ref is then pruned
+// under its own lock, and only if it still has the value that was packed.
+//
+// In a repository that uses the reftable backend, the options are ignored and
+// every table is merged into a single one instead, as `git pack-refs` does.
+func (repo *Repository) PackRefs(o PackRefsOptions) error {
+	if stack, err := repo.reftableStack(); err != nil {
+		return err
+	} else if stack != nil {
+		if err := stack.CompactAll(); err == format.ErrReftableLocked {
+			return ErrRefLocked
+		} else {
+			return err
+		}
+	}
+
+	path := filepath.Join(repo.path, "packed-refs")
+	lock, err := os.OpenFile(path+".lock", os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(0644))
+	if os.IsExist(err) {
+		return ErrRefLocked
+	} else if err != nil {
+		return err
+	}
+	held := true
+	defer func() {
+		if held {
+			lock.Close()
+			os.Remove(lock.Name())
+		}
+	}()
+
+	packed, err := repo.readPackedRefs()
+	if err != nil {
+		return err
+	}
+	result := &format.PackedRefs{Peeled: true, FullyPeeled: true}
+	peel := func(ref *format.Ref) {
+		peeled, err := repo.peelToType(ref.Sha1, "")
+		if err != nil {
+			result.FullyPeeled = false
+			if strings.HasPrefix(ref.Name, "refs/tags/") {
+				result.Peeled = false
+			}
+		} else if peeled != ref.Sha1 {
+			ref.Peeled = peeled
+		}
+	}
+
+	refs := make(map[string]format.Ref)
+	for _, ref := range packed.Refs {
+		if !packed.IsPeeled(ref) {
+			peel(&ref)
+		}
+		refs[ref.Name] = ref
+	}
+
+	var loose []format.Ref
+	err = filepath.Walk(filepath.Join(repo.path, "refs"), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasSuffix(path, ".lock") {
+			return err
+		}
+
+		rel, err := filepath.Rel(repo.path, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if _, ok := refs[name]; !o.All && !ok && !strings.HasPrefix(name, "refs/tags/") {
+			return nil
+		}
+
+		hash, err := repo.Sha1FromLooseRef(name)
+		if err == ErrInvalidRef || err == ErrRefNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		ref := format.Ref{Name: name, Sha1: hash}
+		peel(&ref)
+		refs[name] = ref
+		loose = append(loose, ref)
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, ref := range refs {
+		result.Refs = append(result.Refs, ref)
+	}
+	result.Sort()
+
+	if _, err := lock.ReadFrom(result.Reader()); err != nil {
+		return err
+	} else if err := lock.Close(); err != nil {
+		return err
+	} else if err := os.Rename(lock.Name(), path); err != nil {
+		return err
+	}
+	held = false
+
+	if !o.NoPrune {
+		for _, ref := range loose {
+			repo.pruneLooseRef(ref.Name, ref.Sha1)
+		}
+	}
+	return nil
+}
+
+// pruneLooseRef deletes the loose ref with the given name, provided that it can
+// be locked and that it still points to the given object. Failing that, the
+// ref is left alone, as it still has a packed form.
+func (repo *Repository) pruneLooseRef(name string, hash core.Sha1) {
+	path := filepath.Join(repo.path, filepath.FromSlash(name))
+	lock, err := os.OpenFile(path+".lock", os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(0644))
+	if err != nil {
+		return
+	}
+	lock.Close()
+
+	if current, err := repo.Sha1FromLooseRef(name); err == nil && current == hash {
+		os.Remove(path)
+	}
+	os.Remove(lock.Name())
+	repo.pruneRefDirs(filepath.Dir(path))
+}
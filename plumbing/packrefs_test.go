@@ -0,0 +1,104 @@
+package plumbing
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kourge/ggit/core"
+)
+
+func TestRepository_PackRefs(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	a := _writeFixtureCommit(t, repo, nil, "a", "a\n", 0)
+	b := _writeFixtureCommit(t, repo, []core.Sha1{a}, "b", "b\n", 1)
+	tagger := core.NewPerson("Jane Doe", "jane@example.com", 1400000000, 0)
+	v1 := _writeFixtureObject(t, repo, core.NewTag(a, "commit", "v1", tagger, "v1\n"))
+
+	_writeFixtureRef(t, repo, "HEAD", "ref: refs/heads/master")
+	_writeFixtureRef(t, repo, "refs/heads/master", b.String())
+	_writeFixtureRef(t, repo, "refs/heads/topic", a.String())
+	_writeFixtureRef(t, repo, "refs/tags/v1", v1.String())
+	_writeFixtureRef(t, repo, "refs/tags/release/v0", a.String())
+	_writeFixtureRef(t, repo, "refs/remotes/origin/HEAD", "ref: refs/remotes/origin/master")
+	_writeFixtureRef(t, repo, "packed-refs", b.String()+" refs/heads/topic\n")
+
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(repo.Path(), filepath.FromSlash(name)))
+		return err == nil
+	}
+	packedRefs := func() string {
+		content, _ := ioutil.ReadFile(filepath.Join(repo.Path(), "packed-refs"))
+		return string(content)
+	}
+	header := "# pack-refs with: peeled fully-peeled sorted \n"
+
+	if err := repo.PackRefs(PackRefsOptions{}); err != nil {
+		t.Fatalf("PackRefs() returned error %v", err)
+	}
+	expected := header +
+		a.String() + " refs/heads/topic\n" +
+		a.String() + " refs/tags/release/v0\n" +
+		v1.String() + " refs/tags/v1\n^" + a.String() + "\n"
+	if actual := packedRefs(); actual != expected {
+		t.Errorf("packed-refs = %q, want %q", actual, expected)
+	}
+	if exists("refs/tags/v1") || exists("refs/heads/topic") || !exists("refs/heads/master") {
+		t.Errorf("PackRefs() pruned the wrong loose refs")
+	}
+	if exists("refs/tags/release") {
+		t.Errorf("PackRefs() left an empty directory behind")
+	}
+	if !exists("refs/tags") {
+		t.Errorf("PackRefs() removed refs/tags, which Git keeps")
+	}
+
+	if err := repo.PackRefs(PackRefsOptions{All: true, NoPrune: true}); err != nil {
+		t.Fatalf("PackRefs() returned error %v", err)
+	}
+	expected = header +
+		b.String() + " refs/heads/master\n" +
+		a.String() + " refs/heads/topic\n" +
+		a.String() + " refs/tags/release/v0\n" +
+		v1.String() + " refs/tags/v1\n^" + a.String() + "\n"
+	if actual := packedRefs(); actual != expected {
+		t.Errorf("packed-refs = %q, want %q", actual, expected)
+	}
+	if !exists("refs/heads/master") || !exists("refs/remotes/origin/HEAD") {
+		t.Errorf("PackRefs() pruned loose refs with NoPrune")
+	}
+	if sha1, err := repo.ResolveRef("HEAD"); err != nil || sha1 != b {
+		t.Errorf("HEAD = %v, %v, want %v", sha1, err, b)
+	}
+
+	// A ref that cannot be peeled withdraws the traits that vouch for it.
+	missing := core.Sha1{0xde, 0xad}
+	_writeFixtureRef(t, repo, "refs/heads/gone", missing.String())
+	if err := repo.PackRefs(PackRefsOptions{All: true, NoPrune: true}); err != nil {
+		t.Fatalf("PackRefs() returned error %v", err)
+	}
+	if actual := packedRefs(); !strings.HasPrefix(actual, "# pack-refs with: peeled sorted \n") {
+		t.Errorf("packed-refs = %q, want it to advertise only the peeled and sorted traits", actual)
+	}
+	_writeFixtureRef(t, repo, "refs/tags/gone", missing.String())
+	if err := repo.PackRefs(PackRefsOptions{All: true, NoPrune: true}); err != nil {
+		t.Fatalf("PackRefs() returned error %v", err)
+	}
+	if actual := packedRefs(); !strings.HasPrefix(actual, "# pack-refs with: sorted \n") {
+		t.Errorf("packed-refs = %q, want it to advertise only the sorted trait", actual)
+	} else if !strings.Contains(actual, v1.String()+" refs/tags/v1\n^"+a.String()+"\n") {
+		t.Errorf("packed-refs = %q, want it to keep the peeled value of refs/tags/v1", actual)
+	}
+
+	ioutil.WriteFile(filepath.Join(repo.Path(), "packed-refs.lock"), nil, os.FileMode(0644))
+	if err := repo.PackRefs(PackRefsOptions{All: true}); err != ErrRefLocked {
+		t.Errorf("PackRefs() returned error %v, want %v", err, ErrRefLocked)
+	}
+	if !exists("packed-refs.lock") {
+		t.Errorf("PackRefs() removed a lock it did not hold")
+	}
+}
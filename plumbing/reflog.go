@@ -0,0 +1,285 @@
+package plumbing
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kourge/ggit/config"
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+)
+
+var ErrReflogNotFound = errors.New("reflog not found in repo")
+
+// Reflog reads the reflog of the ref with the given name. If the ref has no
+// reflog, the error ErrReflogNotFound is returned.
+func (repo *Repository) Reflog(ref string) (*format.Reflog, error) {
+	if stack, err := repo.reftableStack(); err != nil {
+		return nil, err
+	} else if stack != nil {
+		return reftableReflog(stack, ref)
+	}
+
+	file, err := os.Open(repo.reflogPath(ref))
+	if os.IsNotExist(err) {
+		return nil, ErrReflogNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reflog := &format.Reflog{}
+	if err := reflog.Decode(file); err != nil {
+		return nil, err
+	}
+	return reflog, nil
+}
+
+// AppendReflog appends the given entry to the reflog of the ref with the given
+// name, creating the reflog if it does not exist yet. UpdateRefs calls this
+// for every ref it changes when reflogs are enabled, so it rarely needs to be
+// called directly.
+func (repo *Repository) AppendReflog(ref string, entry format.ReflogEntry) error {
+	if stack, err := repo.reftableStack(); err != nil {
+		return err
+	} else if stack != nil {
+		return appendReftableLog(stack, ref, entry)
+	}
+
+	path := repo.reflogPath(ref)
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0755)); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+
+	entry.Message = normalizeReflogMessage(entry.Message)
+	if _, err := file.ReadFrom(entry.Reader()); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ExpireReflog removes the entries of the reflog of the ref with the given name
+// that were made before the given time. Equivalent to `git reflog expire
+// --expire=<time> <ref>`. Both the ref and its reflog are locked while the
+// reflog is rewritten, as Git does. If the ref has no reflog, the error
+// ErrReflogNotFound is returned.
+func (repo *Repository) ExpireReflog(ref string, before time.Time) error {
+	if stack, err := repo.reftableStack(); err != nil {
+		return err
+	} else if stack != nil {
+		return expireReftableLog(stack, ref, before)
+	}
+
+	if err := format.ValidateRefName(ref); err != nil {
+		return Errorf("%s: %v", ref, err)
+	}
+	refPath := filepath.Join(repo.path, filepath.FromSlash(ref))
+	if err := os.MkdirAll(filepath.Dir(refPath), os.FileMode(0755)); err != nil {
+		return err
+	}
+	lockPath := refPath + ".lock"
+	lock, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(0644))
+	if os.IsExist(err) {
+		return ErrRefLocked
+	} else if err != nil {
+		return err
+	}
+	lock.Close()
+	defer os.Remove(lockPath)
+
+	reflog, err := repo.Reflog(ref)
+	if err != nil {
+		return err
+	} else if reflog.Expire(before) == 0 {
+		return nil
+	}
+	return writeFileWithLock(repo.reflogPath(ref), reflog.Reader(), os.FileMode(0644))
+}
+
+func (repo *Repository) reflogPath(ref string) string {
+	return filepath.Join(repo.path, "logs", filepath.FromSlash(ref))
+}
+
+// shouldLogRef returns true if a change to the ref with the given name should
+// be recorded in its reflog. That is the case if the reflog already exists, or
+// if core.logAllRefUpdates says so: "always" covers every ref, while true
+// covers HEAD and the refs under refs/heads/, refs/remotes/ and refs/notes/.
+// When core.logAllRefUpdates is not set, it is taken to be true unless the
+// repository is bare.
+func (repo *Repository) shouldLogRef(c config.Config, ref string) bool {
+	if _, err := os.Stat(repo.reflogPath(ref)); err == nil {
+		return true
+	}
+	return logAllRefUpdates(c, ref)
+}
+
+// logAllRefUpdates returns true if core.logAllRefUpdates in c says that a
+// change to the ref with the given name should be recorded in a new reflog.
+func logAllRefUpdates(c config.Config, ref string) bool {
+	switch v := configValue(c, "core", "logallrefupdates").(type) {
+	case string:
+		if strings.EqualFold(v, "always") {
+			return true
+		}
+	case bool:
+		if !v {
+			return false
+		}
+	case nil:
+		if configBool(c, "core", "bare", false) {
+			return false
+		}
+	}
+
+	if ref == "HEAD" {
+		return true
+	}
+	for _, prefix := range []string{"refs/heads/", "refs/remotes/", "refs/notes/"} {
+		if strings.HasPrefix(ref, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultCommitter returns the identity that reflog entries are attributed to
+// when none is given, taken from the GIT_COMMITTER_NAME and
+// GIT_COMMITTER_EMAIL environment variables, or else from user.name and
+// user.email in c. The time is the current time.
+func defaultCommitter(c config.Config) core.Person {
+	name, email := os.Getenv("GIT_COMMITTER_NAME"), os.Getenv("GIT_COMMITTER_EMAIL")
+	if name == "" {
+		name = configString(c, "user", "name")
+	}
+	if email == "" {
+		email = configString(c, "user", "email")
+	}
+
+	now := time.Now()
+	_, offset := now.Zone()
+	return core.NewPerson(name, email, now.Unix(), offset)
+}
+
+// normalizeReflogMessage collapses every run of whitespace in the given
+// message, including newlines, into a single space and trims the ends, as Git
+// does before it writes a reflog entry.
+func normalizeReflogMessage(message string) string {
+	return strings.Join(strings.Fields(message), " ")
+}
+
+// previousBranch returns the branch or commit that was checked out before the
+// n-th most recent checkout, which is what "@{-n}" refers to, by scanning the
+// reflog of HEAD for the messages that `git checkout` leaves.
+func (repo *Repository) previousBranch(n int) (string, error) {
+	reflog, err := repo.Reflog("HEAD")
+	if err == ErrReflogNotFound {
+		return "", Errorf("no previous checkout: @{-%d}", n)
+	} else if err != nil {
+		return "", err
+	}
+
+	const prefix = "checkout: moving from "
+	for i := len(reflog.Entries) - 1; i >= 0 && n > 0; i-- {
+		message := reflog.Entries[i].Message
+		if !strings.HasPrefix(message, prefix) {
+			continue
+		}
+		if n--; n > 0 {
+			continue
+		}
+
+		message = message[len(prefix):]
+		if to := strings.LastIndex(message, " to "); to != -1 {
+			return message[:to], nil
+		}
+		return "", Errorf("malformed checkout message in reflog: %s", reflog.Entries[i].Message)
+	}
+	return "", Errorf("not enough checkouts in reflog of HEAD")
+}
+
+// reflogDateUnits maps the units that parseReflogDate understands in relative
+// dates to their length.
+var reflogDateUnits = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
+}
+
+// reflogDateLayouts lists the absolute date formats that parseReflogDate
+// understands. Dates without a time zone are in the local time zone.
+var reflogDateLayouts = []string{
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02T15:04:05-07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon Jan 2 15:04:05 2006 -0700",
+}
+
+// parseReflogDate parses the date in a "<ref>@{<date>}" expression relative to
+// now. Besides the absolute dates in reflogDateLayouts and "@<unix time>", it
+// accepts "now", "yesterday", and relative dates such as "2 weeks ago",
+// "1.day.ago" or "3 hours 5 minutes ago", in units of seconds, minutes, hours,
+// days, weeks, months and years.
+func parseReflogDate(spec string, now time.Time) (time.Time, error) {
+	spec = strings.TrimSpace(spec)
+	switch strings.ToLower(spec) {
+	case "now":
+		return now, nil
+	case "yesterday":
+		return now.AddDate(0, 0, -1), nil
+	}
+
+	if strings.HasPrefix(spec, "@") {
+		if sec, err := strconv.ParseInt(spec[1:], 10, 64); err == nil {
+			return time.Unix(sec, 0), nil
+		}
+	}
+	for _, layout := range reflogDateLayouts {
+		if t, err := time.ParseInLocation(layout, spec, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+
+	fields := strings.Fields(strings.ToLower(strings.Replace(spec, ".", " ", -1)))
+	if len(fields) < 3 || len(fields)%2 == 0 || fields[len(fields)-1] != "ago" {
+		return time.Time{}, Errorf("invalid date: %s", spec)
+	}
+
+	t := now
+	for i := 0; i < len(fields)-1; i += 2 {
+		n, err := strconv.Atoi(fields[i])
+		if err != nil {
+			return time.Time{}, Errorf("invalid date: %s", spec)
+		}
+
+		unit := strings.TrimSuffix(fields[i+1], "s")
+		switch unit {
+		case "month":
+			t = t.AddDate(0, -n, 0)
+		case "year":
+			t = t.AddDate(-n, 0, 0)
+		default:
+			length, ok := reflogDateUnits[unit]
+			if !ok {
+				return time.Time{}, Errorf("invalid date: %s", spec)
+			}
+			t = t.Add(-time.Duration(n) * length)
+		}
+	}
+	return t, nil
+}
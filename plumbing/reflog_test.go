@@ -0,0 +1,146 @@
+package plumbing
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kourge/ggit/core"
+)
+
+func TestRepository_UpdateRefs_Reflog(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	config := "[core]\n\tlogallrefupdates = true\n"
+	if err := ioutil.WriteFile(filepath.Join(repo.Path(), "config"), []byte(config), os.FileMode(0644)); err != nil {
+		t.Fatal(err)
+	}
+
+	a := _writeFixtureCommit(t, repo, nil, "a", "a\n", 0)
+	b := _writeFixtureCommit(t, repo, []core.Sha1{a}, "b", "b\n", 1)
+	c := _writeFixtureCommit(t, repo, []core.Sha1{b}, "c", "c\n", 2)
+	_writeFixtureRef(t, repo, "HEAD", "ref: refs/heads/master")
+
+	person := func(sec int64) core.Person { return core.NewPerson("Jane Doe", "jane@example.com", 1400000000+sec, 0) }
+	for _, update := range []RefUpdate{
+		{Name: "HEAD", NewSha1: a, Message: "commit (initial): a", Committer: person(0)},
+		{Name: "refs/heads/master", NewSha1: b, Message: "commit: b", Committer: person(100)},
+		{Name: "refs/heads/topic", NewSha1: b, Message: "branch: Created from master", Committer: person(200)},
+		{Name: "HEAD", Symref: "refs/heads/topic", Message: "checkout: moving from master to topic", Committer: person(300)},
+		{Name: "HEAD", NewSha1: c, Message: "commit:\nc\n", Committer: person(400)},
+		{Name: "refs/tags/v1", NewSha1: c, Committer: person(500)},
+	} {
+		if err := repo.UpdateRef(update); err != nil {
+			t.Fatalf("UpdateRef(%+v) returned error %v", update, err)
+		}
+	}
+
+	head, err := repo.Reflog("HEAD")
+	if err != nil {
+		t.Fatalf("Reflog() returned error %v", err)
+	}
+	var messages []string
+	for _, entry := range head.Entries {
+		messages = append(messages, entry.Message)
+	}
+	expected := []string{"commit (initial): a", "commit: b", "checkout: moving from master to topic", "commit: c"}
+	if len(messages) != len(expected) {
+		t.Fatalf("reflog of HEAD has messages %q, want %q", messages, expected)
+	}
+	for i := range expected {
+		if messages[i] != expected[i] {
+			t.Errorf("reflog of HEAD has messages %q, want %q", messages, expected)
+			break
+		}
+	}
+	if _, err := repo.Reflog("refs/tags/v1"); err != ErrReflogNotFound {
+		t.Errorf("Reflog() of a tag returned error %v, want %v", err, ErrReflogNotFound)
+	}
+
+	for _, test := range []struct {
+		expr     string
+		expected core.Sha1
+	}{
+		{"HEAD@{0}", c},
+		{"HEAD@{1}", b},
+		{"HEAD@{3}", a},
+		{"master@{1}", a},
+		{"@{1}", b},
+		{"@{-1}", b},
+		{"@{-1}~1", a},
+		{"master@{@1400000050}", a},
+		{"topic@{2014-05-13 16:58:00 +0000}", b},
+		{"topic@{1 year ago}", c},
+		{"topic@{now}", c},
+	} {
+		if actual, err := repo.RevParse(test.expr); err != nil || actual != test.expected {
+			t.Errorf("RevParse(%q) = %v, %v, want %v", test.expr, actual, err, test.expected)
+		}
+	}
+	if _, err := repo.RevParse("master@{5}"); err == nil {
+		t.Errorf("RevParse(%q) returned no error", "master@{5}")
+	}
+
+	if err := repo.ExpireReflog("HEAD", time.Unix(1400000150, 0)); err != nil {
+		t.Fatalf("ExpireReflog() returned error %v", err)
+	}
+	if head, _ = repo.Reflog("HEAD"); len(head.Entries) != 2 {
+		t.Errorf("reflog of HEAD has %d entries after expiry, want 2", len(head.Entries))
+	}
+
+	// The reflog of a ref that only exists in packed form can be expired too.
+	for _, update := range []RefUpdate{
+		{Name: "refs/heads/feat/one", NewSha1: a, Message: "branch: Created from HEAD", Committer: person(600)},
+		{Name: "refs/heads/feat/one", NewSha1: b, Message: "commit: b", Committer: person(700)},
+	} {
+		if err := repo.UpdateRef(update); err != nil {
+			t.Fatalf("UpdateRef(%+v) returned error %v", update, err)
+		}
+	}
+	if err := repo.PackRefs(PackRefsOptions{All: true}); err != nil {
+		t.Fatalf("PackRefs() returned error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(repo.Path(), "refs", "heads", "feat")); !os.IsNotExist(err) {
+		t.Fatalf("PackRefs() left the directory of a packed ref behind: %v", err)
+	}
+	if err := repo.ExpireReflog("refs/heads/feat/one", time.Unix(1400000650, 0)); err != nil {
+		t.Fatalf("ExpireReflog() of a packed ref returned error %v", err)
+	}
+	if reflog, err := repo.Reflog("refs/heads/feat/one"); err != nil || len(reflog.Entries) != 1 || reflog.Entries[0].New != b {
+		t.Errorf("reflog of a packed ref after expiry = %+v, %v", reflog, err)
+	}
+
+	if err := repo.UpdateRef(RefUpdate{Name: "refs/heads/master", Delete: true}); err != nil {
+		t.Fatalf("UpdateRef() returned error %v", err)
+	}
+	if _, err := repo.Reflog("refs/heads/master"); err != ErrReflogNotFound {
+		t.Errorf("reflog of a deleted ref still exists")
+	}
+}
+
+func TestParseReflogDate(t *testing.T) {
+	now := time.Date(2016, 3, 31, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"now", now},
+		{"yesterday", time.Date(2016, 3, 30, 12, 0, 0, 0, time.UTC)},
+		{"2.days.ago", time.Date(2016, 3, 29, 12, 0, 0, 0, time.UTC)},
+		{"1 hour 30 minutes ago", time.Date(2016, 3, 31, 10, 30, 0, 0, time.UTC)},
+		{"1 month ago", time.Date(2016, 3, 2, 12, 0, 0, 0, time.UTC)},
+		{"2016-01-02", time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"2016-01-02 03:04:05 +0100", time.Date(2016, 1, 2, 2, 4, 5, 0, time.UTC)},
+	} {
+		if actual, err := parseReflogDate(test.spec, now); err != nil || !actual.Equal(test.expected) {
+			t.Errorf("parseReflogDate(%q) = %v, %v, want %v", test.spec, actual, err, test.expected)
+		}
+	}
+
+	if _, err := parseReflogDate("sometime", now); err == nil {
+		t.Errorf("parseReflogDate(%q) returned no error", "sometime")
+	}
+}
@@ -3,23 +3,76 @@ package plumbing
 import (
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
 
 	"github.com/kourge/ggit/core"
 	"github.com/kourge/ggit/format"
 )
 
 // A Repository represents a potential Git repository.
+//
+// Refs are stored either as loose ref files and a packed-refs file or, if
+// extensions.refStorage is set to "reftable" in the config of the repository,
+// as a stack of reftables under "reftable/". Every method that reads or writes
+// refs and reflogs works with either backend.
+//
+// Unless a Repository is created with an ObjectStore of its own, it keeps the
+// packs of its "objects" directory open between object lookups, so it should
+// be closed with Close once it is no longer used.
+//
+// A Repository is safe for concurrent use, provided that its ObjectStore is,
+// as a FilesystemObjectStore is: many goroutines may read objects from the
+// same packs at once. Search and Close must not be called while the Repository
+// is in use by another goroutine.
 type Repository struct {
-	path string
+	path    string
+	objects ObjectStore
+
+	// store is the FilesystemObjectStore for the "objects" directory, which is
+	// created on first use and kept for as long as path stays the same.
+	store      *FilesystemObjectStore
+	storeMutex sync.Mutex
+
+	// reftable is the stack of tables that holds the refs of the repository if
+	// it uses the reftable backend. Which backend it uses is decided on first
+	// use, and both are kept for as long as path stays the same, which
+	// refsPath records.
+	reftable      *format.ReftableStack
+	refsPath      string
+	reftableMutex sync.Mutex
 }
 
 // NewRepository returns a Repository given a path. The path is first cleaned
-// on initialization.
+// on initialization. Objects are stored in the "objects" directory under the
+// path.
 func NewRepository(path string) *Repository {
 	return &Repository{path: filepath.Clean(path)}
 }
 
+// NewRepositoryWithObjectStore returns a Repository given a path, like
+// NewRepository, that reads and writes objects through the given ObjectStore
+// instead of the "objects" directory. Refs and the index are still stored
+// under the path.
+func NewRepositoryWithObjectStore(path string, objects ObjectStore) *Repository {
+	return &Repository{path: filepath.Clean(path), objects: objects}
+}
+
+// Close closes the packs that this repository keeps open. A Repository that
+// was created with NewRepositoryWithObjectStore does not close its ObjectStore,
+// which is left to the caller. The Repository may be used again afterwards, in
+// which case its packs are opened anew.
+func (repo *Repository) Close() error {
+	repo.storeMutex.Lock()
+	defer repo.storeMutex.Unlock()
+
+	if repo.store == nil {
+		return nil
+	}
+	err := repo.store.Close()
+	repo.store = nil
+	return err
+}
+
 // Path returns the path used to initialize the Repository.
 func (repo *Repository) Path() string {
 	return repo.path
@@ -91,25 +144,17 @@ func (repo *Repository) IsValid() bool {
 	return true
 }
 
-// Packs returns a slice of all the packs in this repository.
-func (repo *Repository) Packs() (packs []*format.Pack) {
-	packPath := filepath.Join(repo.path, "objects", "pack")
-	packDir, err := os.Open(packPath)
-	if err != nil {
-		core.Die(err)
-	} else {
-		defer packDir.Close()
+// Packs returns a slice of all the packs in this repository. A repository that
+// does not store its objects in the filesystem has no packs.
+func (repo *Repository) Packs() []*format.Pack {
+	store, ok := repo.ObjectStore().(*FilesystemObjectStore)
+	if !ok {
+		return nil
 	}
 
-	if filenames, err := packDir.Readdirnames(0); err != nil {
+	packs, err := store.Packs()
+	if err != nil {
 		core.Die(err)
-	} else {
-		for _, filename := range filenames {
-			if strings.HasSuffix(filename, ".pack") {
-				packs = append(packs, format.NewPack(filepath.Join(packPath, filename)))
-			}
-		}
 	}
-
 	return packs
 }
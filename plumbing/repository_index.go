@@ -0,0 +1,114 @@
+package plumbing
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/kourge/ggit/format"
+)
+
+const DefaultIndexVersion uint32 = 2
+
+// Index reads and decodes the index file of this repository, verifying its
+// checksum. If the repository has no index file yet, an empty index is
+// returned in the version configured by index.version or feature.manyFiles.
+// If the index file is split, the shared index it refers to is read and merged
+// in, so that the returned index holds all of the entries.
+func (repo *Repository) Index() (*format.Index, error) {
+	idx, err := repo.readIndexFile("index")
+	if os.IsNotExist(err) {
+		return format.NewIndex(repo.defaultIndexVersion())
+	} else if err != nil {
+		return nil, err
+	}
+
+	if sha1, split := idx.SharedIndex(); split {
+		shared, err := repo.readIndexFile("sharedindex." + sha1.String())
+		if err != nil {
+			return nil, err
+		} else if err := idx.MergeSharedIndex(shared); err != nil {
+			return nil, err
+		}
+	}
+	return idx, nil
+}
+
+// readIndexFile reads and decodes the index file with the given name in the
+// repository directory, verifying its checksum.
+func (repo *Repository) readIndexFile(name string) (*format.Index, error) {
+	file, err := os.Open(filepath.Join(repo.path, name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &format.Index{ReaderLen: info.Size()}
+	if err := idx.Decode(file); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// WriteIndex encodes the given index and writes it out as the index file of
+// this repository. The file is written through "index.lock", so that stock Git
+// never observes a partially written index and concurrent writers fail instead
+// of clobbering each other. A split index is written out as such, against the
+// shared index it was read with or that SplitIndex wrote out for it.
+func (repo *Repository) WriteIndex(idx *format.Index) error {
+	return writeFileWithLock(filepath.Join(repo.path, "index"), idx.Reader(), os.FileMode(0644))
+}
+
+// SplitIndex writes out all the entries of the given index, without any
+// extension, as a new shared index file named "sharedindex.<sha1>", and makes
+// the index be split against it from then on. Equivalent to the first half of
+// `git update-index --split-index`; the index itself still has to be written
+// out with WriteIndex.
+func (repo *Repository) SplitIndex(idx *format.Index) error {
+	shared, err := format.NewIndex(idx.Version())
+	if err != nil {
+		return err
+	}
+	for _, entry := range idx.Entries() {
+		entry.FSMonitorValid = false
+		if err := shared.Add(entry); err != nil {
+			return err
+		}
+	}
+
+	data := new(bytes.Buffer)
+	data.ReadFrom(shared.Reader())
+	path := filepath.Join(repo.path, "sharedindex."+shared.Sha1().String())
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := writeFileAtomically(path, data, os.FileMode(0644)); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	return idx.SetSharedIndex(shared)
+}
+
+// defaultIndexVersion returns the version in which a new index is written, as
+// configured by index.version. If that is unset, version 4 is used when
+// feature.manyFiles is enabled, and DefaultIndexVersion otherwise.
+func (repo *Repository) defaultIndexVersion() uint32 {
+	c, err := repo.Config()
+	if err != nil {
+		return DefaultIndexVersion
+	}
+
+	if version := configInt(c, "index", "version", 0); version >= format.IndexVersionMin &&
+		version <= format.IndexVersionMax {
+		return uint32(version)
+	} else if configBool(c, "feature", "manyFiles", false) {
+		return 4
+	}
+	return DefaultIndexVersion
+}
@@ -0,0 +1,105 @@
+package plumbing
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+)
+
+func TestRepository_Index(t *testing.T) {
+	for _, test := range []struct {
+		config  string
+		version uint32
+	}{
+		{"", DefaultIndexVersion},
+		{"[index]\n\tversion = 3\n", 3},
+		{"[feature]\n\tmanyFiles = true\n", 4},
+		{"[feature]\n\tmanyFiles = true\n[index]\n\tversion = 2\n", 2},
+	} {
+		repo, cleanup := _fixtureRepo(t)
+		defer cleanup()
+
+		path := filepath.Join(repo.Path(), "config")
+		if err := ioutil.WriteFile(path, []byte(test.config), os.FileMode(0644)); err != nil {
+			t.Fatal(err)
+		}
+
+		idx, err := repo.Index()
+		if err != nil {
+			t.Fatalf("Index() returned error %v", err)
+		} else if idx.Version() != test.version {
+			t.Errorf("Index().Version() with config %q = %d, want %d", test.config, idx.Version(), test.version)
+		}
+
+		if err := repo.WriteIndex(idx); err != nil {
+			t.Fatalf("WriteIndex() returned error %v", err)
+		}
+		if idx, err := repo.Index(); err != nil {
+			t.Errorf("Index() after WriteIndex() returned error %v", err)
+		} else if idx.Version() != test.version {
+			t.Errorf("Index().Version() after WriteIndex() = %d, want %d", idx.Version(), test.version)
+		}
+	}
+}
+
+func TestRepository_WriteIndex_Locked(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	lockPath := filepath.Join(repo.Path(), "index.lock")
+	if err := ioutil.WriteFile(lockPath, nil, os.FileMode(0644)); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := repo.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.WriteIndex(idx); err == nil {
+		t.Errorf("WriteIndex() should fail while index.lock exists")
+	}
+	if _, err := os.Stat(lockPath); err != nil {
+		t.Errorf("WriteIndex() should leave a foreign index.lock alone")
+	}
+}
+
+func TestRepository_SplitIndex(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	idx, err := repo.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"a", "b/c", "d"} {
+		if err := idx.Add(format.IndexEntry{Mode: core.GitModeRegular, Path: path}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.SplitIndex(idx); err != nil {
+		t.Fatalf("SplitIndex() returned error %v", err)
+	}
+	idx.Remove("b/c")
+	idx.Add(format.IndexEntry{Mode: core.GitModeRegular, Path: "e"})
+	if err := repo.WriteIndex(idx); err != nil {
+		t.Fatalf("WriteIndex() returned error %v", err)
+	}
+
+	sha1, _ := idx.SharedIndex()
+	if _, err := os.Stat(filepath.Join(repo.Path(), "sharedindex."+sha1.String())); err != nil {
+		t.Errorf("SplitIndex() did not write out the shared index: %v", err)
+	}
+
+	reread, err := repo.Index()
+	if err != nil {
+		t.Fatalf("Index() of a split index returned error %v", err)
+	}
+	if !reflect.DeepEqual(reread.Pathnames(), []string{"a", "d", "e"}) {
+		t.Errorf("Index().Pathnames() = %v, want [a d e]", reread.Pathnames())
+	}
+}
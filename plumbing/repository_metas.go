@@ -1,8 +1,11 @@
 package plumbing
 
 import (
+	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/kourge/ggit/config"
 	"github.com/kourge/ggit/format"
 )
 
@@ -15,3 +18,59 @@ func (repo *Repository) Excludes() (*format.GlobTable, error) {
 	path := filepath.Join(repo.path, "info", "exclude")
 	return format.GlobTableAtPath(path)
 }
+
+// Config reads and decodes the config file of this repository.
+func (repo *Repository) Config() (config.Config, error) {
+	file, err := os.Open(filepath.Join(repo.path, "config"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	c := config.Config{}
+	if err := c.Decode(file); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// configValue returns the value of the given key in the given section of c, or
+// nil if it is not set. Keys are matched case-insensitively.
+func configValue(c config.Config, section, key string) interface{} {
+	s, ok := c[section]
+	if !ok {
+		return nil
+	}
+	for k, v := range s.Dict {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return nil
+}
+
+// configString returns the string value of the given key in the given section
+// of c, or an empty string if it is not set or not a string.
+func configString(c config.Config, section, key string) string {
+	v, _ := configValue(c, section, key).(string)
+	return v
+}
+
+// configInt returns the integer value of the given key in the given section of
+// c, or def if it is not set or not an integer.
+func configInt(c config.Config, section, key string, def int64) int64 {
+	if v, ok := configValue(c, section, key).(int64); ok {
+		return v
+	}
+	return def
+}
+
+// configBool returns the boolean value of the given key in the given section of
+// c, or def if it is not set or not a boolean.
+func configBool(c config.Config, section, key string, def bool) bool {
+	if v, ok := configValue(c, section, key).(bool); ok {
+		return v
+	}
+	return def
+}
@@ -1,80 +1,149 @@
 package plumbing
 
 import (
-	"compress/zlib"
 	"errors"
-	"os"
+	"io"
 	"path/filepath"
+	"strings"
 
 	"github.com/kourge/ggit/core"
-	"github.com/kourge/ggit/format"
 )
 
 var (
 	ErrObjectNotFoundInRepo = errors.New("object not found in repository")
 )
 
-// ObjectBySha1 returns an Object with the given Sha1. First, the object is
-// searched amongst loose objects. If it is not found there, then all pack files
-// are searched in order. By now if it is stil not found, the error
-// ErrObjectNotFoundInRepo is returned.
-func (repo *Repository) ObjectBySha1(hash core.Sha1) (core.Object, error) {
-	object, err := repo.LooseObjectBySha1(hash)
-	if err == nil {
-		return object, nil
-	} else if err != ErrObjectNotFoundInRepo {
-		return nil, err
+// ObjectStore returns the ObjectStore that this repository reads and writes
+// objects through. Unless the repository was created with
+// NewRepositoryWithObjectStore, it is a FilesystemObjectStore for the "objects"
+// directory of the repository, which also searches the directories listed in
+// the GIT_ALTERNATE_OBJECT_DIRECTORIES environment variable, as it is when the
+// store is created, ahead of its own alternates. The same FilesystemObjectStore
+// is returned every time, so that the packs that it keeps open and its
+// ObjectCache are shared by every lookup, until the repository is closed. The
+// limit of the ObjectCache is taken from core.deltaBaseCacheLimit when the
+// store is created.
+func (repo *Repository) ObjectStore() ObjectStore {
+	if repo.objects != nil {
+		return repo.objects
 	}
 
-	return repo.PackedObjectBySha1(hash)
+	repo.storeMutex.Lock()
+	defer repo.storeMutex.Unlock()
+
+	dir := filepath.Join(repo.path, "objects")
+	if repo.store != nil && repo.store.dir != dir {
+		repo.store.Close()
+		repo.store = nil
+	}
+	if repo.store == nil {
+		repo.store = NewFilesystemObjectStore(dir)
+		repo.store.alternateDirs = alternateObjectDirectoriesFromEnv()
+		repo.store.objects.SetLimit(repo.deltaBaseCacheLimit())
+	}
+	return repo.store
 }
 
-// LooseObjectBySha1 returns an Object with the given Sha1. If the object in
-// question is packed or does not exist, the error ErrObjectNotFoundInRepo is
-// returned.
-func (repo *Repository) LooseObjectBySha1(hash core.Sha1) (core.Object, error) {
-	prefix, rest := hash.Split(2)
-	path := filepath.Join(repo.path, "objects", prefix, rest)
+// ObjectCache returns the cache of the objects that this repository has read
+// from its packs, through which its hit and miss statistics can be inspected
+// and its limit changed. A repository that does not store its objects in the
+// filesystem has no ObjectCache, in which case nil is returned.
+func (repo *Repository) ObjectCache() *ObjectCache {
+	if store, ok := repo.ObjectStore().(*FilesystemObjectStore); ok {
+		return store.ObjectCache()
+	}
+	return nil
+}
 
-	file, err := os.Open(path)
-	if os.IsNotExist(err) {
-		return nil, ErrObjectNotFoundInRepo
-	} else if err != nil {
-		return nil, err
+// deltaBaseCacheLimit returns the number of bytes of packed objects to cache,
+// as configured by core.deltaBaseCacheLimit.
+func (repo *Repository) deltaBaseCacheLimit() int64 {
+	c, err := repo.Config()
+	if err != nil {
+		return DefaultDeltaBaseCacheLimit
 	}
-	defer file.Close()
+	return configInt(c, "core", "deltaBaseCacheLimit", DefaultDeltaBaseCacheLimit)
+}
+
+// ObjectBySha1 returns an Object with the given Sha1. With the default object
+// store, the object is first searched amongst loose objects. If it is not found
+// there, then all pack files are searched in order. By now if it is stil not
+// found, the error ErrObjectNotFoundInRepo is returned.
+func (repo *Repository) ObjectBySha1(hash core.Sha1) (core.Object, error) {
+	return repo.ObjectStore().Get(hash)
+}
+
+// OpenObject returns the type and size of the object with the given SHA-1,
+// along with a reader of its content, so that objects that are too large to be
+// held in memory, such as big blobs, can be read piece by piece. With the
+// default object store, the content is inflated lazily from loose or packed
+// storage and verified against the SHA-1 as it is read: the error
+// ErrObjectHashMismatch is returned at the end of the content if the two do
+// not match. Objects stored as deltas are resolved in memory first. The reader
+// must be closed once done. If the object does not exist, the error
+// ErrObjectNotFoundInRepo is returned.
+func (repo *Repository) OpenObject(hash core.Sha1) (string, int64, io.ReadCloser, error) {
+	return openObject(repo.ObjectStore(), hash)
+}
 
-	r, err := zlib.NewReader(file)
+// ObjectsBySha1 looks up the objects with the given SHA-1s, as ObjectBySha1
+// does, with at most the given number of lookups running at once, and returns
+// them in the same order as the SHA-1s. If workers is not positive, it defaults
+// to runtime.GOMAXPROCS(0). Once a lookup fails, no more lookups are started,
+// and the error of the first SHA-1 whose lookup failed is returned, such as
+// ErrObjectNotFoundInRepo for an object that does not exist.
+func (repo *Repository) ObjectsBySha1(hashes []core.Sha1, workers int) ([]core.Object, error) {
+	store := repo.ObjectStore()
+	objects := make([]core.Object, len(hashes))
+	err := runBatch(len(hashes), workers, func(i int) error {
+		object, err := store.Get(hashes[i])
+		objects[i] = object
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
+	return objects, nil
+}
 
-	stream := &core.Stream{}
-	if err := stream.Decode(r); err != nil {
-		return nil, err
+// LooseObjectBySha1 returns an Object with the given Sha1. If the object in
+// question is packed or does not exist, or if this repository does not store
+// its objects in the filesystem, the error ErrObjectNotFoundInRepo is returned.
+func (repo *Repository) LooseObjectBySha1(hash core.Sha1) (core.Object, error) {
+	if store, ok := repo.ObjectStore().(*FilesystemObjectStore); ok {
+		return store.LooseObject(hash)
 	}
+	return nil, ErrObjectNotFoundInRepo
+}
 
-	return stream.Object(), nil
+// WriteObject writes the given object into the object store of this repository
+// and returns its SHA-1. With the default object store, the object is written
+// as a loose object, unless an object with the same SHA-1 already exists in
+// loose form.
+func (repo *Repository) WriteObject(object core.Object) (core.Sha1, error) {
+	return repo.ObjectStore().Put(object)
 }
 
 // PackedObjectBySha1 returns an Object with the given Sha1. If the object in
-// question is loose or does not exist, the error ErrObjectNotFoundInRepo is
-// returned.
+// question is loose or does not exist, or if this repository does not store
+// its objects in the filesystem, the error ErrObjectNotFoundInRepo is returned.
+// Objects stored as deltas are resolved, and bases of REF_DELTA entries that
+// live outside of their pack are looked up with ObjectBySha1.
 func (repo *Repository) PackedObjectBySha1(hash core.Sha1) (core.Object, error) {
-	for _, pack := range repo.Packs() {
-		if err := pack.Open(); err != nil {
-			return nil, err
-		}
-		defer pack.Close()
-
-		if object, err := pack.ObjectBySha1(hash); err == format.ErrObjectNotFoundInPack {
-			continue
-		} else if err != nil {
-			return nil, err
-		} else {
-			return object, nil
-		}
+	if store, ok := repo.ObjectStore().(*FilesystemObjectStore); ok {
+		return store.PackedObject(hash)
 	}
-
 	return nil, ErrObjectNotFoundInRepo
 }
+
+// Sha1sWithPrefix returns the SHA-1 checksums of all the objects in this
+// repository, loose or packed, whose hexadecimal representation starts with
+// the given prefix. The prefix must be at least two characters long.
+func (repo *Repository) Sha1sWithPrefix(prefix string) ([]core.Sha1, error) {
+	prefix = strings.ToLower(prefix)
+	if len(prefix) < 2 {
+		return nil, Errorf("SHA-1 prefix %q is too short", prefix)
+	}
+
+	return sha1sWithPrefix(repo.ObjectStore(), prefix)
+}
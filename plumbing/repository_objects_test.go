@@ -0,0 +1,62 @@
+package plumbing
+
+import (
+	"testing"
+
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+)
+
+func TestRepository_ObjectsBySha1(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	var commits []core.Sha1
+	for i, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		commit := _writeFixtureCommit(t, repo, commits, name, name+"\n", int64(i))
+		commits = append(commits, commit)
+		if i%2 == 0 {
+			if _, err := repo.PackObjects([]core.Sha1{commit}, format.PackOptions{}); err != nil {
+				t.Fatalf("PackObjects() returned error %v", err)
+			}
+		}
+	}
+
+	var hashes []core.Sha1
+	for i := 0; i < 50; i++ {
+		hashes = append(hashes, commits...)
+	}
+
+	// Many batches run at once against the same repository, so that packs
+	// are read from by many goroutines at a time.
+	errs := make(chan error, 4)
+	for g := 0; g < cap(errs); g++ {
+		go func() {
+			objects, err := repo.ObjectsBySha1(hashes, 8)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for i, object := range objects {
+				if actual := core.NewStream(object).Hash(); actual != hashes[i] {
+					errs <- Errorf("ObjectsBySha1() returned %s at %d, want %s", actual, i, hashes[i])
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for g := 0; g < cap(errs); g++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	missing := append(append([]core.Sha1(nil), hashes...), core.Sha1{1})
+	if objects, err := repo.ObjectsBySha1(missing, 0); err != ErrObjectNotFoundInRepo || objects != nil {
+		t.Errorf("ObjectsBySha1() with a missing object = %v, %v", objects, err)
+	}
+	if objects, err := repo.ObjectsBySha1(nil, 4); err != nil || len(objects) != 0 {
+		t.Errorf("ObjectsBySha1(nil) = %v, %v", objects, err)
+	}
+}
@@ -1,9 +1,13 @@
 package plumbing
 
 import (
+	"bytes"
 	"errors"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/kourge/ggit/core"
 	"github.com/kourge/ggit/format"
@@ -21,6 +25,16 @@ var (
 // error that is not ErrRefNotFound, then the search is aborted and that error
 // is returned. Otherwise, it falls back to calling Sha1FromPackedRefs.
 func (repo *Repository) Sha1ByRef(ref string) (core.Sha1, error) {
+	if stack, err := repo.reftableStack(); err != nil {
+		return core.Sha1{}, err
+	} else if stack != nil {
+		record, err := reftableRef(stack, ref)
+		if err == nil && record.Target != "" {
+			return core.Sha1{}, ErrInvalidRef
+		}
+		return record.Sha1, err
+	}
+
 	if sha1, err := repo.Sha1FromLooseRef(ref); err == nil {
 		return sha1, err
 	} else if err != ErrRefNotFound {
@@ -61,25 +75,15 @@ func (repo *Repository) Sha1FromLooseRef(ref string) (core.Sha1, error) {
 // failed to be opened, an appropriate error is returned. If the file exists but
 // contains invalid data, an appropriate error is returned.
 func (repo *Repository) Sha1FromPackedRefs(ref string) (core.Sha1, error) {
-	path := filepath.Join(repo.Path(), "packed-refs")
-
-	file, err := os.Open(path)
-	if os.IsNotExist(err) {
-		return core.Sha1{}, ErrRefNotFound
-	} else if err != nil {
-		return core.Sha1{}, err
-	}
-	defer file.Close()
-
-	packedRefs := &format.PackedRefs{}
-	if err := packedRefs.Decode(file); err != nil {
+	packedRefs, err := repo.readPackedRefs()
+	if err != nil {
 		return core.Sha1{}, err
 	}
 
-	if sha1 := packedRefs.Sha1ForName(ref); sha1.IsEmpty() {
-		return sha1, ErrRefNotFound
+	if packedRef, ok := packedRefs.Lookup(ref); !ok {
+		return core.Sha1{}, ErrRefNotFound
 	} else {
-		return sha1, nil
+		return packedRef.Sha1, nil
 	}
 }
 
@@ -89,8 +93,25 @@ func (repo *Repository) Sha1FromPackedRefs(ref string) (core.Sha1, error) {
 // invalid data, then an empty string and the error ErrInvalidSymref are
 // returned. If the symbolic ref points to something that does not look like
 // a ref (i.e. does not start with "refs/"), then an empty string and the error
-// ErrInvalidSymrefTarget are returned.
+// ErrInvalidSymrefTarget are returned. A name that is not well-formed results
+// in the error ErrInvalidRef.
 func (repo *Repository) RefBySymref(symrefName string) (string, error) {
+	if err := format.ValidateRefName(symrefName); err != nil {
+		return "", err
+	}
+
+	if stack, err := repo.reftableStack(); err != nil {
+		return "", err
+	} else if stack != nil {
+		record, err := reftableRef(stack, symrefName)
+		if err != nil {
+			return "", err
+		} else if record.Target == "" {
+			return "", ErrInvalidSymref
+		}
+		return record.Target, nil
+	}
+
 	path := filepath.Join(repo.Path(), symrefName)
 
 	file, err := os.Open(path)
@@ -108,3 +129,171 @@ func (repo *Repository) RefBySymref(symrefName string) (string, error) {
 
 	return symref.Target, nil
 }
+
+// maxSymrefDepth is the maximum number of symbolic refs that ResolveRef
+// follows before giving up.
+const maxSymrefDepth = 5
+
+// ResolveRef looks up the ref with the given name, following symbolic refs
+// such as HEAD until a ref that points to an object is found. Only the first
+// 40 hexadecimal digits of a loose ref file are considered, so special refs
+// such as FETCH_HEAD that carry extra data can be resolved as well. If the ref
+// or any ref it points to does not exist, the error ErrRefNotFound is
+// returned. If the name of any of them is not well-formed, as determined by
+// format.ValidateRefName, the error ErrInvalidRef is returned without touching
+// the filesystem.
+func (repo *Repository) ResolveRef(ref string) (core.Sha1, error) {
+	if err := format.ValidateRefName(ref); err != nil {
+		return core.Sha1{}, err
+	}
+
+	if stack, err := repo.reftableStack(); err != nil {
+		return core.Sha1{}, err
+	} else if stack != nil {
+		record, err := resolveReftableRef(stack, ref)
+		return record.Sha1, err
+	}
+
+	for depth := 0; depth <= maxSymrefDepth; depth++ {
+		path := filepath.Join(repo.Path(), ref)
+		if info, err := os.Stat(path); os.IsNotExist(err) || (err == nil && info.IsDir()) {
+			return repo.Sha1FromPackedRefs(ref)
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return core.Sha1{}, err
+		}
+
+		if bytes.HasPrefix(content, []byte("ref: ")) {
+			symref := &format.Symref{}
+			if err := symref.Decode(bytes.NewReader(content)); err != nil {
+				return core.Sha1{}, err
+			}
+			ref = symref.Target
+			if err := format.ValidateRefName(ref); err != nil {
+				return core.Sha1{}, err
+			}
+			continue
+		}
+
+		if len(content) < 40 {
+			return core.Sha1{}, ErrInvalidRef
+		} else if sha1, err := core.Sha1FromString(string(content[:40])); err != nil {
+			return core.Sha1{}, ErrInvalidRef
+		} else {
+			return sha1, nil
+		}
+	}
+
+	return core.Sha1{}, Errorf("too many levels of symbolic refs: %s", ref)
+}
+
+// Refs returns every ref whose name starts with the given prefix, sorted by
+// name. Equivalent to `git for-each-ref <prefix>`, except that the prefix need
+// not end at a slash. An empty prefix is treated as "refs/".
+//
+// Loose and packed refs are merged into one list, and when a ref exists in
+// both forms, the loose ref takes precedence. Symbolic refs such as
+// "refs/remotes/origin/HEAD" are listed with the value of the ref they point
+// to, and those that point to a ref that does not exist are left out, as are
+// loose refs that are not well-formed. No object is read to list refs, so the
+// Peeled field of a ref is only filled in when the packed-refs file or the
+// reftable records it; use PeelRef to peel any other ref.
+func (repo *Repository) Refs(prefix string) ([]format.Ref, error) {
+	if prefix == "" {
+		prefix = "refs/"
+	}
+	if stack, err := repo.reftableStack(); err != nil {
+		return nil, err
+	} else if stack != nil {
+		return reftableRefs(stack, prefix)
+	}
+
+	packed, err := repo.readPackedRefs()
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]format.Ref)
+	for _, ref := range packed.Refs {
+		if strings.HasPrefix(ref.Name, prefix) {
+			refs[ref.Name] = ref
+		}
+	}
+
+	root := filepath.Join(repo.path, filepath.FromSlash(prefix[:strings.LastIndex(prefix, "/")+1]))
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasSuffix(path, ".lock") {
+			return err
+		}
+
+		rel, err := filepath.Rel(repo.path, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+
+		hash, err := repo.ResolveRef(name)
+		if err == ErrRefNotFound || err == ErrInvalidRef {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if ref, ok := refs[name]; !ok || ref.Sha1 != hash {
+			refs[name] = format.Ref{Name: name, Sha1: hash}
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	sorted := make(format.RefSlice, 0, len(refs))
+	for _, ref := range refs {
+		sorted = append(sorted, ref)
+	}
+	sort.Sort(sorted)
+	return sorted, nil
+}
+
+// PeelRef returns the object that the given ref ultimately points to if it
+// points to an annotated tag, or a zero SHA-1 otherwise. The Peeled field of
+// the ref is returned as is when it is set, and the tag is read and followed
+// when it is not.
+func (repo *Repository) PeelRef(ref format.Ref) core.Sha1 {
+	if !ref.Peeled.IsEmpty() {
+		return ref.Peeled
+	}
+	return repo.peeledSha1(ref.Sha1)
+}
+
+// peeledSha1 returns the object that the given object ultimately points to if
+// it is an annotated tag, or a zero SHA-1 if it is not a tag or cannot be read.
+func (repo *Repository) peeledSha1(hash core.Sha1) core.Sha1 {
+	peeled, err := repo.peelToType(hash, "")
+	if err != nil || peeled == hash {
+		return core.Sha1{}
+	}
+	return peeled
+}
+
+// readPackedRefs reads and decodes the packed-refs file of this repository. If
+// the file does not exist, an empty PackedRefs is returned.
+func (repo *Repository) readPackedRefs() (*format.PackedRefs, error) {
+	packed := &format.PackedRefs{}
+	file, err := os.Open(filepath.Join(repo.path, "packed-refs"))
+	if os.IsNotExist(err) {
+		return packed, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := packed.Decode(file); err != nil {
+		return nil, err
+	}
+	return packed, nil
+}
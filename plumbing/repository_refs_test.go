@@ -0,0 +1,86 @@
+package plumbing
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+)
+
+func TestRepository_Refs(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	a := _writeFixtureCommit(t, repo, nil, "a", "a\n", 0)
+	b := _writeFixtureCommit(t, repo, []core.Sha1{a}, "b", "b\n", 1)
+	tagger := core.NewPerson("Jane Doe", "jane@example.com", 1400000000, 0)
+	v1 := _writeFixtureObject(t, repo, core.NewTag(a, "commit", "v1", tagger, "v1\n"))
+	v2 := _writeFixtureObject(t, repo, core.NewTag(b, "commit", "v2", tagger, "v2\n"))
+
+	_writeFixtureRef(t, repo, "HEAD", "ref: refs/heads/master")
+	_writeFixtureRef(t, repo, "refs/heads/master", b.String())
+	_writeFixtureRef(t, repo, "refs/heads/topic", a.String())
+	_writeFixtureRef(t, repo, "refs/heads/dangling", "ref: refs/heads/nowhere")
+	_writeFixtureRef(t, repo, "refs/heads/broken", "garbage")
+	_writeFixtureRef(t, repo, "refs/heads/x.lock", a.String())
+	_writeFixtureRef(t, repo, "refs/remotes/origin/HEAD", "ref: refs/remotes/origin/master")
+	_writeFixtureRef(t, repo, "refs/tags/v2", v2.String())
+	_writeFixtureRef(t, repo, "packed-refs", "# pack-refs with: peeled fully-peeled sorted \n"+
+		a.String()+" refs/heads/topic\n"+
+		a.String()+" refs/remotes/origin/master\n"+
+		v1.String()+" refs/tags/v1\n^"+a.String()+"\n"+
+		v1.String()+" refs/tags/v2\n^"+a.String())
+
+	refs, err := repo.Refs("")
+	if err != nil {
+		t.Fatalf("Refs() returned error %v", err)
+	}
+	expected := []format.Ref{
+		{Name: "refs/heads/master", Sha1: b},
+		{Name: "refs/heads/topic", Sha1: a},
+		{Name: "refs/remotes/origin/HEAD", Sha1: a},
+		{Name: "refs/remotes/origin/master", Sha1: a},
+		{Name: "refs/tags/v1", Sha1: v1, Peeled: a},
+		{Name: "refs/tags/v2", Sha1: v2},
+	}
+	if !reflect.DeepEqual(refs, expected) {
+		t.Errorf("Refs() = %v, want %v", refs, expected)
+	}
+	for i, peeled := range []core.Sha1{{}, {}, {}, {}, a, b} {
+		if actual := repo.PeelRef(refs[i]); actual != peeled {
+			t.Errorf("PeelRef(%s) = %s, want %s", refs[i].Name, actual, peeled)
+		}
+	}
+
+	if refs, err := repo.Refs("refs/tags/v"); err != nil || len(refs) != 2 {
+		t.Errorf("Refs(%q) = %v, %v, want 2 refs", "refs/tags/v", refs, err)
+	}
+	if refs, err := repo.Refs("refs/heads/t"); err != nil || len(refs) != 1 || refs[0].Name != "refs/heads/topic" {
+		t.Errorf("Refs(%q) = %v, %v, want refs/heads/topic", "refs/heads/t", refs, err)
+	}
+}
+
+func TestRepository_ResolveRef_InvalidName(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	a := _writeFixtureCommit(t, repo, nil, "a", "a\n", 0)
+	_writeFixtureRef(t, repo, "refs/heads/master", a.String())
+	_writeFixtureRef(t, repo, "refs/heads/escape", "ref: refs/../../outside")
+	if err := ioutil.WriteFile(filepath.Join(repo.Path(), "..", "outside"), []byte(a.String()+"\n"), os.FileMode(0644)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"refs/../../outside", "refs/heads/escape", "../outside", "refs/heads/a b"} {
+		if hash, err := repo.ResolveRef(name); err != ErrInvalidRef {
+			t.Errorf("ResolveRef(%q) = %s, %v, want ErrInvalidRef", name, hash, err)
+		}
+	}
+	if target, err := repo.RefBySymref("refs/../../outside"); err != ErrInvalidRef {
+		t.Errorf("RefBySymref() of an invalid name = %q, %v, want ErrInvalidRef", target, err)
+	}
+}
@@ -0,0 +1,298 @@
+package plumbing
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kourge/ggit/config"
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+)
+
+// reftableStack returns the stack of tables that holds the refs of this
+// repository if it uses the reftable backend, which is the case when
+// extensions.refStorage is set to "reftable". If the repository stores its refs
+// as files, nil is returned. New tables are written with the block size given
+// by reftable.blockSize.
+//
+// The config is only read the first time, and the stack is kept open and only
+// reloaded when its list of tables changes. Each caller is given a clone of it,
+// so that it can be used and added to without holding up other goroutines.
+func (repo *Repository) reftableStack() (*format.ReftableStack, error) {
+	repo.reftableMutex.Lock()
+	defer repo.reftableMutex.Unlock()
+
+	if repo.refsPath != repo.path {
+		c, err := repo.Config()
+		if os.IsNotExist(err) {
+			c = nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		repo.reftable = nil
+		if strings.EqualFold(configString(c, "extensions", "refstorage"), "reftable") {
+			stack, err := format.OpenReftableStack(filepath.Join(repo.path, "reftable"))
+			if err != nil {
+				return nil, err
+			}
+			stack.BlockSize = uint32(configInt(c, "reftable", "blocksize", 0))
+			repo.reftable = stack
+		}
+		repo.refsPath = repo.path
+	} else if repo.reftable != nil {
+		if err := repo.reftable.Refresh(); err != nil {
+			return nil, err
+		}
+	}
+
+	if repo.reftable == nil {
+		return nil, nil
+	}
+	return repo.reftable.Clone(), nil
+}
+
+// reftableRef returns the record of the ref with the given name in the given
+// stack, or ErrRefNotFound if there is none.
+func reftableRef(stack *format.ReftableStack, name string) (format.ReftableRef, error) {
+	ref, ok, err := stack.Ref(name)
+	if err != nil {
+		return format.ReftableRef{}, err
+	} else if !ok {
+		return format.ReftableRef{}, ErrRefNotFound
+	}
+	return ref, nil
+}
+
+// resolveReftableRef is the counterpart of ResolveRef for the given stack. It
+// returns the record of the ref at the end of the chain of symbolic refs that
+// starts at the ref with the given name.
+func resolveReftableRef(stack *format.ReftableStack, name string) (format.ReftableRef, error) {
+	for depth := 0; depth <= maxSymrefDepth; depth++ {
+		ref, err := reftableRef(stack, name)
+		if err != nil || ref.Target == "" {
+			return ref, err
+		}
+		name = ref.Target
+	}
+	return format.ReftableRef{}, Errorf("too many levels of symbolic refs: %s", name)
+}
+
+// dereferenceReftable is the counterpart of dereference for the given stack.
+func dereferenceReftable(stack *format.ReftableStack, name string) (string, error) {
+	for depth := 0; depth <= maxSymrefDepth; depth++ {
+		ref, err := reftableRef(stack, name)
+		if err == ErrRefNotFound || (err == nil && ref.Target == "") {
+			return name, nil
+		} else if err != nil {
+			return "", err
+		}
+		name = ref.Target
+	}
+	return "", Errorf("too many levels of symbolic refs: %s", name)
+}
+
+// reftableRefs is the counterpart of Refs for the given stack. Peeled values
+// are taken from the tables, which record them for every ref that points to an
+// annotated tag.
+func reftableRefs(stack *format.ReftableStack, prefix string) ([]format.Ref, error) {
+	records, err := stack.Refs(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]format.Ref, 0, len(records))
+	for _, record := range records {
+		name := record.Name
+		if record.Target != "" {
+			if record, err = resolveReftableRef(stack, record.Target); err == ErrRefNotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		refs = append(refs, format.Ref{Name: name, Sha1: record.Sha1, Peeled: record.Peeled})
+	}
+	return refs, nil
+}
+
+// reftableRefConflicts is the counterpart of checkRefConflicts for the given
+// stack.
+func reftableRefConflicts(stack *format.ReftableStack, name string) error {
+	components := strings.Split(name, "/")
+	for i := 1; i < len(components); i++ {
+		prefix := strings.Join(components[:i], "/")
+		if _, ok, err := stack.Ref(prefix); err != nil {
+			return err
+		} else if ok {
+			return Errorf("cannot lock ref '%s': '%s' exists", name, prefix)
+		}
+	}
+
+	if refs, err := stack.Refs(name + "/"); err != nil {
+		return err
+	} else if len(refs) > 0 {
+		return Errorf("cannot lock ref '%s': '%s' exists", name, refs[0].Name)
+	}
+	return nil
+}
+
+// updateReftableRefs is the counterpart of UpdateRefs for the given stack. The
+// whole transaction becomes a single table, which is added to the stack while
+// its lock is held, and old values are checked against the stack as it is at
+// that point. Deleting a ref writes tombstones for the ref and for every entry
+// of its reflog.
+func (repo *Repository) updateReftableRefs(stack *format.ReftableStack, updates []RefUpdate) error {
+	c, _ := repo.Config()
+	err := stack.Add(func(s *format.ReftableStack, updateIndex uint64) ([]format.ReftableRef, []format.ReftableLog, error) {
+		var refs []format.ReftableRef
+		var logs []format.ReftableLog
+		names := make([]string, len(updates))
+		olds := make([]core.Sha1, len(updates))
+		updated := make(map[string]bool)
+
+		for i, update := range updates {
+			if err := format.ValidateRefName(update.Name); err != nil {
+				return nil, nil, Errorf("%s: %v", update.Name, err)
+			} else if update.Symref != "" {
+				if err := format.ValidateRefName(update.Symref); err != nil {
+					return nil, nil, Errorf("%s: %v", update.Symref, err)
+				}
+			}
+
+			name := update.Name
+			if !update.NoDeref && update.Symref == "" {
+				var err error
+				if name, err = dereferenceReftable(s, name); err != nil {
+					return nil, nil, err
+				}
+			}
+			if updated[name] {
+				return nil, nil, Errorf("multiple updates for ref '%s' not allowed", name)
+			}
+			updated[name] = true
+			if !update.Delete {
+				if err := reftableRefConflicts(s, name); err != nil {
+					return nil, nil, err
+				}
+			}
+
+			current, err := resolveReftableRef(s, name)
+			if err != nil && err != ErrRefNotFound {
+				return nil, nil, err
+			}
+			if update.CheckOld && current.Sha1 != update.OldSha1 {
+				return nil, nil, ErrRefMismatch
+			}
+			names[i], olds[i] = name, current.Sha1
+
+			ref := format.ReftableRef{Name: name, UpdateIndex: updateIndex}
+			switch {
+			case update.Delete:
+				ref.Deleted = true
+				existing, err := s.Logs(name)
+				if err != nil {
+					return nil, nil, err
+				}
+				for _, log := range existing {
+					logs = append(logs, format.ReftableLog{Name: name, UpdateIndex: log.UpdateIndex, Deleted: true})
+				}
+			case update.Symref != "":
+				ref.Target = update.Symref
+			default:
+				ref.Sha1 = update.NewSha1
+				ref.Peeled = repo.peeledSha1(update.NewSha1)
+			}
+			refs = append(refs, ref)
+		}
+
+		head := ""
+		if ref, err := reftableRef(s, "HEAD"); err == nil {
+			head = ref.Target
+		}
+		logged := make(map[string]bool)
+		for i, update := range updates {
+			entry, ok := repo.reflogEntry(c, update, olds[i])
+			if !ok {
+				continue
+			}
+			entry.Message = normalizeReflogMessage(entry.Message)
+			for _, name := range reflogNames(update, names[i], head, updated) {
+				if logged[name] || !shouldLogReftableRef(s, c, name) {
+					continue
+				}
+				logged[name] = true
+				logs = append(logs, format.ReftableLog{Name: name, UpdateIndex: updateIndex, ReflogEntry: entry})
+			}
+		}
+		return refs, logs, nil
+	})
+	if err == format.ErrReftableLocked {
+		return ErrRefLocked
+	}
+	return err
+}
+
+// shouldLogReftableRef is the counterpart of shouldLogRef for the given stack.
+func shouldLogReftableRef(stack *format.ReftableStack, c config.Config, ref string) bool {
+	if logs, err := stack.Logs(ref); err == nil && len(logs) > 0 {
+		return true
+	}
+	return logAllRefUpdates(c, ref)
+}
+
+// reftableReflog is the counterpart of Reflog for the given stack.
+func reftableReflog(stack *format.ReftableStack, ref string) (*format.Reflog, error) {
+	logs, err := stack.Logs(ref)
+	if err != nil {
+		return nil, err
+	} else if len(logs) == 0 {
+		return nil, ErrReflogNotFound
+	}
+
+	reflog := &format.Reflog{Entries: make([]format.ReflogEntry, len(logs))}
+	for i, log := range logs {
+		reflog.Entries[len(logs)-1-i] = log.ReflogEntry
+	}
+	return reflog, nil
+}
+
+// appendReftableLog is the counterpart of AppendReflog for the given stack. The
+// entry is added to the stack as a table of its own.
+func appendReftableLog(stack *format.ReftableStack, ref string, entry format.ReflogEntry) error {
+	entry.Message = normalizeReflogMessage(entry.Message)
+	err := stack.Add(func(s *format.ReftableStack, updateIndex uint64) ([]format.ReftableRef, []format.ReftableLog, error) {
+		return nil, []format.ReftableLog{{Name: ref, UpdateIndex: updateIndex, ReflogEntry: entry}}, nil
+	})
+	if err == format.ErrReftableLocked {
+		return ErrRefLocked
+	}
+	return err
+}
+
+// expireReftableLog is the counterpart of ExpireReflog for the given stack.
+// Expired entries are hidden by tombstones, which compaction then drops.
+func expireReftableLog(stack *format.ReftableStack, ref string, before time.Time) error {
+	err := stack.Add(func(s *format.ReftableStack, updateIndex uint64) ([]format.ReftableRef, []format.ReftableLog, error) {
+		logs, err := s.Logs(ref)
+		if err != nil {
+			return nil, nil, err
+		} else if len(logs) == 0 {
+			return nil, nil, ErrReflogNotFound
+		}
+
+		var tombstones []format.ReftableLog
+		for _, log := range logs {
+			if log.Committer.Time.Before(before) {
+				tombstones = append(tombstones, format.ReftableLog{Name: ref, UpdateIndex: log.UpdateIndex, Deleted: true})
+			}
+		}
+		return nil, tombstones, nil
+	})
+	if err == format.ErrReftableLocked {
+		return ErrRefLocked
+	}
+	return err
+}
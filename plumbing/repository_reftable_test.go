@@ -0,0 +1,121 @@
+package plumbing
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+)
+
+func TestRepository_Reftable(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	config := "[core]\n\trepositoryformatversion = 1\n\tlogallrefupdates = true\n[extensions]\n\trefStorage = reftable\n"
+	if err := ioutil.WriteFile(filepath.Join(repo.Path(), "config"), []byte(config), os.FileMode(0644)); err != nil {
+		t.Fatal(err)
+	}
+
+	a := _writeFixtureCommit(t, repo, nil, "a", "a\n", 0)
+	b := _writeFixtureCommit(t, repo, []core.Sha1{a}, "b", "b\n", 1)
+	person := func(sec int64) core.Person { return core.NewPerson("Jane Doe", "jane@example.com", 1400000000+sec, 0) }
+
+	for _, update := range []RefUpdate{
+		{Name: "HEAD", Symref: "refs/heads/master"},
+		{Name: "HEAD", NewSha1: a, Message: "commit (initial): a", Committer: person(0)},
+		{Name: "refs/heads/topic", NewSha1: a, Committer: person(100)},
+		{Name: "HEAD", NewSha1: b, OldSha1: a, CheckOld: true, Message: "commit: b", Committer: person(200)},
+		{Name: "refs/tags/v1", NewSha1: a},
+	} {
+		if err := repo.UpdateRef(update); err != nil {
+			t.Fatalf("UpdateRef(%+v) returned error %v", update, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(repo.Path(), "refs", "heads", "master")); !os.IsNotExist(err) {
+		t.Errorf("UpdateRef() wrote a loose ref in a reftable repository")
+	}
+	if hash, err := repo.ResolveRef("HEAD"); err != nil || hash != b {
+		t.Errorf("ResolveRef(HEAD) = %v, %v, want %v", hash, err, b)
+	}
+	if target, err := repo.RefBySymref("HEAD"); err != nil || target != "refs/heads/master" {
+		t.Errorf("RefBySymref(HEAD) = %v, %v", target, err)
+	}
+	if hash, err := repo.Sha1ByRef("refs/heads/topic"); err != nil || hash != a {
+		t.Errorf("Sha1ByRef() = %v, %v, want %v", hash, err, a)
+	}
+	if hash, err := repo.RevParse("master~1"); err != nil || hash != a {
+		t.Errorf("RevParse(master~1) = %v, %v, want %v", hash, err, a)
+	}
+
+	err := repo.UpdateRef(RefUpdate{Name: "refs/heads/master", NewSha1: a, OldSha1: a, CheckOld: true})
+	if err != ErrRefMismatch {
+		t.Errorf("UpdateRef() with a stale old value returned %v, want %v", err, ErrRefMismatch)
+	}
+	if err := repo.UpdateRef(RefUpdate{Name: "refs/heads/master/sub", NewSha1: a}); err == nil {
+		t.Errorf("UpdateRef() of a conflicting ref returned no error")
+	}
+
+	reflog, err := repo.Reflog("HEAD")
+	if err != nil || len(reflog.Entries) != 2 || reflog.Entries[1].Message != "commit: b" || reflog.Entries[1].Old != a {
+		t.Errorf("Reflog(HEAD) = %+v, %v", reflog, err)
+	}
+	if reflog, err := repo.Reflog("refs/heads/master"); err != nil || len(reflog.Entries) != 2 {
+		t.Errorf("Reflog(master) = %+v, %v", reflog, err)
+	}
+	if hash, err := repo.RevParse("HEAD@{1}"); err != nil || hash != a {
+		t.Errorf("RevParse(HEAD@{1}) = %v, %v, want %v", hash, err, a)
+	}
+
+	if err := repo.UpdateRef(RefUpdate{Name: "refs/heads/topic", Delete: true}); err != nil {
+		t.Fatalf("UpdateRef() returned error %v", err)
+	}
+	if _, err := repo.ResolveRef("refs/heads/topic"); err != ErrRefNotFound {
+		t.Errorf("ResolveRef() of a deleted ref returned %v", err)
+	}
+	if _, err := repo.Reflog("refs/heads/topic"); err != ErrReflogNotFound {
+		t.Errorf("Reflog() of a deleted ref returned %v", err)
+	}
+
+	refs, err := repo.Refs("")
+	if err != nil {
+		t.Fatalf("Refs() returned error %v", err)
+	}
+	if len(refs) != 2 || refs[0].Name != "refs/heads/master" || refs[0].Sha1 != b || refs[1].Name != "refs/tags/v1" {
+		t.Errorf("Refs() = %+v", refs)
+	}
+
+	if err := repo.ExpireReflog("HEAD", time.Unix(1400000100, 0)); err != nil {
+		t.Fatalf("ExpireReflog() returned error %v", err)
+	}
+	if reflog, err := repo.Reflog("HEAD"); err != nil || len(reflog.Entries) != 1 || reflog.Entries[0].New != b {
+		t.Errorf("Reflog(HEAD) after expiry = %+v, %v", reflog, err)
+	}
+
+	if err := repo.PackRefs(PackRefsOptions{All: true}); err != nil {
+		t.Fatalf("PackRefs() returned error %v", err)
+	}
+	stack, err := format.OpenReftableStack(filepath.Join(repo.Path(), "reftable"))
+	if err != nil || len(stack.Tables()) != 1 {
+		t.Errorf("PackRefs() left tables %v, %v", stack.Tables(), err)
+	}
+	if hash, err := repo.ResolveRef("HEAD"); err != nil || hash != b {
+		t.Errorf("ResolveRef(HEAD) after PackRefs() = %v, %v, want %v", hash, err, b)
+	}
+}
+
+func TestRepository_Reftable_ConfigError(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	if err := os.Mkdir(filepath.Join(repo.Path(), "config"), os.FileMode(0755)); err != nil {
+		t.Fatal(err)
+	}
+	if refs, err := repo.Refs(""); err == nil {
+		t.Errorf("Refs() with an unreadable config = %v, want an error", refs)
+	}
+}
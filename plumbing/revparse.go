@@ -0,0 +1,825 @@
+package plumbing
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kourge/ggit/config"
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+)
+
+var (
+	ErrBadRevision       = errors.New("bad revision")
+	ErrAmbiguousRevision = errors.New("ambiguous revision")
+)
+
+// minShortSha1Length is the minimum number of hexadecimal digits that an
+// abbreviated SHA-1 must have in order to be recognized as such.
+const minShortSha1Length = 4
+
+// revParseDwimRules is the list of patterns that a ref name is expanded with,
+// in order, when resolving a revision. The first pattern that yields an
+// existing ref wins.
+var revParseDwimRules = []string{
+	"%s",
+	"refs/%s",
+	"refs/tags/%s",
+	"refs/heads/%s",
+	"refs/remotes/%s",
+	"refs/remotes/%s/HEAD",
+}
+
+// RevParse resolves a revision expression to the SHA-1 of the object it names.
+// Equivalent to `git rev-parse --verify`. The syntax is described in
+// gitrevisions(7), and the following forms are supported:
+//
+// A full or abbreviated SHA-1 of at least four hexadecimal digits. If an
+// abbreviated SHA-1 matches more than one object, the error
+// ErrAmbiguousRevision is returned, unless the rest of the expression can only
+// apply to one of the candidates.
+//
+// A ref name, which is looked up by trying, in order, "<name>", "refs/<name>",
+// "refs/tags/<name>", "refs/heads/<name>", "refs/remotes/<name>" and
+// "refs/remotes/<name>/HEAD". The first rule only applies to names such as
+// HEAD or FETCH_HEAD that are entirely in uppercase and to names that start
+// with "refs/". A lone "@" is a shorthand for HEAD.
+//
+// "<branch>@{upstream}", "<branch>@{u}" and "<branch>@{push}", which are
+// resolved from the branch and remote sections of the repository config. If
+// the branch is omitted, the branch that HEAD points to is used.
+//
+// "<ref>@{<n>}" and "<ref>@{<date>}", which look up the value that the ref
+// had n changes ago or at the given date in its reflog. If the ref is
+// omitted, the branch that HEAD points to is used. "@{-<n>}" names the branch
+// or commit that was checked out before the n-th most recent checkout.
+//
+// "<rev>^<n>" and "<rev>~<n>", which select the n-th parent and the n-th
+// first-parent ancestor respectively. If n is omitted, it defaults to 1.
+//
+// "<rev>^{<type>}", which peels tags until an object of the given type is
+// found, "<rev>^{}", which peels tags until a non-tag object is found, and
+// "<rev>^{/<regex>}", which finds the youngest commit reachable from rev whose
+// message matches regex.
+//
+// ":<path>" and ":<n>:<path>", which name the blob staged in the index at the
+// given path, at stage 0 or at stage n respectively.
+//
+// ":/<regex>", which finds the youngest commit reachable from any ref whose
+// message matches regex. In both regex forms, a leading "!-" negates the match
+// and a leading "!!" stands for a literal "!".
+//
+// "<rev>:<path>", which names the blob or tree at the given path within the
+// tree of rev.
+//
+// Any other expression results in the error ErrBadRevision.
+func (repo *Repository) RevParse(expr string) (core.Sha1, error) {
+	if strings.HasPrefix(expr, ":/") {
+		return repo.revParseMessage(expr[2:], nil)
+	} else if strings.HasPrefix(expr, ":") {
+		return repo.revParseIndexPath(expr[1:])
+	}
+
+	if i := revParseIndexOutsideBraces(expr, ":"); i != -1 {
+		rev, path := expr[:i], strings.TrimPrefix(expr[i+1:], "./")
+
+		hash, err := repo.revParse(rev, "tree")
+		if err != nil {
+			return core.Sha1{}, err
+		}
+		hash, err = repo.peelToType(hash, "tree")
+		if err != nil {
+			return core.Sha1{}, err
+		}
+		if path == "" {
+			return hash, nil
+		}
+
+		entry, err := repo.treeEntryAtPath(hash, path)
+		if err != nil {
+			return core.Sha1{}, err
+		} else if entry == nil {
+			return core.Sha1{}, Errorf("path '%s' does not exist in '%s'", path, rev)
+		}
+		return entry.Sha1, nil
+	}
+
+	return repo.revParse(expr, "")
+}
+
+// RevParseRange resolves a revision range expression into the commits that
+// should be included in and excluded from a revision walk. In addition to
+// every form accepted by RevParse, the following forms are supported:
+//
+// "<rev1>..<rev2>", which includes rev2 and excludes rev1. Either side may be
+// omitted, in which case it defaults to HEAD.
+//
+// "<rev1>...<rev2>", the symmetric difference, which includes both rev1 and
+// rev2 and excludes all of their merge bases.
+//
+// "^<rev>", which excludes rev.
+//
+// "<rev>^@", which includes all parents of rev but not rev itself.
+//
+// "<rev>^!", which includes rev and excludes all of its parents.
+//
+// "<rev>^-<n>", which includes rev and excludes its n-th parent. If n is
+// omitted, it defaults to 1.
+func (repo *Repository) RevParseRange(expr string) (include, exclude []core.Sha1, err error) {
+	if i := strings.Index(expr, "..."); i != -1 {
+		left, right, err := repo.revParseEnds(expr[:i], expr[i+3:])
+		if err != nil {
+			return nil, nil, err
+		}
+		bases, err := repo.mergeBases(left, right)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []core.Sha1{left, right}, bases, nil
+	} else if i := strings.Index(expr, ".."); i != -1 {
+		left, right, err := repo.revParseEnds(expr[:i], expr[i+2:])
+		if err != nil {
+			return nil, nil, err
+		}
+		return []core.Sha1{right}, []core.Sha1{left}, nil
+	}
+
+	switch {
+	case strings.HasPrefix(expr, "^"):
+		hash, err := repo.RevParse(expr[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, []core.Sha1{hash}, nil
+
+	case strings.HasSuffix(expr, "^@"):
+		_, commit, err := repo.revParseCommit(expr[:len(expr)-2])
+		if err != nil {
+			return nil, nil, err
+		}
+		return commit.Parents(), nil, nil
+
+	case strings.HasSuffix(expr, "^!"):
+		hash, commit, err := repo.revParseCommit(expr[:len(expr)-2])
+		if err != nil {
+			return nil, nil, err
+		}
+		return []core.Sha1{hash}, commit.Parents(), nil
+	}
+
+	if i := strings.LastIndex(expr, "^-"); i != -1 && revParseIsNumber(expr[i+2:]) {
+		n := 1
+		if expr[i+2:] != "" {
+			var err error
+			if n, err = strconv.Atoi(expr[i+2:]); err != nil {
+				return nil, nil, ErrBadRevision
+			}
+		}
+
+		hash, commit, err := repo.revParseCommit(expr[:i])
+		if err != nil {
+			return nil, nil, err
+		}
+		parents := commit.Parents()
+		if n < 1 || n > len(parents) {
+			return nil, nil, Errorf("%s has no parent %d", hash, n)
+		}
+		return []core.Sha1{hash}, []core.Sha1{parents[n-1]}, nil
+	}
+
+	hash, err := repo.RevParse(expr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []core.Sha1{hash}, nil, nil
+}
+
+// revParseIndexPath resolves a path within the index, optionally preceded by
+// a stage number and a colon, to the SHA-1 of the blob staged at that path.
+func (repo *Repository) revParseIndexPath(path string) (core.Sha1, error) {
+	stage := format.IndexStageNormal
+	if len(path) >= 2 && path[1] == ':' && '0' <= path[0] && path[0] <= '3' {
+		stage, path = format.IndexEntryStage(path[0]-'0'), path[2:]
+	}
+	path = strings.TrimPrefix(path, "./")
+
+	idx, err := repo.Index()
+	if err != nil {
+		return core.Sha1{}, err
+	}
+
+	if entry, ok := idx.Lookup(path, stage); ok {
+		return entry.Sha1, nil
+	} else if stage == format.IndexStageNormal && len(idx.Stages(path)) != 0 {
+		return core.Sha1{}, Errorf("path '%s' is in the index, but not at stage 0", path)
+	}
+	return core.Sha1{}, Errorf("path '%s' does not exist in the index", path)
+}
+
+// revParseEnds resolves both ends of a range, substituting HEAD for an
+// omitted end.
+func (repo *Repository) revParseEnds(left, right string) (core.Sha1, core.Sha1, error) {
+	if left == "" {
+		left = "HEAD"
+	}
+	if right == "" {
+		right = "HEAD"
+	}
+
+	leftHash, err := repo.RevParse(left)
+	if err != nil {
+		return core.Sha1{}, core.Sha1{}, err
+	}
+	rightHash, err := repo.RevParse(right)
+	if err != nil {
+		return core.Sha1{}, core.Sha1{}, err
+	}
+	return leftHash, rightHash, nil
+}
+
+// revParseCommit resolves the given expression and peels it to a commit.
+func (repo *Repository) revParseCommit(expr string) (core.Sha1, *core.Commit, error) {
+	hash, err := repo.RevParse(expr)
+	if err != nil {
+		return core.Sha1{}, nil, err
+	}
+	return repo.peelToCommit(hash)
+}
+
+// revParse resolves an expression made of a base revision followed by any
+// number of "~<n>", "^<n>" and "^{...}" suffixes. hint is the type of object
+// that the base revision is expected to be peelable to, which is used to
+// disambiguate abbreviated SHA-1s. An empty hint accepts any object.
+func (repo *Repository) revParse(expr string, hint string) (core.Sha1, error) {
+	i := revParseIndexOutsideBraces(expr, "~^")
+	if i == -1 {
+		i = len(expr)
+	}
+	base, suffixes := expr[:i], expr[i:]
+
+	if strings.HasPrefix(suffixes, "~") ||
+		strings.HasPrefix(suffixes, "^") && !strings.HasPrefix(suffixes, "^{") {
+		hint = "commit"
+	} else if strings.HasPrefix(suffixes, "^{") {
+		if end := strings.IndexByte(suffixes, '}'); end != -1 {
+			switch t := suffixes[2:end]; {
+			case t == "commit", t == "tree":
+				hint = t
+			case strings.HasPrefix(t, "/"):
+				hint = "commit"
+			}
+		}
+	}
+
+	hash, err := repo.revParseBase(base, hint)
+	if err != nil {
+		return core.Sha1{}, err
+	}
+
+	for suffixes != "" {
+		op := suffixes[0]
+		suffixes = suffixes[1:]
+
+		if op == '^' && strings.HasPrefix(suffixes, "{") {
+			end := strings.IndexByte(suffixes, '}')
+			if end == -1 {
+				return core.Sha1{}, ErrBadRevision
+			}
+			arg := suffixes[1:end]
+			suffixes = suffixes[end+1:]
+
+			if strings.HasPrefix(arg, "/") {
+				hash, _, err = repo.peelToCommit(hash)
+				if err != nil {
+					return core.Sha1{}, err
+				}
+				hash, err = repo.revParseMessage(arg[1:], []core.Sha1{hash})
+			} else {
+				hash, err = repo.peelToType(hash, arg)
+			}
+			if err != nil {
+				return core.Sha1{}, err
+			}
+			continue
+		}
+
+		digits := 0
+		for digits < len(suffixes) && '0' <= suffixes[digits] && suffixes[digits] <= '9' {
+			digits++
+		}
+		n := 1
+		if digits > 0 {
+			if n, err = strconv.Atoi(suffixes[:digits]); err != nil {
+				return core.Sha1{}, ErrBadRevision
+			}
+		}
+		suffixes = suffixes[digits:]
+
+		switch op {
+		case '~':
+			hash, err = repo.revParseAncestor(hash, n)
+		case '^':
+			hash, err = repo.revParseParent(hash, n)
+		default:
+			err = ErrBadRevision
+		}
+		if err != nil {
+			return core.Sha1{}, err
+		}
+	}
+
+	return hash, nil
+}
+
+// revParseAncestor follows the first parent of the given commit n times.
+func (repo *Repository) revParseAncestor(hash core.Sha1, n int) (core.Sha1, error) {
+	for ; n > 0; n-- {
+		var err error
+		if hash, err = repo.revParseParent(hash, 1); err != nil {
+			return core.Sha1{}, err
+		}
+	}
+
+	_, _, err := repo.peelToCommit(hash)
+	return hash, err
+}
+
+// revParseParent returns the n-th parent of the given commit, or the commit
+// itself if n is zero.
+func (repo *Repository) revParseParent(hash core.Sha1, n int) (core.Sha1, error) {
+	hash, commit, err := repo.peelToCommit(hash)
+	if err != nil {
+		return core.Sha1{}, err
+	} else if n == 0 {
+		return hash, nil
+	}
+
+	parents := commit.Parents()
+	if n > len(parents) {
+		return core.Sha1{}, Errorf("%s has no parent %d", hash, n)
+	}
+	return parents[n-1], nil
+}
+
+// revParseBase resolves a revision without any suffixes.
+func (repo *Repository) revParseBase(base string, hint string) (core.Sha1, error) {
+	if base == "" {
+		return core.Sha1{}, ErrBadRevision
+	} else if base == "@" {
+		base = "HEAD"
+	}
+
+	if i := strings.LastIndex(base, "@{"); i != -1 && strings.HasSuffix(base, "}") {
+		name, spec := base[:i], base[i+2:len(base)-1]
+		switch strings.ToLower(spec) {
+		case "u", "upstream":
+			ref, err := repo.upstreamOf(name)
+			if err != nil {
+				return core.Sha1{}, err
+			}
+			return repo.ResolveRef(ref)
+		case "push":
+			ref, err := repo.pushDestinationOf(name)
+			if err != nil {
+				return core.Sha1{}, err
+			}
+			return repo.ResolveRef(ref)
+		}
+		return repo.revParseReflog(name, spec)
+	}
+
+	if len(base) == 40 {
+		if hash, err := core.Sha1FromString(base); err == nil {
+			if exists, err := repo.ObjectStore().Has(hash); err != nil {
+				return core.Sha1{}, err
+			} else if exists {
+				return hash, nil
+			}
+		}
+	}
+
+	if ref, err := repo.dwimRef(base); err == nil {
+		return repo.ResolveRef(ref)
+	} else if err != ErrRefNotFound {
+		return core.Sha1{}, err
+	}
+
+	if len(base) >= minShortSha1Length && revParseIsHex(base) {
+		return repo.revParseShortSha1(base, hint)
+	}
+
+	return core.Sha1{}, ErrBadRevision
+}
+
+// revParseReflog resolves "<name>@{<spec>}", where spec is either a number n,
+// a negative number -n, or a date. An empty name stands for the branch that
+// HEAD points to.
+func (repo *Repository) revParseReflog(name, spec string) (core.Sha1, error) {
+	if strings.HasPrefix(spec, "-") {
+		n, err := strconv.Atoi(spec[1:])
+		if err != nil || n <= 0 || name != "" {
+			return core.Sha1{}, ErrBadRevision
+		}
+		branch, err := repo.previousBranch(n)
+		if err != nil {
+			return core.Sha1{}, err
+		}
+		return repo.revParseBase(branch, "")
+	}
+
+	ref := "HEAD"
+	if name == "" {
+		if target, err := repo.RefBySymref("HEAD"); err == nil {
+			ref = target
+		}
+	} else {
+		var err error
+		if ref, err = repo.dwimRef(name); err != nil {
+			return core.Sha1{}, err
+		}
+	}
+
+	reflog, err := repo.Reflog(ref)
+	if err == ErrReflogNotFound {
+		return core.Sha1{}, Errorf("no reflog for '%s'", ref)
+	} else if err != nil {
+		return core.Sha1{}, err
+	}
+
+	if n, err := strconv.Atoi(spec); err == nil {
+		return reflog.Nth(n)
+	}
+	t, err := parseReflogDate(spec, time.Now())
+	if err != nil {
+		return core.Sha1{}, err
+	}
+	return reflog.AtTime(t)
+}
+
+// dwimRef expands the given name according to revParseDwimRules and returns the
+// first ref that exists. If none exists, the error ErrRefNotFound is returned.
+func (repo *Repository) dwimRef(name string) (string, error) {
+	for i, rule := range revParseDwimRules {
+		if i == 0 && !revParseIsSpecialRef(name) && !strings.HasPrefix(name, "refs/") {
+			continue
+		}
+
+		ref := strings.Replace(rule, "%s", name, 1)
+		if format.ValidateRefName(ref) != nil {
+			continue
+		} else if _, err := repo.ResolveRef(ref); err == nil {
+			return ref, nil
+		} else if err != ErrRefNotFound {
+			return "", err
+		}
+	}
+
+	return "", ErrRefNotFound
+}
+
+// revParseShortSha1 resolves an abbreviated SHA-1. When multiple objects match,
+// only those that can be peeled to an object of the type hint are considered.
+func (repo *Repository) revParseShortSha1(prefix string, hint string) (core.Sha1, error) {
+	candidates, err := repo.Sha1sWithPrefix(prefix)
+	if err != nil {
+		return core.Sha1{}, err
+	}
+
+	if len(candidates) > 1 && hint != "" {
+		filtered := candidates[:0]
+		for _, candidate := range candidates {
+			if _, err := repo.peelToType(candidate, hint); err == nil {
+				filtered = append(filtered, candidate)
+			}
+		}
+		candidates = filtered
+	}
+
+	switch len(candidates) {
+	case 0:
+		return core.Sha1{}, ErrBadRevision
+	case 1:
+		return candidates[0], nil
+	}
+	return core.Sha1{}, ErrAmbiguousRevision
+}
+
+// peelToType follows annotated tags starting from the object with the given
+// SHA-1 until an object of type t is found. Commits are additionally peeled to
+// their trees. If t is empty, tags are followed until a non-tag object is
+// found. If t is "object", the SHA-1 is returned as is once it is known to
+// name an existing object.
+func (repo *Repository) peelToType(hash core.Sha1, t string) (core.Sha1, error) {
+	switch t {
+	case "", "object", "commit", "tree", "blob", "tag":
+	default:
+		return core.Sha1{}, Errorf("unknown object type in ^{%s}", t)
+	}
+
+	for {
+		object, err := repo.ObjectBySha1(hash)
+		if err != nil {
+			return core.Sha1{}, err
+		}
+
+		switch {
+		case t == "object", object.Type() == t:
+			return hash, nil
+		case t == "" && object.Type() != "tag":
+			return hash, nil
+		}
+
+		switch object := object.(type) {
+		case *core.Tag:
+			hash = object.Object()
+		case *core.Commit:
+			if t != "tree" {
+				return core.Sha1{}, Errorf("%s is a commit, not a %s", hash, t)
+			}
+			hash = object.Tree()
+		default:
+			return core.Sha1{}, Errorf("%s is a %s, not a %s", hash, object.Type(), t)
+		}
+	}
+}
+
+// revParseMessage returns the youngest commit reachable from tips whose
+// message matches the given regular expression. If tips is nil, the walk
+// starts from HEAD and every ref under "refs/".
+func (repo *Repository) revParseMessage(pattern string, tips []core.Sha1) (core.Sha1, error) {
+	negate := false
+	if strings.HasPrefix(pattern, "!-") {
+		negate, pattern = true, pattern[2:]
+	} else if strings.HasPrefix(pattern, "!!") {
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, "!") {
+		return core.Sha1{}, Errorf("unknown modifier in regex: %s", pattern)
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return core.Sha1{}, err
+	}
+
+	if tips == nil {
+		if tips, err = repo.refTips(); err != nil {
+			return core.Sha1{}, err
+		}
+	}
+
+	walk := repo.NewRevWalk()
+	for _, tip := range tips {
+		if _, _, err := repo.peelToCommit(tip); err == nil {
+			walk.Push(tip)
+		}
+	}
+
+	var found core.Sha1
+	errFound := errors.New("found")
+	err = walk.Walk(func(hash core.Sha1, commit *core.Commit) error {
+		if re.MatchString(commit.Message()) != negate {
+			found = hash
+			return errFound
+		}
+		return nil
+	})
+	if err == errFound {
+		return found, nil
+	} else if err != nil {
+		return core.Sha1{}, err
+	}
+	return core.Sha1{}, Errorf("no commit message matches %s", pattern)
+}
+
+// refTips returns the objects that HEAD and every ref under "refs/" point to.
+func (repo *Repository) refTips() ([]core.Sha1, error) {
+	var tips []core.Sha1
+	if hash, err := repo.ResolveRef("HEAD"); err == nil {
+		tips = append(tips, hash)
+	}
+
+	refs, err := repo.Refs("refs/")
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		tips = append(tips, ref.Sha1)
+	}
+	return tips, nil
+}
+
+// mergeBases returns the best common ancestors of the two given commits, i.e.
+// the common ancestors that are not reachable from any other common ancestor.
+func (repo *Repository) mergeBases(a, b core.Sha1) ([]core.Sha1, error) {
+	ancestorsOfA, err := repo.ancestors([]core.Sha1{a})
+	if err != nil {
+		return nil, err
+	}
+	ancestorsOfB, err := repo.ancestors([]core.Sha1{b})
+	if err != nil {
+		return nil, err
+	}
+
+	var common, parents []core.Sha1
+	for hash, commit := range ancestorsOfA {
+		if _, ok := ancestorsOfB[hash]; ok {
+			common = append(common, hash)
+			parents = append(parents, commit.Parents()...)
+		}
+	}
+
+	redundant, err := repo.ancestors(parents)
+	if err != nil {
+		return nil, err
+	}
+
+	var bases []core.Sha1
+	for _, hash := range common {
+		if _, ok := redundant[hash]; !ok {
+			bases = append(bases, hash)
+		}
+	}
+	sort.Sort(core.Sha1Slice(bases))
+	return bases, nil
+}
+
+// ancestors returns every commit reachable from the given commits, including
+// the commits themselves, keyed by SHA-1.
+func (repo *Repository) ancestors(tips []core.Sha1) (map[core.Sha1]*core.Commit, error) {
+	seen := make(map[core.Sha1]*core.Commit)
+	stack := append([]core.Sha1(nil), tips...)
+
+	for len(stack) != 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		hash, commit, err := repo.peelToCommit(hash)
+		if err != nil {
+			return nil, err
+		} else if _, ok := seen[hash]; ok {
+			continue
+		}
+
+		seen[hash] = commit
+		stack = append(stack, commit.Parents()...)
+	}
+
+	return seen, nil
+}
+
+// upstreamOf returns the name of the remote-tracking ref that the given branch
+// tracks, as configured by branch.<name>.remote and branch.<name>.merge. An
+// empty branch name stands for the branch that HEAD points to.
+func (repo *Repository) upstreamOf(branch string) (string, error) {
+	branch, err := repo.branchName(branch)
+	if err != nil {
+		return "", err
+	}
+
+	c, err := repo.Config()
+	if err != nil {
+		return "", err
+	}
+
+	section := `branch "` + branch + `"`
+	remote := configString(c, section, "remote")
+	merge := configString(c, section, "merge")
+	if remote == "" || merge == "" {
+		return "", Errorf("no upstream configured for branch '%s'", branch)
+	}
+
+	return remoteTrackingRef(c, remote, merge)
+}
+
+// pushDestinationOf returns the name of the remote-tracking ref that
+// corresponds to where the given branch would be pushed to. An empty branch
+// name stands for the branch that HEAD points to.
+func (repo *Repository) pushDestinationOf(branch string) (string, error) {
+	branch, err := repo.branchName(branch)
+	if err != nil {
+		return "", err
+	}
+
+	c, err := repo.Config()
+	if err != nil {
+		return "", err
+	}
+
+	section := `branch "` + branch + `"`
+	remote := configString(c, section, "pushRemote")
+	if remote == "" {
+		remote = configString(c, "remote", "pushDefault")
+	}
+	if remote == "" {
+		remote = configString(c, section, "remote")
+	}
+	if remote == "" {
+		return "", Errorf("no push destination configured for branch '%s'", branch)
+	}
+
+	switch configString(c, "push", "default") {
+	case "nothing":
+		return "", Errorf("push.default is nothing; no push destination for '%s'", branch)
+	case "upstream", "tracking":
+		return repo.upstreamOf(branch)
+	case "", "simple":
+		if remote == configString(c, section, "remote") {
+			return repo.upstreamOf(branch)
+		}
+	}
+
+	return remoteTrackingRef(c, remote, "refs/heads/"+branch)
+}
+
+// branchName turns the given branch name into a short branch name, resolving
+// an empty name or HEAD into the branch that HEAD points to.
+func (repo *Repository) branchName(name string) (string, error) {
+	if name != "" && name != "HEAD" {
+		return strings.TrimPrefix(name, "refs/heads/"), nil
+	}
+
+	ref, err := repo.RefBySymref("HEAD")
+	if err != nil {
+		return "", Errorf("HEAD does not point to a branch")
+	}
+	return strings.TrimPrefix(ref, "refs/heads/"), nil
+}
+
+// remoteTrackingRef maps the given ref on the given remote to a local ref
+// through the fetch refspec of that remote. The remote "." stands for the
+// local repository itself, in which case ref is returned unchanged.
+func remoteTrackingRef(c config.Config, remote, ref string) (string, error) {
+	if remote == "." {
+		return ref, nil
+	}
+
+	refspec := strings.TrimPrefix(configString(c, `remote "`+remote+`"`, "fetch"), "+")
+	parts := strings.SplitN(refspec, ":", 2)
+	if len(parts) != 2 {
+		return "", Errorf("no fetch refspec configured for remote '%s'", remote)
+	}
+	src, dst := parts[0], parts[1]
+
+	if star := strings.IndexByte(src, '*'); star == -1 {
+		if src == ref {
+			return dst, nil
+		}
+	} else if prefix, suffix := src[:star], src[star+1:]; strings.HasPrefix(ref, prefix) &&
+		strings.HasSuffix(ref, suffix) && len(ref) >= len(prefix)+len(suffix) {
+		match := ref[len(prefix) : len(ref)-len(suffix)]
+		return strings.Replace(dst, "*", match, 1), nil
+	}
+
+	return "", Errorf("%s is not fetched by remote '%s'", ref, remote)
+}
+
+// revParseIndexOutsideBraces returns the index of the first byte in s that is
+// any of the bytes in chars and that is not enclosed in curly braces, or -1 if
+// there is none.
+func revParseIndexOutsideBraces(s string, chars string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '{':
+			depth++
+		case s[i] == '}' && depth > 0:
+			depth--
+		case depth == 0 && strings.IndexByte(chars, s[i]) != -1:
+			return i
+		}
+	}
+	return -1
+}
+
+// revParseIsSpecialRef reports whether name looks like HEAD, FETCH_HEAD and
+// the like, i.e. consists only of uppercase letters and underscores.
+func revParseIsSpecialRef(name string) bool {
+	for _, r := range name {
+		if (r < 'A' || r > 'Z') && r != '_' {
+			return false
+		}
+	}
+	return name != ""
+}
+
+func revParseIsHex(s string) bool {
+	for _, r := range s {
+		if !('0' <= r && r <= '9' || 'a' <= r && r <= 'f' || 'A' <= r && r <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func revParseIsNumber(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,219 @@
+package plumbing
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+)
+
+func TestRepository_RevParse(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	//   a1 - a2 - m - a3   (master)
+	//     \      /
+	//       b1 -           (topic)
+	a1 := _writeFixtureCommit(t, repo, nil, "a", "1", 1)
+	a2 := _writeFixtureCommit(t, repo, []core.Sha1{a1}, "a", "2", 2)
+	b1 := _writeFixtureCommit(t, repo, []core.Sha1{a1}, "b", "1", 3)
+	m := _writeFixtureCommit(t, repo, []core.Sha1{a2, b1}, "m", "merge", 4)
+	a3 := _writeFixtureCommit(t, repo, []core.Sha1{m}, "a", "3", 5)
+
+	tagger := core.NewPerson("Jane Doe", "jane@example.com", 1400000000, 0)
+	tag := _writeFixtureObject(t, repo, core.NewTag(a2, "commit", "v1", tagger, "v1\n"))
+
+	_writeFixtureRef(t, repo, "HEAD", "ref: refs/heads/master")
+	_writeFixtureRef(t, repo, "refs/heads/master", a3.String())
+	_writeFixtureRef(t, repo, "refs/heads/topic", b1.String())
+	_writeFixtureRef(t, repo, "refs/tags/v1", tag.String())
+	_writeFixtureRef(t, repo, "refs/remotes/origin/master", a2.String())
+	_writeFixtureRef(t, repo, "refs/remotes/origin/HEAD", "ref: refs/remotes/origin/master")
+
+	config := "[branch \"master\"]\n\tremote = origin\n\tmerge = refs/heads/master\n" +
+		"[remote \"origin\"]\n\tfetch = +refs/heads/*:refs/remotes/origin/*\n"
+	if err := ioutil.WriteFile(filepath.Join(repo.Path(), "config"), []byte(config), os.FileMode(0644)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A ref-like file outside of the repository must never be read.
+	if err := ioutil.WriteFile(filepath.Join(repo.Path(), "..", "outside"), []byte(a1.String()+"\n"), os.FileMode(0644)); err != nil {
+		t.Fatal(err)
+	}
+
+	a3Commit, err := repo.ObjectBySha1(a3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a3Tree := a3Commit.(*core.Commit).Tree()
+	a3Blob, err := repo.treeEntryAtPath(a3Tree, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := repo.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.Add(format.IndexEntry{Path: "a", Sha1: a3Blob.Sha1})
+	idx.Add(format.IndexEntry{Path: "c", Stage: format.IndexStageOurs, Sha1: a1})
+	if err := repo.WriteIndex(idx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		expr     string
+		expected core.Sha1
+	}{
+		{"HEAD", a3},
+		{"@", a3},
+		{"master", a3},
+		{"refs/heads/topic", b1},
+		{a3.String(), a3},
+		{a1.String()[:7], a1},
+		{"HEAD~", m},
+		{"HEAD~2", a2},
+		{"HEAD^^2", b1},
+		{"master~1^2~1", a1},
+		{"HEAD^0", a3},
+		{"v1", tag},
+		{"v1^{}", a2},
+		{"v1^{commit}", a2},
+		{"v1^{tag}", tag},
+		{"v1~1", a1},
+		{"HEAD^{tree}", a3Tree},
+		{"HEAD:", a3Tree},
+		{"HEAD:a", a3Blob.Sha1},
+		{"origin", a2},
+		{"origin/master", a2},
+		{"@{upstream}", a2},
+		{"master@{u}", a2},
+		{"master@{push}", a2},
+		{":/^m", m},
+		{":/!-^[am]", b1},
+		{"HEAD^{/^b}", b1},
+		{":a", a3Blob.Sha1},
+		{":0:a", a3Blob.Sha1},
+		{":2:c", a1},
+	} {
+		actual, err := repo.RevParse(test.expr)
+		if err != nil {
+			t.Errorf("RevParse(%q) returned error %v", test.expr, err)
+		} else if actual != test.expected {
+			t.Errorf("RevParse(%q) = %s, want %s", test.expr, actual, test.expected)
+		}
+	}
+
+	for _, expr := range []string{
+		"",
+		"nonexistent",
+		"HEAD~5",
+		"HEAD^3",
+		"HEAD~99999999999999999999",
+		"HEAD^99999999999999999999",
+		"0123456789abcdef0123456789abcdef01234567",
+		"refs/../../outside",
+		"heads/../../../outside",
+		"HEAD:nonexistent",
+		"topic@{upstream}",
+		"v1^{blob}",
+		":/nothing matches this",
+		":c",
+		":1:c",
+	} {
+		if actual, err := repo.RevParse(expr); err == nil {
+			t.Errorf("RevParse(%q) = %s, want error", expr, actual)
+		}
+	}
+}
+
+func TestRepository_RevParse_Ambiguous(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	seen := make(map[string]*core.Blob)
+	var first, second *core.Blob
+	for i := 0; second == nil; i++ {
+		blob := &core.Blob{Content: []byte(strconv.Itoa(i))}
+		prefix := core.NewStream(blob).Hash().String()[:minShortSha1Length]
+		if other, ok := seen[prefix]; ok {
+			first, second = other, blob
+		}
+		seen[prefix] = blob
+	}
+
+	hash := _writeFixtureObject(t, repo, first)
+	prefix := hash.String()[:minShortSha1Length]
+
+	if actual, err := repo.RevParse(prefix); err != nil {
+		t.Errorf("RevParse(%q) returned error %v", prefix, err)
+	} else if actual != hash {
+		t.Errorf("RevParse(%q) = %s, want %s", prefix, actual, hash)
+	}
+
+	_writeFixtureObject(t, repo, second)
+	if _, err := repo.RevParse(prefix); err != ErrAmbiguousRevision {
+		t.Errorf("RevParse(%q) returned error %v, want %v", prefix, err, ErrAmbiguousRevision)
+	}
+}
+
+func TestRepository_RevParseRange(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	a1 := _writeFixtureCommit(t, repo, nil, "a", "1", 1)
+	a2 := _writeFixtureCommit(t, repo, []core.Sha1{a1}, "a", "2", 2)
+	b1 := _writeFixtureCommit(t, repo, []core.Sha1{a1}, "b", "1", 3)
+	m := _writeFixtureCommit(t, repo, []core.Sha1{a2, b1}, "m", "merge", 4)
+
+	_writeFixtureRef(t, repo, "HEAD", "ref: refs/heads/master")
+	_writeFixtureRef(t, repo, "refs/heads/master", m.String())
+	_writeFixtureRef(t, repo, "refs/heads/topic", b1.String())
+	_writeFixtureRef(t, repo, "refs/heads/other", a2.String())
+
+	for _, test := range []struct {
+		expr    string
+		include []core.Sha1
+		exclude []core.Sha1
+	}{
+		{"master", []core.Sha1{m}, nil},
+		{"^topic", nil, []core.Sha1{b1}},
+		{"topic..master", []core.Sha1{m}, []core.Sha1{b1}},
+		{"topic..", []core.Sha1{m}, []core.Sha1{b1}},
+		{"..topic", []core.Sha1{b1}, []core.Sha1{m}},
+		{"topic...other", []core.Sha1{b1, a2}, []core.Sha1{a1}},
+		{"topic...master", []core.Sha1{b1, m}, []core.Sha1{b1}},
+		{"master^@", []core.Sha1{a2, b1}, nil},
+		{"master^!", []core.Sha1{m}, []core.Sha1{a2, b1}},
+		{"master^-", []core.Sha1{m}, []core.Sha1{a2}},
+		{"master^-2", []core.Sha1{m}, []core.Sha1{b1}},
+	} {
+		include, exclude, err := repo.RevParseRange(test.expr)
+		if err != nil {
+			t.Errorf("RevParseRange(%q) returned error %v", test.expr, err)
+			continue
+		}
+		if !_sha1sEqual(include, test.include) {
+			t.Errorf("RevParseRange(%q) include = %v, want %v", test.expr, include, test.include)
+		}
+		if !_sha1sEqual(exclude, test.exclude) {
+			t.Errorf("RevParseRange(%q) exclude = %v, want %v", test.expr, exclude, test.exclude)
+		}
+	}
+}
+
+func _sha1sEqual(a, b []core.Sha1) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,569 @@
+package plumbing
+
+import (
+	"container/heap"
+	"strings"
+
+	"github.com/kourge/ggit/core"
+)
+
+// A RevWalkOrder determines the order in which a RevWalk yields commits.
+type RevWalkOrder int
+
+const (
+	// RevWalkOrderDefault yields commits in reverse chronological order of
+	// their commit dates. A parent may be yielded before some of its children
+	// if their commit dates are skewed.
+	RevWalkOrderDefault RevWalkOrder = iota
+
+	// RevWalkOrderDate yields commits in reverse chronological order, but
+	// never yields a parent before all of its children. Equivalent to
+	// `git rev-list --date-order`.
+	RevWalkOrderDate
+
+	// RevWalkOrderTopo never yields a parent before all of its children and
+	// avoids interleaving commits from multiple lines of history. Equivalent
+	// to `git rev-list --topo-order`.
+	RevWalkOrderTopo
+)
+
+// RevWalkFunc is the type of the function called for each commit yielded by
+// Walk. If it returns an error, the walk is halted, and in turn, that error is
+// returned by Walk.
+type RevWalkFunc func(hash core.Sha1, commit *core.Commit) error
+
+// A RevWalk traverses the history of a repository. Equivalent to
+// `git rev-list`. It starts from the commits given to Push and yields every
+// commit reachable from them, except for those reachable from the commits
+// given to Hide. In other words, the range A..B is expressed by hiding A and
+// pushing B.
+//
+// Order determines the order in which commits are yielded. See the
+// documentation on RevWalkOrder for more details.
+//
+// Reverse is a bool that, when set to true, yields the commits in the reverse
+// of the order determined by Order. MaxCount is applied before the order is
+// reversed.
+//
+// FirstParent is a bool that, when set to true, only follows the first parent
+// of a merge commit.
+//
+// MaxCount is the maximum number of commits to yield. If left unspecified as
+// zero, there is no limit.
+//
+// Paths is a slice of paths that limits the commits yielded to those that
+// change any of the given paths, which may be files or directories. When
+// Paths is not empty, history is simplified in the same manner as Git's
+// default history simplification: if a merge commit has the same content as
+// one of its parents at the given paths, only that parent is followed.
+type RevWalk struct {
+	Order       RevWalkOrder
+	Reverse     bool
+	FirstParent bool
+	MaxCount    int
+	Paths       []string
+
+	repo    *Repository
+	include []core.Sha1
+	exclude []core.Sha1
+}
+
+// NewRevWalk returns a RevWalk that traverses the history of this repository.
+func (repo *Repository) NewRevWalk() *RevWalk {
+	return &RevWalk{repo: repo}
+}
+
+// Push adds a commit from which the walk starts. Annotated tags are peeled to
+// the commits they point to.
+func (w *RevWalk) Push(hash core.Sha1) {
+	w.include = append(w.include, hash)
+}
+
+// Hide excludes the given commit and every commit reachable from it from the
+// walk. Equivalent to the ^C notation. Annotated tags are peeled to the
+// commits they point to.
+func (w *RevWalk) Hide(hash core.Sha1) {
+	w.exclude = append(w.exclude, hash)
+}
+
+// PushRange adds the range from..to, i.e. every commit that is reachable from
+// to but not from from.
+func (w *RevWalk) PushRange(from, to core.Sha1) {
+	w.Hide(from)
+	w.Push(to)
+}
+
+type revWalkCommit struct {
+	hash          core.Sha1
+	commit        *core.Commit
+	parents       []*revWalkCommit
+	seen          bool
+	queued        bool
+	uninteresting bool
+	treesame      bool
+	children      int
+	seq           int
+}
+
+func (c *revWalkCommit) time() int64 {
+	return c.commit.Committer().Unix()
+}
+
+// revWalkEverybodySlop is the number of commits that are processed after the
+// queue only holds uninteresting commits, so that commits with skewed dates do
+// not cause uninteresting commits to be yielded.
+const revWalkEverybodySlop = 5
+
+// Walk traverses the history and calls walkFn for each commit, in the order
+// determined by the fields of this RevWalk.
+//
+// Commits are loaded as they are yielded, so walkFn is first called before
+// most of the history has been read, and a walk that walkFn halts or that
+// MaxCount cuts short reads no further than it has to. Hidden commits,
+// RevWalkOrderDate, RevWalkOrderTopo, and Reverse all need the whole range of
+// commits to be known before the first one can be yielded, so with any of
+// them the range is collected in full first.
+func (w *RevWalk) Walk(walkFn RevWalkFunc) error {
+	if len(w.exclude) == 0 && w.Order == RevWalkOrderDefault && !w.Reverse {
+		return w.stream(walkFn)
+	}
+
+	list, err := w.limit()
+	if err != nil {
+		return err
+	}
+
+	switch w.Order {
+	case RevWalkOrderDate:
+		list = revWalkSortTopo(list, false)
+	case RevWalkOrderTopo:
+		list = revWalkSortTopo(list, true)
+	}
+
+	if w.MaxCount > 0 && len(list) > w.MaxCount {
+		list = list[:w.MaxCount]
+	}
+
+	if w.Reverse {
+		for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+			list[i], list[j] = list[j], list[i]
+		}
+	}
+
+	for _, c := range list {
+		if err := walkFn(c.hash, c.commit); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// stream yields every commit reachable from the pushed commits, in reverse
+// chronological order, as soon as it is taken off the queue. It must only be
+// used when no commit is hidden.
+func (w *RevWalk) stream(walkFn RevWalkFunc) error {
+	walker, err := w.start()
+	if err != nil {
+		return err
+	}
+
+	yielded := 0
+	for w.MaxCount <= 0 || yielded < w.MaxCount {
+		c, err := walker.next()
+		if err != nil {
+			return err
+		} else if c == nil {
+			break
+		} else if len(w.Paths) != 0 && c.treesame {
+			continue
+		}
+
+		if err := walkFn(c.hash, c.commit); err != nil {
+			return err
+		}
+		yielded++
+	}
+
+	return nil
+}
+
+// limit collects every interesting commit in reverse chronological order.
+func (w *RevWalk) limit() ([]*revWalkCommit, error) {
+	walker, err := w.start()
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*revWalkCommit
+	slop := revWalkEverybodySlop
+	for {
+		c, err := walker.next()
+		if err != nil {
+			return nil, err
+		} else if c == nil {
+			break
+		} else if !c.uninteresting {
+			list = append(list, c)
+		}
+
+		if walker.interesting == 0 {
+			if slop -= 1; slop == 0 {
+				break
+			}
+		} else {
+			slop = revWalkEverybodySlop
+		}
+	}
+
+	filtered := list[:0]
+	for _, c := range list {
+		if c.uninteresting || (len(w.Paths) != 0 && c.treesame) {
+			continue
+		}
+		filtered = append(filtered, c)
+	}
+
+	return filtered, nil
+}
+
+// A revWalker holds the state of a walk in progress: the commits loaded so far
+// and the queue of those that are yet to be taken off it.
+type revWalker struct {
+	w       *RevWalk
+	commits map[core.Sha1]*revWalkCommit
+	queue   revWalkQueue
+
+	// interesting is the number of commits in the queue that are not
+	// uninteresting.
+	interesting int
+}
+
+// start returns a revWalker whose queue holds the hidden and pushed commits of
+// this walk.
+func (w *RevWalk) start() (*revWalker, error) {
+	walker := &revWalker{w: w, commits: make(map[core.Sha1]*revWalkCommit)}
+
+	for _, hash := range w.exclude {
+		c, err := walker.load(hash)
+		if err != nil {
+			return nil, err
+		}
+		walker.markUninteresting(c)
+		walker.push(c)
+	}
+	for _, hash := range w.include {
+		c, err := walker.load(hash)
+		if err != nil {
+			return nil, err
+		}
+		walker.push(c)
+	}
+
+	return walker, nil
+}
+
+// load returns the commit with the given SHA-1, loading it first unless it has
+// already been loaded. Annotated tags are peeled to the commits they point to.
+func (walker *revWalker) load(hash core.Sha1) (*revWalkCommit, error) {
+	if c, exists := walker.commits[hash]; exists {
+		return c, nil
+	}
+
+	hash, commit, err := walker.w.repo.peelToCommit(hash)
+	if err != nil {
+		return nil, err
+	} else if c, exists := walker.commits[hash]; exists {
+		return c, nil
+	}
+
+	c := &revWalkCommit{hash: hash, commit: commit, seq: len(walker.commits)}
+	walker.commits[hash] = c
+	return c, nil
+}
+
+// push adds the given commit to the queue unless it has been queued before.
+func (walker *revWalker) push(c *revWalkCommit) {
+	if c.seen {
+		return
+	}
+	c.seen = true
+	c.queued = true
+	if !c.uninteresting {
+		walker.interesting++
+	}
+	heap.Push(&walker.queue, c)
+}
+
+// next takes the most recent commit off the queue, loads its parents, and
+// queues them in turn. Once the queue is empty, nil is returned.
+func (walker *revWalker) next() (*revWalkCommit, error) {
+	if walker.queue.Len() == 0 {
+		return nil, nil
+	}
+
+	c := heap.Pop(&walker.queue).(*revWalkCommit)
+	c.queued = false
+	if !c.uninteresting {
+		walker.interesting--
+	}
+
+	parents := c.commit.Parents()
+	if walker.w.FirstParent && len(parents) > 1 {
+		parents = parents[:1]
+	}
+	for _, hash := range parents {
+		parent, err := walker.load(hash)
+		if err != nil {
+			return nil, err
+		}
+		c.parents = append(c.parents, parent)
+	}
+
+	if c.uninteresting {
+		for _, parent := range c.parents {
+			walker.markUninteresting(parent)
+			walker.push(parent)
+		}
+	} else {
+		if len(walker.w.Paths) != 0 {
+			if err := walker.w.simplify(c); err != nil {
+				return nil, err
+			}
+		}
+		for _, parent := range c.parents {
+			walker.push(parent)
+		}
+	}
+
+	return c, nil
+}
+
+// markUninteresting marks the given commit and all of its ancestors that have
+// already been loaded as uninteresting.
+func (walker *revWalker) markUninteresting(c *revWalkCommit) {
+	stack := []*revWalkCommit{c}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if c.uninteresting {
+			continue
+		}
+		c.uninteresting = true
+		if c.queued {
+			walker.interesting--
+		}
+		for _, parent := range c.parents {
+			if !parent.uninteresting {
+				stack = append(stack, parent)
+			}
+		}
+	}
+}
+
+// simplify determines whether the given commit leaves the content at the paths
+// of this walk unchanged with respect to any of its parents. If it does, only
+// the first such parent is followed from then on.
+func (w *RevWalk) simplify(c *revWalkCommit) error {
+	entries, err := w.pathEntries(c.commit.Tree())
+	if err != nil {
+		return err
+	}
+
+	if len(c.parents) == 0 {
+		c.treesame = true
+		for _, entry := range entries {
+			if !entry.IsEmpty() {
+				c.treesame = false
+			}
+		}
+		return nil
+	}
+
+	for _, parent := range c.parents {
+		parentEntries, err := w.pathEntries(parent.commit.Tree())
+		if err != nil {
+			return err
+		}
+
+		same := true
+		for i := range entries {
+			if entries[i] != parentEntries[i] {
+				same = false
+			}
+		}
+
+		if same {
+			c.treesame = true
+			c.parents = []*revWalkCommit{parent}
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// pathEntries returns the SHA-1 of the object found at each of the paths of
+// this walk within the given tree. An empty Sha1 stands for a missing path.
+func (w *RevWalk) pathEntries(tree core.Sha1) ([]core.Sha1, error) {
+	entries := make([]core.Sha1, len(w.Paths))
+	for i, path := range w.Paths {
+		entry, err := w.repo.treeEntryAtPath(tree, path)
+		if err != nil {
+			return nil, err
+		} else if entry != nil {
+			entries[i] = entry.Sha1
+		}
+	}
+	return entries, nil
+}
+
+// revWalkSortTopo sorts the given commits so that no parent comes before any
+// of its children. If lifo is true, the most recently discovered commit is
+// picked next, which keeps lines of history together. Otherwise, the commit
+// with the most recent date is picked next.
+func revWalkSortTopo(list []*revWalkCommit, lifo bool) []*revWalkCommit {
+	inList := make(map[*revWalkCommit]bool, len(list))
+	for _, c := range list {
+		inList[c] = true
+		c.children = 0
+	}
+	for _, c := range list {
+		for _, parent := range c.parents {
+			if inList[parent] {
+				parent.children += 1
+			}
+		}
+	}
+
+	var stack []*revWalkCommit
+	queue := &revWalkQueue{}
+	for i := len(list) - 1; i >= 0; i-- {
+		if c := list[i]; c.children == 0 {
+			if lifo {
+				stack = append(stack, c)
+			} else {
+				heap.Push(queue, c)
+			}
+		}
+	}
+
+	sorted := make([]*revWalkCommit, 0, len(list))
+	for len(stack) > 0 || queue.Len() > 0 {
+		var c *revWalkCommit
+		if lifo {
+			c = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		} else {
+			c = heap.Pop(queue).(*revWalkCommit)
+		}
+		sorted = append(sorted, c)
+
+		for _, parent := range c.parents {
+			if !inList[parent] {
+				continue
+			}
+			if parent.children -= 1; parent.children == 0 {
+				if lifo {
+					stack = append(stack, parent)
+				} else {
+					heap.Push(queue, parent)
+				}
+			}
+		}
+	}
+
+	return sorted
+}
+
+// A revWalkQueue is a priority queue that satisfies heap.Interface and yields
+// the commit with the most recent commit date first. Ties are broken by the
+// order in which the commits were loaded.
+type revWalkQueue []*revWalkCommit
+
+func (q revWalkQueue) Len() int {
+	return len(q)
+}
+
+func (q revWalkQueue) Less(i, j int) bool {
+	if ti, tj := q[i].time(), q[j].time(); ti != tj {
+		return ti > tj
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q revWalkQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *revWalkQueue) Push(x interface{}) {
+	*q = append(*q, x.(*revWalkCommit))
+}
+
+func (q *revWalkQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	c := old[n-1]
+	*q = old[:n-1]
+	return c
+}
+
+// peelToCommit follows annotated tags starting from the object with the given
+// SHA-1 until a commit is reached. The SHA-1 of that commit is returned along
+// with the commit itself.
+func (repo *Repository) peelToCommit(hash core.Sha1) (core.Sha1, *core.Commit, error) {
+	for {
+		object, err := repo.ObjectBySha1(hash)
+		if err != nil {
+			return hash, nil, err
+		}
+
+		switch object := object.(type) {
+		case *core.Commit:
+			return hash, object, nil
+		case *core.Tag:
+			hash = object.Object()
+		default:
+			return hash, nil, Errorf("%s is a %s, not a commit", hash, object.Type())
+		}
+	}
+}
+
+// treeEntryAtPath looks up the entry at the given slash-separated path within
+// the tree with the given SHA-1. If no such entry exists, nil is returned
+// without an error.
+func (repo *Repository) treeEntryAtPath(tree core.Sha1, path string) (*core.TreeEntry, error) {
+	var found *core.TreeEntry
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if found != nil {
+			if found.Mode != core.GitModeDir {
+				return nil, nil
+			}
+			tree = found.Sha1
+		}
+
+		object, err := repo.ObjectBySha1(tree)
+		if err != nil {
+			return nil, err
+		}
+		t, isTree := object.(*core.Tree)
+		if !isTree {
+			return nil, Errorf("%s is a %s, not a tree", tree, object.Type())
+		}
+
+		found = nil
+		for _, entry := range t.Entries() {
+			if entry.Name == name {
+				e := entry
+				found = &e
+				break
+			}
+		}
+		if found == nil {
+			return nil, nil
+		}
+	}
+
+	return found, nil
+}
@@ -0,0 +1,128 @@
+package plumbing
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kourge/ggit/core"
+)
+
+// _fixtureRevWalkRepo builds the following history, where b1 and b2 live on
+// a side branch that is merged back by m:
+//
+//	a1 - a2 ------- a3 - m
+//	       \            /
+//	        b1 ------ b2
+func _fixtureRevWalkRepo(t *testing.T) (*Repository, map[string]core.Sha1, func()) {
+	repo, cleanup := _fixtureRepo(t)
+	c := make(map[string]core.Sha1)
+
+	c["a1"] = _writeFixtureCommit(t, repo, nil, "a", "1", 1)
+	c["a2"] = _writeFixtureCommit(t, repo, []core.Sha1{c["a1"]}, "a", "2", 2)
+	c["b1"] = _writeFixtureCommit(t, repo, []core.Sha1{c["a2"]}, "b", "1", 3)
+	c["a3"] = _writeFixtureCommit(t, repo, []core.Sha1{c["a2"]}, "a", "3", 4)
+	c["b2"] = _writeFixtureCommit(t, repo, []core.Sha1{c["b1"]}, "b", "2", 5)
+	c["m"] = _writeFixtureCommit(t, repo, []core.Sha1{c["a3"], c["b2"]}, "a", "3", 6)
+
+	return repo, c, cleanup
+}
+
+func _collectRevWalk(t *testing.T, w *RevWalk, c map[string]core.Sha1) []string {
+	names := make(map[core.Sha1]string)
+	for name, hash := range c {
+		names[hash] = name
+	}
+
+	var walked []string
+	if err := w.Walk(func(hash core.Sha1, commit *core.Commit) error {
+		walked = append(walked, names[hash])
+		return nil
+	}); err != nil {
+		t.Fatalf("w.Walk() returned error %v", err)
+	}
+	return walked
+}
+
+func TestRevWalk(t *testing.T) {
+	repo, c, cleanup := _fixtureRevWalkRepo(t)
+	defer cleanup()
+
+	for _, test := range []struct {
+		setup    func(w *RevWalk)
+		expected []string
+	}{
+		{func(w *RevWalk) {
+			w.Push(c["m"])
+		}, []string{"m", "b2", "a3", "b1", "a2", "a1"}},
+		{func(w *RevWalk) {
+			w.Push(c["m"])
+			w.Order = RevWalkOrderTopo
+		}, []string{"m", "b2", "b1", "a3", "a2", "a1"}},
+		{func(w *RevWalk) {
+			w.Push(c["m"])
+			w.Reverse = true
+			w.MaxCount = 3
+		}, []string{"a3", "b2", "m"}},
+		{func(w *RevWalk) {
+			w.Push(c["m"])
+			w.FirstParent = true
+		}, []string{"m", "a3", "a2", "a1"}},
+		{func(w *RevWalk) {
+			w.PushRange(c["a3"], c["m"])
+		}, []string{"m", "b2", "b1"}},
+		{func(w *RevWalk) {
+			w.Push(c["b2"])
+			w.Push(c["a3"])
+			w.Hide(c["a2"])
+		}, []string{"b2", "a3", "b1"}},
+		{func(w *RevWalk) {
+			w.Push(c["m"])
+			w.Paths = []string{"a"}
+		}, []string{"a3", "a2", "a1"}},
+	} {
+		w := repo.NewRevWalk()
+		test.setup(w)
+		if actual := _collectRevWalk(t, w, c); !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("w.Walk() yielded %v, want %v", actual, test.expected)
+		}
+	}
+}
+
+func TestRevWalk_Streaming(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	// The parent of a is missing, so only a walk that stops before reaching a
+	// can succeed.
+	a := _writeFixtureCommit(t, repo, []core.Sha1{{1}}, "a", "1", 1)
+	b := _writeFixtureCommit(t, repo, []core.Sha1{a}, "a", "2", 2)
+	c := _writeFixtureCommit(t, repo, []core.Sha1{b}, "a", "3", 3)
+
+	w := repo.NewRevWalk()
+	w.Push(c)
+	w.MaxCount = 2
+	var walked []core.Sha1
+	if err := w.Walk(func(hash core.Sha1, commit *core.Commit) error {
+		walked = append(walked, hash)
+		return nil
+	}); err != nil {
+		t.Errorf("w.Walk() with MaxCount read past the commits it yielded: %v", err)
+	} else if !reflect.DeepEqual(walked, []core.Sha1{c, b}) {
+		t.Errorf("w.Walk() yielded %v, want %v", walked, []core.Sha1{c, b})
+	}
+
+	halt := Errorf("halt")
+	w = repo.NewRevWalk()
+	w.Push(c)
+	if err := w.Walk(func(hash core.Sha1, commit *core.Commit) error {
+		return halt
+	}); err != halt {
+		t.Errorf("w.Walk() halted by walkFn returned error %v", err)
+	}
+
+	w = repo.NewRevWalk()
+	w.Push(c)
+	if err := w.Walk(func(hash core.Sha1, commit *core.Commit) error { return nil }); err == nil {
+		t.Errorf("w.Walk() over a missing parent should fail")
+	}
+}
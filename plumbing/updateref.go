@@ -0,0 +1,515 @@
+package plumbing
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kourge/ggit/config"
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+)
+
+var (
+	ErrRefLocked   = errors.New("ref is locked by another process")
+	ErrRefMismatch = errors.New("ref does not have the expected old value")
+)
+
+// A RefUpdate describes a change to a single ref, as applied by UpdateRef and
+// UpdateRefs.
+//
+// Name is the full name of the ref to change, such as "refs/heads/master" or
+// "HEAD". If it is a symbolic ref, the ref that it points to is changed
+// instead, unless NoDeref is true or Symref is set.
+//
+// NewSha1 is the object that the ref should point to afterwards. Symref, if not
+// empty, is the full name of the ref that the ref should become a symbolic ref
+// to instead. Delete is a bool that, when set to true, deletes the ref instead
+// of changing it; both its loose and its packed form are removed.
+//
+// OldSha1 is the object that the ref must point to for the change to be
+// applied. It is only checked if CheckOld is true, in which case a zero OldSha1
+// means that the ref must not exist yet. The value of a symbolic ref is that of
+// the ref it points to.
+//
+// Message describes the change in the reflog, e.g. "commit: Fix typo", and
+// Committer is the identity that the reflog entry is attributed to. If
+// Committer has no name, the identity is taken from the environment and the
+// repository config, and the current time is used. Whether a change is
+// recorded in the reflog of a ref at all depends on core.logAllRefUpdates.
+// Changing a symbolic ref only leaves a reflog entry if Message is not empty.
+type RefUpdate struct {
+	Name      string
+	NewSha1   core.Sha1
+	Symref    string
+	Delete    bool
+	OldSha1   core.Sha1
+	CheckOld  bool
+	NoDeref   bool
+	Message   string
+	Committer core.Person
+}
+
+// UpdateRef applies a single change to a ref. Equivalent to `git update-ref`
+// and `git symbolic-ref`. See the documentation on RefUpdate and UpdateRefs
+// for more details.
+func (repo *Repository) UpdateRef(update RefUpdate) error {
+	return repo.UpdateRefs([]RefUpdate{update})
+}
+
+// UpdateRefs applies the given changes to refs as a single transaction: either
+// all of them are applied or none are. Equivalent to `git update-ref --stdin`
+// with a transaction.
+//
+// Every ref is locked the same way Git does it, by exclusively creating a file
+// named "<ref>.lock" next to it, so that stock Git running at the same time
+// never observes a half-applied transaction. If any lock cannot be taken,
+// ErrRefLocked is returned. Old values are checked once all the locks are
+// held, and if any does not match, ErrRefMismatch is returned. New values are
+// written into the lock files, which are only renamed into place once every
+// update has been prepared. Deleting a packed ref takes "packed-refs.lock" as
+// well, and the packed-refs file is read and rewritten into it while the lock
+// is held; it is renamed into place before any loose ref is touched.
+//
+// Should renaming a lock file into place or removing a deleted ref fail
+// partway through, the packed-refs file and the refs that were already
+// changed are restored to their previous content before the error is
+// returned. Their locks have been released by then, so this is done on a
+// best-effort basis.
+//
+// Once a ref is changed, the change is appended to its reflog. A change made
+// through a symbolic ref such as HEAD, or to the branch that HEAD points to, is
+// appended to the reflog of HEAD as well. Deleting a ref deletes its reflog.
+func (repo *Repository) UpdateRefs(updates []RefUpdate) error {
+	if stack, err := repo.reftableStack(); err != nil {
+		return err
+	} else if stack != nil {
+		return repo.updateReftableRefs(stack, updates)
+	}
+
+	tx := &refTransaction{repo: repo, locked: make(map[string]bool)}
+	defer tx.rollback()
+
+	for _, update := range updates {
+		if err := tx.prepare(update); err != nil {
+			return err
+		}
+	}
+	if err := tx.preparePackedRefs(); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// A refTransaction holds the locks taken by UpdateRefs.
+type refTransaction struct {
+	repo   *Repository
+	refs   []*lockedRef
+	locked map[string]bool
+
+	// packed is the packed-refs file, which is only locked if a packed ref is
+	// deleted.
+	packed lockedFile
+}
+
+// A lockedFile is a file that a transaction has locked, along with what it
+// held before the transaction. held is true while the lock file exists, and
+// applied is true once the lock file has been renamed into place or the file
+// has been deleted.
+type lockedFile struct {
+	path     string
+	previous []byte
+	existed  bool
+	held     bool
+	applied  bool
+}
+
+func (f *lockedFile) lockPath() string {
+	return f.path + ".lock"
+}
+
+// readPrevious records what the file holds before the transaction. The lock
+// must be held.
+func (f *lockedFile) readPrevious() error {
+	content, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	f.previous, f.existed = content, true
+	return nil
+}
+
+// restore puts back what the file held before the transaction, if the
+// transaction has already changed it.
+func (f *lockedFile) restore() error {
+	if !f.applied {
+		return nil
+	}
+	f.applied = false
+	if !f.existed {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return writeFileAtomically(f.path, bytes.NewReader(f.previous), os.FileMode(0644))
+}
+
+// A lockedRef is a ref whose lock file has been created and, unless the ref is
+// being deleted, holds its new content.
+type lockedRef struct {
+	lockedFile
+	update RefUpdate
+	name   string
+	old    core.Sha1
+}
+
+func (tx *refTransaction) prepare(update RefUpdate) error {
+	if err := format.ValidateRefName(update.Name); err != nil {
+		return Errorf("%s: %v", update.Name, err)
+	} else if update.Symref != "" {
+		if err := format.ValidateRefName(update.Symref); err != nil {
+			return Errorf("%s: %v", update.Symref, err)
+		}
+	}
+
+	name := update.Name
+	if !update.NoDeref && update.Symref == "" {
+		var err error
+		if name, err = tx.repo.dereference(name); err != nil {
+			return err
+		}
+	}
+	if tx.locked[name] {
+		return Errorf("multiple updates for ref '%s' not allowed", name)
+	}
+
+	ref := &lockedRef{update: update, name: name}
+	ref.path = filepath.Join(tx.repo.path, filepath.FromSlash(name))
+	if !update.Delete {
+		if err := tx.repo.checkRefConflicts(name); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(ref.path), os.FileMode(0755)); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(ref.lockPath(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(0644))
+	if os.IsExist(err) {
+		return ErrRefLocked
+	} else if err != nil {
+		return err
+	}
+	ref.held = true
+	tx.refs = append(tx.refs, ref)
+	tx.locked[name] = true
+
+	if err := ref.readPrevious(); err != nil {
+		file.Close()
+		return err
+	}
+	current, err := tx.repo.ResolveRef(name)
+	if err == ErrRefNotFound {
+		current = core.Sha1{}
+	} else if err != nil {
+		file.Close()
+		return err
+	}
+	if update.CheckOld && current != update.OldSha1 {
+		file.Close()
+		return ErrRefMismatch
+	}
+	ref.old = current
+
+	var content string
+	switch {
+	case update.Delete:
+	case update.Symref != "":
+		content = "ref: " + update.Symref + "\n"
+	default:
+		content = update.NewSha1.String() + "\n"
+	}
+	if _, err := file.WriteString(content); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// preparePackedRefs locks the packed-refs file if any of the refs that are
+// deleted is packed, and writes the packed-refs file without them into the
+// lock file. The packed-refs file is only read once the lock is held, so that
+// no concurrent change to it is lost.
+func (tx *refTransaction) preparePackedRefs() error {
+	deleted := make(map[string]bool)
+	for _, ref := range tx.refs {
+		if ref.update.Delete {
+			deleted[ref.name] = true
+		}
+	}
+	if len(deleted) == 0 {
+		return nil
+	}
+
+	tx.packed.path = filepath.Join(tx.repo.path, "packed-refs")
+	lock, err := os.OpenFile(tx.packed.lockPath(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.FileMode(0644))
+	if os.IsExist(err) {
+		return ErrRefLocked
+	} else if err != nil {
+		return err
+	}
+	tx.packed.held = true
+	defer lock.Close()
+
+	if err := tx.packed.readPrevious(); err != nil {
+		return err
+	}
+	packed := &format.PackedRefs{}
+	if err := packed.Decode(bytes.NewReader(tx.packed.previous)); err != nil {
+		return err
+	}
+
+	kept := packed.Refs[:0]
+	for _, ref := range packed.Refs {
+		if !deleted[ref.Name] {
+			kept = append(kept, ref)
+		}
+	}
+	if len(kept) == len(packed.Refs) {
+		lock.Close()
+		os.Remove(tx.packed.lockPath())
+		tx.packed.held = false
+		return nil
+	}
+	packed.Refs = kept
+
+	if _, err := lock.ReadFrom(packed.Reader()); err != nil {
+		return err
+	}
+	return lock.Close()
+}
+
+func (tx *refTransaction) commit() error {
+	if tx.packed.held {
+		if err := os.Rename(tx.packed.lockPath(), tx.packed.path); err != nil {
+			return err
+		}
+		tx.packed.held = false
+		tx.packed.applied = true
+	}
+
+	for _, ref := range tx.refs {
+		var err error
+		if ref.update.Delete {
+			if err = os.Remove(ref.path); os.IsNotExist(err) {
+				err = nil
+			}
+			if err == nil {
+				os.Remove(ref.lockPath())
+			}
+		} else {
+			err = os.Rename(ref.lockPath(), ref.path)
+		}
+		if err != nil {
+			tx.undo()
+			return err
+		}
+		ref.held = false
+		ref.applied = true
+	}
+
+	for _, ref := range tx.refs {
+		if ref.update.Delete {
+			tx.repo.pruneRefDirs(filepath.Dir(ref.path))
+			logPath := tx.repo.reflogPath(ref.name)
+			os.Remove(logPath)
+			tx.repo.pruneRefDirs(filepath.Dir(logPath))
+		}
+	}
+
+	return tx.log()
+}
+
+// undo restores the packed-refs file and every ref that has already been
+// changed to what they held before the transaction.
+func (tx *refTransaction) undo() {
+	for _, ref := range tx.refs {
+		ref.restore()
+	}
+	tx.packed.restore()
+}
+
+// log appends an entry for every ref that was changed to the reflogs that it
+// belongs in.
+func (tx *refTransaction) log() error {
+	c, err := tx.repo.Config()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	head, _ := tx.repo.RefBySymref("HEAD")
+	for _, ref := range tx.refs {
+		entry, ok := tx.repo.reflogEntry(c, ref.update, ref.old)
+		if !ok {
+			continue
+		}
+		for _, name := range reflogNames(ref.update, ref.name, head, tx.locked) {
+			if !tx.repo.shouldLogRef(c, name) {
+				continue
+			}
+			if err := tx.repo.AppendReflog(name, entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reflogEntry returns the reflog entry that records the given update of a ref
+// whose value was old, and whether the update is recorded at all.
+func (repo *Repository) reflogEntry(c config.Config, update RefUpdate, old core.Sha1) (format.ReflogEntry, bool) {
+	if update.Delete || (update.Symref != "" && update.Message == "") {
+		return format.ReflogEntry{}, false
+	}
+
+	entry := format.ReflogEntry{
+		Old:       old,
+		New:       update.NewSha1,
+		Committer: update.Committer,
+		Message:   update.Message,
+	}
+	if entry.Committer.Name == "" {
+		entry.Committer = defaultCommitter(c)
+	}
+	if update.Symref != "" {
+		entry.New, _ = repo.ResolveRef(update.Symref)
+	}
+	return entry, true
+}
+
+// reflogNames returns the names of the refs whose reflogs record the given
+// update of the ref with the given name: the ref itself, along with the
+// symbolic ref that the update went through, or HEAD if it points to the ref
+// and is not updated by the same transaction.
+func reflogNames(update RefUpdate, name, head string, updated map[string]bool) []string {
+	names := []string{name}
+	if update.Name != name {
+		names = append(names, update.Name)
+	} else if head == name && !updated["HEAD"] {
+		names = append(names, "HEAD")
+	}
+	return names
+}
+
+// rollback removes every lock file that is still held, along with the
+// directories that were created for them.
+func (tx *refTransaction) rollback() {
+	for _, ref := range tx.refs {
+		if ref.held {
+			os.Remove(ref.lockPath())
+			ref.held = false
+			tx.repo.pruneRefDirs(filepath.Dir(ref.path))
+		}
+	}
+	if tx.packed.held {
+		os.Remove(tx.packed.lockPath())
+		tx.packed.held = false
+	}
+}
+
+// dereference follows the chain of loose symbolic refs that starts at the ref
+// with the given name and returns the name of the ref at its end, which may not
+// exist yet.
+func (repo *Repository) dereference(name string) (string, error) {
+	for depth := 0; depth <= maxSymrefDepth; depth++ {
+		path := filepath.Join(repo.path, filepath.FromSlash(name))
+		if info, err := os.Stat(path); os.IsNotExist(err) || (err == nil && info.IsDir()) {
+			return name, nil
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+
+		if !bytes.HasPrefix(content, []byte("ref: ")) {
+			return name, nil
+		}
+		symref := &format.Symref{}
+		if err := symref.Decode(bytes.NewReader(content)); err != nil {
+			return "", err
+		}
+		name = symref.Target
+	}
+	return "", Errorf("too many levels of symbolic refs: %s", name)
+}
+
+// checkRefConflicts returns an error if a ref with the given name cannot be
+// created because a ref exists at the name of one of its parent directories,
+// or because refs exist under a directory of the same name.
+func (repo *Repository) checkRefConflicts(name string) error {
+	packed, err := repo.packedRefNames()
+	if err != nil {
+		return err
+	}
+
+	components := strings.Split(name, "/")
+	for i := 1; i < len(components); i++ {
+		prefix := strings.Join(components[:i], "/")
+		info, err := os.Stat(filepath.Join(repo.path, filepath.FromSlash(prefix)))
+		if (err == nil && !info.IsDir()) || packed[prefix] {
+			return Errorf("cannot lock ref '%s': '%s' exists", name, prefix)
+		}
+	}
+
+	path := filepath.Join(repo.path, filepath.FromSlash(name))
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		repo.pruneRefDirs(path)
+		if _, err := os.Stat(path); err == nil {
+			return Errorf("cannot lock ref '%s': there are refs under '%s/'", name, name)
+		}
+	}
+	for packedName := range packed {
+		if strings.HasPrefix(packedName, name+"/") {
+			return Errorf("cannot lock ref '%s': '%s' exists", name, packedName)
+		}
+	}
+	return nil
+}
+
+// pruneRefDirs removes the directory at the given path and each of its parents
+// as long as they are empty. Like Git, it leaves the refs directory and its
+// immediate subdirectories, such as "refs/heads", alone, and likewise under
+// logs.
+func (repo *Repository) pruneRefDirs(dir string) {
+	refs := filepath.Join(repo.path, "refs")
+	if strings.HasPrefix(dir, filepath.Join(repo.path, "logs")+string(filepath.Separator)) {
+		refs = filepath.Join(repo.path, "logs", "refs")
+	}
+	for strings.HasPrefix(filepath.Dir(dir), refs+string(filepath.Separator)) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// packedRefNames returns the set of names of the refs in the packed-refs file.
+func (repo *Repository) packedRefNames() (map[string]bool, error) {
+	packed, err := repo.readPackedRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, ref := range packed.Refs {
+		names[ref.Name] = true
+	}
+	return names, nil
+}
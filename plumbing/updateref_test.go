@@ -0,0 +1,179 @@
+package plumbing
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kourge/ggit/core"
+)
+
+func TestRepository_UpdateRef(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	a := _writeFixtureCommit(t, repo, nil, "a", "a\n", 0)
+	b := _writeFixtureCommit(t, repo, []core.Sha1{a}, "b", "b\n", 1)
+	_writeFixtureRef(t, repo, "HEAD", "ref: refs/heads/master")
+
+	if err := repo.UpdateRef(RefUpdate{Name: "HEAD", NewSha1: a, CheckOld: true}); err != nil {
+		t.Fatalf("UpdateRef() returned error %v", err)
+	}
+	if sha1, err := repo.Sha1FromLooseRef("refs/heads/master"); err != nil || sha1 != a {
+		t.Errorf("refs/heads/master = %v, %v, want %v", sha1, err, a)
+	}
+
+	err := repo.UpdateRef(RefUpdate{Name: "refs/heads/master", NewSha1: b, OldSha1: b, CheckOld: true})
+	if err != ErrRefMismatch {
+		t.Errorf("UpdateRef() with stale old value returned error %v, want %v", err, ErrRefMismatch)
+	}
+	if _, err := os.Stat(filepath.Join(repo.Path(), "refs", "heads", "master.lock")); !os.IsNotExist(err) {
+		t.Errorf("lock file was left behind")
+	}
+
+	ioutil.WriteFile(filepath.Join(repo.Path(), "refs", "heads", "master.lock"), nil, os.FileMode(0644))
+	if err := repo.UpdateRef(RefUpdate{Name: "refs/heads/master", NewSha1: b}); err != ErrRefLocked {
+		t.Errorf("UpdateRef() on locked ref returned error %v, want %v", err, ErrRefLocked)
+	}
+	os.Remove(filepath.Join(repo.Path(), "refs", "heads", "master.lock"))
+
+	if err := repo.UpdateRef(RefUpdate{Name: "HEAD", Symref: "refs/heads/topic"}); err != nil {
+		t.Fatalf("UpdateRef() returned error %v", err)
+	}
+	if target, err := repo.RefBySymref("HEAD"); err != nil || target != "refs/heads/topic" {
+		t.Errorf("HEAD = %v, %v, want refs/heads/topic", target, err)
+	}
+
+	for _, name := range []string{"refs/heads/master/sub", "refs/heads/bad..name", "refs/heads/x.lock", "head"} {
+		if err := repo.UpdateRef(RefUpdate{Name: name, NewSha1: a}); err == nil {
+			t.Errorf("UpdateRef(%q) returned no error", name)
+		}
+	}
+}
+
+func TestRepository_UpdateRefs(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	a := _writeFixtureCommit(t, repo, nil, "a", "a\n", 0)
+	b := _writeFixtureCommit(t, repo, []core.Sha1{a}, "b", "b\n", 1)
+	_writeFixtureRef(t, repo, "refs/heads/master", a.String())
+	_writeFixtureRef(t, repo, "packed-refs", a.String()+" refs/tags/v1\n"+b.String()+" refs/tags/v2\n^"+a.String())
+
+	err := repo.UpdateRefs([]RefUpdate{
+		{Name: "refs/heads/master", NewSha1: b, OldSha1: a, CheckOld: true},
+		{Name: "refs/heads/new/branch", NewSha1: b, CheckOld: true},
+		{Name: "refs/tags/v2", Delete: true, OldSha1: a, CheckOld: true},
+	})
+	if err != ErrRefMismatch {
+		t.Fatalf("UpdateRefs() returned error %v, want %v", err, ErrRefMismatch)
+	}
+	if sha1, _ := repo.Sha1ByRef("refs/heads/master"); sha1 != a {
+		t.Errorf("refs/heads/master = %v after failed transaction, want %v", sha1, a)
+	}
+	if _, err := os.Stat(filepath.Join(repo.Path(), "refs", "heads", "new")); !os.IsNotExist(err) {
+		t.Errorf("directory for refs/heads/new/branch was left behind")
+	}
+
+	err = repo.UpdateRefs([]RefUpdate{
+		{Name: "refs/heads/master", NewSha1: b, OldSha1: a, CheckOld: true},
+		{Name: "refs/heads/new/branch", NewSha1: b, CheckOld: true},
+		{Name: "refs/tags/v2", Delete: true, OldSha1: b, CheckOld: true},
+	})
+	if err != nil {
+		t.Fatalf("UpdateRefs() returned error %v", err)
+	}
+
+	for name, expected := range map[string]core.Sha1{
+		"refs/heads/master":     b,
+		"refs/heads/new/branch": b,
+		"refs/tags/v1":          a,
+	} {
+		if sha1, err := repo.Sha1ByRef(name); err != nil || sha1 != expected {
+			t.Errorf("%s = %v, %v, want %v", name, sha1, err, expected)
+		}
+	}
+	if _, err := repo.Sha1ByRef("refs/tags/v2"); err != ErrRefNotFound {
+		t.Errorf("refs/tags/v2 still exists after deletion")
+	}
+
+	content, _ := ioutil.ReadFile(filepath.Join(repo.Path(), "packed-refs"))
+	if expected := a.String() + " refs/tags/v1\n"; string(content) != expected {
+		t.Errorf("packed-refs = %q, want %q", content, expected)
+	}
+
+	if err := repo.UpdateRef(RefUpdate{Name: "refs/heads/new/branch", Delete: true}); err != nil {
+		t.Fatalf("UpdateRef() returned error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(repo.Path(), "refs", "heads", "new")); !os.IsNotExist(err) {
+		t.Errorf("empty directory refs/heads/new was left behind")
+	}
+}
+
+func TestRepository_UpdateRefs_PartialFailure(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	a := _writeFixtureCommit(t, repo, nil, "a", "a\n", 0)
+	b := _writeFixtureCommit(t, repo, []core.Sha1{a}, "b", "b\n", 1)
+	_writeFixtureRef(t, repo, "refs/heads/master", a.String())
+	packed := a.String() + " refs/tags/v1\n" + b.String() + " refs/tags/v2\n"
+	_writeFixtureRef(t, repo, "packed-refs", strings.TrimSuffix(packed, "\n"))
+
+	tx := &refTransaction{repo: repo, locked: make(map[string]bool)}
+	defer tx.rollback()
+	for _, update := range []RefUpdate{
+		{Name: "refs/tags/v2", Delete: true},
+		{Name: "refs/heads/master", NewSha1: b},
+		{Name: "refs/heads/topic", NewSha1: b},
+	} {
+		if err := tx.prepare(update); err != nil {
+			t.Fatalf("tx.prepare() returned error %v", err)
+		}
+	}
+	if err := tx.preparePackedRefs(); err != nil {
+		t.Fatalf("tx.preparePackedRefs() returned error %v", err)
+	}
+
+	// A directory full of refs appears where the last ref is to be renamed to,
+	// so that the transaction fails after the other refs have been changed.
+	_writeFixtureRef(t, repo, "refs/heads/topic/x", b.String())
+	if err := tx.commit(); err == nil {
+		t.Fatalf("tx.commit() should fail")
+	}
+
+	if sha1, err := repo.Sha1ByRef("refs/heads/master"); err != nil || sha1 != a {
+		t.Errorf("refs/heads/master = %v, %v after a failed commit, want %v", sha1, err, a)
+	}
+	if sha1, err := repo.Sha1ByRef("refs/tags/v2"); err != nil || sha1 != b {
+		t.Errorf("refs/tags/v2 = %v, %v after a failed commit, want %v", sha1, err, b)
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(repo.Path(), "packed-refs")); string(content) != packed {
+		t.Errorf("packed-refs = %q after a failed commit, want %q", content, packed)
+	}
+
+	tx.rollback()
+	for _, path := range []string{"packed-refs.lock", "refs/heads/master.lock", "refs/heads/topic.lock"} {
+		if _, err := os.Stat(filepath.Join(repo.Path(), path)); !os.IsNotExist(err) {
+			t.Errorf("%s was left behind: %v", path, err)
+		}
+	}
+}
+
+func TestRepository_UpdateRefs_PackedRefsLocked(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	a := _writeFixtureCommit(t, repo, nil, "a", "a\n", 0)
+	_writeFixtureRef(t, repo, "packed-refs", a.String()+" refs/tags/v1")
+	_writeFixtureRef(t, repo, "packed-refs.lock", "")
+
+	if err := repo.UpdateRef(RefUpdate{Name: "refs/tags/v1", Delete: true}); err != ErrRefLocked {
+		t.Errorf("UpdateRef() with packed-refs locked returned error %v, want %v", err, ErrRefLocked)
+	}
+	if _, err := os.Stat(filepath.Join(repo.Path(), "refs", "tags", "v1.lock")); !os.IsNotExist(err) {
+		t.Errorf("lock of refs/tags/v1 was left behind: %v", err)
+	}
+}
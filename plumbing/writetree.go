@@ -0,0 +1,108 @@
+package plumbing
+
+import (
+	"strings"
+
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+)
+
+// WriteTree creates tree objects out of the entries of the given index and
+// returns the SHA-1 of the root tree. Equivalent to `git write-tree`.
+//
+// Directories whose nodes in the cache tree of the index are valid are not
+// written out again; the SHA-1 recorded in the cache tree is used instead. The
+// nodes of every other directory are updated, so the index should be written
+// back with WriteIndex afterwards for the next call to benefit from them.
+// Entries added with IntentToAdd are left out. If the index has conflicts, an
+// error is returned.
+func (repo *Repository) WriteTree(idx *format.Index) (core.Sha1, error) {
+	if conflicts := idx.Conflicts(); len(conflicts) != 0 {
+		return core.Sha1{}, Errorf("%s: unmerged (stage %d)", conflicts[0], idx.Stages(conflicts[0])[0].Stage)
+	}
+
+	root := idx.CacheTree()
+	if root == nil {
+		root = &format.CacheTree{EntryCount: -1}
+		idx.SetCacheTree(root)
+	}
+
+	hash, _, err := repo.writeTreeLevel(idx.Entries(), "", root)
+	return hash, err
+}
+
+// writeTreeLevel writes out the tree for the directory with the given prefix,
+// which is either empty or ends with a slash. entries must hold exactly the
+// index entries under that directory. The returned bool is true if the tree
+// has no entries, in which case it is left out of its parent.
+func (repo *Repository) writeTreeLevel(
+	entries []format.IndexEntry,
+	prefix string,
+	node *format.CacheTree,
+) (core.Sha1, bool, error) {
+	if node.Valid() {
+		return node.Sha1, false, nil
+	}
+
+	var treeEntries []core.TreeEntry
+	written := make(map[*format.CacheTree]bool)
+	hasIntentToAdd := false
+
+	for i := 0; i < len(entries); {
+		entry := entries[i]
+		name := entry.Path[len(prefix):]
+
+		slash := strings.IndexByte(name, '/')
+		if slash == -1 {
+			if entry.IntentToAdd {
+				hasIntentToAdd = true
+			} else {
+				treeEntries = append(treeEntries, core.TreeEntry{Mode: entry.Mode, Name: name, Sha1: entry.Sha1})
+			}
+			i++
+			continue
+		}
+
+		name = name[:slash]
+		dirPrefix := prefix + name + "/"
+		j := i + 1
+		for j < len(entries) && strings.HasPrefix(entries[j].Path, dirPrefix) {
+			j++
+		}
+
+		subtree := node.AddSubtree(name)
+		hash, empty, err := repo.writeTreeLevel(entries[i:j], dirPrefix, subtree)
+		if err != nil {
+			return core.Sha1{}, false, err
+		}
+		if !subtree.Valid() {
+			hasIntentToAdd = true
+		}
+		if !empty {
+			treeEntries = append(treeEntries, core.TreeEntry{Mode: core.GitModeDir, Name: name, Sha1: hash})
+			written[subtree] = true
+		}
+		i = j
+	}
+
+	hash, err := repo.WriteObject(core.NewTree(treeEntries))
+	if err != nil {
+		return core.Sha1{}, false, err
+	}
+
+	subtrees := node.Subtrees[:0]
+	for _, subtree := range node.Subtrees {
+		if written[subtree] {
+			subtrees = append(subtrees, subtree)
+		}
+	}
+
+	node.Sha1 = hash
+	node.Subtrees = subtrees
+	node.EntryCount = len(entries)
+	if hasIntentToAdd {
+		node.EntryCount = -1
+	}
+
+	return hash, len(treeEntries) == 0, nil
+}
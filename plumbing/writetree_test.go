@@ -0,0 +1,64 @@
+package plumbing
+
+import (
+	"testing"
+
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+)
+
+func TestRepository_WriteTree(t *testing.T) {
+	repo, cleanup := _fixtureRepo(t)
+	defer cleanup()
+
+	blob := _writeFixtureObject(t, repo, &core.Blob{Content: []byte("content")})
+	mode := core.GitModeRegular | core.GitModeReadWritable
+
+	idx, err := format.NewIndex(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"a-b", "a/x", "a/y/z", "b", "c/d"} {
+		idx.Add(format.IndexEntry{Path: path, Mode: mode, Sha1: blob})
+	}
+
+	hash, err := repo.WriteTree(idx)
+	if err != nil {
+		t.Fatalf("WriteTree() returned error %v", err)
+	}
+	if entry, err := repo.treeEntryAtPath(hash, "a/y/z"); err != nil || entry == nil || entry.Sha1 != blob {
+		t.Errorf("tree entry a/y/z = %+v, %v", entry, err)
+	}
+
+	tree := idx.CacheTree()
+	if !tree.Valid() || tree.Sha1 != hash || tree.EntryCount != 5 {
+		t.Errorf("CacheTree() = %+v after WriteTree()", tree)
+	}
+	if y := tree.Lookup("a/y"); y == nil || !y.Valid() || y.EntryCount != 1 {
+		t.Errorf("CacheTree().Lookup(\"a/y\") = %+v after WriteTree()", y)
+	}
+
+	// Changing an entry and writing the tree again, reusing the cache tree,
+	// must yield the same tree as writing it from scratch.
+	idx.Add(format.IndexEntry{Path: "a/y/w", Mode: mode, Sha1: blob, IntentToAdd: true})
+	idx.Add(format.IndexEntry{Path: "c/e", Mode: mode, Sha1: blob})
+	hash, err = repo.WriteTree(idx)
+	if err != nil {
+		t.Fatalf("WriteTree() returned error %v", err)
+	}
+
+	idx.SetCacheTree(nil)
+	if fresh, err := repo.WriteTree(idx); err != nil {
+		t.Fatalf("WriteTree() returned error %v", err)
+	} else if fresh != hash {
+		t.Errorf("WriteTree() with a cache tree = %s, without = %s", hash, fresh)
+	}
+	if tree := idx.CacheTree(); tree.Valid() || !tree.Lookup("c").Valid() {
+		t.Errorf("directories with intent-to-add entries should stay invalid")
+	}
+
+	idx.Add(format.IndexEntry{Path: "b", Stage: format.IndexStageOurs, Mode: mode, Sha1: blob})
+	if _, err := repo.WriteTree(idx); err == nil {
+		t.Errorf("WriteTree() should fail on an index with conflicts")
+	}
+}
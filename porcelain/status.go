@@ -0,0 +1,689 @@
+package porcelain
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+	"github.com/kourge/ggit/plumbing"
+)
+
+// StatusOptions contains all the possible options for Status.
+//
+// Dir is a string that is a path to a directory inside the working tree of a
+// repository. If left blank, it defaults to the current working directory.
+//
+// Ignored is a bool that, when set to true, causes ignored files to be reported
+// as well, like `git status --ignored`.
+//
+// AllUntracked is a bool that, when set to true, causes every untracked file to
+// be reported individually, like `git status --untracked-files=all`. By
+// default, a directory that holds no tracked file is reported as a whole.
+type StatusOptions struct {
+	Dir          string
+	Ignored      bool
+	AllUntracked bool
+}
+
+// A StatusKind tells which kind of line of `git status --porcelain=v2` a
+// StatusEntry stands for. Its value is the character that the line starts
+// with.
+type StatusKind byte
+
+const (
+	StatusOrdinary  StatusKind = '1'
+	StatusUnmerged  StatusKind = 'u'
+	StatusUntracked StatusKind = '?'
+	StatusIgnored   StatusKind = '!'
+)
+
+// A StatusCode describes how a path differs between two of HEAD, the index and
+// the working tree. Its value is the character that Git uses for it.
+type StatusCode byte
+
+const (
+	StatusUnmodified  StatusCode = '.'
+	StatusModified    StatusCode = 'M'
+	StatusTypeChanged StatusCode = 'T'
+	StatusAdded       StatusCode = 'A'
+	StatusDeleted     StatusCode = 'D'
+	StatusUpdated     StatusCode = 'U'
+)
+
+// A StatusEntry describes a single path reported by Status.
+//
+// Staged describes how the path differs between HEAD and the index, and
+// Unstaged how it differs between the index and the working tree. For an
+// unmerged path, they describe which side deleted, added, or updated the path,
+// as with the two-letter codes of `git status`. For an untracked or ignored
+// path, both are StatusUnmodified. The path of an untracked or ignored
+// directory ends with a slash.
+//
+// HeadMode, IndexMode and WorktreeMode are the modes of the path in HEAD, in
+// the index and in the working tree, and HeadSha1 and IndexSha1 are the objects
+// it points to in HEAD and in the index. A mode of zero means that the path is
+// absent. For an unmerged path, StageModes and StageSha1s hold the entries of
+// the index at each stage instead of IndexMode and IndexSha1, indexed by stage
+// minus one.
+type StatusEntry struct {
+	Kind         StatusKind
+	Staged       StatusCode
+	Unstaged     StatusCode
+	Path         string
+	HeadMode     core.GitMode
+	IndexMode    core.GitMode
+	WorktreeMode core.GitMode
+	HeadSha1     core.Sha1
+	IndexSha1    core.Sha1
+	StageModes   [3]core.GitMode
+	StageSha1s   [3]core.Sha1
+}
+
+// String returns this entry as a line of `git status --porcelain=v2`, without
+// the trailing line feed. Paths are quoted the way Git quotes them by default.
+func (entry StatusEntry) String() string {
+	path := quotePath(entry.Path)
+	switch entry.Kind {
+	case StatusUntracked, StatusIgnored:
+		return fmt.Sprintf("%c %s", entry.Kind, path)
+	case StatusUnmerged:
+		return fmt.Sprintf(
+			"u %c%c %s %s %s %s %s %s %s %s %s",
+			entry.Staged, entry.Unstaged, entry.submoduleState(),
+			entry.StageModes[0], entry.StageModes[1], entry.StageModes[2], entry.WorktreeMode,
+			entry.StageSha1s[0], entry.StageSha1s[1], entry.StageSha1s[2], path,
+		)
+	}
+	return fmt.Sprintf(
+		"1 %c%c %s %s %s %s %s %s %s",
+		entry.Staged, entry.Unstaged, entry.submoduleState(),
+		entry.HeadMode, entry.IndexMode, entry.WorktreeMode,
+		entry.HeadSha1, entry.IndexSha1, path,
+	)
+}
+
+func (entry StatusEntry) submoduleState() string {
+	for _, mode := range append([]core.GitMode{entry.HeadMode, entry.IndexMode}, entry.StageModes[:]...) {
+		if mode == core.GitModeGitlink {
+			return "S..."
+		}
+	}
+	return "N..."
+}
+
+// Status compares HEAD, the index and the working tree of a repository.
+// Equivalent to `git status --porcelain=v2`, without rename detection. See
+// the documentation on StatusOptions for more details.
+//
+// Changed paths come first, sorted by path, followed by unmerged paths, then
+// by untracked paths and then by ignored paths, each sorted by path. A file whose stat data matches that of its
+// index entry is assumed to be unchanged without being hashed, unless it was
+// modified too close to when the index was written for the stat data to be
+// trusted. Ignore rules are read from the .gitignore file of each directory and
+// from $GIT_DIR/info/exclude.
+func Status(o StatusOptions) ([]StatusEntry, error) {
+	if o.Dir == "" {
+		dir, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		o.Dir = dir
+	}
+
+	repo := plumbing.NewRepository(o.Dir)
+	defer repo.Close()
+	if err := repo.Search(); err != nil {
+		return nil, err
+	} else if filepath.Base(repo.Path()) != ".git" {
+		return nil, core.Errorf("%s: this operation must be run in a work tree", repo.Path())
+	}
+
+	s := &statusWalker{
+		options:  o,
+		repo:     repo,
+		worktree: filepath.Dir(repo.Path()),
+		fileMode: true,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	tracked, err := s.compareIndex()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.walk("", s.ignores, false); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(statusEntrySlice(s.untracked))
+	tracked = append(tracked, s.untracked...)
+	if o.Ignored {
+		sort.Sort(statusEntrySlice(s.ignored))
+		tracked = append(tracked, s.ignored...)
+	}
+	return tracked, nil
+}
+
+// A statusWalker holds the state of a single call to Status.
+type statusWalker struct {
+	options   StatusOptions
+	repo      *plumbing.Repository
+	worktree  string
+	fileMode  bool
+	index     *format.Index
+	entries   []format.IndexEntry
+	indexTime format.IndexEntryStat
+	head      map[string]core.TreeEntry
+	ignores   []statusIgnores
+	untracked []StatusEntry
+	ignored   []StatusEntry
+}
+
+// A statusIgnores holds the ignore rules that apply to the directory at dir,
+// which is either empty or ends with a slash.
+type statusIgnores struct {
+	dir   string
+	table *format.GlobTable
+}
+
+func (s *statusWalker) load() error {
+	var err error
+	if s.index, err = s.repo.Index(); err != nil {
+		return err
+	}
+	s.entries = s.index.Entries()
+
+	if info, err := os.Stat(filepath.Join(s.repo.Path(), "index")); err == nil {
+		s.indexTime = format.NewIndexEntryStat(info)
+	}
+
+	if c, err := s.repo.Config(); err == nil {
+		if section, ok := c["core"]; ok {
+			for key, value := range section.Dict {
+				if strings.EqualFold(key, "filemode") {
+					if b, ok := value.(bool); ok {
+						s.fileMode = b
+					}
+				}
+			}
+		}
+	}
+
+	s.head = make(map[string]core.TreeEntry)
+	if _, err := s.repo.ResolveRef("HEAD"); err == nil {
+		tree, err := s.repo.RevParse("HEAD^{tree}")
+		if err != nil {
+			return err
+		} else if err := s.flattenTree(tree, ""); err != nil {
+			return err
+		}
+	} else if err != plumbing.ErrRefNotFound {
+		return err
+	}
+
+	if excludes, err := s.repo.Excludes(); err == nil {
+		s.ignores = append(s.ignores, statusIgnores{"", excludes})
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if ignores, err := s.repo.Ignores(); err == nil {
+		s.ignores = append(s.ignores, statusIgnores{"", ignores})
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// flattenTree records every non-tree entry under the given tree in s.head,
+// keyed by its path prefixed with prefix.
+func (s *statusWalker) flattenTree(hash core.Sha1, prefix string) error {
+	object, err := s.repo.ObjectBySha1(hash)
+	if err != nil {
+		return err
+	}
+	tree, ok := object.(*core.Tree)
+	if !ok {
+		return core.Errorf("%s is a %s, not a tree", hash, object.Type())
+	}
+
+	for _, entry := range tree.Entries() {
+		path := prefix + entry.Name
+		if entry.Mode.Type() == core.GitModeDir {
+			if err := s.flattenTree(entry.Sha1, path+"/"); err != nil {
+				return err
+			}
+			continue
+		}
+		entry.Name = path
+		s.head[path] = entry
+	}
+	return nil
+}
+
+// compareIndex compares every entry of the index against HEAD and the working
+// tree, and every path in HEAD against the index. As in Git, changed paths are
+// listed before unmerged paths.
+func (s *statusWalker) compareIndex() ([]StatusEntry, error) {
+	var results, unmerged []StatusEntry
+	seen := make(map[string]bool)
+
+	for i := 0; i < len(s.entries); {
+		j := i + 1
+		for j < len(s.entries) && s.entries[j].Path == s.entries[i].Path {
+			j++
+		}
+		path := s.entries[i].Path
+		seen[path] = true
+
+		var result StatusEntry
+		var err error
+		if s.entries[i].Stage != format.IndexStageNormal {
+			result, err = s.compareUnmerged(s.entries[i:j])
+		} else {
+			result, err = s.compareEntry(s.entries[i])
+		}
+		if err != nil {
+			return nil, err
+		}
+		if result.Kind == StatusUnmerged {
+			unmerged = append(unmerged, result)
+		} else if result.Staged != StatusUnmodified || result.Unstaged != StatusUnmodified {
+			results = append(results, result)
+		}
+		i = j
+	}
+
+	for path, entry := range s.head {
+		if !seen[path] {
+			results = append(results, StatusEntry{
+				Kind:     StatusOrdinary,
+				Staged:   StatusDeleted,
+				Unstaged: StatusUnmodified,
+				Path:     path,
+				HeadMode: entry.Mode,
+				HeadSha1: entry.Sha1,
+			})
+		}
+	}
+
+	sort.Sort(statusEntrySlice(results))
+	sort.Sort(statusEntrySlice(unmerged))
+	return append(results, unmerged...), nil
+}
+
+func (s *statusWalker) compareEntry(entry format.IndexEntry) (StatusEntry, error) {
+	result := StatusEntry{
+		Kind:      StatusOrdinary,
+		Staged:    StatusUnmodified,
+		Unstaged:  StatusUnmodified,
+		Path:      entry.Path,
+		IndexMode: entry.Mode,
+		IndexSha1: entry.Sha1,
+	}
+
+	if entry.IntentToAdd {
+		result.IndexMode, result.IndexSha1 = 0, core.Sha1{}
+	}
+
+	if head, ok := s.head[entry.Path]; !ok {
+		if !entry.IntentToAdd {
+			result.Staged = StatusAdded
+		}
+	} else {
+		result.HeadMode, result.HeadSha1 = head.Mode, head.Sha1
+		if head.Mode.Type() != entry.Mode.Type() {
+			result.Staged = StatusTypeChanged
+		} else if head.Mode != entry.Mode || head.Sha1 != entry.Sha1 {
+			result.Staged = StatusModified
+		}
+	}
+
+	var err error
+	result.WorktreeMode, result.Unstaged, err = s.compareWorktree(entry)
+	return result, err
+}
+
+// compareWorktree returns the mode of the file in the working tree for the
+// given entry and how it differs from the entry.
+func (s *statusWalker) compareWorktree(entry format.IndexEntry) (core.GitMode, StatusCode, error) {
+	if entry.SkipWorktree || entry.AssumeValid {
+		return entry.Mode, StatusUnmodified, nil
+	}
+
+	info, err := os.Lstat(filepath.Join(s.worktree, filepath.FromSlash(entry.Path)))
+	if os.IsNotExist(err) || isNotDir(err) {
+		return 0, StatusDeleted, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+
+	mode := core.GitModeFromFileMode(info.Mode())
+	if entry.Mode == core.GitModeGitlink {
+		if mode.Type() != core.GitModeDir {
+			return 0, StatusDeleted, nil
+		}
+		return entry.Mode, StatusUnmodified, nil
+	}
+	if mode.Type() == core.GitModeDir {
+		return 0, StatusDeleted, nil
+	}
+	if !s.fileMode && mode.Type() == core.GitModeRegular && entry.Mode.Type() == core.GitModeRegular {
+		mode = entry.Mode
+	}
+
+	if entry.IntentToAdd {
+		return mode, StatusAdded, nil
+	} else if mode.Type() != entry.Mode.Type() {
+		return mode, StatusTypeChanged, nil
+	} else if mode != entry.Mode {
+		return mode, StatusModified, nil
+	}
+
+	stat := format.NewIndexEntryStat(info)
+	if stat.Matches(entry.IndexEntryStat) && !s.racilyClean(entry) {
+		return mode, StatusUnmodified, nil
+	}
+
+	hash, err := s.hashFile(entry.Path, info)
+	if err != nil {
+		return 0, 0, err
+	} else if hash != entry.Sha1 {
+		return mode, StatusModified, nil
+	}
+	return mode, StatusUnmodified, nil
+}
+
+// racilyClean returns true if the file of the given entry was modified no
+// earlier than when the index was written, in which case it may have been
+// modified again within the same timestamp without its stat data changing.
+func (s *statusWalker) racilyClean(entry format.IndexEntry) bool {
+	if entry.MtimeSecs != s.indexTime.MtimeSecs {
+		return entry.MtimeSecs > s.indexTime.MtimeSecs
+	}
+	return entry.MtimeNanosecs >= s.indexTime.MtimeNanosecs
+}
+
+// hashFile returns the SHA-1 of the blob that the file at the given path in the
+// working tree would be stored as.
+func (s *statusWalker) hashFile(path string, info os.FileInfo) (core.Sha1, error) {
+	fullPath := filepath.Join(s.worktree, filepath.FromSlash(path))
+
+	var content []byte
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			return core.Sha1{}, err
+		}
+		content = []byte(target)
+	} else {
+		var err error
+		if content, err = ioutil.ReadFile(fullPath); err != nil {
+			return core.Sha1{}, err
+		}
+	}
+
+	return core.NewStream(&core.Blob{Content: content}).Hash(), nil
+}
+
+func (s *statusWalker) compareUnmerged(stages []format.IndexEntry) (StatusEntry, error) {
+	result := StatusEntry{Kind: StatusUnmerged, Path: stages[0].Path}
+	var present [3]bool
+	for _, stage := range stages {
+		if stage.Stage == format.IndexStageNormal {
+			continue
+		}
+		result.StageModes[stage.Stage-1] = stage.Mode
+		result.StageSha1s[stage.Stage-1] = stage.Sha1
+		present[stage.Stage-1] = true
+	}
+
+	base, ours, theirs := present[0], present[1], present[2]
+	switch {
+	case base && !ours && !theirs:
+		result.Staged, result.Unstaged = StatusDeleted, StatusDeleted
+	case !base && ours && !theirs:
+		result.Staged, result.Unstaged = StatusAdded, StatusUpdated
+	case base && ours && !theirs:
+		result.Staged, result.Unstaged = StatusUpdated, StatusDeleted
+	case !base && !ours && theirs:
+		result.Staged, result.Unstaged = StatusUpdated, StatusAdded
+	case base && !ours && theirs:
+		result.Staged, result.Unstaged = StatusDeleted, StatusUpdated
+	case !base && ours && theirs:
+		result.Staged, result.Unstaged = StatusAdded, StatusAdded
+	default:
+		result.Staged, result.Unstaged = StatusUpdated, StatusUpdated
+	}
+
+	info, err := os.Lstat(filepath.Join(s.worktree, filepath.FromSlash(result.Path)))
+	if err == nil {
+		result.WorktreeMode = core.GitModeFromFileMode(info.Mode())
+	} else if !os.IsNotExist(err) && !isNotDir(err) {
+		return StatusEntry{}, err
+	}
+	return result, nil
+}
+
+// walk looks for untracked and ignored paths in the directory at dir, which is
+// either empty or ends with a slash, given the ignore rules that apply to its
+// parent directories. If dirIgnored is true, the directory itself is ignored,
+// so everything in it that is not tracked is ignored as well.
+func (s *statusWalker) walk(dir string, ignores []statusIgnores, dirIgnored bool) error {
+	infos, ignores, err := s.readDir(dir, ignores)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		path := dir + info.Name()
+		if info.Name() == ".git" {
+			continue
+		}
+
+		if !info.IsDir() {
+			if s.isTracked(path) {
+				continue
+			}
+			if ignored, err := s.isIgnored(ignores, path, false); err != nil {
+				return err
+			} else if ignored || dirIgnored {
+				s.report(StatusIgnored, path)
+			} else {
+				s.report(StatusUntracked, path)
+			}
+			continue
+		}
+
+		if s.isTracked(path) {
+			continue
+		}
+
+		ignored, err := s.isIgnored(ignores, path, true)
+		if err != nil {
+			return err
+		}
+		ignored = ignored || dirIgnored
+		if s.hasTrackedUnder(path + "/") {
+			if err := s.walk(path+"/", ignores, ignored); err != nil {
+				return err
+			}
+			continue
+		} else if ignored && s.options.AllUntracked {
+			if err := s.walk(path+"/", ignores, true); err != nil {
+				return err
+			}
+			continue
+		} else if ignored {
+			s.report(StatusIgnored, path+"/")
+			continue
+		}
+
+		if _, err := os.Stat(filepath.Join(s.worktree, filepath.FromSlash(path), ".git")); err == nil {
+			s.report(StatusUntracked, path+"/")
+			continue
+		}
+
+		untracked, ignoredSoFar := s.untracked, s.ignored
+		if err := s.walk(path+"/", ignores, false); err != nil {
+			return err
+		}
+		if !s.options.AllUntracked && len(s.untracked) > len(untracked) {
+			s.untracked = untracked
+			s.report(StatusUntracked, path+"/")
+		} else if !s.options.AllUntracked && len(s.ignored) > len(ignoredSoFar) {
+			s.ignored = ignoredSoFar
+			s.report(StatusIgnored, path+"/")
+		}
+	}
+	return nil
+}
+
+// readDir returns the entries of the directory at dir, along with the ignore
+// rules that apply to them, which include the .gitignore file in it. The rules
+// of the root of the working tree are loaded up front.
+func (s *statusWalker) readDir(dir string, ignores []statusIgnores) ([]os.FileInfo, []statusIgnores, error) {
+	fullPath := filepath.Join(s.worktree, filepath.FromSlash(dir))
+	infos, err := ioutil.ReadDir(fullPath)
+	if err != nil {
+		return nil, nil, err
+	} else if dir == "" {
+		return infos, ignores, nil
+	}
+
+	table, err := format.GlobTableAtPath(filepath.Join(fullPath, ".gitignore"))
+	if err == nil {
+		ignores = append(ignores[:len(ignores):len(ignores)], statusIgnores{dir, table})
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	return infos, ignores, nil
+}
+
+func (s *statusWalker) report(kind StatusKind, path string) {
+	entry := StatusEntry{Kind: kind, Staged: StatusUnmodified, Unstaged: StatusUnmodified, Path: path}
+	if kind == StatusUntracked {
+		s.untracked = append(s.untracked, entry)
+	} else {
+		s.ignored = append(s.ignored, entry)
+	}
+}
+
+// isIgnored returns whether the given path is ignored by the given rules. Rules
+// that come later take precedence over earlier ones, and the rules of a
+// directory take precedence over those of its parents.
+func (s *statusWalker) isIgnored(ignores []statusIgnores, path string, isDir bool) (bool, error) {
+	for i := len(ignores) - 1; i >= 0; i-- {
+		rel := strings.TrimPrefix(path, ignores[i].dir)
+		if matched, decided, err := matchIgnores(ignores[i].table, rel, isDir); err != nil {
+			return false, err
+		} else if decided {
+			return matched, nil
+		}
+	}
+	return false, nil
+}
+
+// matchIgnores returns whether the given path is ignored by the given table, and
+// whether any pattern in the table matched it at all.
+func matchIgnores(table *format.GlobTable, path string, isDir bool) (matched, decided bool, err error) {
+	if matched, err = table.MatchPath(path, isDir); err != nil || matched {
+		return matched, matched, err
+	}
+
+	negated := &format.GlobTable{}
+	for _, pattern := range table.Globs {
+		if strings.HasPrefix(pattern, "!") {
+			negated.Globs = append(negated.Globs, pattern[1:])
+		}
+	}
+	decided, err = negated.MatchPath(path, isDir)
+	return false, decided, err
+}
+
+func (s *statusWalker) search(path string) int {
+	return sort.Search(len(s.entries), func(i int) bool {
+		return s.entries[i].Path >= path
+	})
+}
+
+func (s *statusWalker) isTracked(path string) bool {
+	i := s.search(path)
+	return i < len(s.entries) && s.entries[i].Path == path
+}
+
+func (s *statusWalker) hasTrackedUnder(prefix string) bool {
+	i := s.search(prefix)
+	return i < len(s.entries) && strings.HasPrefix(s.entries[i].Path, prefix)
+}
+
+// isNotDir returns true if the given error arose because a component of a path
+// that was expected to be a directory is not one.
+func isNotDir(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		return pathErr.Err == syscall.ENOTDIR
+	}
+	return false
+}
+
+// quotePath quotes a path the way Git does when core.quotePath is enabled: if
+// it contains a double quote, a backslash, a control character or a byte that
+// is not ASCII, it is enclosed in double quotes and those characters are
+// escaped as in C.
+func quotePath(path string) string {
+	needsQuoting := false
+	for i := 0; i < len(path); i++ {
+		if c := path[i]; c < 0x20 || c >= 0x7f || c == '"' || c == '\\' {
+			needsQuoting = true
+			break
+		}
+	}
+	if !needsQuoting {
+		return path
+	}
+
+	buffer := new(bytes.Buffer)
+	buffer.WriteByte('"')
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; c {
+		case '\a':
+			buffer.WriteString(`\a`)
+		case '\b':
+			buffer.WriteString(`\b`)
+		case '\t':
+			buffer.WriteString(`\t`)
+		case '\n':
+			buffer.WriteString(`\n`)
+		case '\v':
+			buffer.WriteString(`\v`)
+		case '\f':
+			buffer.WriteString(`\f`)
+		case '\r':
+			buffer.WriteString(`\r`)
+		case '"', '\\':
+			buffer.WriteByte('\\')
+			buffer.WriteByte(c)
+		default:
+			if c < 0x20 || c >= 0x7f {
+				fmt.Fprintf(buffer, "\\%03o", c)
+			} else {
+				buffer.WriteByte(c)
+			}
+		}
+	}
+	buffer.WriteByte('"')
+	return buffer.String()
+}
+
+type statusEntrySlice []StatusEntry
+
+func (p statusEntrySlice) Len() int           { return len(p) }
+func (p statusEntrySlice) Less(i, j int) bool { return p[i].Path < p[j].Path }
+func (p statusEntrySlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
@@ -0,0 +1,197 @@
+package porcelain
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kourge/ggit/core"
+	"github.com/kourge/ggit/format"
+	"github.com/kourge/ggit/plumbing"
+)
+
+// _fixtureWorktree creates a working tree in a temporary directory with the
+// given files, stages all of them, and commits those in committed. Every file
+// is dated a minute back, so that none of them is racily clean. The returned
+// function removes the directory.
+func _fixtureWorktree(t *testing.T, files map[string]string, committed []string) (string, func()) {
+	dir, err := ioutil.TempDir("", "ggit-worktree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	gitDir := filepath.Join(dir, ".git")
+	for _, name := range []string{"hooks", "info", "objects/pack", "refs/heads", "refs/tags"} {
+		if err := os.MkdirAll(filepath.Join(gitDir, name), os.FileMode(0755)); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(gitDir, "HEAD"), []byte("ref: refs/heads/master\n"), os.FileMode(0644))
+
+	repo := plumbing.NewRepository(gitDir)
+	idx, _ := format.NewIndex(2)
+	past := time.Now().Add(-time.Minute)
+	for path, content := range files {
+		fullPath := filepath.Join(dir, filepath.FromSlash(path))
+		os.MkdirAll(filepath.Dir(fullPath), os.FileMode(0755))
+		if err := ioutil.WriteFile(fullPath, []byte(content), os.FileMode(0644)); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+		os.Chtimes(fullPath, past, past)
+		info, _ := os.Lstat(fullPath)
+
+		hash, err := repo.WriteObject(&core.Blob{Content: []byte(content)})
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+		idx.Add(format.IndexEntry{
+			IndexEntryStat: format.NewIndexEntryStat(info),
+			Mode:           core.GitModeRegular | core.GitModeReadWritable,
+			Sha1:           hash,
+			Path:           path,
+		})
+	}
+
+	head, _ := format.NewIndex(2)
+	for _, path := range committed {
+		entry, _ := idx.Lookup(path, format.IndexStageNormal)
+		head.Add(entry)
+	}
+	tree, err := repo.WriteTree(head)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	person := core.NewPerson("A U Thor", "author@example.com", 1234567890, 0)
+	commit, err := repo.WriteObject(core.NewCommit(tree, nil, person, person, "initial\n"))
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(gitDir, "refs", "heads", "master"), []byte(commit.String()+"\n"), os.FileMode(0644))
+
+	if err := repo.WriteIndex(idx); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return dir, cleanup
+}
+
+func TestStatus(t *testing.T) {
+	dir, cleanup := _fixtureWorktree(t, map[string]string{
+		".gitignore":   "*.log\nbuild/\n",
+		"clean":        "clean\n",
+		"modified":     "modified\n",
+		"deleted":      "deleted\n",
+		"added":        "added\n",
+		"sub/touched":  "touched\n",
+		"sub/.keep":    "",
+		"sub/debug.go": "package sub\n",
+	}, []string{".gitignore", "clean", "modified", "deleted", "sub/touched", "sub/.keep", "sub/debug.go"})
+	defer cleanup()
+
+	write := func(path, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(path)), []byte(content), os.FileMode(0644)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("modified", "changed\n")
+	os.Remove(filepath.Join(dir, "deleted"))
+	// Same content, new timestamps: the stat data differs but the hash does not.
+	write("sub/touched", "touched\n")
+	write("untracked", "")
+	write("sub/trace.log", "")
+	os.MkdirAll(filepath.Join(dir, "new", "deeper"), os.FileMode(0755))
+	write("new/deeper/file", "")
+	os.MkdirAll(filepath.Join(dir, "build"), os.FileMode(0755))
+	write("build/out", "")
+
+	entries, err := Status(StatusOptions{Dir: filepath.Join(dir, "sub"), Ignored: true})
+	if err != nil {
+		t.Fatalf("Status() returned error %v", err)
+	}
+
+	var actual []string
+	for _, entry := range entries {
+		actual = append(actual, string([]byte{byte(entry.Kind), byte(entry.Staged), byte(entry.Unstaged)})+" "+entry.Path)
+	}
+	expected := []string{
+		"1A. added",
+		"1.D deleted",
+		"1.M modified",
+		"?.. new/",
+		"?.. untracked",
+		"!.. build/",
+		"!.. sub/trace.log",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Status() = %v, want %v", actual, expected)
+	}
+
+	modified := entries[2]
+	if modified.HeadMode != modified.IndexMode || modified.WorktreeMode != modified.IndexMode ||
+		modified.HeadSha1 != modified.IndexSha1 {
+		t.Errorf("Status() entry for modified = %+v", modified)
+	}
+	var zero core.Sha1
+	expectedLine := "1 A. N... 000000 100644 100644 " + zero.String() + " " + entries[0].IndexSha1.String() + " added"
+	if line := entries[0].String(); line != expectedLine {
+		t.Errorf("String() = %q, want %q", line, expectedLine)
+	}
+}
+
+func TestStatus_Unmerged(t *testing.T) {
+	dir, cleanup := _fixtureWorktree(t, map[string]string{
+		"a":         "a\n",
+		"dir/a.txt": "base\n",
+		"z":         "z\n",
+	}, []string{"a", "dir/a.txt", "z"})
+	defer cleanup()
+
+	repo := plumbing.NewRepository(filepath.Join(dir, ".git"))
+	defer repo.Close()
+	idx, err := repo.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, _ := idx.Lookup("dir/a.txt", format.IndexStageNormal)
+	for _, stage := range []format.IndexEntryStage{format.IndexStageBase, format.IndexStageOurs, format.IndexStageTheirs} {
+		entry.Stage = stage
+		idx.Add(entry)
+	}
+	if err := repo.WriteIndex(idx); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"a", "z"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte("changed\n"), os.FileMode(0644)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := Status(StatusOptions{Dir: dir})
+	if err != nil {
+		t.Fatalf("Status() returned error %v", err)
+	}
+	var actual []string
+	for _, entry := range entries {
+		actual = append(actual, string([]byte{byte(entry.Kind), byte(entry.Staged), byte(entry.Unstaged)})+" "+entry.Path)
+	}
+	expected := []string{"1.M a", "1.M z", "uUU dir/a.txt"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Status() = %v, want %v", actual, expected)
+	}
+}
+
+func TestStatusEntry_String_Quoted(t *testing.T) {
+	entry := StatusEntry{Kind: StatusUntracked, Path: "tab\there/\"quoted\"/caf\xc3\xa9"}
+	if actual, expected := entry.String(), `? "tab\there/\"quoted\"/caf\303\251"`; actual != expected {
+		t.Errorf("String() = %s, want %s", actual, expected)
+	}
+}